@@ -4,11 +4,19 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/prxssh/relay/internal/cli"
 	"github.com/prxssh/relay/internal/tui"
 )
 
 func main() {
-	if err := tui.Start(); err != nil {
+	var err error
+	if len(os.Args) > 1 {
+		err = cli.Run(os.Args[1:])
+	} else {
+		err = tui.Start()
+	}
+
+	if err != nil {
 		fmt.Println("Error running RELAY: ", err)
 		os.Exit(1)
 	}
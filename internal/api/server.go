@@ -0,0 +1,179 @@
+package api
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prxssh/relay/internal/relay"
+)
+
+// Server exposes a relay.Client over a small JSON HTTP API so relay can be
+// driven headless, e.g. by the CLI talking to a running daemon.
+//
+//	GET  /torrents   list every torrent with its stats
+//	POST /torrents   add a torrent, either as a raw .torrent body
+//	                 (Content-Type: application/x-bittorrent) or by URL
+//	                 given in the "uri" form value
+type Server struct {
+	client *relay.Client
+	mux    *http.ServeMux
+}
+
+// TorrentInfo is the JSON representation of a torrent.
+type TorrentInfo struct {
+	InfoHash      string `json:"info_hash"`
+	Name          string `json:"name"`
+	Status        string `json:"status"`
+	Downloaded    int64  `json:"downloaded"`
+	Verified      int64  `json:"verified"`
+	Uploaded      int64  `json:"uploaded"`
+	DownloadSpeed int64  `json:"download_speed"`
+	UploadSpeed   int64  `json:"upload_speed"`
+	ETA           int64  `json:"eta"`
+	Seeders       uint32 `json:"seeders"`
+	Leechers      uint32 `json:"leechers"`
+	QueuePosition int    `json:"queue_position"`
+	Error         string `json:"error,omitempty"`
+	Moved         int64  `json:"moved,omitempty"`
+	DownloadLimit int64  `json:"download_limit,omitempty"`
+	UploadLimit   int64  `json:"upload_limit,omitempty"`
+}
+
+// ContentTypeTorrent is the media type of .torrent files.
+const ContentTypeTorrent = "application/x-bittorrent"
+
+func NewServer(client *relay.Client) *Server {
+	s := &Server{client: client, mux: http.NewServeMux()}
+
+	s.mux.HandleFunc("GET /torrents", s.listTorrents)
+	s.mux.HandleFunc("POST /torrents", s.addTorrent)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+/////////////// Private ///////////////
+
+func (s *Server) listTorrents(w http.ResponseWriter, r *http.Request) {
+	sessions := s.client.Torrents()
+
+	torrents := make([]TorrentInfo, 0, len(sessions))
+	for _, session := range sessions {
+		torrents = append(torrents, toTorrentInfo(session.Stats()))
+	}
+
+	writeJSON(w, http.StatusOK, torrents)
+}
+
+func (s *Server) addTorrent(w http.ResponseWriter, r *http.Request) {
+	var stats relay.SessionStats
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), ContentTypeTorrent) {
+		session, err := s.client.AddTorrentContext(
+			r.Context(),
+			r.Body,
+			nil,
+		)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		stats = session.Stats()
+	} else {
+		uri := r.FormValue("uri")
+		if uri == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": "expected a .torrent body or a 'uri' value",
+			})
+			return
+		}
+		var err error
+		stats, err = s.addURI(r.Context(), uri)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusCreated, toTorrentInfo(stats))
+}
+
+// addURI adds the torrent behind a magnet link or a .torrent URL.
+func (s *Server) addURI(
+	ctx context.Context,
+	uri string,
+) (relay.SessionStats, error) {
+	if strings.HasPrefix(uri, "magnet:") {
+		session, err := s.client.AddMagnetContext(ctx, uri)
+		if err != nil {
+			return relay.SessionStats{}, err
+		}
+		return session.Stats(), nil
+	}
+
+	session, err := s.client.AddTorrentURL(uri)
+	if err != nil {
+		return relay.SessionStats{}, err
+	}
+	return session.Stats(), nil
+}
+
+func toTorrentInfo(stats relay.SessionStats) TorrentInfo {
+	return TorrentInfo{
+		InfoHash:      hex.EncodeToString(stats.InfoHash[:]),
+		Name:          stats.Name,
+		Status:        string(stats.Status),
+		Downloaded:    stats.Downloaded,
+		Verified:      stats.Verified,
+		Uploaded:      stats.Uploaded,
+		DownloadSpeed: stats.DownloadSpeed,
+		UploadSpeed:   stats.UploadSpeed,
+		ETA:           etaSeconds(stats.ETA),
+		Seeders:       stats.Seeders,
+		Leechers:      stats.Leechers,
+		QueuePosition: stats.QueuePosition,
+		Error:         stats.Error,
+		Moved:         stats.Moved,
+		DownloadLimit: stats.DownloadLimit,
+		UploadLimit:   stats.UploadLimit,
+	}
+}
+
+// etaSeconds converts an ETA to whole seconds for TorrentInfo, -1 for
+// relay.ETAUnknown.
+func etaSeconds(eta time.Duration) int64 {
+	if eta == relay.ETAUnknown {
+		return -1
+	}
+	return int64(eta.Round(time.Second) / time.Second)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, relay.ErrTorrentExists):
+		status = http.StatusConflict
+	case errors.Is(err, relay.ErrTorrentTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	}
+
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("api: failed to write response", "error", err)
+	}
+}
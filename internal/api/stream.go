@@ -0,0 +1,80 @@
+package api
+
+import (
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/prxssh/relay/internal/relay"
+)
+
+// StreamServer serves the files of torrents over HTTP while they download, so
+// media players and browsers can play them right away.
+//
+//	GET /stream/{infohash}/{fileindex}   the file's contents
+//
+// Range requests are supported, and seeking moves download priority to the
+// requested bytes. Reads wait for data that isn't downloaded yet unless the
+// client is configured for non-blocking reads.
+type StreamServer struct {
+	client *relay.Client
+	mux    *http.ServeMux
+}
+
+func NewStreamServer(client *relay.Client) *StreamServer {
+	s := &StreamServer{client: client, mux: http.NewServeMux()}
+
+	s.mux.HandleFunc("GET /stream/{infohash}/{fileindex}", s.streamFile)
+
+	return s
+}
+
+func (s *StreamServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+/////////////// Private ///////////////
+
+func (s *StreamServer) streamFile(w http.ResponseWriter, r *http.Request) {
+	var infoHash [20]byte
+	raw, err := hex.DecodeString(r.PathValue("infohash"))
+	if err != nil || len(raw) != len(infoHash) {
+		http.Error(w, "invalid info hash", http.StatusBadRequest)
+		return
+	}
+	copy(infoHash[:], raw)
+
+	session, ok := s.client.Torrent(infoHash)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	fileIndex, err := strconv.Atoi(r.PathValue("fileindex"))
+	files := session.Files()
+	if err != nil || fileIndex < 0 || fileIndex >= len(files) {
+		http.NotFound(w, r)
+		return
+	}
+	name := files[fileIndex].Path[len(files[fileIndex].Path)-1]
+
+	reader, err := session.Open(fileIndex)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	// Set the type up front: ServeContent would otherwise sniff it from the
+	// start of the file, waiting for data a player may not even want.
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	http.ServeContent(w, r, name, time.Time{}, reader)
+}
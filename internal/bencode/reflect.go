@@ -0,0 +1,324 @@
+package bencode
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// Encode writes v like Marshal, but v may be any value rather than only the
+// types Unmarshal produces. Structs become dictionaries, keyed by the name in
+// a field's `bencode:"name"` tag or else by the field's name. A tag of "-"
+// skips the field and the "omitempty" option, as in
+// `bencode:"comment,omitempty"`, leaves it out when it's zero or empty.
+// Integers and bools encode as integers; byte slices and arrays, like the
+// [20]byte of a SHA-1, as strings; other slices and arrays as lists and maps
+// with string keys as dictionaries. Nil pointers and interfaces are errors
+// unless omitted.
+func (m *Marshaller) Encode(v any) error {
+	val, err := toGeneric(reflect.ValueOf(v))
+	if err != nil {
+		return err
+	}
+
+	return m.Marshal(val)
+}
+
+// Decode reads the next value like Unmarshal and stores it in the value v
+// points to, the reverse of Encode. Dictionary keys without a matching struct
+// field are ignored and fields without a key keep their value. Pointers are
+// allocated as needed.
+func (u *Unmarshaller) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("bencode: Decode needs a non-nil pointer, not %T", v)
+	}
+
+	val, err := u.Unmarshal()
+	if err != nil {
+		return err
+	}
+
+	return fromGeneric(val, rv.Elem())
+}
+
+/////////////// Private ///////////////
+
+// field is a struct field as it's encoded.
+type field struct {
+	index     int
+	key       string
+	omitEmpty bool
+}
+
+// structFields returns the encoded fields of a struct type: its exported
+// fields that aren't tagged "-".
+func structFields(t reflect.Type) []field {
+	var fields []field
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+
+		fields = append(fields, field{
+			index:     i,
+			key:       name,
+			omitEmpty: opts == "omitempty",
+		})
+	}
+
+	return fields
+}
+
+// isEmpty reports whether a field tagged omitempty is left out.
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String:
+		return v.Len() == 0
+	default:
+		return v.IsZero()
+	}
+}
+
+// isBytes reports whether t is a slice or array of bytes, encoded as a string.
+func isBytes(t reflect.Type) bool {
+	return (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) &&
+		t.Elem().Kind() == reflect.Uint8
+}
+
+// toGeneric converts v into the types Marshal takes.
+func toGeneric(v reflect.Value) (any, error) {
+	if !v.IsValid() {
+		return nil, errors.New("bencode: cannot encode nil")
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil, fmt.Errorf("bencode: cannot encode nil %s", v.Type())
+		}
+		return toGeneric(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("bencode: %d overflows int64", v.Uint())
+		}
+		return int64(v.Uint()), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Slice, reflect.Array:
+		if isBytes(v.Type()) {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			return string(b), nil
+		}
+
+		list := make([]any, v.Len())
+		for i := range list {
+			item, err := toGeneric(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			list[i] = item
+		}
+		return list, nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf(
+				"bencode: unsupported map key type %s",
+				v.Type().Key(),
+			)
+		}
+
+		dict := make(map[string]any, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			val, err := toGeneric(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			dict[iter.Key().String()] = val
+		}
+		return dict, nil
+	case reflect.Struct:
+		dict := make(map[string]any)
+		for _, f := range structFields(v.Type()) {
+			fv := v.Field(f.index)
+			if f.omitEmpty && isEmpty(fv) {
+				continue
+			}
+
+			val, err := toGeneric(fv)
+			if err != nil {
+				return nil, fmt.Errorf("%w (field %q)", err, f.key)
+			}
+			dict[f.key] = val
+		}
+		return dict, nil
+	default:
+		return nil, fmt.Errorf("bencode: unsupported type %s", v.Type())
+	}
+}
+
+// fromGeneric stores val, as returned by Unmarshal, in v.
+func fromGeneric(val any, v reflect.Value) error {
+	mismatch := func() error {
+		return fmt.Errorf("bencode: cannot decode %T into %s", val, v.Type())
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return fromGeneric(val, v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() > 0 {
+			return mismatch()
+		}
+		v.Set(reflect.ValueOf(val))
+		return nil
+	case reflect.Bool:
+		n, ok := val.(int64)
+		if !ok {
+			return mismatch()
+		}
+		v.SetBool(n != 0)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := val.(int64)
+		if !ok {
+			return mismatch()
+		}
+		if v.OverflowInt(n) {
+			return fmt.Errorf("bencode: %d overflows %s", n, v.Type())
+		}
+		v.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		n, ok := val.(int64)
+		if !ok {
+			return mismatch()
+		}
+		if n < 0 || v.OverflowUint(uint64(n)) {
+			return fmt.Errorf("bencode: %d overflows %s", n, v.Type())
+		}
+		v.SetUint(uint64(n))
+		return nil
+	case reflect.String:
+		s, ok := val.(string)
+		if !ok {
+			return mismatch()
+		}
+		v.SetString(s)
+		return nil
+	case reflect.Slice:
+		if isBytes(v.Type()) {
+			s, ok := val.(string)
+			if !ok {
+				return mismatch()
+			}
+			v.SetBytes([]byte(s))
+			return nil
+		}
+
+		list, ok := val.([]any)
+		if !ok {
+			return mismatch()
+		}
+		slice := reflect.MakeSlice(v.Type(), len(list), len(list))
+		for i, item := range list {
+			if err := fromGeneric(item, slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+		return nil
+	case reflect.Array:
+		if isBytes(v.Type()) {
+			s, ok := val.(string)
+			if !ok {
+				return mismatch()
+			}
+			if len(s) != v.Len() {
+				return fmt.Errorf(
+					"bencode: cannot decode string of length %d into %s",
+					len(s),
+					v.Type(),
+				)
+			}
+			reflect.Copy(v, reflect.ValueOf([]byte(s)))
+			return nil
+		}
+
+		list, ok := val.([]any)
+		if !ok {
+			return mismatch()
+		}
+		if len(list) != v.Len() {
+			return fmt.Errorf(
+				"bencode: cannot decode list of length %d into %s",
+				len(list),
+				v.Type(),
+			)
+		}
+		for i, item := range list {
+			if err := fromGeneric(item, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		dict, ok := val.(map[string]any)
+		if !ok || v.Type().Key().Kind() != reflect.String {
+			return mismatch()
+		}
+		m := reflect.MakeMapWithSize(v.Type(), len(dict))
+		for k, item := range dict {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := fromGeneric(item, elem); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(k).Convert(v.Type().Key()), elem)
+		}
+		v.Set(m)
+		return nil
+	case reflect.Struct:
+		dict, ok := val.(map[string]any)
+		if !ok {
+			return mismatch()
+		}
+		for _, f := range structFields(v.Type()) {
+			item, ok := dict[f.key]
+			if !ok {
+				continue
+			}
+			if err := fromGeneric(item, v.Field(f.index)); err != nil {
+				return fmt.Errorf("%w (field %q)", err, f.key)
+			}
+		}
+		return nil
+	default:
+		return mismatch()
+	}
+}
@@ -0,0 +1,105 @@
+package bencode
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testFile struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type testInfo struct {
+	Name     string     `bencode:"name"`
+	PieceLen int64      `bencode:"piece length"`
+	Pieces   [20]byte   `bencode:"pieces"`
+	Private  bool       `bencode:"private,omitempty"`
+	Files    []testFile `bencode:"files"`
+}
+
+type testTorrent struct {
+	Announce string    `bencode:"announce"`
+	Comment  string    `bencode:"comment,omitempty"`
+	Info     *testInfo `bencode:"info"`
+	Ignored  string    `bencode:"-"`
+}
+
+func TestDecodeAndEncodeStruct(t *testing.T) {
+	pieces := strings.Repeat("x", 20)
+	input := "d8:announce18:http://tr/announce" +
+		"10:created by5:relay" +
+		"4:infod5:filesld6:lengthi3e4:pathl1:aeed6:lengthi4e4:pathl1:b1:ceee" +
+		"4:name3:dir12:piece lengthi16384e6:pieces20:" + pieces + "ee"
+
+	var got testTorrent
+	err := NewUnmarshaller(strings.NewReader(input)).Decode(&got)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	want := testTorrent{
+		Announce: "http://tr/announce",
+		Info: &testInfo{
+			Name:     "dir",
+			PieceLen: 16384,
+			Files: []testFile{
+				{Length: 3, Path: []string{"a"}},
+				{Length: 4, Path: []string{"b", "c"}},
+			},
+		},
+	}
+	copy(want.Info.Pieces[:], pieces)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("decoded:\ngot:      %+v\nexpected: %+v", got, want)
+	}
+
+	// "created by" has no field, so it's gone; the empty comment and the
+	// false private flag are omitted.
+	var buf bytes.Buffer
+	if err := NewMarshaller(&buf).Encode(got); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	wantEncoded := strings.Replace(input, "10:created by5:relay", "", 1)
+	if buf.String() != wantEncoded {
+		t.Errorf(
+			"encoded:\ngot:      %q\nexpected: %q",
+			buf.String(),
+			wantEncoded,
+		)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		v     any
+	}{
+		{"string into int", "4:spam", new(int)},
+		{"int into string", "i1e", new(string)},
+		{"overflow", "i300e", new(int8)},
+		{"negative into uint", "i-1e", new(uint)},
+		{"short array", "3:abc", new([20]byte)},
+		{"field type", "d4:name" + "i1ee", new(testInfo)},
+		{"not a pointer", "i1e", 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u := NewUnmarshaller(strings.NewReader(tc.input))
+			if err := u.Decode(tc.v); err == nil {
+				t.Fatal("expected error, but got none")
+			}
+		})
+	}
+}
+
+func TestEncodeRejectsNil(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewMarshaller(&buf).Encode(testTorrent{}); err == nil {
+		t.Error("expected an error for a nil info pointer")
+	}
+}
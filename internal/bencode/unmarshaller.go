@@ -2,15 +2,77 @@ package bencode
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"strconv"
+	"strings"
 )
 
 type Unmarshaller struct {
 	r *bufio.Reader
+	// If true dictionaries must have their keys in ascending order without
+	// duplicates, see NewStrictUnmarshaller.
+	strict bool
+
+	// Bytes consumed so far, see Offset
+	offset int64
+	// Lists and dictionaries begun but not ended yet
+	depth int
+	// Keys of top-level dictionaries whose values' spans are recorded
+	record map[string]bool
+	spans  map[string]Span
+}
+
+// Span locates a value in the input of an Unmarshaller, as the offsets of its
+// first byte and of the byte following it.
+type Span struct {
+	Start, End int64
+}
+
+// TokenKind is the kind of a Token.
+type TokenKind int
+
+const (
+	// An integer, in Token.Int
+	TokenInteger TokenKind = iota + 1
+	// A string, in Token.String
+	TokenString
+	// The start of a list; its items follow up to a TokenEnd
+	TokenListStart
+	// The start of a dictionary; keys and values alternate up to a TokenEnd
+	TokenDictStart
+	// The end of the innermost list or dictionary
+	TokenEnd
+)
+
+// Token is a piece of bencoded input as returned by Unmarshaller.Token.
+type Token struct {
+	Kind   TokenKind
+	Int    int64
+	String string
+}
+
+// SyntaxError describes malformed input and where it is.
+type SyntaxError struct {
+	// Offset of the first byte of the malformed value
+	Offset int64
+	Err    error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %v at offset %d", e.Err, e.Offset)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
 }
 
+// errUnexpectedEnd is the error of an 'e' where a value should be.
+var errUnexpectedEnd = errors.New("unexpected end")
+
 type bencodedType byte
 
 const (
@@ -24,39 +86,134 @@ func NewUnmarshaller(r io.Reader) *Unmarshaller {
 	return &Unmarshaller{r: bufio.NewReader(r)}
 }
 
+// NewStrictUnmarshaller returns an Unmarshaller that also rejects dictionaries
+// whose keys aren't in ascending byte order or repeat, as bencode requires.
+// The default unmarshaller lets the last duplicate win, so a non-canonical
+// dictionary would marshal back to different bytes than it was read from.
+func NewStrictUnmarshaller(r io.Reader) *Unmarshaller {
+	return &Unmarshaller{r: bufio.NewReader(r), strict: true}
+}
+
 func (u *Unmarshaller) Unmarshal() (any, error) {
-	btype, err := u.r.ReadByte()
+	tok, err := u.Token()
 	if err != nil {
 		return nil, err
 	}
 
-	var val any
-	var unmarshalErr error
+	return u.unmarshalToken(tok)
+}
+
+// Token reads the next token of the input, io.EOF once it's exhausted. Unlike
+// Unmarshal it never holds more than a single integer or string, so callers
+// can walk through large inputs, e.g. the pieces of a torrent, without
+// building the maps and lists around them. Token and Unmarshal may be mixed:
+// Unmarshal reads the whole value starting at the next token.
+//
+// Malformed input is reported as a *SyntaxError. Input ending within a list
+// or dictionary is one for io.ErrUnexpectedEOF.
+func (u *Unmarshaller) Token() (Token, error) {
+	start := u.offset
+	tok, err := u.readToken()
+	if err == nil || err == io.EOF && u.depth == 0 && u.offset == start {
+		return tok, err
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return Token{}, &SyntaxError{Offset: start, Err: err}
+}
+
+// Buffered returns the number of bytes read from the underlying reader but
+// not consumed by Unmarshal yet, e.g. raw data following a bencoded value.
+func (u *Unmarshaller) Buffered() int {
+	return u.r.Buffered()
+}
+
+// Offset returns the number of bytes consumed by Unmarshal so far.
+func (u *Unmarshaller) Offset() int64 {
+	return u.offset
+}
+
+// RecordSpan makes Unmarshal record where the value of key in a top-level
+// dictionary lies in the input, available from Span afterwards. Hashing those
+// bytes gives the digest of the value exactly as it was encoded, e.g. a
+// torrent's info hash, whereas marshalling the value again may not reproduce
+// them.
+func (u *Unmarshaller) RecordSpan(key string) {
+	if u.record == nil {
+		u.record = make(map[string]bool)
+		u.spans = make(map[string]Span)
+	}
+	u.record[key] = true
+}
+
+// Span returns the span of the value of a key passed to RecordSpan, if the
+// key was found.
+func (u *Unmarshaller) Span(key string) (Span, bool) {
+	span, ok := u.spans[key]
+	return span, ok
+}
+
+/////////////// Private ///////////////
+
+// readToken reads the next token for Token.
+func (u *Unmarshaller) readToken() (Token, error) {
+	btype, err := u.r.ReadByte()
+	if err != nil {
+		return Token{}, err
+	}
+	u.offset++
 
 	switch btype {
 	case byte(bInteger):
-		val, unmarshalErr = u.unmarshalInteger()
-	case byte(bDict):
-		val, unmarshalErr = u.unmarshalDict()
+		n, err := u.unmarshalInteger()
+		if err != nil {
+			return Token{}, err
+		}
+		return Token{Kind: TokenInteger, Int: n}, nil
 	case byte(bList):
-		val, unmarshalErr = u.unmarshalList()
+		u.depth++
+		return Token{Kind: TokenListStart}, nil
+	case byte(bDict):
+		u.depth++
+		return Token{Kind: TokenDictStart}, nil
+	case byte(bTerminator):
+		if u.depth == 0 {
+			return Token{}, errUnexpectedEnd
+		}
+		u.depth--
+		return Token{Kind: TokenEnd}, nil
 	default:
 		if err := u.r.UnreadByte(); err != nil {
-			return nil, err
+			return Token{}, err
 		}
-		val, unmarshalErr = u.unmarshalString()
-	}
+		u.offset--
 
-	if unmarshalErr != nil {
-		return nil, unmarshalErr
+		s, err := u.unmarshalString()
+		if err != nil {
+			return Token{}, err
+		}
+		return Token{Kind: TokenString, String: s}, nil
 	}
-	return val, nil
 }
 
-/////////////// Private ///////////////
-
+// unmarshalInteger reads an integer up to its 'e'. Only the canonical form
+// is accepted: no leading zeros, no negative zero and no sign but '-'.
 func (u *Unmarshaller) unmarshalInteger() (int64, error) {
-	return u.readInteger(bTerminator)
+	b, err := u.readUntil(bTerminator)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkCanonicalInteger(b); err != nil {
+		return 0, err
+	}
+
+	n, err := parseInt(b)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer %q: %w", b, errors.Unwrap(err))
+	}
+	return n, nil
 }
 
 func (u *Unmarshaller) unmarshalString() (string, error) {
@@ -70,34 +227,75 @@ func (u *Unmarshaller) unmarshalString() (string, error) {
 	}
 
 	if size < 0 {
-		return "", errors.New(
-			"bencode: invalid string, negative length",
-		)
+		return "", errors.New("invalid string, negative length")
 	}
 
-	buf := make([]byte, size)
-	if _, err := io.ReadFull(u.r, buf); err != nil {
-		return "", err
+	return u.readString(int(size))
+}
+
+// readString reads a string of size bytes. The bytes are copied straight from
+// the reader's buffer into the string, which is the only allocation even for
+// strings larger than the buffer, like the pieces of a big torrent.
+func (u *Unmarshaller) readString(size int) (string, error) {
+	var sb strings.Builder
+	sb.Grow(size)
+
+	for sb.Len() < size {
+		chunk, err := u.r.Peek(min(size-sb.Len(), u.r.Size()))
+		sb.Write(chunk)
+		u.r.Discard(len(chunk))
+		u.offset += int64(len(chunk))
+
+		if err == io.EOF && sb.Len() > 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", err
+		}
 	}
 
-	return string(buf), nil
+	return sb.String(), nil
+}
+
+// unmarshalToken returns the value starting with tok, reading the rest of it
+// for lists and dictionaries.
+func (u *Unmarshaller) unmarshalToken(tok Token) (any, error) {
+	switch tok.Kind {
+	case TokenInteger:
+		return tok.Int, nil
+	case TokenString:
+		return tok.String, nil
+	case TokenListStart:
+		list, err := u.unmarshalList()
+		if err != nil {
+			return nil, err
+		}
+		return list, nil
+	case TokenDictStart:
+		dict, err := u.unmarshalDict()
+		if err != nil {
+			return nil, err
+		}
+		return dict, nil
+	default:
+		// The end token is the 'e' just read.
+		return nil, &SyntaxError{Offset: u.offset - 1, Err: errUnexpectedEnd}
+	}
 }
 
 func (u *Unmarshaller) unmarshalList() ([]any, error) {
 	list := make([]any, 0)
 
 	for {
-		peek, err := u.r.Peek(1)
+		tok, err := u.Token()
 		if err != nil {
 			return nil, err
 		}
-
-		if peek[0] == byte(bTerminator) {
-			u.r.ReadByte()
+		if tok.Kind == TokenEnd {
 			break
 		}
 
-		v, err := u.Unmarshal()
+		v, err := u.unmarshalToken(tok)
 		if err != nil {
 			return nil, err
 		}
@@ -109,27 +307,55 @@ func (u *Unmarshaller) unmarshalList() ([]any, error) {
 
 func (u *Unmarshaller) unmarshalDict() (map[string]any, error) {
 	dict := make(map[string]any)
+	// Nesting of the dictionary's values, see RecordSpan
+	depth := u.depth
 
+	var prevKey string
 	for {
-		peek, err := u.r.Peek(1)
+		keyStart := u.offset
+		tok, err := u.Token()
 		if err != nil {
 			return nil, err
 		}
-
-		if peek[0] == byte(bTerminator) {
-			u.r.ReadByte()
+		if tok.Kind == TokenEnd {
 			break
 		}
+		if tok.Kind != TokenString {
+			return nil, &SyntaxError{
+				Offset: keyStart,
+				Err:    errors.New("dictionary key is not a string"),
+			}
+		}
 
-		key, err := u.unmarshalString()
-		if err != nil {
-			return nil, err
+		key := tok.String
+		if u.strict && len(dict) > 0 {
+			switch {
+			case key == prevKey:
+				return nil, &SyntaxError{
+					Offset: keyStart,
+					Err:    fmt.Errorf("duplicate dictionary key %q", key),
+				}
+			case key < prevKey:
+				return nil, &SyntaxError{
+					Offset: keyStart,
+					Err: fmt.Errorf(
+						"dictionary key %q out of order after %q",
+						key,
+						prevKey,
+					),
+				}
+			}
 		}
+		prevKey = key
 
+		start := u.offset
 		val, err := u.Unmarshal()
 		if err != nil {
 			return nil, err
 		}
+		if depth == 1 && u.record[key] {
+			u.spans[key] = Span{Start: start, End: u.offset}
+		}
 
 		dict[string(key)] = val
 	}
@@ -137,12 +363,100 @@ func (u *Unmarshaller) unmarshalDict() (map[string]any, error) {
 	return dict, nil
 }
 
+// readInteger reads a decimal integer terminated by delim. The digits are
+// parsed in place in the reader's buffer.
 func (u *Unmarshaller) readInteger(delim bencodedType) (int64, error) {
-	read, err := u.r.ReadBytes(byte(delim))
+	b, err := u.readUntil(delim)
 	if err != nil {
 		return 0, err
 	}
 
-	sint := string(read[:len(read)-1])
-	return strconv.ParseInt(sint, 10, 64)
+	n, err := parseInt(b)
+	if err != nil {
+		return 0, fmt.Errorf("invalid length %q: %w", b, errors.Unwrap(err))
+	}
+	return n, nil
+}
+
+// readUntil returns the bytes of an integer up to delim, which is consumed.
+// The slice is only valid until the next read.
+func (u *Unmarshaller) readUntil(delim bencodedType) ([]byte, error) {
+	read, err := u.r.ReadSlice(byte(delim))
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, errors.New("integer too long")
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.offset += int64(len(read))
+
+	return read[:len(read)-1], nil
+}
+
+// checkCanonicalInteger rejects the integer bodies bencode forbids even though
+// they'd parse: "", "-0", leading zeros like "03" and a '+' sign.
+func checkCanonicalInteger(b []byte) error {
+	if len(b) == 0 {
+		return errors.New("empty integer")
+	}
+	if b[0] == '+' {
+		return fmt.Errorf("integer %q has a plus sign", b)
+	}
+
+	if string(b) == "-0" {
+		return errors.New("negative zero")
+	}
+	digits := bytes.TrimPrefix(b, []byte("-"))
+	if len(digits) > 1 && digits[0] == '0' {
+		return fmt.Errorf("integer %q has leading zeros", b)
+	}
+	return nil
+}
+
+// parseInt parses a base 10 integer like strconv.ParseInt without converting
+// b to a string first, which would allocate.
+func parseInt(b []byte) (int64, error) {
+	syntaxError := func() error {
+		return &strconv.NumError{
+			Func: "ParseInt",
+			Num:  string(b),
+			Err:  strconv.ErrSyntax,
+		}
+	}
+
+	digits := b
+	neg := false
+	if len(digits) > 0 && (digits[0] == '-' || digits[0] == '+') {
+		neg = digits[0] == '-'
+		digits = digits[1:]
+	}
+	if len(digits) == 0 {
+		return 0, syntaxError()
+	}
+
+	// Accumulate the magnitude as uint64 so math.MinInt64 fits.
+	limit := uint64(math.MaxInt64)
+	if neg {
+		limit++
+	}
+	var n uint64
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, syntaxError()
+		}
+		d := uint64(c - '0')
+		if n > (limit-d)/10 {
+			return 0, &strconv.NumError{
+				Func: "ParseInt",
+				Num:  string(b),
+				Err:  strconv.ErrRange,
+			}
+		}
+		n = n*10 + d
+	}
+
+	if neg {
+		return -int64(n-1) - 1, nil
+	}
+	return int64(n), nil
 }
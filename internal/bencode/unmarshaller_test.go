@@ -1,7 +1,11 @@
 package bencode
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -38,6 +42,36 @@ func TestUnmarshal(t *testing.T) {
 			expected: nil,
 			err:      true,
 		},
+		{
+			name:     "negative zero",
+			input:    "i-0e",
+			expected: nil,
+			err:      true,
+		},
+		{
+			name:     "integer with leading zero",
+			input:    "i03e",
+			expected: nil,
+			err:      true,
+		},
+		{
+			name:     "negative integer with leading zero",
+			input:    "i-03e",
+			expected: nil,
+			err:      true,
+		},
+		{
+			name:     "empty integer",
+			input:    "ie",
+			expected: nil,
+			err:      true,
+		},
+		{
+			name:     "integer with plus sign",
+			input:    "i+7e",
+			expected: nil,
+			err:      true,
+		},
 		{
 			name:     "integer not terminated",
 			input:    "i42",
@@ -195,3 +229,256 @@ func TestUnmarshal(t *testing.T) {
 		})
 	}
 }
+
+func TestStrictUnmarshallerRejectsNonCanonicalDicts(t *testing.T) {
+	testCases := []struct {
+		name   string
+		input  string
+		strict bool
+	}{
+		{"sorted", "d1:ai1e1:bi2ee", true},
+		{"out of order", "d1:bi1e1:ai2ee", false},
+		{"duplicate", "d1:ai1e1:ai2ee", false},
+		{"nested out of order", "d1:ad1:bi1e1:ai2eee", false},
+		{"prefix sorts first", "d1:ai1e2:aai2ee", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewUnmarshaller(strings.NewReader(tc.input)).Unmarshal()
+			if err != nil {
+				t.Fatalf("lenient: unexpected error: %v", err)
+			}
+
+			_, err = NewStrictUnmarshaller(strings.NewReader(tc.input)).
+				Unmarshal()
+			if tc.strict && err != nil {
+				t.Fatalf("strict: unexpected error: %v", err)
+			}
+			if !tc.strict && err == nil {
+				t.Fatal("strict: expected error, but got none")
+			}
+		})
+	}
+}
+
+func TestUnmarshallerRecordsSpans(t *testing.T) {
+	input := "d1:ad4:infoi1ee4:infod1:bi2e1:ali3eee1:zi0ee"
+	u := NewUnmarshaller(strings.NewReader(input))
+	u.RecordSpan("info")
+	u.RecordSpan("missing")
+
+	if _, err := u.Unmarshal(); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if got := u.Offset(); got != int64(len(input)) {
+		t.Errorf("offset = %d, want %d", got, len(input))
+	}
+
+	// Only the top-level "info" is recorded, not the nested one.
+	span, ok := u.Span("info")
+	if !ok {
+		t.Fatal("no span recorded for info")
+	}
+	got, want := input[span.Start:span.End], "d1:bi2e1:ali3eee"
+	if got != want {
+		t.Errorf("span covers %q, want %q", got, want)
+	}
+	if _, ok := u.Span("missing"); ok {
+		t.Error("span recorded for a missing key")
+	}
+}
+
+func TestTokenStream(t *testing.T) {
+	u := NewUnmarshaller(strings.NewReader("d4:listli1el3:fooee3:numi-7ee"))
+
+	want := []Token{
+		{Kind: TokenDictStart},
+		{Kind: TokenString, String: "list"},
+		{Kind: TokenListStart},
+		{Kind: TokenInteger, Int: 1},
+		{Kind: TokenListStart},
+		{Kind: TokenString, String: "foo"},
+		{Kind: TokenEnd},
+		{Kind: TokenEnd},
+		{Kind: TokenString, String: "num"},
+		{Kind: TokenInteger, Int: -7},
+		{Kind: TokenEnd},
+	}
+	for i, w := range want {
+		tok, err := u.Token()
+		if err != nil {
+			t.Fatalf("token %d: %v", i, err)
+		}
+		if tok != w {
+			t.Fatalf("token %d = %+v, want %+v", i, tok, w)
+		}
+	}
+	if _, err := u.Token(); err != io.EOF {
+		t.Errorf("after the last token: err = %v, want %v", err, io.EOF)
+	}
+
+	// A stray end outside any list or dictionary is an error.
+	if _, err := NewUnmarshaller(strings.NewReader("e")).Token(); err == nil {
+		t.Error("expected an error for an unexpected end")
+	}
+}
+
+func TestTokenThenUnmarshal(t *testing.T) {
+	u := NewUnmarshaller(strings.NewReader("d4:infod1:ai1eee"))
+
+	for _, kind := range []TokenKind{TokenDictStart, TokenString} {
+		if tok, err := u.Token(); err != nil || tok.Kind != kind {
+			t.Fatalf("Token = %+v, %v; want kind %d", tok, err, kind)
+		}
+	}
+	got, err := u.Unmarshal()
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if want := map[string]any{"a": int64(1)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unmarshal = %#v, want %#v", got, want)
+	}
+	if tok, err := u.Token(); err != nil || tok.Kind != TokenEnd {
+		t.Errorf("Token = %+v, %v; want the end of the dictionary", tok, err)
+	}
+}
+
+func TestSyntaxErrorOffsets(t *testing.T) {
+	testCases := []struct {
+		name   string
+		input  string
+		strict bool
+		offset int64
+	}{
+		{"bad integer", "d4:spami4x2ee", false, 7},
+		{"leading zero", "li1ei03ee", false, 4},
+		{"bad string length", "l4:spamx:fooe", false, 7},
+		{"truncated string", "d4:spam10:short", false, 7},
+		{"truncated list", "d4:listli1e", false, 11},
+		{"stray end", "li1eee", false, 5},
+		{"missing value", "d1:ai1e1:be", false, 10},
+		{"key not a string", "d1:ai1ei2ei3ee", false, 7},
+		{"duplicate key", "d1:ai1e1:ai2ee", true, 7},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u := NewUnmarshaller(strings.NewReader(tc.input))
+			if tc.strict {
+				u = NewStrictUnmarshaller(strings.NewReader(tc.input))
+			}
+
+			var err error
+			for err == nil {
+				_, err = u.Unmarshal()
+			}
+
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("err = %v, want a *SyntaxError", err)
+			}
+			if syntaxErr.Offset != tc.offset {
+				t.Errorf(
+					"offset = %d, want %d (%v)",
+					syntaxErr.Offset,
+					tc.offset,
+					err,
+				)
+			}
+		})
+	}
+
+	// Running out of input between values isn't an error of the input.
+	_, err := NewUnmarshaller(strings.NewReader("")).Unmarshal()
+	if err != io.EOF {
+		t.Errorf("empty input: err = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestParseIntMatchesStrconv(t *testing.T) {
+	for _, in := range []string{
+		"0", "42", "-42", "+7", "007", "", "-", "4a2",
+		"9223372036854775807", "9223372036854775808",
+		"-9223372036854775808", "-9223372036854775809",
+	} {
+		want, wantErr := strconv.ParseInt(in, 10, 64)
+		got, err := parseInt([]byte(in))
+		if (err == nil) != (wantErr == nil) || err == nil && got != want {
+			t.Errorf(
+				"parseInt(%q) = %d, %v; want %d, %v",
+				in,
+				got,
+				err,
+				want,
+				wantErr,
+			)
+		}
+	}
+}
+
+// benchmarkTorrent returns a bencoded torrent of 50,000 pieces, about 1 MB of
+// piece hashes.
+func benchmarkTorrent(b *testing.B) []byte {
+	b.Helper()
+
+	var buf bytes.Buffer
+	err := NewMarshaller(&buf).Marshal(map[string]any{
+		"announce":      "http://tracker.example.org/announce",
+		"creation date": int64(1700000000),
+		"info": map[string]any{
+			"name":         "big",
+			"length":       int64(50000 * 262144),
+			"piece length": int64(262144),
+			"pieces":       strings.Repeat("0123456789abcdefghij", 50000),
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// benchmarkPeers returns a non-compact tracker response listing 1,000 peers.
+func benchmarkPeers(b *testing.B) []byte {
+	b.Helper()
+
+	peers := make([]any, 1000)
+	for i := range peers {
+		peers[i] = map[string]any{
+			"ip":      "10.0.0.1",
+			"port":    int64(6881 + i),
+			"peer id": "-XX0001-abcdefghijkl",
+		}
+	}
+
+	var buf bytes.Buffer
+	err := NewMarshaller(&buf).Marshal(map[string]any{
+		"interval": int64(1800),
+		"peers":    peers,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func benchmarkUnmarshal(b *testing.B, data []byte) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+
+	for i := 0; i < b.N; i++ {
+		_, err := NewUnmarshaller(bytes.NewReader(data)).Unmarshal()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalTorrent(b *testing.B) {
+	benchmarkUnmarshal(b, benchmarkTorrent(b))
+}
+
+func BenchmarkUnmarshalPeers(b *testing.B) {
+	benchmarkUnmarshal(b, benchmarkPeers(b))
+}
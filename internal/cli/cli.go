@@ -0,0 +1,283 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prxssh/relay/internal/api"
+	"github.com/prxssh/relay/internal/relay"
+	"github.com/prxssh/relay/internal/torrent"
+)
+
+const usage = `usage: relay [command] [arguments]
+
+With no command, relay starts the terminal UI.
+
+Commands:
+  add <file|magnet|url>   add a torrent to a running daemon
+  daemon                  run the engine and HTTP API without the UI
+  create <path>           create a .torrent from a file or directory
+  help                    show this help
+`
+
+// Run executes the subcommand named by args[0] with the remaining arguments.
+func Run(args []string) error {
+	if len(args) == 0 {
+		fmt.Print(usage)
+		return nil
+	}
+
+	switch args[0] {
+	case "add":
+		return runAdd(args[1:])
+	case "daemon":
+		return runDaemon(args[1:])
+	case "create":
+		return runCreate(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", args[0], usage)
+	}
+}
+
+/////////////// Private ///////////////
+
+func runAdd(args []string) error {
+	fs := flag.NewFlagSet("add", flag.ContinueOnError)
+	addr := fs.String("api", "", "daemon API address (default from config)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: relay add [-api addr] <file|magnet|url>")
+	}
+
+	if *addr == "" {
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		*addr = cfg.APIAddr
+	}
+	endpoint := "http://" + *addr + "/torrents"
+
+	source := fs.Arg(0)
+
+	var (
+		resp *http.Response
+		err  error
+	)
+	if isURI(source) {
+		resp, err = http.PostForm(endpoint, url.Values{"uri": {source}})
+	} else {
+		f, ferr := os.Open(source)
+		if ferr != nil {
+			return ferr
+		}
+		defer f.Close()
+
+		resp, err = http.Post(endpoint, api.ContentTypeTorrent, f)
+	}
+	if err != nil {
+		return fmt.Errorf("add: is the daemon running? %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		var body struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil ||
+			body.Error == "" {
+			return fmt.Errorf("add: daemon responded %s", resp.Status)
+		}
+		return fmt.Errorf("add: %s", body.Error)
+	}
+
+	var info api.TorrentInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return err
+	}
+
+	fmt.Printf("added %s (%s)\n", info.Name, info.InfoHash)
+	return nil
+}
+
+func runDaemon(args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	configPath := fs.String(
+		"config",
+		"",
+		"config file (default from user config dir)",
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var (
+		cfg relay.Config
+		err error
+	)
+	if *configPath != "" {
+		cfg, err = relay.LoadConfig(*configPath)
+	} else {
+		cfg, err = loadConfig()
+	}
+	if err != nil {
+		return err
+	}
+
+	client, err := relay.NewClient(cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx, stop := signal.NotifyContext(
+		context.Background(),
+		os.Interrupt,
+		syscall.SIGTERM,
+	)
+	defer stop()
+
+	srv := &http.Server{
+		Addr:              cfg.APIAddr,
+		Handler:           api.NewServer(client),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	servers := []*http.Server{srv}
+	if cfg.StreamAddr != "" {
+		servers = append(servers, &http.Server{
+			Addr:              cfg.StreamAddr,
+			Handler:           api.NewStreamServer(client),
+			ReadHeaderTimeout: 10 * time.Second,
+		})
+	}
+
+	errCh := make(chan error, len(servers))
+	for _, s := range servers {
+		go func() {
+			errCh <- s.ListenAndServe()
+		}()
+	}
+	fmt.Printf("relay daemon listening on %s\n", cfg.APIAddr)
+	if cfg.StreamAddr != "" {
+		fmt.Printf("streaming torrents on %s\n", cfg.StreamAddr)
+	}
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(
+		context.Background(),
+		5*time.Second,
+	)
+	defer cancel()
+
+	var shutdownErr error
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			shutdownErr = err
+		}
+	}
+	return shutdownErr
+}
+
+// multiFlag collects every occurrence of a repeatable string flag.
+type multiFlag []string
+
+func (m *multiFlag) String() string {
+	return strings.Join(*m, ",")
+}
+
+func (m *multiFlag) Set(v string) error {
+	*m = append(*m, v)
+	return nil
+}
+
+func runCreate(args []string) error {
+	var trackers multiFlag
+
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	fs.Var(&trackers, "t", "tracker announce URL (repeatable)")
+	out := fs.String("o", "", "output file (default <name>.torrent)")
+	comment := fs.String("c", "", "comment")
+	pieceLength := fs.Int64(
+		"piece-length",
+		0,
+		"piece length in bytes (default picked from the total size)",
+	)
+	private := fs.Bool("private", false, "only find peers through trackers")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New(
+			"usage: relay create [-t url]... [-o file] [-c comment] " +
+				"[-piece-length n] [-private] <path>",
+		)
+	}
+
+	root := fs.Arg(0)
+	if *out == "" {
+		st, err := os.Stat(root)
+		if err != nil {
+			return err
+		}
+		*out = st.Name() + ".torrent"
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+
+	err = torrent.Create(f, root, torrent.CreateOpts{
+		AnnounceURLs: trackers,
+		Comment:      *comment,
+		CreatedBy:    "relay",
+		PieceLength:  *pieceLength,
+		Private:      *private,
+	})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+
+	fmt.Printf("created %s\n", *out)
+	return nil
+}
+
+func loadConfig() (relay.Config, error) {
+	path, err := relay.DefaultConfigPath()
+	if err != nil {
+		return relay.Config{}, err
+	}
+
+	return relay.LoadConfig(path)
+}
+
+func isURI(s string) bool {
+	return strings.HasPrefix(s, "magnet:") ||
+		strings.HasPrefix(s, "http://") ||
+		strings.HasPrefix(s, "https://")
+}
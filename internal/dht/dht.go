@@ -0,0 +1,503 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prxssh/relay/internal/tracker"
+	"github.com/prxssh/relay/internal/utils"
+)
+
+const (
+	// queryTimeout is how long a query waits for its answer before the node
+	// is taken to be unreachable.
+	queryTimeout = 3 * time.Second
+	// refreshInterval is how often the table is refreshed with a lookup of
+	// our own ID, which also rejoins the DHT after losing every node.
+	refreshInterval = 15 * time.Minute
+	// tokenRotation is how often the secret behind tokens changes. Tokens of
+	// the previous secret are still accepted, so a token lasts at least this
+	// long and at most twice as long.
+	tokenRotation = 5 * time.Minute
+	// peerTTL is how long a peer announced to us is handed out, unless it
+	// announces again.
+	peerTTL = 30 * time.Minute
+	// maxTorrents and maxPeersPerTorrent bound the memory spent on peers
+	// announced to us; further announces are dropped.
+	maxTorrents        = 1000
+	maxPeersPerTorrent = 200
+	// maxValues is the most peers a get_peers response carries, keeping it
+	// well within a UDP datagram.
+	maxValues = 50
+)
+
+// ErrClosed is returned by queries of a closed DHT.
+var ErrClosed = errors.New("dht: closed")
+
+// Options tweaks a DHT node.
+type Options struct {
+	// Our node ID; zero picks a random one
+	ID NodeID
+	// Nodes, as host:port, to join the DHT through while we know no others
+	BootstrapNodes []string
+	// Nodes known from a previous run, e.g. as returned by Nodes; they're
+	// tried along with the bootstrap nodes while the table is empty
+	Nodes []*Node
+	// Clock used for expiry and refreshes; nil means utils.RealClock
+	Clock utils.Clock
+}
+
+// DHT is a node of the mainline DHT (BEP 5), the distributed tracker that
+// finds peers for torrents without a tracker, or in addition to one. It
+// answers the queries of other nodes and looks up and announces peers for
+// us. It's safe for concurrent use.
+type DHT struct {
+	conn      *net.UDPConn
+	id        NodeID
+	table     *table
+	bootstrap []string
+	known     []*Node
+	clock     utils.Clock
+
+	// Guards everything below
+	mu sync.Mutex
+	// Queries awaiting an answer, keyed by transaction ID
+	pending  map[string]*pendingQuery
+	nextTxID uint16
+	// Secrets tokens are derived from, and when secret was made
+	secret, prevSecret [16]byte
+	secretTime         time.Time
+	// Peers announced to us: their last announce keyed by address, per info
+	// hash
+	peers map[NodeID]map[string]time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Closed once the read loop returned
+	done chan struct{}
+}
+
+// pendingQuery is a query waiting for its answer from addr.
+type pendingQuery struct {
+	addr string
+	ch   chan *message
+}
+
+// Listen starts a DHT node on the UDP address addr, e.g. ":6881", and joins
+// the DHT in the background.
+func Listen(addr string, opts Options) (*DHT, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dht: %w", err)
+	}
+	conn, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dht: %w", err)
+	}
+
+	id := opts.ID
+	if id == (NodeID{}) {
+		if id, err = RandomNodeID(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	clock := opts.Clock
+	if clock == nil {
+		clock = utils.RealClock
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &DHT{
+		conn:      conn,
+		id:        id,
+		table:     newTable(id),
+		bootstrap: opts.BootstrapNodes,
+		known:     opts.Nodes,
+		clock:     clock,
+		pending:   make(map[string]*pendingQuery),
+		peers:     make(map[NodeID]map[string]time.Time),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	d.rotateSecret()
+	d.rotateSecret()
+
+	go d.readLoop()
+	go d.refreshLoop()
+
+	return d, nil
+}
+
+// ID returns our node ID.
+func (d *DHT) ID() NodeID {
+	return d.id
+}
+
+// Addr returns the address the node listens on.
+func (d *DHT) Addr() *net.UDPAddr {
+	return d.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// NumNodes returns the number of nodes in the routing table.
+func (d *DHT) NumNodes() int {
+	return d.table.len()
+}
+
+// Nodes returns the good nodes of the routing table, closest to us first, so
+// they can be saved and passed back in Options.Nodes on the next run.
+func (d *DHT) Nodes() []*Node {
+	return d.table.closest(d.id, d.table.len())
+}
+
+// AddNode adds a node to the routing table if it answers a ping, e.g. one
+// that a peer told us about with a PORT message.
+func (d *DHT) AddNode(ctx context.Context, addr *net.UDPAddr) error {
+	_, err := d.query(ctx, &Node{Addr: addr}, methodPing, &args{})
+	return err
+}
+
+// GetPeers looks up the peers of the torrent with infoHash, delivering them
+// as they are found. The channel is closed once the lookup is over or ctx is
+// done.
+func (d *DHT) GetPeers(
+	ctx context.Context,
+	infoHash [sha1.Size]byte,
+) <-chan tracker.Peer {
+	return d.getPeers(ctx, infoHash, 0)
+}
+
+// Announce looks up the peers of the torrent with infoHash like GetPeers,
+// then tells the closest nodes that we're a peer too, accepting connections
+// on port.
+func (d *DHT) Announce(
+	ctx context.Context,
+	infoHash [sha1.Size]byte,
+	port uint16,
+) <-chan tracker.Peer {
+	return d.getPeers(ctx, infoHash, port)
+}
+
+// Close leaves the DHT. Lookups in progress end.
+func (d *DHT) Close() error {
+	d.cancel()
+	err := d.conn.Close()
+	<-d.done
+
+	return err
+}
+
+/////////////// Private ///////////////
+
+// getPeers runs a get_peers lookup for GetPeers and Announce, announcing on
+// port unless it's zero.
+func (d *DHT) getPeers(
+	ctx context.Context,
+	infoHash [sha1.Size]byte,
+	port uint16,
+) <-chan tracker.Peer {
+	peers := make(chan tracker.Peer)
+
+	go func() {
+		defer close(peers)
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stop := context.AfterFunc(d.ctx, cancel)
+		defer stop()
+
+		seen := make(map[string]bool)
+		closest := d.lookup(ctx, infoHash, methodGetPeers, func(r *response) {
+			for _, v := range r.Values {
+				p, ok := decodePeer(v)
+				if !ok || seen[p.Addr()] {
+					continue
+				}
+				seen[p.Addr()] = true
+
+				select {
+				case peers <- p:
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+		if port == 0 {
+			return
+		}
+
+		var wg sync.WaitGroup
+		for _, c := range closest {
+			if c.token == "" {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				d.query(ctx, c.node, methodAnnouncePeer, &args{
+					InfoHash: infoHash,
+					Port:     int(port),
+					Token:    c.token,
+				})
+			}()
+		}
+		wg.Wait()
+	}()
+
+	return peers
+}
+
+// refreshLoop looks up our own ID now and every refreshInterval, filling the
+// table with the nodes closest to us and rejoining through the bootstrap
+// nodes whenever it ran empty.
+func (d *DHT) refreshLoop() {
+	for {
+		d.lookup(d.ctx, d.id, methodFindNode, nil)
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-d.clock.After(refreshInterval):
+		}
+	}
+}
+
+// readLoop handles every message received until the connection is closed.
+func (d *DHT) readLoop() {
+	defer close(d.done)
+
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+
+		msg, err := decodeMessage(buf[:n])
+		if err != nil {
+			slog.Debug("Dropping DHT message", "addr", addr, "error", err)
+			continue
+		}
+
+		if msg.Y == typeQuery {
+			d.handleQuery(msg, addr)
+			continue
+		}
+
+		d.mu.Lock()
+		pq, ok := d.pending[msg.T]
+		if ok && pq.addr == addr.String() {
+			delete(d.pending, msg.T)
+			pq.ch <- msg
+		}
+		d.mu.Unlock()
+	}
+}
+
+// query sends a query to node and waits for the answer. The node joins the
+// table once it answers, even if its ID wasn't known before; one that
+// doesn't is marked as failed.
+func (d *DHT) query(
+	ctx context.Context,
+	node *Node,
+	method string,
+	a *args,
+) (*response, error) {
+	a.ID = d.id
+
+	pq := &pendingQuery{addr: node.Addr.String(), ch: make(chan *message, 1)}
+	d.mu.Lock()
+	var t string
+	for {
+		d.nextTxID++
+		t = string(binary.BigEndian.AppendUint16(nil, d.nextTxID))
+		if _, ok := d.pending[t]; !ok {
+			break
+		}
+	}
+	d.pending[t] = pq
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, t)
+		d.mu.Unlock()
+	}()
+
+	err := d.send(node.Addr, &message{T: t, Y: typeQuery, Q: method, A: a})
+	if err != nil {
+		return nil, err
+	}
+
+	timer := d.clock.NewTimer(queryTimeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-pq.ch:
+		if msg.Y == typeError {
+			return nil, msg.remoteError()
+		}
+		d.table.add(&Node{ID: msg.R.ID, Addr: node.Addr}, d.clock.Now())
+		return msg.R, nil
+	case <-timer.C():
+		if node.ID != (NodeID{}) {
+			d.table.failed(node.ID)
+		}
+		return nil, fmt.Errorf("dht: %s to %s timed out", method, node.Addr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-d.ctx.Done():
+		return nil, ErrClosed
+	}
+}
+
+// send writes a message to addr.
+func (d *DHT) send(addr *net.UDPAddr, msg *message) error {
+	data, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.conn.WriteToUDP(data, addr)
+	return err
+}
+
+// handleQuery answers a query of another node, which joins the table.
+func (d *DHT) handleQuery(msg *message, addr *net.UDPAddr) {
+	d.table.add(&Node{ID: msg.A.ID, Addr: addr}, d.clock.Now())
+
+	reply := &message{T: msg.T, Y: typeResponse, R: &response{ID: d.id}}
+	switch msg.Q {
+	case methodPing:
+	case methodFindNode:
+		reply.R.Nodes = encodeNodes(d.table.closest(msg.A.Target, bucketSize))
+	case methodGetPeers:
+		reply.R.Token = d.token(addr.IP)
+		if values := d.storedPeers(msg.A.InfoHash); len(values) > 0 {
+			reply.R.Values = values
+		} else {
+			reply.R.Nodes = encodeNodes(
+				d.table.closest(msg.A.InfoHash, bucketSize),
+			)
+		}
+	case methodAnnouncePeer:
+		if !d.validToken(msg.A.Token, addr.IP) {
+			reply = errorMessage(msg.T, errCodeProtocol, "bad token")
+			break
+		}
+		port := msg.A.Port
+		if msg.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			reply = errorMessage(msg.T, errCodeProtocol, "invalid port")
+			break
+		}
+		d.storePeer(msg.A.InfoHash, addr.IP, port)
+	default:
+		reply = errorMessage(msg.T, errCodeMethod, "method unknown")
+	}
+
+	if err := d.send(addr, reply); err != nil {
+		slog.Debug("Answering DHT query failed", "addr", addr, "error", err)
+	}
+}
+
+// token returns the token a node at ip has to present to announce_peer: a
+// hash of its address and a secret, so no state is kept per node.
+func (d *DHT) token(ip net.IP) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.clock.Now().Sub(d.secretTime) >= tokenRotation {
+		d.rotateSecret()
+	}
+	return makeToken(d.secret, ip)
+}
+
+// validToken reports whether token was handed out to a node at ip recently.
+func (d *DHT) validToken(token string, ip net.IP) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.clock.Now().Sub(d.secretTime) >= tokenRotation {
+		d.rotateSecret()
+	}
+	return token == makeToken(d.secret, ip) ||
+		token == makeToken(d.prevSecret, ip)
+}
+
+// rotateSecret makes a new token secret, keeping the current one as the
+// previous. The caller must hold mu, unless d isn't shared yet.
+func (d *DHT) rotateSecret() {
+	d.prevSecret = d.secret
+	rand.Read(d.secret[:])
+	d.secretTime = d.clock.Now()
+}
+
+func makeToken(secret [16]byte, ip net.IP) string {
+	h := sha1.New()
+	h.Write(secret[:])
+	h.Write(ip.To16())
+	return string(h.Sum(nil))
+}
+
+// storePeer records a peer announced for infoHash.
+func (d *DHT) storePeer(infoHash NodeID, ip net.IP, port int) {
+	value, ok := encodePeer(ip, port)
+	if !ok {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	peers, ok := d.peers[infoHash]
+	if !ok {
+		if len(d.peers) >= maxTorrents {
+			return
+		}
+		peers = make(map[string]time.Time)
+		d.peers[infoHash] = peers
+	}
+	if _, ok := peers[value]; !ok && len(peers) >= maxPeersPerTorrent {
+		return
+	}
+	peers[value] = d.clock.Now()
+}
+
+// storedPeers returns up to maxValues compact peers announced for infoHash,
+// dropping the ones that expired.
+func (d *DHT) storedPeers(infoHash NodeID) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clock.Now()
+	var values []string
+	for value, announced := range d.peers[infoHash] {
+		if now.Sub(announced) > peerTTL {
+			delete(d.peers[infoHash], value)
+			continue
+		}
+		if len(values) < maxValues {
+			values = append(values, value)
+		}
+	}
+	if len(d.peers[infoHash]) == 0 {
+		delete(d.peers, infoHash)
+	}
+
+	return values
+}
@@ -0,0 +1,180 @@
+package dht
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// mockNode is a scripted DHT node: it answers find_node with no nodes and
+// get_peers with its peers and a token, and reports the announce_peer queries
+// it gets.
+type mockNode struct {
+	conn      *net.UDPConn
+	id        NodeID
+	peers     []string
+	token     string
+	announces chan *args
+}
+
+func newMockNode(t *testing.T, peers []string) *mockNode {
+	t.Helper()
+
+	localhost := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	conn, err := net.ListenUDP("udp4", localhost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockNode{
+		conn:      conn,
+		id:        NodeID{0xEE},
+		peers:     peers,
+		token:     "mock-token",
+		announces: make(chan *args, 4),
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go m.serve()
+	return m
+}
+
+func (m *mockNode) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		msg, err := decodeMessage(buf[:n])
+		if err != nil || msg.Y != typeQuery {
+			continue
+		}
+
+		reply := &message{T: msg.T, Y: typeResponse, R: &response{ID: m.id}}
+		switch msg.Q {
+		case methodGetPeers:
+			reply.R.Values = m.peers
+			reply.R.Token = m.token
+		case methodAnnouncePeer:
+			if msg.A.Token != m.token {
+				reply = errorMessage(msg.T, errCodeProtocol, "bad token")
+			}
+			m.announces <- msg.A
+		}
+
+		data, _ := encodeMessage(reply)
+		m.conn.WriteToUDP(data, addr)
+	}
+}
+
+func listenTestDHT(t *testing.T, bootstrap ...string) *DHT {
+	t.Helper()
+
+	d, err := Listen("127.0.0.1:0", Options{BootstrapNodes: bootstrap})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	return d
+}
+
+func TestAnnounceUsesGetPeersToken(t *testing.T) {
+	var peers []string
+	for _, port := range []int{1000, 2000} {
+		v, _ := encodePeer(net.IPv4(10, 0, 0, 1), port)
+		peers = append(peers, v)
+	}
+	mock := newMockNode(t, peers)
+
+	d := listenTestDHT(t, mock.conn.LocalAddr().String())
+	infoHash := sha1.Sum([]byte("torrent"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var got []string
+	for p := range d.Announce(ctx, infoHash, 6881) {
+		got = append(got, p.Addr())
+	}
+	slices.Sort(got)
+	want := []string{"10.0.0.1:1000", "10.0.0.1:2000"}
+	if !slices.Equal(got, want) {
+		t.Errorf("peers = %q, want %q", got, want)
+	}
+
+	// The announce presents the token of the get_peers answer.
+	select {
+	case a := <-mock.announces:
+		if a.Token != mock.token || a.Port != 6881 || a.InfoHash != infoHash {
+			t.Errorf(
+				"announced %x on port %d with token %q",
+				a.InfoHash,
+				a.Port,
+				a.Token,
+			)
+		}
+	case <-ctx.Done():
+		t.Fatal("no announce_peer reached the node")
+	}
+
+	// The node joined the table with the ID it answered with.
+	if nodes := d.table.closest(mock.id, 1); len(nodes) != 1 ||
+		nodes[0].ID != mock.id {
+		t.Errorf("table has %v, want the mock node", nodes)
+	}
+}
+
+func TestServesAnnouncedPeers(t *testing.T) {
+	server := listenTestDHT(t)
+	client := listenTestDHT(t, server.Addr().String())
+	infoHash := sha1.Sum([]byte("torrent"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for range client.Announce(ctx, infoHash, 7000) {
+		t.Error("got a peer before anyone announced")
+	}
+
+	var got []string
+	for p := range client.GetPeers(ctx, infoHash) {
+		got = append(got, p.Addr())
+	}
+	if want := []string{"127.0.0.1:7000"}; !slices.Equal(got, want) {
+		t.Errorf("peers = %q, want %q", got, want)
+	}
+
+	// An announce without a valid token is refused.
+	node := &Node{ID: server.ID(), Addr: server.Addr()}
+	_, err := client.query(ctx, node, methodAnnouncePeer, &args{
+		InfoHash: infoHash,
+		Port:     7001,
+		Token:    "forged",
+	})
+	var remoteErr *Error
+	if !errors.As(err, &remoteErr) || remoteErr.Code != errCodeProtocol {
+		t.Errorf("err = %v, want a %d error", err, errCodeProtocol)
+	}
+}
+
+func TestSelfLookupJoinsThroughBootstrapNodes(t *testing.T) {
+	router := listenTestDHT(t)
+	d := listenTestDHT(t, router.Addr().String())
+
+	// Bootstrap nodes stand in with the lookup's target as their ID, which
+	// for the refresh lookup is our own.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	closest := d.lookup(ctx, d.ID(), methodFindNode, nil)
+	if len(closest) != 1 || closest[0].node.ID != router.ID() {
+		t.Fatalf("self lookup found %d nodes, want the router", len(closest))
+	}
+	if d.NumNodes() != 1 {
+		t.Errorf("table has %d nodes after joining, want 1", d.NumNodes())
+	}
+}
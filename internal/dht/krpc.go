@@ -0,0 +1,133 @@
+package dht
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/prxssh/relay/internal/bencode"
+)
+
+// KRPC error codes (BEP 5)
+const (
+	errCodeGeneric  = 201
+	errCodeServer   = 202
+	errCodeProtocol = 203
+	errCodeMethod   = 204
+)
+
+// KRPC message types and query methods
+const (
+	typeQuery    = "q"
+	typeResponse = "r"
+	typeError    = "e"
+
+	methodPing         = "ping"
+	methodFindNode     = "find_node"
+	methodGetPeers     = "get_peers"
+	methodAnnouncePeer = "announce_peer"
+)
+
+// Error is an error message a node answered a query with.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("dht: remote error %d: %s", e.Code, e.Message)
+}
+
+/////////////// Private ///////////////
+
+// message is a KRPC message: a query, a response or an error, told apart by
+// Y. Queries and their answers share the transaction ID T.
+type message struct {
+	T string    `bencode:"t"`
+	Y string    `bencode:"y"`
+	Q string    `bencode:"q,omitempty"`
+	A *args     `bencode:"a,omitempty"`
+	R *response `bencode:"r,omitempty"`
+	// Error code and message
+	E []any `bencode:"e,omitempty"`
+	// Client version (optional)
+	V string `bencode:"v,omitempty"`
+}
+
+// args are the arguments of a query; which are set depends on the method.
+type args struct {
+	ID       NodeID `bencode:"id"`
+	Target   NodeID `bencode:"target,omitempty"`
+	InfoHash NodeID `bencode:"info_hash,omitempty"`
+	Port     int    `bencode:"port,omitempty"`
+	Token    string `bencode:"token,omitempty"`
+	// If set, the announced port is the one the query came from
+	ImpliedPort int `bencode:"implied_port,omitempty"`
+}
+
+// response is the body of a response; which fields are set depends on the
+// method queried.
+type response struct {
+	ID NodeID `bencode:"id"`
+	// Compact nodes closest to the target or info hash
+	Nodes string `bencode:"nodes,omitempty"`
+	// Compact peers of the info hash
+	Values []string `bencode:"values,omitempty"`
+	// Lets the querying node announce itself with announce_peer later
+	Token string `bencode:"token,omitempty"`
+}
+
+// encodeMessage bencodes msg for sending.
+func encodeMessage(msg *message) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bencode.NewMarshaller(&buf).Encode(msg); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decodeMessage parses a received message.
+func decodeMessage(data []byte) (*message, error) {
+	var msg message
+	err := bencode.NewUnmarshaller(bytes.NewReader(data)).Decode(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch msg.Y {
+	case typeQuery:
+		if msg.A == nil {
+			return nil, fmt.Errorf("dht: %s query without arguments", msg.Q)
+		}
+	case typeResponse:
+		if msg.R == nil {
+			return nil, fmt.Errorf("dht: response without body")
+		}
+	case typeError:
+	default:
+		return nil, fmt.Errorf("dht: unknown message type %q", msg.Y)
+	}
+
+	return &msg, nil
+}
+
+// remoteError returns the error of an error message.
+func (msg *message) remoteError() *Error {
+	e := &Error{Code: errCodeGeneric}
+	if len(msg.E) > 0 {
+		if code, ok := msg.E[0].(int64); ok {
+			e.Code = int(code)
+		}
+	}
+	if len(msg.E) > 1 {
+		e.Message, _ = msg.E[1].(string)
+	}
+
+	return e
+}
+
+// errorMessage returns the error message answering the query with
+// transaction ID t.
+func errorMessage(t string, code int, text string) *message {
+	return &message{T: t, Y: typeError, E: []any{int64(code), text}}
+}
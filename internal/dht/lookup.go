@@ -0,0 +1,172 @@
+package dht
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// lookupAlpha is how many nodes a lookup queries at once.
+const lookupAlpha = 3
+
+/////////////// Private ///////////////
+
+// candidate is a node a lookup may query.
+type candidate struct {
+	node      *Node
+	queried   bool
+	responded bool
+	// Token of a get_peers response, for announcing to the node
+	token string
+}
+
+// lookup searches iteratively for the nodes closest to target (Kademlia): it
+// queries the closest nodes it knows, learns of closer ones from their
+// answers and repeats until the bucketSize closest nodes it knows all
+// answered or failed. method is find_node or get_peers; onResponse, unless
+// nil, is called with each answer. It starts from the table, or from the
+// nodes of a previous run and the bootstrap nodes while the table is empty,
+// and returns the closest nodes that answered.
+func (d *DHT) lookup(
+	ctx context.Context,
+	target NodeID,
+	method string,
+	onResponse func(*response),
+) []*candidate {
+	var (
+		candidates []*candidate
+		seen       = make(map[string]bool)
+	)
+	addCandidate := func(n *Node) {
+		if seen[n.Addr.String()] {
+			return
+		}
+		seen[n.Addr.String()] = true
+		candidates = append(candidates, &candidate{node: n})
+	}
+
+	for _, n := range d.table.closest(target, bucketSize) {
+		addCandidate(n)
+	}
+	if len(candidates) == 0 {
+		for _, n := range d.known {
+			addCandidate(n)
+		}
+		// Bootstrap nodes are queried first; their IDs are learned from
+		// their answers.
+		for _, n := range d.resolveBootstrap(ctx, target) {
+			addCandidate(n)
+		}
+	}
+
+	for ctx.Err() == nil {
+		slices.SortStableFunc(candidates, func(a, b *candidate) int {
+			switch {
+			case closer(target, a.node.ID, b.node.ID):
+				return -1
+			case closer(target, b.node.ID, a.node.ID):
+				return 1
+			default:
+				return 0
+			}
+		})
+		candidates = candidates[:min(len(candidates), 4*bucketSize)]
+
+		var round []*candidate
+		for _, c := range candidates[:min(len(candidates), bucketSize)] {
+			if !c.queried && len(round) < lookupAlpha {
+				c.queried = true
+				round = append(round, c)
+			}
+		}
+		if len(round) == 0 {
+			break
+		}
+
+		var (
+			wg sync.WaitGroup
+			mu sync.Mutex
+		)
+		for _, c := range round {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				a := &args{Target: target, InfoHash: target}
+				r, err := d.query(ctx, c.node, method, a)
+				if err != nil {
+					return
+				}
+				nodes, _ := decodeNodes(r.Nodes)
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				c.responded, c.token = true, r.Token
+				c.node = &Node{ID: r.ID, Addr: c.node.Addr}
+				// We may be among the nodes of the answer.
+				for _, n := range nodes {
+					if n.ID != d.id {
+						addCandidate(n)
+					}
+				}
+				if onResponse != nil {
+					onResponse(r)
+				}
+			}()
+		}
+		wg.Wait()
+
+		candidates = slices.DeleteFunc(candidates, func(c *candidate) bool {
+			return c.queried && !c.responded
+		})
+	}
+
+	var closest []*candidate
+	for _, c := range candidates {
+		if c.responded && len(closest) < bucketSize {
+			closest = append(closest, c)
+		}
+	}
+	return closest
+}
+
+// resolveBootstrap resolves the bootstrap nodes. Their IDs are unknown, so
+// they're given target's, which puts them first in a lookup.
+func (d *DHT) resolveBootstrap(ctx context.Context, target NodeID) []*Node {
+	var nodes []*Node
+	for _, hostport := range d.bootstrap {
+		host, portStr, err := net.SplitHostPort(hostport)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			continue
+		}
+
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip4", host)
+		if err != nil {
+			slog.Debug(
+				"Resolving DHT bootstrap node failed",
+				"node", hostport,
+				"error", err,
+			)
+			continue
+		}
+		for _, ip := range ips {
+			nodes = append(nodes, &Node{
+				ID: target,
+				Addr: net.UDPAddrFromAddrPort(
+					netip.AddrPortFrom(ip.Unmap(), uint16(port)),
+				),
+			})
+		}
+	}
+
+	return nodes
+}
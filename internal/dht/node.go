@@ -0,0 +1,134 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+
+	"github.com/prxssh/relay/internal/tracker"
+)
+
+// NodeID identifies a DHT node. It shares the 160-bit space of info hashes,
+// so the nodes closest to an info hash are the ones that track its peers.
+type NodeID [sha1.Size]byte
+
+// RandomNodeID returns a fresh random node ID.
+func RandomNodeID() (NodeID, error) {
+	var id NodeID
+	if _, err := rand.Read(id[:]); err != nil {
+		return NodeID{}, fmt.Errorf("dht: failed generating node id: %w", err)
+	}
+
+	return id, nil
+}
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Node is a DHT node we know the address of.
+type Node struct {
+	ID   NodeID
+	Addr *net.UDPAddr
+}
+
+/////////////// Private ///////////////
+
+const (
+	// compactNodeLen is the size of a node in the 'nodes' string of a
+	// response: its ID, IPv4 address and port.
+	compactNodeLen = sha1.Size + net.IPv4len + 2
+	// compactPeerLen is the size of a peer in the 'values' of a get_peers
+	// response: its IPv4 address and port.
+	compactPeerLen = net.IPv4len + 2
+)
+
+// closer reports whether a is closer to target than b by the XOR metric.
+func closer(target, a, b NodeID) bool {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// commonPrefixLen returns the number of leading bits a and b share.
+func commonPrefixLen(a, b NodeID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			n := i * 8
+			for x&0x80 == 0 {
+				x <<= 1
+				n++
+			}
+			return n
+		}
+	}
+	return len(a) * 8
+}
+
+// encodeNodes packs nodes in the compact form of the 'nodes' key. Nodes
+// without an IPv4 address don't fit it and are left out.
+func encodeNodes(nodes []*Node) string {
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		ip := n.Addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf.Write(n.ID[:])
+		buf.Write(ip)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n.Addr.Port)))
+	}
+
+	return buf.String()
+}
+
+// decodeNodes unpacks the compact 'nodes' of a response.
+func decodeNodes(s string) ([]*Node, error) {
+	if len(s)%compactNodeLen != 0 {
+		return nil, fmt.Errorf("dht: invalid compact nodes length %d", len(s))
+	}
+
+	nodes := make([]*Node, 0, len(s)/compactNodeLen)
+	for b := []byte(s); len(b) > 0; b = b[compactNodeLen:] {
+		n := &Node{Addr: &net.UDPAddr{
+			IP:   net.IP(bytes.Clone(b[sha1.Size : sha1.Size+net.IPv4len])),
+			Port: int(binary.BigEndian.Uint16(b[sha1.Size+net.IPv4len:])),
+		}}
+		copy(n.ID[:], b)
+		nodes = append(nodes, n)
+	}
+
+	return nodes, nil
+}
+
+// encodePeer packs a peer the way the 'values' of a get_peers response list
+// them. ok is false for peers without an IPv4 address.
+func encodePeer(ip net.IP, port int) (s string, ok bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return "", false
+	}
+
+	b := binary.BigEndian.AppendUint16(bytes.Clone(ip4), uint16(port))
+	return string(b), true
+}
+
+// decodePeer unpacks a peer of the 'values' of a get_peers response.
+func decodePeer(s string) (tracker.Peer, bool) {
+	if len(s) != compactPeerLen {
+		return tracker.Peer{}, false
+	}
+
+	return tracker.Peer{
+		IP:   net.IP([]byte(s[:net.IPv4len])),
+		Port: binary.BigEndian.Uint16([]byte(s[net.IPv4len:])),
+	}, true
+}
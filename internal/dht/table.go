@@ -0,0 +1,172 @@
+package dht
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// bucketSize is the K of Kademlia: the capacity of a bucket and the
+	// number of closest nodes a lookup converges on.
+	bucketSize = 8
+	// maxNodeFailures is how many queries in a row a node may leave
+	// unanswered before it's considered bad and makes room for others.
+	maxNodeFailures = 2
+)
+
+// table is the routing table: the nodes we know, in buckets by how many
+// leading bits their ID shares with ours. Bucket i holds the nodes sharing
+// exactly i bits, except for the last, which holds every node sharing at
+// least as many. That's the bucket our own ID falls into and the only one
+// that splits when full, as in BEP 5, so the table knows many nodes close to
+// us and a few of every other part of the ID space. It's safe for concurrent
+// use.
+type table struct {
+	mu      sync.Mutex
+	self    NodeID
+	buckets []*bucket
+}
+
+// bucket holds up to bucketSize nodes, least recently seen first.
+type bucket struct {
+	entries []*tableEntry
+}
+
+type tableEntry struct {
+	node     *Node
+	lastSeen time.Time
+	// Queries in a row the node didn't answer
+	failures int
+}
+
+func newTable(self NodeID) *table {
+	return &table{self: self, buckets: []*bucket{{}}}
+}
+
+// add records that a node answered us or sent us a query. A known node is
+// refreshed; a new one is added if its bucket has room, splitting the last
+// bucket if need be, or takes the place of a bad node. Good nodes are never
+// evicted for new ones: nodes that stayed around long are likely to stay
+// longer. It reports whether the node is in the table.
+func (t *table) add(n *Node, now time.Time) bool {
+	if n.ID == t.self {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for {
+		i := t.bucketIndex(n.ID)
+		b := t.buckets[i]
+
+		if j := b.index(n.ID); j >= 0 {
+			e := b.entries[j]
+			e.node, e.lastSeen, e.failures = n, now, 0
+			b.entries = append(slices.Delete(b.entries, j, j+1), e)
+			return true
+		}
+
+		e := &tableEntry{node: n, lastSeen: now}
+		if len(b.entries) < bucketSize {
+			b.entries = append(b.entries, e)
+			return true
+		}
+		if i == len(t.buckets)-1 && len(t.buckets) < len(NodeID{})*8 {
+			t.split()
+			continue
+		}
+
+		for j, old := range b.entries {
+			if old.failures >= maxNodeFailures {
+				b.entries = append(slices.Delete(b.entries, j, j+1), e)
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// failed records that a node didn't answer a query.
+func (t *table) failed(id NodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.buckets[t.bucketIndex(id)]
+	if j := b.index(id); j >= 0 {
+		b.entries[j].failures++
+	}
+}
+
+// closest returns up to k good nodes closest to target, closest first.
+func (t *table) closest(target NodeID, k int) []*Node {
+	t.mu.Lock()
+	var nodes []*Node
+	for _, b := range t.buckets {
+		for _, e := range b.entries {
+			if e.failures < maxNodeFailures {
+				nodes = append(nodes, e.node)
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	slices.SortFunc(nodes, func(a, b *Node) int {
+		switch {
+		case closer(target, a.ID, b.ID):
+			return -1
+		case closer(target, b.ID, a.ID):
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	return nodes[:min(k, len(nodes))]
+}
+
+// len returns the number of nodes in the table, good or bad.
+func (t *table) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var n int
+	for _, b := range t.buckets {
+		n += len(b.entries)
+	}
+	return n
+}
+
+// bucketIndex returns the index of the bucket id belongs in. The caller must
+// hold mu.
+func (t *table) bucketIndex(id NodeID) int {
+	return min(commonPrefixLen(t.self, id), len(t.buckets)-1)
+}
+
+// split divides the last bucket in two: the nodes sharing just as many bits
+// with us as the bucket's index stay, the closer ones move to a new last
+// bucket. The caller must hold mu.
+func (t *table) split() {
+	depth := len(t.buckets) - 1
+	last := t.buckets[depth]
+
+	next := &bucket{}
+	var keep []*tableEntry
+	for _, e := range last.entries {
+		if commonPrefixLen(t.self, e.node.ID) > depth {
+			next.entries = append(next.entries, e)
+		} else {
+			keep = append(keep, e)
+		}
+	}
+	last.entries = keep
+	t.buckets = append(t.buckets, next)
+}
+
+// index returns the position of the node with id in the bucket, or -1.
+func (b *bucket) index(id NodeID) int {
+	return slices.IndexFunc(b.entries, func(e *tableEntry) bool {
+		return e.node.ID == id
+	})
+}
@@ -0,0 +1,124 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// idWithPrefix returns an ID sharing exactly shared leading bits with self,
+// made unique by n.
+func idWithPrefix(self NodeID, shared int, n byte) NodeID {
+	id := self
+	id[shared/8] ^= 0x80 >> (shared % 8)
+	id[len(id)-1] ^= n
+	return id
+}
+
+func testNode(id NodeID, port int) *Node {
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port}
+	return &Node{ID: id, Addr: addr}
+}
+
+func TestTableSplitsOwnBucket(t *testing.T) {
+	var self NodeID
+	self[0] = 0x55
+	tbl := newTable(self)
+	now := time.Now()
+
+	// Eight far nodes fill the only bucket.
+	for i := range bucketSize {
+		if !tbl.add(testNode(idWithPrefix(self, 0, byte(i+1)), i), now) {
+			t.Fatalf("far node %d wasn't added", i)
+		}
+	}
+	if len(tbl.buckets) != 1 {
+		t.Fatalf("%d buckets before the split, want 1", len(tbl.buckets))
+	}
+
+	// A ninth node splits it: the far nodes keep the first bucket, the new
+	// one sharing a bit with us goes to the second.
+	near := testNode(idWithPrefix(self, 1, 1), 100)
+	if !tbl.add(near, now) {
+		t.Fatal("near node wasn't added")
+	}
+	if len(tbl.buckets) != 2 {
+		t.Fatalf("%d buckets after the split, want 2", len(tbl.buckets))
+	}
+	if n := len(tbl.buckets[0].entries); n != bucketSize {
+		t.Errorf("far bucket has %d nodes, want %d", n, bucketSize)
+	}
+	if tbl.buckets[1].index(near.ID) < 0 {
+		t.Error("near node isn't in the last bucket")
+	}
+
+	// The far bucket doesn't split again; it's full of good nodes.
+	far := testNode(idWithPrefix(self, 0, 99), 200)
+	if tbl.add(far, now) {
+		t.Error("node added to a full bucket of good nodes")
+	}
+
+	// Once a node went bad it makes room.
+	bad := tbl.buckets[0].entries[0].node.ID
+	for range maxNodeFailures {
+		tbl.failed(bad)
+	}
+	if !tbl.add(far, now) {
+		t.Fatal("node not added in place of a bad one")
+	}
+	if tbl.buckets[0].index(bad) >= 0 {
+		t.Error("bad node is still in the table")
+	}
+	if got := tbl.len(); got != bucketSize+1 {
+		t.Errorf("table has %d nodes, want %d", got, bucketSize+1)
+	}
+	if tbl.add(testNode(self, 300), now) {
+		t.Error("our own ID was added")
+	}
+}
+
+func TestTableClosest(t *testing.T) {
+	var self NodeID
+	tbl := newTable(self)
+	now := time.Now()
+
+	for shared := range 20 {
+		tbl.add(testNode(idWithPrefix(self, shared, 0), shared), now)
+	}
+
+	// The closest nodes to our own ID share the most bits with it.
+	got := tbl.closest(self, 3)
+	if len(got) != 3 {
+		t.Fatalf("got %d nodes, want 3", len(got))
+	}
+	for i, n := range got {
+		if shared := commonPrefixLen(self, n.ID); shared != 19-i {
+			t.Errorf("node %d shares %d bits, want %d", i, shared, 19-i)
+		}
+	}
+}
+
+func TestCompactNodesRoundTrip(t *testing.T) {
+	var id NodeID
+	id[0] = 0xAB
+	nodes := []*Node{
+		testNode(id, 6881),
+		{ID: id, Addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1")}},
+	}
+
+	got, err := decodeNodes(encodeNodes(nodes))
+	if err != nil {
+		t.Fatalf("decodeNodes: %v", err)
+	}
+	// The IPv6 node doesn't fit the compact form.
+	if len(got) != 1 {
+		t.Fatalf("got %d nodes, want 1", len(got))
+	}
+	if got[0].ID != id || got[0].Addr.String() != "10.0.0.1:6881" {
+		t.Errorf("got node %s at %s", got[0].ID, got[0].Addr)
+	}
+
+	if _, err := decodeNodes("short"); err == nil {
+		t.Error("expected an error for a misaligned nodes string")
+	}
+}
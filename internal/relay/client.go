@@ -5,61 +5,572 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha1"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"slices"
+	"sync"
+	"time"
 
+	"github.com/prxssh/relay/internal/dht"
 	"github.com/prxssh/relay/internal/torrent"
+	"github.com/prxssh/relay/internal/utils"
 )
 
 // Client represents a struct which manages the complete state of the torrents.
 type Client struct {
 	// Unique 20-byte identifier for this client.
 	ID [sha1.Size]byte
+	// Sent with every announce so trackers know us across IP changes
+	announceKey string
+	// Downloads a magnet link's info dictionary from a peer;
+	// torrent.FetchMetadata unless a test swaps it before adding magnets
+	fetchMetadata metadataFetcher
+	// Guards torrents, queue, lowDisk and urlValidators
+	mu sync.RWMutex
 	// Mapping of a torrent's info hash to its active session.
 	torrents map[[sha1.Size]byte]*session
+	// Every session in queue order; earlier sessions get free slots first.
+	queue []*session
+	// Set while free disk space is below cfg.MinFreeDisk; downloads are
+	// paused until it recovers.
+	lowDisk bool
+	// Local interface addresses as of the last network check
+	netAddrs string
+	// Cache validators of the .torrent files added by URL, keyed by URL
+	urlValidators map[string]urlValidators
+	// Serializes queue rebalancing
+	rebalanceMu sync.Mutex
+	// Settings new sessions are created with
+	cfg Config
+	// Recent client-wide transfer rates, one sample per stats tick
+	speedHistory *utils.Ring[SpeedSample]
+	// Estimates our external address from what peers report
+	ipVoter *torrent.IPVoter
+	// Decides which peers are dialed first, shared by all sessions
+	connPolicy *torrent.ConnectPolicy
+	// Upload slots shared by all sessions; nil if unlimited
+	uploadSlots *torrent.UploadSlots
+	// Peer connection caps shared by all sessions
+	connSlots *torrent.ConnSlots
+	// Accepts inbound peer connections for every session
+	listener net.Listener
+	// Finds peers of public torrents; nil if disabled or unavailable
+	dht *dht.DHT
+	// Client-wide transfer rate limits, on top of each session's
+	downLimiter *utils.RateLimiter
+	upLimiter   *utils.RateLimiter
+	ctx         context.Context
+	cancelFunc  context.CancelFunc
+}
+
+// urlValidators are the response headers used to ask a server whether a
+// .torrent file changed since we last fetched it.
+type urlValidators struct {
+	etag         string
+	lastModified string
 }
 
 const clientIDPrefix string = "-RL0001-"
 
-func NewClient() (*Client, error) {
-	clientID, err := generatePeerID()
+func NewClient(cfg Config) (*Client, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	clientID, err := generatePeerID(cfg.PeerIDPrefix)
+	if err != nil {
+		return nil, err
+	}
+	announceKey, err := generateAnnounceKey()
+	if err != nil {
+		return nil, err
+	}
+	connPolicy, err := cfg.connectPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	c := &Client{
+		ID:            clientID,
+		announceKey:   announceKey,
+		fetchMetadata: torrent.FetchMetadata,
+		torrents:      make(map[[sha1.Size]byte]*session),
+		urlValidators: make(map[string]urlValidators),
+		cfg:           cfg,
+		speedHistory:  utils.NewRing[SpeedSample](speedHistorySize),
+		ipVoter:       torrent.NewIPVoter(),
+		connPolicy:    connPolicy,
+		connSlots: torrent.NewConnSlots(
+			cfg.MaxConnections,
+			cfg.MaxConnectionsPerTorrent,
+		),
+		downLimiter: utils.NewRateLimiter(0),
+		upLimiter:   utils.NewRateLimiter(0),
+		ctx:         ctx,
+		cancelFunc:  cancelFunc,
+	}
+	if cfg.MaxUploads > 0 {
+		c.uploadSlots = torrent.NewUploadSlots(cfg.MaxUploads)
+	}
+	if err := c.listen(); err != nil {
+		cancelFunc()
+		return nil, err
+	}
+	state, err := c.loadState()
 	if err != nil {
+		c.listener.Close()
+		cancelFunc()
 		return nil, err
 	}
+	c.startDHT(state.DHTNodes)
+	c.restoreState(state)
+
+	go c.statsLoop()
+	go c.diskLoop()
+	go c.stateLoop()
+	go c.networkLoop()
+	go c.scrapeLoop()
+	go c.watchLoop()
+	go c.acceptLoop()
 
-	return &Client{
-		ID:       clientID,
-		torrents: make(map[[sha1.Size]byte]*session),
-	}, nil
+	return c, nil
 }
 
+// Close saves the state, then stops every session and the client's background
+// work, and stops accepting peers. It returns once the sessions have told their
+// trackers 'stopped', which they do all at once.
+func (c *Client) Close() {
+	c.saveState()
+	c.cancelFunc()
+	c.listener.Close()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, s := range c.torrents {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.stop()
+		}()
+	}
+	wg.Wait()
+	if c.dht != nil {
+		c.dht.Close()
+	}
+}
+
+// SpeedHistory returns the client-wide transfer rates summed over all
+// sessions, oldest first, one sample per stats tick.
+func (c *Client) SpeedHistory() []SpeedSample {
+	return c.speedHistory.Snapshot()
+}
+
+// ExternalIP returns our external address as reported by a majority of peers,
+// or false while there's no consensus yet.
+func (c *Client) ExternalIP() (net.IP, bool) {
+	return c.ipVoter.External()
+}
+
+// SetDownloadLimit caps the download rate summed over all torrents, in bytes
+// per second. Zero removes the cap.
+func (c *Client) SetDownloadLimit(bytesPerSec int64) {
+	c.downLimiter.SetRate(bytesPerSec)
+}
+
+// SetUploadLimit caps the upload rate summed over all torrents, in bytes per
+// second. Zero removes the cap.
+func (c *Client) SetUploadLimit(bytesPerSec int64) {
+	c.upLimiter.SetRate(bytesPerSec)
+}
+
+// RateLimits returns the client-wide download and upload rate caps in bytes
+// per second, zero where there is none.
+func (c *Client) RateLimits() (down, up int64) {
+	return c.downLimiter.Rate(), c.upLimiter.Rate()
+}
+
+// ErrTorrentExists is returned when adding a torrent the client already has.
+var ErrTorrentExists = errors.New("relay: torrent already added")
+
+// ErrTorrentNotFound is returned for an info hash the client has no torrent
+// with.
+var ErrTorrentNotFound = errors.New("relay: torrent not found")
+
+// ErrNotModified is returned by AddTorrentURL when the server reports the
+// .torrent file unchanged since it was last added from the same URL.
+var ErrNotModified = errors.New("relay: torrent file not modified")
+
+// ErrTorrentTooLarge is returned when adding a .torrent file bigger than
+// Config.MaxTorrentSize.
+var ErrTorrentTooLarge = errors.New("relay: torrent file too large")
+
+// ErrNotTorrent is returned when the data added as a .torrent file isn't
+// bencoded, e.g. an HTML error page served in its place.
+var ErrNotTorrent = errors.New("relay: not a torrent file")
+
+// AddTorrentFile adds the torrent described by the .torrent file at path.
 func (c *Client) AddTorrentFile(path string) (*session, error) {
-	data, err := os.ReadFile(path)
+	return c.AddTorrentFileContext(c.ctx, path, nil)
+}
+
+// AddTorrentFileContext is AddTorrentFile for callers that want to show
+// progress while a huge .torrent file loads, or let the user give up on it:
+// progress, unless nil, is called as each phase of loading begins, and the add
+// is abandoned once ctx is done.
+func (c *Client) AddTorrentFileContext(
+	ctx context.Context,
+	path string,
+	progress func(torrent.ParsePhase),
+) (*session, error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
+
+	return c.addMetainfo(ctx, f, path, progress)
+}
 
-	torrent, err := torrent.New(bytes.NewReader(data))
+// AddTorrentFileWithSource adds the torrent described by the .torrent file at
+// torrentPath, reusing a copy of its data that already exists below
+// existingDataPath, laid out as it would be in a download directory. The files
+// are put in the download directory as mode says, falling back to copying
+// where linking isn't possible, and rechecked; only what's missing or damaged
+// is downloaded. This imports data for seeding without storing it twice.
+func (c *Client) AddTorrentFileWithSource(
+	torrentPath, existingDataPath string,
+	mode torrent.LinkMode,
+) (*session, error) {
+	f, err := os.Open(torrentPath)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 
-	session, err := newSession(context.Background(), c.ID, torrent)
+	data, err := c.readMetainfo(f)
 	if err != nil {
 		return nil, err
 	}
 
-	c.torrents[torrent.Info.Hash] = session
-	return session, nil
+	return c.addTorrent(
+		c.ctx,
+		data,
+		torrentPath,
+		nil,
+		func(s *session) error {
+			err := torrent.LinkFiles(
+				s.torrent.Info,
+				existingDataPath,
+				s.downloadDir,
+				mode,
+			)
+			if err != nil {
+				return err
+			}
+
+			s.verifyExisting()
+			return nil
+		},
+	)
+}
+
+// AddTorrentURL downloads a .torrent file over HTTP(S) and adds it. Fetching
+// a URL again is a conditional request based on the ETag and Last-Modified
+// headers of the previous response, and fails with ErrNotModified if the
+// server says the file hasn't changed, so pollers don't add it twice.
+func (c *Client) AddTorrentURL(url string) (*session, error) {
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	cached := c.urlValidators[url]
+	c.mu.RUnlock()
+	if cached.etag != "" {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	if cached.lastModified != "" {
+		req.Header.Set("If-Modified-Since", cached.lastModified)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, ErrNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(
+			"fetching %s: unexpected status %d",
+			url,
+			resp.StatusCode,
+		)
+	}
+
+	data, err := c.readMetainfo(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", url, err)
+	}
+
+	session, err := c.addTorrent(c.ctx, data, url, nil, nil)
+	if err == nil || errors.Is(err, ErrTorrentExists) {
+		c.mu.Lock()
+		c.urlValidators[url] = urlValidators{
+			etag:         resp.Header.Get("ETag"),
+			lastModified: resp.Header.Get("Last-Modified"),
+		}
+		c.mu.Unlock()
+	}
+	return session, err
+}
+
+// AddTorrent adds the torrent whose bencoded metainfo is read from r.
+func (c *Client) AddTorrent(r io.Reader) (*session, error) {
+	return c.AddTorrentContext(c.ctx, r, nil)
+}
+
+// AddTorrentContext is AddTorrent with progress reporting and cancellation,
+// like AddTorrentFileContext.
+func (c *Client) AddTorrentContext(
+	ctx context.Context,
+	r io.Reader,
+	progress func(torrent.ParsePhase),
+) (*session, error) {
+	return c.addMetainfo(ctx, r, "", progress)
+}
+
+// Torrent returns the session of the torrent with infoHash, or false if the
+// client doesn't have it.
+func (c *Client) Torrent(infoHash [sha1.Size]byte) (*session, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	s, ok := c.torrents[infoHash]
+	return s, ok
+}
+
+// Torrents returns a snapshot of every session, in queue order.
+func (c *Client) Torrents() []*session {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	sessions := make([]*session, len(c.queue))
+	copy(sessions, c.queue)
+	return sessions
+}
+
+// RemoveTorrent stops the torrent with infoHash, disconnecting its peers, and
+// forgets it, along with the copy of its metainfo. If deleteData is true its
+// downloaded files are deleted too; otherwise they're left where they are.
+func (c *Client) RemoveTorrent(
+	infoHash [sha1.Size]byte,
+	deleteData bool,
+) error {
+	c.mu.Lock()
+	s, ok := c.torrents[infoHash]
+	if !ok {
+		c.mu.Unlock()
+		return fmt.Errorf("%w: %x", ErrTorrentNotFound, infoHash)
+	}
+	delete(c.torrents, infoHash)
+	c.queue = slices.DeleteFunc(c.queue, func(q *session) bool {
+		return q == s
+	})
+	c.mu.Unlock()
+
+	s.stop()
+	c.saveState()
+	c.rebalance()
+
+	if c.cfg.StatePath != "" {
+		err := os.Remove(c.metainfoPath(infoHash))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Deleting metainfo failed", "error", err)
+		}
+	}
+	if !deleteData {
+		return nil
+	}
+
+	s.mu.Lock()
+	dir := s.downloadDir
+	s.mu.Unlock()
+	return torrent.DeleteFiles(s.torrent.Info, dir)
 }
 
 /////////////// Private /////////////////
 
-func generatePeerID() ([sha1.Size]byte, error) {
+// statsLoop samples the transfer rate of every session on each stats tick and
+// records their sum as the client-wide rate.
+func (c *Client) statsLoop() {
+	ticker := time.NewTicker(statsTickInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case now := <-ticker.C:
+			elapsed := now.Sub(last)
+			last = now
+
+			c.mu.RLock()
+			total := SpeedSample{Time: now}
+			for _, s := range c.torrents {
+				sample := s.sampleSpeed(now, elapsed)
+				total.Download += sample.Download
+				total.Upload += sample.Upload
+			}
+			c.mu.RUnlock()
+
+			c.speedHistory.Push(total)
+		}
+	}
+}
+
+// readMetainfo reads a .torrent file from r, giving up as soon as it exceeds
+// the configured size limit. It fails fast on data that can't be a bencoded
+// dictionary without handing it to the parser.
+func (c *Client) readMetainfo(r io.Reader) ([]byte, error) {
+	limit := c.cfg.maxTorrentSize()
+
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf(
+			"%w: more than %d bytes",
+			ErrTorrentTooLarge,
+			limit,
+		)
+	}
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, ErrNotTorrent
+	}
+
+	return data, nil
+}
+
+// addMetainfo reads a .torrent file from r, added from source, and adds its
+// torrent. See AddTorrentFileContext for ctx and progress.
+func (c *Client) addMetainfo(
+	ctx context.Context,
+	r io.Reader,
+	source string,
+	progress func(torrent.ParsePhase),
+) (*session, error) {
+	if progress != nil {
+		progress(torrent.PhaseReading)
+	}
+	data, err := c.readMetainfo(utils.ContextReader(ctx, r))
+	if err != nil {
+		return nil, err
+	}
+
+	return c.addTorrent(ctx, data, source, progress, nil)
+}
+
+// addTorrent adds the torrent with the bencoded metainfo data, added from
+// source, and keeps a copy of the metainfo to restore it on the next run.
+// Parsing reports to progress, unless nil, and stops once ctx is done.
+// prepare, unless nil, is run on the new session before it's queued; it's
+// skipped for a torrent the client already has, so a duplicate doesn't hash
+// or link data that's already in use.
+func (c *Client) addTorrent(
+	ctx context.Context,
+	data []byte,
+	source string,
+	progress func(torrent.ParsePhase),
+	prepare func(*session) error,
+) (*session, error) {
+	if prepare == nil {
+		prepare = (*session).resumeExisting
+	}
+
+	t, err := torrent.Parse(ctx, bytes.NewReader(data), progress)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := c.Torrent(t.Info.Hash); ok {
+		return nil, ErrTorrentExists
+	}
+
+	session, err := newSession(c.ctx, c.ID, t, c.cfg)
+	if err != nil {
+		return nil, err
+	}
+	session.source = source
+	if err := prepare(session); err != nil {
+		session.stop()
+		return nil, err
+	}
+
+	if err := c.addSession(session); err != nil {
+		session.stop()
+		return nil, err
+	}
+
+	if err := c.saveMetainfo(t.Info.Hash, data); err != nil {
+		slog.Warn("Saving metainfo failed", "name", t.Info.Name, "error", err)
+	}
+	c.saveState()
+
+	return session, nil
+}
+
+// addSession registers a new session at the back of the queue and lets the
+// queue decide whether it starts right away.
+func (c *Client) addSession(s *session) error {
+	s.onStateChange = c.rebalance
+	s.announceKey = c.announceKey
+	s.dht = c.dht
+	s.ipVoter = c.ipVoter
+	s.connPolicy = c.connPolicy
+	s.connSlots = c.connSlots
+	s.clientDownLimiter = c.downLimiter
+	s.clientUpLimiter = c.upLimiter
+	if c.uploadSlots != nil {
+		s.choker.ShareUploadSlots(c.uploadSlots)
+	}
+
+	c.mu.Lock()
+	if _, ok := c.torrents[s.torrent.Info.Hash]; ok {
+		c.mu.Unlock()
+		return ErrTorrentExists
+	}
+	c.torrents[s.torrent.Info.Hash] = s
+	c.queue = append(c.queue, s)
+	c.mu.Unlock()
+
+	// Decide on fresh numbers whether the new download may start writing.
+	c.checkDisk()
+	c.rebalance()
+	return nil
+}
+
+func generatePeerID(prefix string) ([sha1.Size]byte, error) {
 	var clientID [sha1.Size]byte
 
-	copy(clientID[:], []byte(clientIDPrefix))
-	if _, err := rand.Read(clientID[len(clientIDPrefix):]); err != nil {
+	if prefix == "" || len(prefix) > sha1.Size {
+		prefix = clientIDPrefix
+	}
+
+	copy(clientID[:], []byte(prefix))
+	if _, err := rand.Read(clientID[len(prefix):]); err != nil {
 		return [sha1.Size]byte{}, fmt.Errorf(
 			"failed generated peer id: %w",
 			err,
@@ -68,3 +579,14 @@ func generatePeerID() ([sha1.Size]byte, error) {
 
 	return clientID, nil
 }
+
+// generateAnnounceKey returns a random key for announces: 8 hex digits, the
+// form most clients use.
+func generateAnnounceKey() (string, error) {
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", fmt.Errorf("failed generating announce key: %w", err)
+	}
+
+	return fmt.Sprintf("%X", key), nil
+}
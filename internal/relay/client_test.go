@@ -0,0 +1,794 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prxssh/relay/internal/torrent"
+	"github.com/prxssh/relay/internal/tracker"
+)
+
+func TestAddTorrentURLRejectsBadMetainfo(t *testing.T) {
+	testCases := []struct {
+		name string
+		body []byte
+		want error
+	}{
+		{
+			name: "oversized file",
+			body: append([]byte("d"), bytes.Repeat([]byte("x"), 2048)...),
+			want: ErrTorrentTooLarge,
+		},
+		{
+			name: "html error page",
+			body: []byte("<!DOCTYPE html><html><body>Not found</body></html>"),
+			want: ErrNotTorrent,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.Write(tc.body)
+				},
+			))
+			defer srv.Close()
+
+			c, err := NewClient(Config{
+				DownloadDir:    t.TempDir(),
+				MaxTorrentSize: 1024,
+			})
+			if err != nil {
+				t.Fatalf("NewClient: %v", err)
+			}
+			defer c.Close()
+
+			_, err = c.AddTorrentURL(srv.URL + "/test.torrent")
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("AddTorrentURL: err = %v, want %v", err, tc.want)
+			}
+
+			_, err = c.AddTorrent(bytes.NewReader(tc.body))
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("AddTorrent: err = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestAddTorrentURLIsConditional(t *testing.T) {
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://test/announce": newFakeTracker(),
+	})
+
+	dir := t.TempDir()
+	metainfo := createTestTorrent(t, dir)
+	modTime := time.Now()
+
+	var etag string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", etag)
+			http.ServeContent(
+				w,
+				r,
+				"test.torrent",
+				modTime,
+				bytes.NewReader(metainfo),
+			)
+		},
+	))
+	defer srv.Close()
+
+	c, err := NewClient(Config{DownloadDir: dir})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	etag = `"v1"`
+	if _, err := c.AddTorrentURL(srv.URL); err != nil {
+		t.Fatalf("first AddTorrentURL: %v", err)
+	}
+	if _, err := c.AddTorrentURL(srv.URL); !errors.Is(err, ErrNotModified) {
+		t.Fatalf("unchanged AddTorrentURL: err = %v, want ErrNotModified", err)
+	}
+
+	// A changed file is fetched again; here it's the same torrent.
+	etag = `"v2"`
+	if _, err := c.AddTorrentURL(srv.URL); !errors.Is(err, ErrTorrentExists) {
+		t.Fatalf("changed AddTorrentURL: err = %v, want ErrTorrentExists", err)
+	}
+}
+
+func TestCheckNetworkDetectsAddressChange(t *testing.T) {
+	addrs := []net.Addr{&net.IPNet{
+		IP:   net.IPv4(192, 168, 1, 10),
+		Mask: net.CIDRMask(24, 32),
+	}}
+	orig := interfaceAddrs
+	interfaceAddrs = func() ([]net.Addr, error) { return addrs, nil }
+	t.Cleanup(func() { interfaceAddrs = orig })
+
+	c := &Client{}
+	if c.checkNetwork() {
+		t.Fatal("first check reported a change")
+	}
+	if c.checkNetwork() {
+		t.Fatal("unchanged addresses reported as a change")
+	}
+
+	addrs = []net.Addr{&net.IPNet{
+		IP:   net.IPv4(10, 8, 0, 2),
+		Mask: net.CIDRMask(24, 32),
+	}}
+	if !c.checkNetwork() {
+		t.Fatal("new address not reported as a change")
+	}
+}
+
+func TestNetworkChangedRestartsAnnounces(t *testing.T) {
+	c, err := NewClient(Config{DownloadDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	ft := newFakeTracker()
+	useFakeTrackers(t, map[string]*fakeTracker{"http://test/announce": ft})
+	s := newQueueTestSession(t, c, 1, false)
+	if err := c.addSession(s); err != nil {
+		t.Fatalf("addSession: %v", err)
+	}
+	if ev := ft.waitEvent(t); ev != tracker.EventStarted {
+		t.Fatalf("got event %q, want %q", ev, tracker.EventStarted)
+	}
+	for announcing := true; announcing; {
+		s.mu.Lock()
+		announcing = s.trackers[0].isAnnouncing
+		s.mu.Unlock()
+	}
+
+	c.NetworkChanged()
+	if ev := ft.waitEvent(t); ev != tracker.EventStarted {
+		t.Fatalf(
+			"got event %q after network change, want %q",
+			ev,
+			tracker.EventStarted,
+		)
+	}
+}
+
+func TestCloseWaitsForStoppedAnnounces(t *testing.T) {
+	c, err := NewClient(Config{DownloadDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	ft := newFakeTracker()
+	useFakeTrackers(t, map[string]*fakeTracker{"http://test/announce": ft})
+	s := newQueueTestSession(t, c, 1, false)
+	if err := c.addSession(s); err != nil {
+		t.Fatalf("addSession: %v", err)
+	}
+	if ev := ft.waitEvent(t); ev != tracker.EventStarted {
+		t.Fatalf("got event %q, want %q", ev, tracker.EventStarted)
+	}
+
+	ft.mu.Lock()
+	ft.delay = 50 * time.Millisecond
+	ft.mu.Unlock()
+	c.Close()
+
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if got := ft.events[len(ft.events)-1]; got != tracker.EventStopped {
+		t.Errorf(
+			"last event when Close returned = %q, want %q",
+			got,
+			tracker.EventStopped,
+		)
+	}
+}
+
+func TestTorrentLooksUpByInfoHash(t *testing.T) {
+	c, err := NewClient(Config{DownloadDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	useFakeTrackers(
+		t,
+		map[string]*fakeTracker{"http://test/announce": newFakeTracker()},
+	)
+	s := newQueueTestSession(t, c, 1, false)
+	if err := c.addSession(s); err != nil {
+		t.Fatalf("addSession: %v", err)
+	}
+
+	if got, ok := c.Torrent(s.torrent.Info.Hash); !ok || got != s {
+		t.Errorf("Torrent(%x) = %p, %v; want %p", s.torrent.Info.Hash, got, ok, s)
+	}
+	if _, ok := c.Torrent([20]byte{0xff}); ok {
+		t.Error("Torrent found a torrent the client doesn't have")
+	}
+}
+
+func TestAddTorrentFileWithSourceLinksData(t *testing.T) {
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://test/announce": newFakeTracker(),
+	})
+
+	existing := t.TempDir()
+	torrentPath := filepath.Join(t.TempDir(), "data.torrent")
+	err := os.WriteFile(torrentPath, createTestTorrent(t, existing), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	downloadDir := t.TempDir()
+	c, err := NewClient(Config{DownloadDir: downloadDir})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	s, err := c.AddTorrentFileWithSource(
+		torrentPath,
+		existing,
+		torrent.LinkHard,
+	)
+	if err != nil {
+		t.Fatalf("AddTorrentFileWithSource: %v", err)
+	}
+	if !s.picker.Done() {
+		t.Error("linked data wasn't recognized as complete")
+	}
+
+	src, err := os.Stat(filepath.Join(existing, "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := os.Stat(filepath.Join(downloadDir, "data.bin"))
+	if err != nil {
+		t.Fatalf("data wasn't linked into the download directory: %v", err)
+	}
+	if !os.SameFile(src, dst) {
+		t.Error("data was copied instead of hardlinked")
+	}
+
+	// A duplicate is turned away before its data is linked or hashed.
+	data, err := os.ReadFile(torrentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prepared bool
+	_, err = c.addTorrent(
+		context.Background(),
+		data,
+		torrentPath,
+		nil,
+		func(*session) error {
+			prepared = true
+			return nil
+		},
+	)
+	if !errors.Is(err, ErrTorrentExists) {
+		t.Errorf("adding a duplicate: err = %v, want ErrTorrentExists", err)
+	}
+	if prepared {
+		t.Error("duplicate was prepared")
+	}
+}
+
+func TestRecheckedDataCountsAsVerifiedNotDownloaded(t *testing.T) {
+	ft := newFakeTracker()
+	useFakeTrackers(t, map[string]*fakeTracker{"http://test/announce": ft})
+
+	// Only the first of the two pieces is intact.
+	existing := t.TempDir()
+	torrentPath := filepath.Join(t.TempDir(), "data.torrent")
+	err := os.WriteFile(torrentPath, createTestTorrent(t, existing), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filepath.Join(existing, "data.bin"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("damaged"), torrent.BlockSize)
+	f.Close()
+
+	c, err := NewClient(Config{DownloadDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	s, err := c.AddTorrentFileWithSource(
+		torrentPath,
+		existing,
+		torrent.LinkCopy,
+	)
+	if err != nil {
+		t.Fatalf("AddTorrentFileWithSource: %v", err)
+	}
+
+	stats := s.Stats()
+	if stats.Verified != torrent.BlockSize || stats.Downloaded != 0 {
+		t.Errorf(
+			"verified %d, downloaded %d; want %d, 0",
+			stats.Verified,
+			stats.Downloaded,
+			torrent.BlockSize,
+		)
+	}
+
+	ft.waitEvent(t)
+	ft.mu.Lock()
+	params := ft.lastParams
+	ft.mu.Unlock()
+	if params.Left != torrent.BlockSize || params.Downloaded != 0 {
+		t.Errorf(
+			"announced left %d, downloaded %d; want %d, 0",
+			params.Left,
+			params.Downloaded,
+			torrent.BlockSize,
+		)
+	}
+}
+
+func TestAddTorrentResumesFromExistingFiles(t *testing.T) {
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://test/announce": newFakeTracker(),
+	})
+
+	// The data is left in the download directory, e.g. by a run whose
+	// state was lost, with the second piece damaged.
+	dir := t.TempDir()
+	data := createTestTorrent(t, dir)
+	f, err := os.OpenFile(filepath.Join(dir, "data.bin"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("damaged"), torrent.BlockSize)
+	f.Close()
+
+	c, err := NewClient(Config{DownloadDir: dir})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	s, err := c.AddTorrent(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("AddTorrent: %v", err)
+	}
+	if stats := s.Stats(); stats.Verified != torrent.BlockSize {
+		t.Errorf("verified %d, want %d", stats.Verified, torrent.BlockSize)
+	}
+}
+
+func TestAnnouncesCarryClientKey(t *testing.T) {
+	ft := newFakeTracker()
+	useFakeTrackers(t, map[string]*fakeTracker{"http://test/announce": ft})
+
+	c, err := NewClient(Config{DownloadDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+	if len(c.announceKey) != 8 {
+		t.Fatalf("announce key = %q, want 8 hex digits", c.announceKey)
+	}
+
+	data := createTestTorrent(t, t.TempDir())
+	if _, err := c.AddTorrent(bytes.NewReader(data)); err != nil {
+		t.Fatalf("AddTorrent: %v", err)
+	}
+
+	ft.waitEvent(t)
+	ft.mu.Lock()
+	params := ft.lastParams
+	ft.mu.Unlock()
+	if params.Key != c.announceKey {
+		t.Errorf("announced key %q, want %q", params.Key, c.announceKey)
+	}
+}
+
+func TestClientAcceptsPeers(t *testing.T) {
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://test/announce": newFakeTracker(),
+	})
+
+	c, err := NewClient(Config{DownloadDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	s, err := c.AddTorrent(bytes.NewReader(createTestTorrent(t, t.TempDir())))
+	if err != nil {
+		t.Fatalf("AddTorrent: %v", err)
+	}
+
+	port := c.ListenAddr().(*net.TCPAddr).Port
+	if got := c.cfg.ListenPort; int(got) != port {
+		t.Errorf("announcing port %d, listening on %d", got, port)
+	}
+	remote := &tracker.Peer{IP: net.IPv4(127, 0, 0, 1), Port: uint16(port)}
+	dial := func(infoHash [20]byte) error {
+		p, err := torrent.DialPeer(remote, &torrent.PeerConnectOpts{
+			InfoHash: infoHash,
+			PeerID:   [20]byte{1},
+			Pieces:   int64(s.torrent.NumPieces()),
+		})
+		if err == nil {
+			p.Close()
+		}
+		return err
+	}
+
+	if err := dial(s.torrent.Info.Hash); err != nil {
+		t.Fatalf("handshake with the client failed: %v", err)
+	}
+	if err := dial([20]byte{2}); err == nil {
+		t.Error("handshake for an unknown torrent succeeded")
+	}
+}
+
+func TestClientRateLimitsApplyToPeers(t *testing.T) {
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://test/announce": newFakeTracker(),
+	})
+
+	c, err := NewClient(Config{DownloadDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	s, err := c.AddTorrent(bytes.NewReader(createTestTorrent(t, t.TempDir())))
+	if err != nil {
+		t.Fatalf("AddTorrent: %v", err)
+	}
+	c.SetDownloadLimit(1000)
+	c.SetUploadLimit(500)
+	if down, up := c.RateLimits(); down != 1000 || up != 500 {
+		t.Errorf("limits %d/%d, want 1000/500", down, up)
+	}
+
+	opts := s.peerConnectOpts()
+	if !slices.Contains(opts.ReadLimits, c.downLimiter) {
+		t.Error("peer reads don't count against the client's download cap")
+	}
+	if !slices.Contains(opts.WriteLimits, c.upLimiter) {
+		t.Error("peer writes don't count against the client's upload cap")
+	}
+}
+
+func TestSessionStatsReportEffectiveLimits(t *testing.T) {
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://test/announce": newFakeTracker(),
+	})
+
+	c, err := NewClient(Config{DownloadDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	s, err := c.AddTorrent(bytes.NewReader(createTestTorrent(t, t.TempDir())))
+	if err != nil {
+		t.Fatalf("AddTorrent: %v", err)
+	}
+
+	tests := []struct {
+		name             string
+		torrent, client  int64
+		wantDown, wantUp int64
+	}{
+		{"no caps", 0, 0, 0, 0},
+		{"torrent cap only", 1000, 0, 1000, 1000},
+		{"client cap only", 0, 2000, 2000, 2000},
+		{"tighter torrent cap", 1000, 2000, 1000, 1000},
+		{"tighter client cap", 3000, 2000, 2000, 2000},
+	}
+	for _, tt := range tests {
+		s.SetRateLimits(tt.torrent, tt.torrent)
+		c.SetDownloadLimit(tt.client)
+		c.SetUploadLimit(tt.client)
+
+		stats := s.Stats()
+		if stats.DownloadLimit != tt.wantDown ||
+			stats.UploadLimit != tt.wantUp {
+			t.Errorf(
+				"%s: limits %d/%d, want %d/%d",
+				tt.name,
+				stats.DownloadLimit,
+				stats.UploadLimit,
+				tt.wantDown,
+				tt.wantUp,
+			)
+		}
+	}
+}
+
+func TestRemoveTorrent(t *testing.T) {
+	for _, deleteData := range []bool{false, true} {
+		t.Run(fmt.Sprintf("deleteData=%v", deleteData), func(t *testing.T) {
+			useFakeTrackers(t, map[string]*fakeTracker{
+				"http://test/announce": newFakeTracker(),
+			})
+
+			dir := t.TempDir()
+			c, err := NewClient(Config{
+				DownloadDir: dir,
+				StatePath:   filepath.Join(t.TempDir(), "state.bencode"),
+			})
+			if err != nil {
+				t.Fatalf("NewClient: %v", err)
+			}
+			defer c.Close()
+
+			s, err := c.AddTorrent(bytes.NewReader(createTestTorrent(t, dir)))
+			if err != nil {
+				t.Fatalf("AddTorrent: %v", err)
+			}
+			hash := s.torrent.Info.Hash
+
+			port := c.ListenAddr().(*net.TCPAddr).Port
+			p, err := torrent.DialPeer(
+				&tracker.Peer{IP: net.IPv4(127, 0, 0, 1), Port: uint16(port)},
+				&torrent.PeerConnectOpts{
+					InfoHash: hash,
+					PeerID:   [20]byte{1},
+					Pieces:   int64(s.torrent.NumPieces()),
+				},
+			)
+			if err != nil {
+				t.Fatalf("DialPeer: %v", err)
+			}
+			defer p.Close()
+			go p.Start()
+			numPeers := func() int {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				return len(s.peers)
+			}
+			waitFor(t, "peer to connect", func() bool {
+				return numPeers() == 1
+			})
+
+			if err := c.RemoveTorrent(hash, deleteData); err != nil {
+				t.Fatalf("RemoveTorrent: %v", err)
+			}
+			if _, ok := c.Torrent(hash); ok || len(c.Torrents()) != 0 {
+				t.Error("removed torrent still listed")
+			}
+			waitFor(t, "peer to disconnect", func() bool {
+				return numPeers() == 0
+			})
+			_, err = os.Stat(c.metainfoPath(hash))
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("metainfo copy left behind: %v", err)
+			}
+
+			_, err = os.Stat(filepath.Join(dir, "data.bin"))
+			if deleted := errors.Is(err, fs.ErrNotExist); deleted != deleteData {
+				t.Errorf("data deleted = %v, want %v", deleted, deleteData)
+			}
+
+			err = c.RemoveTorrent(hash, deleteData)
+			if !errors.Is(err, ErrTorrentNotFound) {
+				t.Errorf(
+					"removing again: err = %v, want %v",
+					err,
+					ErrTorrentNotFound,
+				)
+			}
+		})
+	}
+}
+
+// TestClientConcurrentAccess adds, looks up, lists and removes torrents from
+// several goroutines at once, as the TUI and API do. It's meant to run under
+// -race.
+func TestClientConcurrentAccess(t *testing.T) {
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://test/announce": newFakeTracker(),
+	})
+
+	c, err := NewClient(Config{DownloadDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	// Torrents of different data, so each has its own info hash.
+	var metainfos [][]byte
+	for i := range 4 {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "data.bin")
+		if err := os.WriteFile(path, []byte{byte(i)}, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		err := torrent.Create(&buf, path, torrent.CreateOpts{
+			AnnounceURLs: []string{"http://test/announce"},
+		})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		metainfos = append(metainfos, buf.Bytes())
+	}
+
+	var wg sync.WaitGroup
+	for _, data := range metainfos {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				s, err := c.AddTorrent(bytes.NewReader(data))
+				if err != nil {
+					t.Errorf("AddTorrent: %v", err)
+					return
+				}
+				if _, ok := c.Torrent(s.torrent.Info.Hash); !ok {
+					t.Error("added torrent not found")
+				}
+				err = c.RemoveTorrent(s.torrent.Info.Hash, false)
+				if err != nil {
+					t.Errorf("RemoveTorrent: %v", err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				for _, s := range c.Torrents() {
+					s.Stats()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(c.Torrents()); n != 0 {
+		t.Errorf("%d torrents left after removing all", n)
+	}
+}
+
+func TestWatchDirAddsTorrents(t *testing.T) {
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://test/announce": newFakeTracker(),
+	})
+
+	// The same torrent twice, and a file that isn't one.
+	watchDir := t.TempDir()
+	data := createTestTorrent(t, t.TempDir())
+	for name, content := range map[string][]byte{
+		"a.torrent": data,
+		"b.torrent": data,
+		"c.torrent": []byte("junk"),
+	} {
+		path := filepath.Join(watchDir, name)
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := NewClient(Config{DownloadDir: t.TempDir(), WatchDir: watchDir})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	processed := filepath.Join(watchDir, watchProcessedDir)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, _ := os.ReadDir(processed)
+		if len(entries) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of 2 torrents processed", len(entries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := len(c.Torrents()); got != 1 {
+		t.Errorf("%d torrents added, want 1", got)
+	}
+	if _, err := os.Stat(filepath.Join(watchDir, "c.torrent")); err != nil {
+		t.Errorf("invalid torrent file wasn't left in place: %v", err)
+	}
+}
+
+func TestScrapeBatchesTorrentsPerTracker(t *testing.T) {
+	// Announces fail, so only scrapes report swarm sizes.
+	shared, other := newFakeTracker(), newFakeTracker()
+	shared.err = errors.New("announces are down")
+	other.err = shared.err
+	shared.stats = make(map[[20]byte]tracker.ScrapeStats)
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://shared/announce": shared,
+		"http://other/announce":  other,
+	})
+
+	c, err := NewClient(Config{DownloadDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	// Three torrents on the shared tracker, the last also on one that
+	// doesn't support scraping.
+	var sessions []*session
+	for i := range 3 {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "data.bin")
+		if err := os.WriteFile(path, []byte{byte(i)}, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		urls := []string{"http://shared/announce"}
+		if i == 2 {
+			urls = append(urls, "http://other/announce")
+		}
+		var buf bytes.Buffer
+		err := torrent.Create(&buf, path, torrent.CreateOpts{
+			AnnounceURLs: urls,
+		})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		s, err := c.AddTorrent(&buf)
+		if err != nil {
+			t.Fatalf("AddTorrent: %v", err)
+		}
+		sessions = append(sessions, s)
+
+		shared.mu.Lock()
+		shared.stats[s.torrent.Info.Hash] = tracker.ScrapeStats{
+			Seeders:  uint32(10 + i),
+			Leechers: uint32(20 + i),
+		}
+		shared.mu.Unlock()
+	}
+
+	c.scrapeTrackers(context.Background())
+
+	shared.mu.Lock()
+	scrapes := shared.scrapes
+	shared.mu.Unlock()
+	if len(scrapes) != 1 || len(scrapes[0]) != 3 {
+		t.Fatalf("scrapes = %x, want one of all three torrents", scrapes)
+	}
+	for i, s := range sessions {
+		stats := s.Stats()
+		if stats.Seeders != uint32(10+i) || stats.Leechers != uint32(20+i) {
+			t.Errorf(
+				"torrent %d: %d seeders, %d leechers; want %d, %d",
+				i,
+				stats.Seeders,
+				stats.Leechers,
+				10+i,
+				20+i,
+			)
+		}
+	}
+}
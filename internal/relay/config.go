@@ -0,0 +1,397 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/prxssh/relay/internal/torrent"
+)
+
+// Config holds the user-tunable settings of a Client. Every session created by
+// the client starts out with a copy of it. It's persisted as TOML so it can be
+// edited by hand.
+type Config struct {
+	// Directory torrent data is downloaded into
+	DownloadDir string `toml:"download_dir"`
+	// Directory completed downloads are moved to; empty leaves them in
+	// DownloadDir. Sessions can override it.
+	CompletedDir string `toml:"completed_dir"`
+	// Port we accept peer connections on and announce to trackers. Zero
+	// picks a free port.
+	ListenPort uint16 `toml:"listen_port"`
+	// Prefix of our peer ID identifying the client, e.g. "-RL0001-"
+	PeerIDPrefix string `toml:"peer_id_prefix"`
+	// If true, streaming readers returned by session.Open block until the
+	// requested data is downloaded instead of failing with ErrNotReady.
+	BlockingReads bool `toml:"blocking_reads"`
+	// Upper bound on a single tracker announce, after which it's abandoned
+	// and the tracker is backed off. Zero means defaultAnnounceTimeout.
+	AnnounceTimeout time.Duration `toml:"announce_timeout"`
+	// How long an incomplete torrent may go without completing a piece
+	// before it's considered stalled and recovery is attempted. Zero means
+	// defaultStallTimeout.
+	StallTimeout time.Duration `toml:"stall_timeout"`
+	// How often each torrent reconsiders which peers to upload to. Zero
+	// means torrent.DefaultRechokeInterval; at least minChokeInterval.
+	ChokeInterval time.Duration `toml:"choke_interval"`
+	// How long the optimistic unchoke stays with one peer before rotating.
+	// It's rounded to a whole number of choke rounds. Zero means
+	// torrent.DefaultOptimisticUnchokeInterval; at least the choke interval.
+	OptimisticUnchokeInterval time.Duration `toml:"optimistic_unchoke_interval"`
+	// Maximum number of torrents downloading at once; the rest wait in the
+	// queue. Zero means unlimited.
+	MaxActiveDownloads int `toml:"max_active_downloads"`
+	// Maximum number of torrents seeding at once. Zero means unlimited.
+	MaxActiveSeeds int `toml:"max_active_seeds"`
+	// Maximum number of peers unchoked at once across all torrents, shared
+	// out fairly among them. Zero means unlimited.
+	MaxUploads int `toml:"max_uploads"`
+	// Maximum number of peers unchoked at once by a single torrent. Zero
+	// means unlimited.
+	MaxUploadsPerTorrent int `toml:"max_uploads_per_torrent"`
+	// Maximum number of peer connections, inbound and outbound, across all
+	// torrents. Zero means unlimited.
+	MaxConnections int `toml:"max_connections"`
+	// Maximum number of peer connections of a single torrent. Zero means
+	// unlimited.
+	MaxConnectionsPerTorrent int `toml:"max_connections_per_torrent"`
+	// If true nothing is uploaded: every peer stays choked. Meant for metered
+	// connections and testing. Swarms depend on peers giving back, and some
+	// private trackers ban peers that never upload, so use it sparingly.
+	// Sessions can override it.
+	DisableUploads bool `toml:"disable_uploads"`
+	// If true peers that advertised encryption support are dialed before
+	// the others
+	PreferEncryptedPeers bool `toml:"prefer_encrypted_peers"`
+	// File listing IP ranges whose peers are never dialed, e.g. those of an
+	// ISP known to interfere with BitTorrent. One CIDR prefix or address per
+	// line; '#' starts a comment line. Empty avoids no one.
+	AvoidPeerRanges string `toml:"avoid_peer_ranges"`
+	// Storage backend for torrent data, StorageFile or StorageMmap. Empty
+	// means StorageFile.
+	StorageBackend string `toml:"storage_backend"`
+	// If true every file of a downloading torrent is created at its full
+	// size up front, sparse where the filesystem allows. Files of skipped
+	// priority are created too.
+	PreallocateFiles bool `toml:"preallocate_files"`
+	// Extra HTTP headers sent to trackers, keyed by tracker host name, e.g.
+	// an Authorization header required by a private tracker's proxy
+	TrackerHeaders map[string]map[string]string `toml:"tracker_headers"`
+	// Free space in bytes below which downloads are paused to keep the disk
+	// from filling up; seeds keep running. Zero disables the check.
+	MinFreeDisk int64 `toml:"min_free_disk"`
+	// If true, trackers are told the external address peers report seeing
+	// us at, once enough of them agree. Useful when the tracker would see a
+	// different address, e.g. a proxy's.
+	AnnounceExternalIP bool `toml:"announce_external_ip"`
+	// If true, announces tell trackers we support encrypted connections, so
+	// they may hand us peers that insist on encryption. Off by default:
+	// Message Stream Encryption isn't implemented yet.
+	AnnounceCrypto bool `toml:"announce_crypto"`
+	// File the torrent list and progress are saved to between runs, with a
+	// copy of every torrent's metainfo kept next to it. Empty disables
+	// persistence.
+	StatePath string `toml:"state_path"`
+	// Directory scanned for .torrent files to add, e.g. where a browser
+	// saves them. Added files are moved to its "processed" subdirectory.
+	// Empty disables watching.
+	WatchDir string `toml:"watch_dir"`
+	// If true, .torrent files added from WatchDir are deleted instead of
+	// moved
+	WatchDeleteProcessed bool `toml:"watch_delete_processed"`
+	// Largest .torrent file in bytes accepted from a URL, an upload or disk.
+	// Zero means defaultMaxTorrentSize.
+	MaxTorrentSize int64 `toml:"max_torrent_size"`
+	// DHT nodes, as host:port, to bootstrap from when no nodes from a
+	// previous run are known
+	DHTBootstrapNodes []string `toml:"dht_bootstrap_nodes"`
+	// If true the DHT isn't joined and peers are only found through
+	// trackers. Private torrents never use the DHT either way.
+	DisableDHT bool `toml:"disable_dht"`
+	// Local IP address tracker announces are sent from, e.g. that of a VPN
+	// interface, so they never leave through the default route. Announces
+	// fail while the address is unavailable. Empty lets the system choose.
+	BindAddress string `toml:"bind_address"`
+	// Address the daemon's HTTP API listens on, e.g. "127.0.0.1:7070"
+	APIAddr string `toml:"api_addr"`
+	// Address the daemon serves torrent files on for streaming, e.g.
+	// "127.0.0.1:7071". Empty disables streaming over HTTP.
+	StreamAddr string `toml:"stream_addr"`
+}
+
+// Storage backends selectable with Config.StorageBackend.
+const (
+	// Regular file I/O; works everywhere
+	StorageFile = "file"
+	// Memory-mapped files; can be faster for large torrents on SSDs. Falls
+	// back to StorageFile where mmap isn't available.
+	StorageMmap = "mmap"
+)
+
+// DefaultConfig returns the configuration used when the user hasn't changed
+// anything.
+func DefaultConfig() Config {
+	return Config{
+		DownloadDir:               defaultDownloadDir(),
+		ListenPort:                6969,
+		PeerIDPrefix:              clientIDPrefix,
+		BlockingReads:             true,
+		AnnounceTimeout:           defaultAnnounceTimeout,
+		StallTimeout:              defaultStallTimeout,
+		ChokeInterval:             torrent.DefaultRechokeInterval,
+		OptimisticUnchokeInterval: torrent.DefaultOptimisticUnchokeInterval,
+		MaxActiveDownloads:        5,
+		MaxActiveSeeds:            10,
+		MaxUploads:                20,
+		MaxUploadsPerTorrent:      5,
+		MaxConnections:            500,
+		MaxConnectionsPerTorrent:  80,
+		StorageBackend:            StorageFile,
+		StatePath:                 defaultStatePath(),
+		MaxTorrentSize:            defaultMaxTorrentSize,
+		DHTBootstrapNodes:         defaultDHTBootstrapNodes(),
+		APIAddr:                   "127.0.0.1:7070",
+	}
+}
+
+// DefaultConfigPath returns where the config file lives unless the user says
+// otherwise, e.g. ~/.config/relay/config.toml on Linux.
+func DefaultConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "relay", "config.toml"), nil
+}
+
+// LoadConfig reads the config file at path. Settings missing from the file
+// keep their defaults. If the file doesn't exist, it's created with the
+// default configuration.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+
+	_, err := toml.DecodeFile(path, &cfg)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, SaveConfig(path, cfg)
+	}
+	if err != nil {
+		return Config{}, fmt.Errorf("config: failed to load %s: %w", path, err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return Config{}, fmt.Errorf("config: %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// SaveConfig writes cfg to the file at path, creating its directory if needed.
+func SaveConfig(path string, cfg Config) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := toml.NewEncoder(f).Encode(cfg); err != nil {
+		return fmt.Errorf("config: failed to save %s: %w", path, err)
+	}
+
+	return f.Close()
+}
+
+/////////////// Private ///////////////
+
+const defaultAnnounceTimeout = 30 * time.Second
+
+const defaultStallTimeout = 5 * time.Minute
+
+// minChokeInterval keeps the choker from churning unchokes faster than peers
+// can make use of them.
+const minChokeInterval = 2 * time.Second
+
+// defaultMaxTorrentSize comfortably fits the metainfo of even very large
+// torrents.
+const defaultMaxTorrentSize = 4 << 20
+
+// defaultDHTBootstrapNodes returns the well-known routers of the mainline
+// DHT.
+func defaultDHTBootstrapNodes() []string {
+	return []string{
+		"router.bittorrent.com:6881",
+		"router.utorrent.com:6881",
+		"dht.transmissionbt.com:6881",
+		"dht.libtorrent.org:25401",
+	}
+}
+
+func (c Config) validate() error {
+	if len(c.PeerIDPrefix) > 20 {
+		return fmt.Errorf(
+			"peer_id_prefix %q is longer than 20 bytes",
+			c.PeerIDPrefix,
+		)
+	}
+
+	for _, node := range c.DHTBootstrapNodes {
+		if _, _, err := net.SplitHostPort(node); err != nil {
+			return fmt.Errorf("dht_bootstrap_nodes: %w", err)
+		}
+	}
+
+	if c.ChokeInterval != 0 && c.ChokeInterval < minChokeInterval {
+		return fmt.Errorf(
+			"choke_interval %s is below the minimum of %s",
+			c.ChokeInterval,
+			minChokeInterval,
+		)
+	}
+	if c.OptimisticUnchokeInterval != 0 &&
+		c.OptimisticUnchokeInterval < c.chokeInterval() {
+		return fmt.Errorf(
+			"optimistic_unchoke_interval %s is shorter than the choke "+
+				"interval %s",
+			c.OptimisticUnchokeInterval,
+			c.chokeInterval(),
+		)
+	}
+
+	if c.BindAddress != "" && net.ParseIP(c.BindAddress) == nil {
+		return fmt.Errorf("bind_address %q is not an IP address", c.BindAddress)
+	}
+
+	switch c.StorageBackend {
+	case "", StorageFile, StorageMmap:
+	default:
+		return fmt.Errorf(
+			"unknown storage_backend %q, want %q or %q",
+			c.StorageBackend,
+			StorageFile,
+			StorageMmap,
+		)
+	}
+
+	return nil
+}
+
+func (c Config) announceTimeout() time.Duration {
+	if c.AnnounceTimeout <= 0 {
+		return defaultAnnounceTimeout
+	}
+	return c.AnnounceTimeout
+}
+
+func (c Config) stallTimeout() time.Duration {
+	if c.StallTimeout <= 0 {
+		return defaultStallTimeout
+	}
+	return c.StallTimeout
+}
+
+func (c Config) chokeInterval() time.Duration {
+	if c.ChokeInterval <= 0 {
+		return torrent.DefaultRechokeInterval
+	}
+	return c.ChokeInterval
+}
+
+// optimisticRounds returns the number of choke rounds closest to the
+// optimistic unchoke interval.
+func (c Config) optimisticRounds() int {
+	interval := c.OptimisticUnchokeInterval
+	if interval <= 0 {
+		interval = torrent.DefaultOptimisticUnchokeInterval
+	}
+	choke := c.chokeInterval()
+	return max(int((interval+choke/2)/choke), 1)
+}
+
+func (c Config) maxTorrentSize() int64 {
+	if c.MaxTorrentSize <= 0 {
+		return defaultMaxTorrentSize
+	}
+	return c.MaxTorrentSize
+}
+
+// connectPolicy builds the policy peers are dialed by, reading the avoided
+// ranges from AvoidPeerRanges.
+func (c Config) connectPolicy() (*torrent.ConnectPolicy, error) {
+	var avoid []*net.IPNet
+	if c.AvoidPeerRanges != "" {
+		f, err := os.Open(c.AvoidPeerRanges)
+		if err != nil {
+			return nil, fmt.Errorf("config: avoid_peer_ranges: %w", err)
+		}
+		defer f.Close()
+
+		avoid, err = torrent.ParseIPRanges(f)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"config: avoid_peer_ranges %s: %w",
+				c.AvoidPeerRanges,
+				err,
+			)
+		}
+	}
+
+	return torrent.NewConnectPolicy(c.PreferEncryptedPeers, avoid), nil
+}
+
+// trackerHeader returns the extra headers configured for the host of the
+// announce URL, or nil if there are none.
+func (c Config) trackerHeader(announce string) http.Header {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil
+	}
+
+	headers, ok := c.TrackerHeaders[u.Hostname()]
+	if !ok {
+		return nil
+	}
+
+	header := make(http.Header, len(headers))
+	for key, value := range headers {
+		header.Set(key, value)
+	}
+	return header
+}
+
+// newStorage returns the configured storage backend for data below dir.
+func (c Config) newStorage(dir string, info *torrent.Info) torrent.Storage {
+	if c.StorageBackend == StorageMmap {
+		return torrent.NewMmapStorage(dir, info)
+	}
+	return torrent.NewFileStorage(dir, info)
+}
+
+func defaultDownloadDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "downloads"
+	}
+
+	return filepath.Join(home, "Downloads")
+}
+
+func defaultStatePath() string {
+	path, err := DefaultStatePath()
+	if err != nil {
+		return ""
+	}
+
+	return path
+}
@@ -0,0 +1,167 @@
+package relay
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prxssh/relay/internal/dht"
+)
+
+func TestLoadConfigCreatesDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay", "config.toml")
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if !reflect.DeepEqual(cfg, DefaultConfig()) {
+		t.Errorf("got %+v, want defaults %+v", cfg, DefaultConfig())
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("default config file was not created: %v", err)
+	}
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+
+	want := DefaultConfig()
+	want.DownloadDir = "/srv/torrents"
+	want.ListenPort = 51413
+	want.AnnounceTimeout = 5 * time.Second
+	want.MaxActiveDownloads = 0
+	want.TrackerHeaders = map[string]map[string]string{
+		"tracker.example.org": {"Authorization": "Bearer secret"},
+	}
+
+	if err := SaveConfig(path, want); err != nil {
+		t.Fatalf("SaveConfig: %v", err)
+	}
+	got, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	header := got.trackerHeader("https://tracker.example.org:8443/announce")
+	if v := header.Get("Authorization"); v != "Bearer secret" {
+		t.Errorf("tracker Authorization header = %q, want it applied", v)
+	}
+	if header := got.trackerHeader("http://other/announce"); header != nil {
+		t.Errorf("unrelated tracker got headers %v", header)
+	}
+}
+
+func TestLoadConfigRejectsLongPeerIDPrefix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := []byte(`peer_id_prefix = "-THIS-PREFIX-IS-TOO-LONG-"`)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("expected an error for an over-long peer ID prefix")
+	}
+}
+
+func TestLoadConfigRejectsBadBootstrapNode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	data := []byte(`dht_bootstrap_nodes = ["router.example.org"]`)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("expected an error for a bootstrap node without a port")
+	}
+}
+
+func TestLoadConfigChokeIntervals(t *testing.T) {
+	testCases := []struct {
+		name       string
+		data       string
+		wantErr    bool
+		wantRounds int
+	}{
+		{"defaults", ``, false, 3},
+		{"custom", `choke_interval = "5s"
+optimistic_unchoke_interval = "20s"`, false, 4},
+		{"rounded", `optimistic_unchoke_interval = "44s"`, false, 4},
+		{"choke too short", `choke_interval = "500ms"`, true, 0},
+		{"optimistic too short", `optimistic_unchoke_interval = "5s"`, true, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.toml")
+			if err := os.WriteFile(path, []byte(tc.data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadConfig(path)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("LoadConfig: err = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err == nil && cfg.optimisticRounds() != tc.wantRounds {
+				t.Errorf(
+					"optimisticRounds() = %d, want %d",
+					cfg.optimisticRounds(),
+					tc.wantRounds,
+				)
+			}
+		})
+	}
+}
+
+func TestNewClientValidatesConfig(t *testing.T) {
+	_, err := NewClient(Config{
+		DownloadDir:   t.TempDir(),
+		ChokeInterval: time.Millisecond,
+	})
+	if err == nil {
+		t.Fatal("expected an error for a choke interval below the minimum")
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.bencode")
+
+	empty, err := LoadState(path)
+	if err != nil || len(empty.Torrents) != 0 {
+		t.Fatalf("LoadState(missing) = %+v, %v; want empty state", empty, err)
+	}
+
+	want := State{Torrents: []TorrentState{
+		{
+			Source:      "/tmp/ubuntu.torrent",
+			InfoHash:    [20]byte{1, 2, 3},
+			DownloadDir: "/srv/torrents",
+			Paused:      true,
+			Have:        []byte{0xF0, 0x01},
+			DictPeerTrackers: []string{
+				"http://tracker.example.org/announce",
+			},
+		},
+	}}
+	want.DHTNodes = []*dht.Node{{
+		ID:   dht.NodeID{0xAB},
+		Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6881},
+	}}
+
+	if err := SaveState(path, want); err != nil {
+		t.Fatalf("SaveState: %v", err)
+	}
+	got, err := LoadState(path)
+	if err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
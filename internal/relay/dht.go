@@ -0,0 +1,83 @@
+package relay
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/prxssh/relay/internal/dht"
+	"github.com/prxssh/relay/internal/tracker"
+)
+
+// dhtAnnounceInterval is how often a session looks itself up on the DHT and
+// announces itself there.
+const dhtAnnounceInterval = 15 * time.Minute
+
+/////////////// Private ///////////////
+
+// startDHT joins the DHT on the UDP port of the same number as the peer
+// listener, unless Config.DisableDHT is set, through the nodes a previous run
+// knew as well as the bootstrap nodes. Peers are found through trackers too,
+// so if the port can't be bound the client does without.
+func (c *Client) startDHT(nodes []*dht.Node) {
+	if c.cfg.DisableDHT {
+		return
+	}
+
+	addr := net.JoinHostPort(
+		c.cfg.BindAddress,
+		strconv.Itoa(int(c.cfg.ListenPort)),
+	)
+	d, err := dht.Listen(addr, dht.Options{
+		BootstrapNodes: c.cfg.DHTBootstrapNodes,
+		Nodes:          nodes,
+	})
+	if err != nil {
+		slog.Warn("Starting the DHT failed", "error", err)
+		return
+	}
+
+	c.dht = d
+}
+
+// dhtPeers returns the peers the DHT knows for infoHash, or none without a
+// DHT. The lookup is bounded like a tracker announce.
+func (c *Client) dhtPeers(
+	ctx context.Context,
+	infoHash [20]byte,
+) []*tracker.Peer {
+	if c.dht == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.announceTimeout())
+	defer cancel()
+
+	var peers []*tracker.Peer
+	for p := range c.dht.GetPeers(ctx, infoHash) {
+		peers = append(peers, &p)
+	}
+	return peers
+}
+
+// dhtLoop looks the torrent's peers up on the DHT and announces us there, now
+// and every dhtAnnounceInterval until ctx is done, connecting to the peers
+// found.
+func (s *session) dhtLoop(ctx context.Context) {
+	for {
+		var peers []*tracker.Peer
+		infoHash := s.torrent.Info.Hash
+		for p := range s.dht.Announce(ctx, infoHash, s.cfg.ListenPort) {
+			peers = append(peers, &p)
+		}
+		s.connectPeers(peers)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.clock.After(dhtAnnounceInterval):
+		}
+	}
+}
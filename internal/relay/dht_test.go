@@ -0,0 +1,137 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prxssh/relay/internal/dht"
+	"github.com/prxssh/relay/internal/torrent"
+)
+
+func TestDHTAnnouncesPublicTorrentsOnly(t *testing.T) {
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://test/announce": newFakeTracker(),
+	})
+
+	router, err := dht.Listen("127.0.0.1:0", dht.Options{})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer router.Close()
+	bootstrap := []string{router.Addr().String()}
+
+	c, err := NewClient(Config{
+		DownloadDir:       t.TempDir(),
+		BindAddress:       "127.0.0.1",
+		DHTBootstrapNodes: bootstrap,
+	})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+	if c.dht == nil {
+		t.Fatal("client didn't join the DHT")
+	}
+
+	data := createTestTorrent(t, t.TempDir())
+	public, err := c.AddTorrent(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("AddTorrent: %v", err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "private.bin")
+	if err := os.WriteFile(path, []byte("private"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = torrent.Create(&buf, path, torrent.CreateOpts{
+		AnnounceURLs: []string{"http://test/announce"},
+		PieceLength:  torrent.BlockSize,
+		Private:      true,
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	private, err := c.AddTorrent(&buf)
+	if err != nil {
+		t.Fatalf("AddTorrent: %v", err)
+	}
+
+	probe, err := dht.Listen("127.0.0.1:0", dht.Options{
+		BootstrapNodes: bootstrap,
+	})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer probe.Close()
+	peersOf := func(s *session) []string {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		var addrs []string
+		for p := range probe.GetPeers(ctx, s.torrent.Info.Hash) {
+			addrs = append(addrs, p.Addr())
+		}
+		return addrs
+	}
+
+	want := "127.0.0.1:" + strconv.Itoa(int(c.cfg.ListenPort))
+	waitFor(t, "the public torrent's announce", func() bool {
+		addrs := peersOf(public)
+		return len(addrs) == 1 && addrs[0] == want
+	})
+	if addrs := peersOf(private); len(addrs) != 0 {
+		t.Errorf("private torrent announced on the DHT: %q", addrs)
+	}
+}
+
+func TestDHTNodesPersistAcrossRuns(t *testing.T) {
+	router, err := dht.Listen("127.0.0.1:0", dht.Options{})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer router.Close()
+
+	statePath := filepath.Join(t.TempDir(), "state.bencode")
+	c, err := NewClient(Config{
+		DownloadDir:       t.TempDir(),
+		BindAddress:       "127.0.0.1",
+		StatePath:         statePath,
+		DHTBootstrapNodes: []string{router.Addr().String()},
+	})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	waitFor(t, "the DHT to learn the router", func() bool {
+		return c.Stats().DHTNodes > 0
+	})
+	c.Close()
+
+	state, err := LoadState(statePath)
+	if err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	if len(state.DHTNodes) != 1 || state.DHTNodes[0].ID != router.ID() {
+		t.Fatalf("saved DHT nodes %v, want the router", state.DHTNodes)
+	}
+
+	// Without bootstrap nodes the next run joins through the saved ones.
+	c, err = NewClient(Config{
+		DownloadDir: t.TempDir(),
+		BindAddress: "127.0.0.1",
+		StatePath:   statePath,
+	})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+	waitFor(t, "the DHT to rejoin through saved nodes", func() bool {
+		return c.Stats().DHTNodes > 0
+	})
+}
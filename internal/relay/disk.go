@@ -0,0 +1,76 @@
+package relay
+
+import (
+	"log/slog"
+	"time"
+)
+
+// diskCheckInterval is how often the free space of the download filesystem is
+// checked against Config.MinFreeDisk.
+const diskCheckInterval = time.Minute
+
+// freeDiskSpace reports the bytes available on the filesystem holding path.
+// It's a variable so tests can simulate a filling disk.
+var freeDiskSpace = diskFree
+
+// LowDisk reports whether free space on the download filesystem is below
+// Config.MinFreeDisk, in which case downloads are paused.
+func (c *Client) LowDisk() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.lowDisk
+}
+
+/////////////// Private ///////////////
+
+// diskLoop re-checks free disk space on every diskCheckInterval tick.
+func (c *Client) diskLoop() {
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			if c.checkDisk() {
+				c.rebalance()
+			}
+		}
+	}
+}
+
+// checkDisk compares the free space of the download filesystem against
+// Config.MinFreeDisk and reports whether lowDisk changed. When free space
+// can't be determined, the last known state is kept.
+func (c *Client) checkDisk() bool {
+	if c.cfg.MinFreeDisk <= 0 {
+		return false
+	}
+
+	free, err := freeDiskSpace(c.cfg.DownloadDir)
+	if err != nil {
+		slog.Debug("Checking free disk space failed", "error", err)
+		return false
+	}
+	low := free < c.cfg.MinFreeDisk
+
+	c.mu.Lock()
+	changed := c.lowDisk != low
+	c.lowDisk = low
+	c.mu.Unlock()
+
+	if changed && low {
+		slog.Warn(
+			"Low disk space, pausing downloads",
+			"dir", c.cfg.DownloadDir,
+			"free", free,
+			"min_free", c.cfg.MinFreeDisk,
+		)
+	} else if changed {
+		slog.Info("Disk space recovered, resuming downloads")
+	}
+
+	return changed
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd)
+
+package relay
+
+import "errors"
+
+// diskFree isn't implemented on this platform; the free disk safeguard is
+// disabled.
+func diskFree(path string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
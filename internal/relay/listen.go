@@ -0,0 +1,82 @@
+package relay
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+
+	"github.com/prxssh/relay/internal/torrent"
+)
+
+// ListenAddr returns the address the client accepts peer connections on.
+func (c *Client) ListenAddr() net.Addr {
+	return c.listener.Addr()
+}
+
+/////////////// Private ///////////////
+
+// listen opens the listener peers connect to, on Config.ListenPort of
+// Config.BindAddress. Port zero picks a free port, which is then what's
+// announced to trackers.
+func (c *Client) listen() error {
+	addr := net.JoinHostPort(
+		c.cfg.BindAddress,
+		strconv.Itoa(int(c.cfg.ListenPort)),
+	)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listening for peers: %w", err)
+	}
+
+	c.listener = l
+	c.cfg.ListenPort = uint16(l.Addr().(*net.TCPAddr).Port)
+	return nil
+}
+
+// acceptLoop hands every inbound connection to acceptPeer until the listener
+// is closed.
+func (c *Client) acceptLoop() {
+	for {
+		conn, err := c.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Debug("Accepting peer failed", "error", err)
+			continue
+		}
+
+		go c.acceptPeer(conn)
+	}
+}
+
+// acceptPeer completes the handshake of an inbound connection for the active
+// session of the torrent the peer asks for, then runs the peer with it.
+func (c *Client) acceptPeer(conn net.Conn) {
+	var s *session
+	lookup := func(
+		infoHash [sha1.Size]byte,
+	) (*torrent.PeerConnectOpts, bool) {
+		var ok bool
+		s, ok = c.Torrent(infoHash)
+		if !ok || !s.isActive() {
+			return nil, false
+		}
+		return s.peerConnectOpts(), true
+	}
+
+	p, err := torrent.AcceptPeer(conn, lookup)
+	if err != nil {
+		slog.Debug(
+			"Inbound peer rejected",
+			"addr", conn.RemoteAddr(),
+			"error", err,
+		)
+		return
+	}
+
+	s.runPeer(p)
+}
@@ -0,0 +1,160 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/prxssh/relay/internal/torrent"
+	"github.com/prxssh/relay/internal/tracker"
+)
+
+// magnetFetchers is how many peers the metadata of a magnet link is fetched
+// from at once. The first to deliver wins.
+const magnetFetchers = 8
+
+// ErrNoMetadata is returned when adding a magnet link whose metadata none of
+// the peers found could provide.
+var ErrNoMetadata = errors.New("relay: metadata not found")
+
+// metadataFetcher downloads a torrent's info dictionary from the peer at
+// addr, like torrent.FetchMetadata.
+type metadataFetcher func(
+	ctx context.Context,
+	addr string,
+	opts *torrent.PeerConnectOpts,
+) ([]byte, error)
+
+// AddMagnet adds the torrent named by a magnet link, see AddMagnetContext.
+func (c *Client) AddMagnet(uri string) (*session, error) {
+	return c.AddMagnetContext(c.ctx, uri)
+}
+
+// AddMagnetContext adds the torrent named by a magnet link. Sessions need the
+// torrent's metadata, so it's first fetched from peers (BEP 9) found through
+// the link's trackers and the DHT, which can take a while; the add is
+// abandoned once ctx is done. A copy of the metadata is kept like that of a
+// .torrent file.
+func (c *Client) AddMagnetContext(
+	ctx context.Context,
+	uri string,
+) (*session, error) {
+	m, err := torrent.ParseMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := c.Torrent(m.InfoHash); ok {
+		return nil, ErrTorrentExists
+	}
+
+	info, err := c.fetchMagnetInfo(ctx, m, c.fetchMetadata)
+	if err != nil {
+		return nil, err
+	}
+	data, err := m.Metainfo(info)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.addTorrent(ctx, data, uri, nil, nil)
+}
+
+/////////////// Private ///////////////
+
+// fetchMagnetInfo asks the magnet link's trackers and the DHT for peers and
+// fetches the info dictionary from them with fetch. The fetches still running
+// once one succeeds are cancelled, and have returned by the time it does.
+func (c *Client) fetchMagnetInfo(
+	ctx context.Context,
+	m *torrent.Magnet,
+	fetch metadataFetcher,
+) ([]byte, error) {
+	if len(m.Trackers) == 0 && c.dht == nil {
+		return nil, errors.New("relay: magnet link has no trackers")
+	}
+
+	var peers []*tracker.Peer
+	for _, url := range m.Trackers {
+		client, err := newTrackerClient(url, tracker.Options{
+			Header:    c.cfg.trackerHeader(url),
+			LocalAddr: net.ParseIP(c.cfg.BindAddress),
+		})
+		if err != nil {
+			continue
+		}
+
+		announceCtx, cancel := context.WithTimeout(
+			ctx,
+			c.cfg.announceTimeout(),
+		)
+		res, err := client.Announce(announceCtx, &tracker.AnnounceParams{
+			InfoHash:      m.InfoHash,
+			PeerID:        c.ID,
+			Port:          c.cfg.ListenPort,
+			Key:           c.announceKey,
+			SupportCrypto: c.cfg.AnnounceCrypto,
+			// The size is unknown yet; what matters is that we're not
+			// taken for a seed, which gets no seeds back.
+			Left: 1,
+		})
+		cancel()
+		if err != nil {
+			slog.Debug("Magnet announce failed", "url", url, "error", err)
+			continue
+		}
+		peers = append(peers, res.Peers...)
+	}
+	peers = append(peers, c.dhtPeers(ctx, m.InfoHash)...)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	opts := &torrent.PeerConnectOpts{InfoHash: m.InfoHash, PeerID: c.ID}
+	addrs := make(chan string)
+	results := make(chan []byte, len(peers))
+	for range min(magnetFetchers, len(peers)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for addr := range addrs {
+				info, err := fetch(ctx, addr, opts)
+				if err != nil {
+					info = nil
+				}
+				results <- info
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(addrs)
+		for _, p := range peers {
+			select {
+			case addrs <- p.Addr():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for range peers {
+		select {
+		case info := <-results:
+			if info != nil {
+				return info, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, ErrNoMetadata
+}
@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/prxssh/relay/internal/bencode"
+	"github.com/prxssh/relay/internal/torrent"
+	"github.com/prxssh/relay/internal/tracker"
+)
+
+func TestAddMagnetFetchesMetadata(t *testing.T) {
+	var info bytes.Buffer
+	err := bencode.NewMarshaller(&info).Marshal(map[string]any{
+		"name":         "magnet",
+		"length":       int64(10),
+		"piece length": int64(torrent.BlockSize),
+		"pieces":       string(make([]byte, 20)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha1.Sum(info.Bytes())
+
+	ft := newFakeTracker()
+	ft.peers = []*tracker.Peer{
+		{IP: net.IPv4(10, 0, 0, 1), Port: 1},
+		{IP: net.IPv4(10, 0, 0, 2), Port: 2},
+	}
+	useFakeTrackers(t, map[string]*fakeTracker{"http://test/announce": ft})
+
+	c, err := NewClient(Config{DownloadDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	// Only the second peer has the metadata.
+	c.fetchMetadata = func(
+		ctx context.Context,
+		addr string,
+		opts *torrent.PeerConnectOpts,
+	) ([]byte, error) {
+		if addr != "10.0.0.2:2" || opts.InfoHash != hash {
+			return nil, torrent.ErrNoMetadata
+		}
+		return info.Bytes(), nil
+	}
+
+	uri := "magnet:?xt=urn:btih:" + hex.EncodeToString(hash[:]) +
+		"&dn=magnet&tr=http%3A%2F%2Ftest%2Fannounce"
+	s, err := c.AddMagnet(uri)
+	if err != nil {
+		t.Fatalf("AddMagnet: %v", err)
+	}
+	if s.torrent.Info.Hash != hash || s.torrent.Info.Name != "magnet" {
+		t.Errorf(
+			"added %q with hash %x, want magnet with %x",
+			s.torrent.Info.Name,
+			s.torrent.Info.Hash,
+			hash,
+		)
+	}
+
+	if _, err := c.AddMagnet(uri); !errors.Is(err, ErrTorrentExists) {
+		t.Errorf("adding again: err = %v, want %v", err, ErrTorrentExists)
+	}
+	_, err = c.AddMagnet("magnet:?dn=magnet")
+	if !errors.Is(err, torrent.ErrInvalidMagnet) {
+		t.Errorf(
+			"adding without xt: err = %v, want %v",
+			err,
+			torrent.ErrInvalidMagnet,
+		)
+	}
+}
@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// networkCheckInterval is how often the local interface addresses are checked
+// for a network change, e.g. after the machine wakes up or a VPN reconnects.
+const networkCheckInterval = 10 * time.Second
+
+// interfaceAddrs lists the addresses of the local network interfaces. It's a
+// variable so tests can simulate a network change.
+var interfaceAddrs = net.InterfaceAddrs
+
+// NetworkChanged tells the client its network connectivity changed, so its
+// tracker announces and what it knows about its external address are stale.
+// Every tracker is announced to again right away as if the torrent just
+// started, letting it learn our new address, and the external address is
+// estimated from scratch. It's called automatically when the interface
+// addresses change, and can be called by hand when that goes unnoticed.
+func (c *Client) NetworkChanged() {
+	c.ipVoter.Reset()
+
+	for _, s := range c.Torrents() {
+		s.reannounce(true)
+	}
+}
+
+/////////////// Private ///////////////
+
+// networkLoop checks for network changes on every networkCheckInterval tick.
+func (c *Client) networkLoop() {
+	ticker := time.NewTicker(networkCheckInterval)
+	defer ticker.Stop()
+
+	c.checkNetwork()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			if c.checkNetwork() {
+				slog.Info("Network changed, announcing again")
+				c.NetworkChanged()
+			}
+		}
+	}
+}
+
+// checkNetwork compares the interface addresses to the ones seen last time and
+// reports whether they changed. The first check only records them. When they
+// can't be listed, the last known addresses are kept.
+func (c *Client) checkNetwork() bool {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		slog.Debug("Listing interface addresses failed", "error", err)
+		return false
+	}
+
+	list := make([]string, len(addrs))
+	for i, addr := range addrs {
+		list[i] = addr.String()
+	}
+	slices.Sort(list)
+	fingerprint := strings.Join(list, ",")
+
+	c.mu.Lock()
+	changed := c.netAddrs != "" && c.netAddrs != fingerprint
+	c.netAddrs = fingerprint
+	c.mu.Unlock()
+
+	return changed
+}
@@ -0,0 +1,219 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/prxssh/relay/internal/torrent"
+	"github.com/prxssh/relay/internal/utils"
+)
+
+// stateSaveInterval is how often the torrent list is saved while running, so
+// a crash loses little progress.
+const stateSaveInterval = time.Minute
+
+// metainfoPath returns where the copy of a torrent's metainfo is kept, in a
+// torrents directory next to the state file.
+func (c *Client) metainfoPath(infoHash [sha1.Size]byte) string {
+	return filepath.Join(
+		filepath.Dir(c.cfg.StatePath),
+		"torrents",
+		hex.EncodeToString(infoHash[:])+".torrent",
+	)
+}
+
+// saveMetainfo keeps a copy of an added torrent's metainfo, so it can be
+// restored on the next run no matter where it was added from.
+func (c *Client) saveMetainfo(infoHash [sha1.Size]byte, data []byte) error {
+	if c.cfg.StatePath == "" {
+		return nil
+	}
+
+	path := c.metainfoPath(infoHash)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// saveState writes every torrent and its progress, and the good nodes of the
+// DHT, to the state file.
+func (c *Client) saveState() {
+	if c.cfg.StatePath == "" {
+		return
+	}
+
+	var state State
+	for _, s := range c.Torrents() {
+		state.Torrents = append(state.Torrents, s.persistentState())
+	}
+	if c.dht != nil {
+		state.DHTNodes = c.dht.Nodes()
+	}
+
+	if err := SaveState(c.cfg.StatePath, state); err != nil {
+		slog.Warn(
+			"Saving state failed",
+			"path", c.cfg.StatePath,
+			"error", err,
+		)
+	}
+}
+
+// stateLoop saves the state on every stateSaveInterval tick.
+func (c *Client) stateLoop() {
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.saveState()
+		}
+	}
+}
+
+// loadState reads the state saved by a previous run; it's empty without a
+// state file.
+func (c *Client) loadState() (State, error) {
+	if c.cfg.StatePath == "" {
+		return State{}, nil
+	}
+
+	return LoadState(c.cfg.StatePath)
+}
+
+// restoreState re-adds the torrents of state, in their old queue order.
+// Torrents that can't be restored are logged and dropped.
+func (c *Client) restoreState(state State) {
+	for _, ts := range state.Torrents {
+		if err := c.restoreTorrent(ts); err != nil {
+			slog.Warn(
+				"Restoring torrent failed",
+				"info_hash", hex.EncodeToString(ts.InfoHash[:]),
+				"error", err,
+			)
+		}
+	}
+}
+
+func (c *Client) restoreTorrent(ts TorrentState) error {
+	data, err := os.ReadFile(c.metainfoPath(ts.InfoHash))
+	if err != nil {
+		return err
+	}
+	t, err := torrent.New(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if t.Info.Hash != ts.InfoHash {
+		return errors.New("metainfo doesn't match info hash")
+	}
+
+	cfg := c.cfg
+	if ts.DownloadDir != "" {
+		cfg.DownloadDir = ts.DownloadDir
+	}
+	s, err := newSession(c.ctx, c.ID, t, cfg)
+	if err != nil {
+		return err
+	}
+	s.source = ts.Source
+	s.restoreHave(utils.Bitfield(ts.Have))
+	s.restoreDictPeers(ts.DictPeerTrackers)
+	if ts.Paused {
+		s.status = statusPaused
+	}
+
+	if err := c.addSession(s); err != nil {
+		s.stop()
+		return err
+	}
+	return nil
+}
+
+// persistentState returns what is saved about the session between runs.
+func (s *session) persistentState() TorrentState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Held pieces aren't on storage yet.
+	numPieces := s.torrent.NumPieces()
+	have := utils.NewBitfield(numPieces)
+	for i := 0; i < numPieces; i++ {
+		if _, held := s.held[i]; !held && s.picker.Has(i) {
+			have.Set(i)
+		}
+	}
+
+	var dictTrackers []string
+	for _, mt := range s.trackers {
+		if mt.dictPeers {
+			dictTrackers = append(dictTrackers, mt.url)
+		}
+	}
+
+	return TorrentState{
+		Source:           s.source,
+		InfoHash:         s.torrent.Info.Hash,
+		DownloadDir:      s.downloadDir,
+		Paused:           s.status == statusPaused,
+		Have:             have,
+		DictPeerTrackers: dictTrackers,
+	}
+}
+
+// restoreDictPeers marks the trackers with the given announce URLs as not
+// supporting compact peer lists, as learned by a previous run.
+func (s *session) restoreDictPeers(urls []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, mt := range s.trackers {
+		if slices.Contains(urls, mt.url) {
+			mt.dictPeers = true
+		}
+	}
+}
+
+// restoreHave marks the pieces in have as downloaded without hashing them
+// again. Pieces of files that went missing or shrank since are rechecked
+// against the data on disk instead.
+func (s *session) restoreHave(have utils.Bitfield) {
+	info := s.torrent.Info
+	numPieces := s.torrent.NumPieces()
+	if len(have) != (numPieces+7)/8 {
+		return
+	}
+
+	recheck := make(map[int]bool)
+	for i, f := range info.FileList() {
+		path := filepath.Join(append([]string{s.downloadDir}, f.Path...)...)
+		if st, err := os.Stat(path); err == nil && st.Size() >= f.Length {
+			continue
+		}
+		first, last := info.FilePieces(i)
+		for piece := first; piece <= last; piece++ {
+			recheck[piece] = true
+		}
+	}
+
+	for i := 0; i < numPieces; i++ {
+		if !have.Has(i) || recheck[i] && !s.verifyPieceOnDisk(i) {
+			continue
+		}
+		s.setHave(i)
+		if !recheck[i] {
+			s.unverified[i] = true
+		}
+	}
+}
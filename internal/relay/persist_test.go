@@ -0,0 +1,97 @@
+package relay
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prxssh/relay/internal/torrent"
+)
+
+// createTestTorrent writes a file of two pieces into dir and returns the
+// metainfo of a torrent for it.
+func createTestTorrent(t *testing.T, dir string) []byte {
+	t.Helper()
+
+	path := filepath.Join(dir, "data.bin")
+	data := bytes.Repeat([]byte("persist!"), 2*torrent.BlockSize/8)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err := torrent.Create(&buf, path, torrent.CreateOpts{
+		AnnounceURLs: []string{"http://test/announce"},
+		PieceLength:  torrent.BlockSize,
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestClientRestoresTorrents(t *testing.T) {
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://test/announce": newFakeTracker(),
+	})
+
+	dir := t.TempDir()
+	cfg := Config{
+		DownloadDir: dir,
+		StatePath:   filepath.Join(t.TempDir(), "state.bencode"),
+	}
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	s, err := c.AddTorrent(bytes.NewReader(createTestTorrent(t, dir)))
+	if err != nil {
+		t.Fatalf("AddTorrent: %v", err)
+	}
+	if err := s.RecheckFile(0); err != nil {
+		t.Fatalf("RecheckFile: %v", err)
+	}
+	s.halt(statusPaused)
+	infoHash := s.torrent.Info.Hash
+	c.Close()
+
+	t.Run("paused seed", func(t *testing.T) {
+		c, err := NewClient(cfg)
+		if err != nil {
+			t.Fatalf("NewClient: %v", err)
+		}
+		defer c.Close()
+
+		restored := c.Torrents()
+		if len(restored) != 1 || restored[0].torrent.Info.Hash != infoHash {
+			t.Fatalf("restored %d torrents, want the added one", len(restored))
+		}
+		s := restored[0]
+		if !s.picker.Done() {
+			t.Error("progress was not restored")
+		}
+		if s.isActive() || s.Stats().Status != statusPaused {
+			t.Errorf("status = %q, want paused", s.Stats().Status)
+		}
+	})
+
+	t.Run("damaged data is rechecked", func(t *testing.T) {
+		path := filepath.Join(dir, "data.bin")
+		if err := os.Truncate(path, torrent.BlockSize); err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := NewClient(cfg)
+		if err != nil {
+			t.Fatalf("NewClient: %v", err)
+		}
+		defer c.Close()
+
+		s := c.Torrents()[0]
+		if !s.picker.Has(0) || s.picker.Has(1) {
+			t.Error("expected only the intact first piece to be kept")
+		}
+	})
+}
@@ -0,0 +1,46 @@
+package relay
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"slices"
+
+	"github.com/prxssh/relay/internal/torrent"
+	"github.com/prxssh/relay/internal/tracker"
+)
+
+/////////////// Private ///////////////
+
+// pexLoop sends every connected peer that supports it a peer exchange
+// message every torrent.PEXInterval until ctx is done.
+func (s *session) pexLoop(ctx context.Context) {
+	for {
+		timer := s.clock.NewTimer(torrent.PEXInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+			s.sendPEX()
+		}
+	}
+}
+
+// sendPEX tells each connected peer about the others.
+func (s *session) sendPEX() {
+	s.mu.Lock()
+	peers := slices.Collect(maps.Keys(s.peers))
+	s.mu.Unlock()
+
+	for _, p := range peers {
+		if err := p.SendPEX(peers); err != nil {
+			slog.Debug("Sending PEX failed", "addr", p.Addr, "error", err)
+		}
+	}
+}
+
+// receivePEX connects to the peers a peer told us about.
+func (s *session) receivePEX(_ *torrent.Peer, peers []*tracker.Peer) {
+	s.connectPeers(peers)
+}
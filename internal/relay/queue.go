@@ -0,0 +1,134 @@
+package relay
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"slices"
+)
+
+// ForceStart starts a queued torrent right away, regardless of the queue
+// limits. A force-started torrent is never queued by the client again.
+func (c *Client) ForceStart(infoHash [sha1.Size]byte) error {
+	c.mu.RLock()
+	s, ok := c.torrents[infoHash]
+	c.mu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("torrent %x not found", infoHash)
+	}
+
+	s.mu.Lock()
+	s.forceStart = true
+	s.mu.Unlock()
+
+	s.start()
+	c.rebalance()
+	return nil
+}
+
+/////////////// Private ///////////////
+
+// rebalance makes the set of active sessions match the configured limits.
+// Downloads get up to MaxActiveDownloads slots in queue order. Download slots
+// left unused are lent to seeds, and a newly added download reclaims them by
+// queueing the lowest priority seed again. Sessions beyond the limits wait in
+// the queue. Force-started sessions run regardless and don't take up slots.
+// While the disk is low on space no download runs, except force-started ones.
+func (c *Client) rebalance() {
+	c.rebalanceMu.Lock()
+	defer c.rebalanceMu.Unlock()
+
+	c.mu.RLock()
+	queue := slices.Clone(c.queue)
+	lowDisk := c.lowDisk
+	c.mu.RUnlock()
+
+	var downloads, seeds []*session
+	for _, s := range queue {
+		s.mu.Lock()
+		status, force := s.status, s.forceStart
+		s.mu.Unlock()
+
+		if force || !c.queueable(status) {
+			continue
+		}
+
+		if s.picker.Done() {
+			seeds = append(seeds, s)
+		} else {
+			downloads = append(downloads, s)
+		}
+	}
+
+	if lowDisk {
+		c.pauseDownloads(downloads)
+		downloads = nil
+	}
+
+	downloadLimit, seedLimit := c.cfg.MaxActiveDownloads, c.cfg.MaxActiveSeeds
+	if downloadLimit > 0 && seedLimit > 0 && len(downloads) < downloadLimit {
+		seedLimit += downloadLimit - len(downloads)
+	}
+
+	var position int
+	c.fillSlots(downloads, downloadLimit, &position)
+	c.fillSlots(seeds, seedLimit, &position)
+}
+
+// fillSlots starts the first limit sessions and queues the rest, numbering
+// them from position. Always-active sessions claim slots first and are never
+// queued, even when they alone exceed the limit.
+func (c *Client) fillSlots(sessions []*session, limit int, position *int) {
+	ordered := make([]*session, 0, len(sessions))
+	var rest []*session
+	for _, s := range sessions {
+		s.mu.Lock()
+		alwaysActive := s.alwaysActive
+		s.mu.Unlock()
+
+		if alwaysActive {
+			ordered = append(ordered, s)
+		} else {
+			rest = append(rest, s)
+		}
+	}
+	numAlwaysActive := len(ordered)
+	ordered = append(ordered, rest...)
+
+	for i, s := range ordered {
+		if limit <= 0 || i < limit || i < numAlwaysActive {
+			s.start()
+			continue
+		}
+
+		*position++
+		if s.isActive() {
+			s.halt(statusQueued)
+		}
+		s.mu.Lock()
+		s.queuePosition = *position
+		s.mu.Unlock()
+	}
+}
+
+// pauseDownloads halts downloads while the disk is low on space. They are
+// started again by the first rebalance after it recovered.
+func (c *Client) pauseDownloads(downloads []*session) {
+	for _, s := range downloads {
+		s.halt(statusLowDisk)
+		s.mu.Lock()
+		s.queuePosition = 0
+		s.mu.Unlock()
+	}
+}
+
+// queueable reports whether a session in status is managed by the queue.
+// Stopped and paused sessions stay as the user left them.
+func (c *Client) queueable(status torrentStatus) bool {
+	switch status {
+	case statusQueued, statusInProgress, statusCompleted, statusLowDisk:
+		return true
+	default:
+		return false
+	}
+}
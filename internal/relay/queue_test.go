@@ -0,0 +1,194 @@
+package relay
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+)
+
+// newQueueTestSession creates a session for a test torrent identified by id,
+// without adding it to a client. If complete is set, all its pieces are
+// already downloaded, making it a seed.
+func newQueueTestSession(
+	t *testing.T,
+	c *Client,
+	id byte,
+	complete bool,
+) *session {
+	t.Helper()
+
+	tr := newTestTorrent("http://test/announce")
+	tr.Info.Hash[0] = id
+
+	s, err := newSession(context.Background(), c.ID, tr, c.cfg)
+	if err != nil {
+		t.Fatalf("newSession: %v", err)
+	}
+	t.Cleanup(s.stop)
+
+	if complete {
+		for i := 0; i < tr.NumPieces(); i++ {
+			s.picker.SetHave(i)
+		}
+	}
+
+	return s
+}
+
+// addTestTorrents adds n distinct incomplete test torrents to c.
+func addTestTorrents(t *testing.T, c *Client, n int) []*session {
+	t.Helper()
+
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://test/announce": newFakeTracker(),
+	})
+
+	sessions := make([]*session, n)
+	for i := range sessions {
+		sessions[i] = newQueueTestSession(t, c, byte(i+1), false)
+		if err := c.addSession(sessions[i]); err != nil {
+			t.Fatalf("addSession: %v", err)
+		}
+	}
+
+	return sessions
+}
+
+func TestQueueLimitsActiveDownloads(t *testing.T) {
+	c, err := NewClient(Config{
+		DownloadDir:        t.TempDir(),
+		MaxActiveDownloads: 1,
+	})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(c.Close)
+
+	sessions := addTestTorrents(t, c, 3)
+
+	wantPositions := []int{0, 1, 2}
+	for i, s := range sessions {
+		if got := s.Stats().QueuePosition; got != wantPositions[i] {
+			t.Errorf(
+				"session %d queue position = %d, want %d",
+				i,
+				got,
+				wantPositions[i],
+			)
+		}
+	}
+	if !sessions[0].isActive() || sessions[1].isActive() {
+		t.Fatal("expected only the first torrent to be active")
+	}
+
+	if err := c.ForceStart(sessions[2].torrent.Info.Hash); err != nil {
+		t.Fatalf("ForceStart: %v", err)
+	}
+	if !sessions[2].isActive() {
+		t.Error("force-started torrent is not active")
+	}
+	if got := sessions[1].Stats().QueuePosition; got != 1 {
+		t.Errorf("queued torrent position = %d, want 1", got)
+	}
+
+	// Finishing the active download frees its slot for the next in line.
+	sessions[0].pieceCompleted(0)
+	sessions[0].pieceCompleted(1)
+	if !sessions[1].isActive() {
+		t.Error("queued torrent was not promoted after a download finished")
+	}
+}
+
+func TestQueueLendsDownloadSlotsToSeeds(t *testing.T) {
+	c, err := NewClient(Config{
+		DownloadDir:        t.TempDir(),
+		MaxActiveDownloads: 1,
+		MaxActiveSeeds:     1,
+	})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(c.Close)
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://test/announce": newFakeTracker(),
+	})
+
+	older := newQueueTestSession(t, c, 1, true)
+	pinned := newQueueTestSession(t, c, 2, true)
+	for _, s := range []*session{older, pinned} {
+		if err := c.addSession(s); err != nil {
+			t.Fatalf("addSession: %v", err)
+		}
+	}
+	pinned.SetAlwaysActive(true)
+
+	// With nothing downloading, the free download slot goes to a seed.
+	if !older.isActive() || !pinned.isActive() {
+		t.Fatal("expected both seeds to be active")
+	}
+
+	download := newQueueTestSession(t, c, 3, false)
+	if err := c.addSession(download); err != nil {
+		t.Fatalf("addSession: %v", err)
+	}
+
+	if !download.isActive() {
+		t.Error("new download did not get a slot")
+	}
+	if !pinned.isActive() {
+		t.Error("always-active seed was evicted")
+	}
+	if older.isActive() {
+		t.Error("expected a seed to be queued to make room for the download")
+	}
+}
+
+func TestLowDiskPausesDownloads(t *testing.T) {
+	var free atomic.Int64
+	free.Store(50)
+	orig := freeDiskSpace
+	freeDiskSpace = func(string) (int64, error) { return free.Load(), nil }
+	t.Cleanup(func() { freeDiskSpace = orig })
+
+	c, err := NewClient(Config{
+		DownloadDir: t.TempDir(),
+		MinFreeDisk: 100,
+	})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(c.Close)
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://test/announce": newFakeTracker(),
+	})
+
+	seed := newQueueTestSession(t, c, 1, true)
+	download := newQueueTestSession(t, c, 2, false)
+	for _, s := range []*session{seed, download} {
+		if err := c.addSession(s); err != nil {
+			t.Fatalf("addSession: %v", err)
+		}
+	}
+
+	if !c.LowDisk() {
+		t.Fatal("client didn't notice the low disk")
+	}
+	if download.isActive() || download.Stats().Status != statusLowDisk {
+		t.Errorf(
+			"download status = %q, want %q",
+			download.Stats().Status,
+			statusLowDisk,
+		)
+	}
+	if !seed.isActive() {
+		t.Error("seed was paused")
+	}
+
+	free.Store(200)
+	if c.checkDisk() {
+		c.rebalance()
+	}
+	if c.LowDisk() || !download.isActive() {
+		t.Error("download not resumed after disk space recovered")
+	}
+}
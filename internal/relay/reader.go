@@ -0,0 +1,201 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrNotReady is returned by non-blocking streaming readers when the requested
+// bytes haven't been downloaded yet.
+var ErrNotReady = errors.New("relay: data not downloaded yet")
+
+// errReaderClosed is returned by reads and seeks on a closed streaming reader.
+var errReaderClosed = errors.New("relay: reader closed")
+
+// streamReadahead is the number of pieces ahead of a reader's position that
+// get deadlines, so the picker keeps the data just in front of it flowing.
+const streamReadahead = 4
+
+// fileReader streams one file of a torrent out of storage, waiting for (and
+// prioritizing) pieces that haven't been downloaded yet.
+type fileReader struct {
+	s *session
+	// Offset of the file within the torrent's contiguous data
+	offset int64
+	// Length of the file
+	length int64
+	// Current read position within the file
+	pos int64
+	// Pieces that currently carry a deadline set by this reader
+	window []int
+	// Set once the reader is closed
+	closed bool
+}
+
+// Open returns a reader for the file at fileIndex. Reads of data that isn't
+// downloaded yet block until it is, or fail with ErrNotReady if the client is
+// configured for non-blocking reads. The pieces right ahead of the read
+// position are prioritized, and seeking moves that window along. Closing the
+// reader withdraws the window, so callers must close it once they're done.
+func (s *session) Open(fileIndex int) (io.ReadSeekCloser, error) {
+	files := s.torrent.Info.FileList()
+	if fileIndex < 0 || fileIndex >= len(files) {
+		return nil, fmt.Errorf("file index %d out of range", fileIndex)
+	}
+
+	r := &fileReader{
+		s:      s,
+		offset: s.torrent.Info.FileOffset(fileIndex),
+		length: files[fileIndex].Length,
+	}
+	r.prioritize()
+
+	return r, nil
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, errReaderClosed
+	}
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+
+	// Never read across a piece boundary so we only wait for one piece.
+	pieceLen := r.s.torrent.Info.PieceLen
+	abs := r.offset + r.pos
+	piece := int(abs / pieceLen)
+	pieceEnd := int64(piece+1) * pieceLen
+
+	size := min(int64(len(p)), r.length-r.pos, pieceEnd-abs)
+	if err := r.s.waitPiece(piece, r.s.cfg.BlockingReads); err != nil {
+		return 0, err
+	}
+
+	n, err := r.s.dataStorage().ReadAt(p[:size], abs)
+	r.pos += int64(n)
+	r.prioritize()
+
+	return n, err
+}
+
+func (r *fileReader) Seek(offset int64, whence int) (int64, error) {
+	if r.closed {
+		return 0, errReaderClosed
+	}
+
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.length + offset
+	default:
+		return 0, fmt.Errorf("seek: invalid whence %d", whence)
+	}
+
+	if pos < 0 {
+		return 0, errors.New("seek: negative position")
+	}
+
+	r.pos = pos
+	r.prioritize()
+
+	return pos, nil
+}
+
+// Close withdraws the deadlines the reader set, leaving the pieces to
+// whatever else wants them. Closing a closed reader is a no-op.
+func (r *fileReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	r.withdraw()
+	return nil
+}
+
+/////////////// Private ///////////////
+
+// prioritize gives the pieces right ahead of the read position staggered
+// deadlines and withdraws the ones it set for the previous position. Pieces
+// another reader, or SetPieceDeadline, wants keep the deadline they want them
+// by.
+func (r *fileReader) prioritize() {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	r.withdraw()
+	if r.pos >= r.length {
+		return
+	}
+
+	pieceLen := r.s.torrent.Info.PieceLen
+	first := int((r.offset + r.pos) / pieceLen)
+	last := int((r.offset + r.length - 1) / pieceLen)
+
+	now := r.s.clock.Now()
+	for i := 0; i < streamReadahead && first+i <= last; i++ {
+		piece := first + i
+		if r.s.picker.Has(piece) {
+			continue
+		}
+
+		deadline := now.Add(time.Duration(i) * time.Second)
+		r.s.setPieceDeadline(r, piece, deadline)
+		r.window = append(r.window, piece)
+	}
+}
+
+// withdraw clears the deadlines of the reader's window. The caller must hold
+// s.mu.
+func (r *fileReader) withdraw() {
+	for _, piece := range r.window {
+		r.s.setPieceDeadline(r, piece, time.Time{})
+	}
+	r.window = r.window[:0]
+}
+
+// setPieceDeadline records the deadline owner wants the piece by, a zero
+// deadline withdrawing it, and hands the picker the earliest deadline anyone
+// still wants the piece by. A nil owner stands for SetPieceDeadline. The
+// caller must hold s.mu.
+func (s *session) setPieceDeadline(
+	owner *fileReader,
+	index int,
+	deadline time.Time,
+) {
+	wanted := s.pieceDeadlines[index]
+	if deadline.IsZero() {
+		delete(wanted, owner)
+	} else {
+		if wanted == nil {
+			wanted = make(map[*fileReader]time.Time)
+			s.pieceDeadlines[index] = wanted
+		}
+		wanted[owner] = deadline
+	}
+
+	var earliest time.Time
+	for _, d := range wanted {
+		if earliest.IsZero() || d.Before(earliest) {
+			earliest = d
+		}
+	}
+	if len(wanted) == 0 {
+		delete(s.pieceDeadlines, index)
+	}
+	// A piece we have needs no deadline, whoever still wants it.
+	if s.picker.Has(index) {
+		earliest = time.Time{}
+	}
+	s.picker.SetDeadline(index, earliest)
+}
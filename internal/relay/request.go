@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"time"
+
+	"github.com/prxssh/relay/internal/torrent"
+)
+
+// requestRetryInterval is how often a peer's request loop looks for blocks
+// without being woken, so an idle peer gets to take over the blocks another
+// peer is slow on.
+const requestRetryInterval = 5 * time.Second
+
+/////////////// Private ///////////////
+
+// requestLoop keeps p's request pipeline filled from the scheduler until done
+// is closed. It runs whenever wake signals that p's state changed, e.g. it
+// unchoked us, announced a piece or delivered a block, and at least every
+// requestRetryInterval. The blocks outstanding with p go back to the pool once
+// it chokes us or done is closed.
+func (s *session) requestLoop(
+	p *torrent.Peer,
+	wake <-chan struct{},
+	done <-chan struct{},
+) {
+	defer s.scheduler.Release(p)
+
+	for {
+		timer := s.clock.NewTimer(requestRetryInterval)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-wake:
+			timer.Stop()
+		case <-timer.C():
+		}
+
+		s.fillRequests(p)
+	}
+}
+
+// fillRequests requests blocks from p until its pipeline is full, as long as
+// the peer unchokes us and the session is running. Otherwise the blocks
+// outstanding with p are released, since it won't deliver them.
+func (s *session) fillRequests(p *torrent.Peer) {
+	if !s.isActive() || !p.CanRequest() {
+		s.scheduler.Release(p)
+		return
+	}
+
+	for {
+		req, ok := s.scheduler.Next(p)
+		if !ok {
+			return
+		}
+		err := p.SendRequest(req.Piece, req.Begin, req.Length)
+		if err != nil {
+			// Choked in the meantime, or disconnected.
+			s.scheduler.Release(p)
+			return
+		}
+	}
+}
+
+// wakeRequests wakes p's request loop without blocking if a wake-up is
+// already pending.
+func (s *session) wakeRequests(p *torrent.Peer) {
+	s.mu.Lock()
+	wake := s.peers[p]
+	s.mu.Unlock()
+
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
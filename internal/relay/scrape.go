@@ -0,0 +1,127 @@
+package relay
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prxssh/relay/internal/tracker"
+)
+
+const (
+	// scrapeInterval is how often the client asks the trackers of all its
+	// torrents for their swarm sizes, which keeps the numbers of torrents
+	// that announce rarely, or not at all while queued, fresh.
+	scrapeInterval = 30 * time.Minute
+	// scrapeBatchSize is the most info hashes one scrape request carries,
+	// keeping HTTP scrape URLs well below the length servers accept.
+	scrapeBatchSize = 50
+)
+
+/////////////// Private ///////////////
+
+// scrapeTarget is one session's tracker to update from a scrape.
+type scrapeTarget struct {
+	s  *session
+	mt *managedTracker
+}
+
+// scrapeLoop scrapes all trackers on every scrapeInterval tick.
+func (c *Client) scrapeLoop() {
+	ticker := time.NewTicker(scrapeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.scrapeTrackers(c.ctx)
+		}
+	}
+}
+
+// scrapeTrackers updates the swarm sizes of every session's trackers.
+// Sessions announcing to the same URL are scraped together, scrapeBatchSize
+// torrents per request, so seeding hundreds of torrents on one tracker costs
+// a handful of requests rather than hundreds. Different announce URLs of one
+// host, e.g. with different passkeys, can't share a request.
+func (c *Client) scrapeTrackers(ctx context.Context) {
+	c.mu.RLock()
+	sessions := slices.Collect(maps.Values(c.torrents))
+	c.mu.RUnlock()
+
+	groups := make(map[string][]scrapeTarget)
+	for _, s := range sessions {
+		s.mu.Lock()
+		for _, mt := range s.trackers {
+			groups[mt.url] = append(groups[mt.url], scrapeTarget{s, mt})
+		}
+		s.mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for url, targets := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.scrapeTracker(ctx, url, targets)
+		}()
+	}
+	wg.Wait()
+}
+
+// scrapeTracker scrapes the torrents of targets, which all announce to url,
+// and records the swarm sizes the tracker reports. Any session's client for
+// the URL will do; they're configured alike.
+func (c *Client) scrapeTracker(
+	ctx context.Context,
+	url string,
+	targets []scrapeTarget,
+) {
+	client := targets[0].mt.client
+	var infoHashes [][sha1.Size]byte
+	for _, target := range targets {
+		infoHashes = append(infoHashes, target.s.torrent.Info.Hash)
+	}
+	slices.SortFunc(infoHashes, func(a, b [sha1.Size]byte) int {
+		return slices.Compare(a[:], b[:])
+	})
+	infoHashes = slices.Compact(infoHashes)
+
+	stats := make(map[[sha1.Size]byte]tracker.ScrapeStats, len(infoHashes))
+	for batch := range slices.Chunk(infoHashes, scrapeBatchSize) {
+		scrapeCtx, cancel := context.WithTimeout(
+			ctx,
+			c.cfg.announceTimeout(),
+		)
+		res, err := client.Scrape(scrapeCtx, batch)
+		cancel()
+		if err != nil {
+			if !errors.Is(err, tracker.ErrScrapeUnsupported) {
+				slog.Debug(
+					"Scraping tracker failed",
+					"url", url,
+					"error", err,
+				)
+			}
+			break
+		}
+		maps.Copy(stats, res)
+	}
+
+	for _, target := range targets {
+		st, ok := stats[target.s.torrent.Info.Hash]
+		if !ok {
+			continue
+		}
+		target.s.mu.Lock()
+		target.mt.seeders, target.mt.leechers = st.Seeders, st.Leechers
+		target.s.mu.Unlock()
+	}
+}
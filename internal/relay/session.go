@@ -1,14 +1,24 @@
 package relay
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha1"
 	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
 	"sync"
 	"time"
 
+	"github.com/prxssh/relay/internal/dht"
 	"github.com/prxssh/relay/internal/torrent"
 	"github.com/prxssh/relay/internal/tracker"
+	"github.com/prxssh/relay/internal/utils"
 )
 
 // torrentStatus represents the various states a torrent session can be in.
@@ -17,17 +27,38 @@ type torrentStatus string
 // managedTracker wraps a tracker client with its specific state, such as its
 // personal announce interval and the time for its next announce.
 type managedTracker struct {
-	client           tracker.ITrackerProtocol
-	interval         time.Duration
+	url      string
+	client   tracker.ITrackerProtocol
+	interval time.Duration
+	// The zero time announces right away
 	nextAnnounceTime time.Time
 	failures         int
 	isAnnouncing     bool
+	// Set once the tracker has accepted our 'started' event. Until then every
+	// announce to it carries 'started', regardless of the session status.
+	started bool
+	// Swarm size as last reported by this tracker
+	seeders  uint32
+	leechers uint32
+	// Tier the tracker belongs to
+	tier *trackerTier
+	// Set once the tracker turned out not to support compact peer lists;
+	// peers are asked for as dictionaries from then on.
+	dictPeers bool
 }
 
 // session represents the state and metadata for an active torrent
 // download. It holds all the necessary information to mangae the lifecycle of
 // a torrent, from communicating with the tracker to tracking download
 // upload/progress.
+//
+// Locks are always acquired in this order, and never the other way round:
+//
+//	Client.rebalanceMu → Client.mu → session.mu → Choker.mu →
+//	    Peer.writeMu → Peer.mu → Scheduler.mu → Picker.mu → Piece
+//
+// Skipping levels is fine. Anything calling back up the chain, like
+// onStateChange into the client, is called after s.mu has been released.
 type session struct {
 	// Unique 20-byte ID for this client
 	peerID [sha1.Size]byte
@@ -35,17 +66,132 @@ type session struct {
 	torrent *torrent.Torrent
 	// Client used to communicate with tracker
 	trackers []*managedTracker
-	mu       sync.Mutex
+	// Where the torrent was added from, a .torrent path or URL; empty if it
+	// was read from elsewhere
+	source string
+	// The trackers grouped into the announce tiers of the torrent's
+	// announce-list, in its order. Only the active tracker of a tier is
+	// announced to; the others take over when it fails. Trackers added
+	// later, and those of torrents listing only URLs, form a tier each.
+	tiers []*trackerTier
+	mu    sync.Mutex
 	// Duration the client should wait between tracker announce
 	announceInterval time.Duration
 	// Indicates the current state of the torrent download
 	status torrentStatus
-	// Total number of bytes downloaded till now
+	// Why the session was halted with statusErrored; nil otherwise
+	err error
+	// Total number of bytes downloaded till now. Data that was already on
+	// disk, e.g. found by a recheck, isn't counted.
 	downloaded int64
+	// Bytes of the pieces we have a verified copy of, downloaded or not.
+	// What's left to download is measured against it.
+	verified int64
 	// Total number of bytes uploaded till now
-	uploaded   int64
-	ctx        context.Context
-	cancelFunc context.CancelFunc
+	uploaded int64
+	// Counters at the time of the previous speed sample
+	lastSampleDownloaded int64
+	lastSampleUploaded   int64
+	// Recent transfer rates, one sample per stats tick
+	speedHistory *utils.Ring[SpeedSample]
+	// Per-torrent transfer rate limits; unlimited unless set
+	downLimiter *utils.RateLimiter
+	upLimiter   *utils.RateLimiter
+	// Chooses which piece to download next
+	picker *torrent.Picker
+	// Deadlines wanted per piece by each open reader, and under a nil
+	// reader by SetPieceDeadline. The picker gets the earliest of a piece.
+	// Guarded by mu.
+	pieceDeadlines map[int]map[*fileReader]time.Time
+	// Tells the time for announces, stall detection and peer timeouts
+	clock utils.Clock
+	// Download priority of each file, translated into piece priorities
+	filePriorities []torrent.Priority
+	// Where the torrent's data is read from and written to
+	storage torrent.Storage
+	// Directory the torrent's data currently lives in
+	downloadDir string
+	// Directory the data is moved to once the download completes; empty to
+	// leave it where it is
+	completedDir string
+	// Bytes moved to completedDir so far while the status is statusMoving
+	moved int64
+	// HTTP seeds from the torrent's url-list
+	webSeeds []*torrent.WebSeed
+	// Hands out the pieces and blocks to download to peers and web seeds
+	scheduler *torrent.Scheduler
+	// Decides which peers we upload to
+	choker *torrent.Choker
+	// The client's tracker key; may be empty
+	announceKey string
+	// The client's DHT node; may be nil
+	dht *dht.DHT
+	// The client's estimate of our external address; may be nil
+	ipVoter *torrent.IPVoter
+	// The client's policy for which peers we dial, and in which order; may be
+	// nil
+	connPolicy *torrent.ConnectPolicy
+	// The client's peer connection caps; may be nil
+	connSlots *torrent.ConnSlots
+	// The client-wide transfer rate limits; may be nil
+	clientDownLimiter *utils.RateLimiter
+	clientUpLimiter   *utils.RateLimiter
+	// Closed and replaced every time a piece completes, waking up streaming
+	// readers waiting for data.
+	pieceDoneCh chan struct{}
+	// If true pieces are downloaded and written to storage in index order
+	sequential bool
+	// Verified pieces waiting in memory for an earlier piece before they're
+	// written, in sequential mode
+	held map[int][]byte
+	// Pieces being assembled from the blocks peers send
+	pieces map[int]*torrent.Piece
+	// Peers currently connected, so they can be disconnected when the
+	// session stops, each with the channel waking its request loop
+	peers map[*torrent.Peer]chan struct{}
+	// Pieces taken as downloaded without hashing their data this run, e.g.
+	// restored from saved state. They're verified before the torrent turns
+	// into a seed.
+	unverified map[int]bool
+	// Failed pieces each peer contributed blocks to, by IP address
+	hashFailures map[string]int
+	// IP addresses of peers banned for sending corrupt data; they're neither
+	// dialed nor accepted again
+	banned map[string]bool
+	// Set while a goroutine is writing held pieces to storage
+	flushing bool
+	// When the current run started or last completed a piece
+	lastProgress time.Time
+	// When the stall watchdog last tried to get the download going again
+	lastRecovery time.Time
+	// Set while the download is stalled; cleared by the next piece
+	stalled bool
+	// Settings this session was created with
+	cfg Config
+	// Signals the announce loop to re-evaluate its schedule, e.g. after a
+	// tracker was added at runtime.
+	wakeCh chan struct{}
+	// Set once the download completed until the announce loop has told the
+	// trackers with 'completed'
+	announceCompleted bool
+	// Cancels the announce loop and peer activity of the current run; nil
+	// while the session isn't active. Pause cancels it with errPaused.
+	runCancel context.CancelCauseFunc
+	// Tracks the announce loop, whose 'stopped' announce stop waits for
+	announcing sync.WaitGroup
+	// If true the session runs regardless of the client's queue limits
+	forceStart bool
+	// If true the session takes up a queue slot but is never evicted from it
+	// to make room for others
+	alwaysActive bool
+	// 1-based position in the client's queue, 0 if not queued
+	queuePosition int
+	// Called, without s.mu held, when the session's queueing inputs change
+	// (e.g. it finished downloading) so the client can rebalance its queue.
+	// May be nil.
+	onStateChange func()
+	ctx           context.Context
+	cancelFunc    context.CancelFunc
 }
 
 const (
@@ -54,28 +200,74 @@ const (
 	statusCompleted  torrentStatus = "completed"
 	statusStopped    torrentStatus = "stopped"
 	statusInProgress torrentStatus = "in-progress"
+	statusQueued     torrentStatus = "queued"
+	statusErrored    torrentStatus = "errored"
+	statusMoving     torrentStatus = "moving"
+	statusLowDisk    torrentStatus = "low-disk"
+	// Reported in place of statusInProgress while no piece completes; see
+	// stallWatchdog
+	statusStalled torrentStatus = "stalled"
 )
 
 const defaultAnnounceInterval = 30 * time.Minute
 
+// stoppedAnnounceTimeout bounds the 'stopped' announces sent once a session
+// halts, so trackers that don't answer can't hold up shutdown for long.
+const stoppedAnnounceTimeout = 5 * time.Second
+
+// errPaused is the cause a run is cancelled with when the session is paused,
+// which leaves the swarm without announcing 'stopped'.
+var errPaused = errors.New("session paused")
+
+// peerReapInterval is how often a session looks for peers to disconnect, see
+// reapPeers.
+const peerReapInterval = 30 * time.Second
+
+// hashFailBanThreshold is how many pieces failing verification a peer may
+// contribute blocks to before it's disconnected and banned.
+const hashFailBanThreshold = 3
+
+// webSeedRetryInterval is how long a web seed rests after its first failed
+// fetch. It grows with every consecutive failure.
+const webSeedRetryInterval = 30 * time.Second
+
+// newTrackerClient constructs the protocol client for an announce URL. It's a
+// variable so tests can substitute fake trackers.
+var newTrackerClient = tracker.New
+
 func newSession(
 	parentCtx context.Context,
 	clientID [sha1.Size]byte,
-	torrent *torrent.Torrent,
+	t *torrent.Torrent,
+	cfg Config,
 ) (*session, error) {
 	ctx, cancelFunc := context.WithCancel(parentCtx)
 
+	// Torrents built by hand may only list URLs; each is a tier of its own
+	// then.
+	announceTiers := t.AnnounceTiers
+	if len(announceTiers) == 0 {
+		for _, url := range t.AnnounceURLs {
+			announceTiers = append(announceTiers, []string{url})
+		}
+	}
+
 	var managedTrackers []*managedTracker
-	for _, url := range torrent.AnnounceURLs {
-		trackerClient, err := tracker.New(url)
-		if err != nil {
+	var tiers []*trackerTier
+	for _, urls := range announceTiers {
+		var tier []*managedTracker
+		for _, url := range urls {
+			mt, err := newManagedTracker(url, cfg)
+			if err != nil {
+				continue
+			}
+			tier = append(tier, mt)
+		}
+		if len(tier) == 0 {
 			continue
 		}
-		managedTrackers = append(managedTrackers, &managedTracker{
-			client:           trackerClient,
-			interval:         defaultAnnounceInterval,
-			nextAnnounceTime: time.Now(),
-		})
+		managedTrackers = append(managedTrackers, tier...)
+		tiers = append(tiers, newTrackerTier(tier...))
 	}
 
 	if len(managedTrackers) == 0 {
@@ -83,39 +275,1182 @@ func newSession(
 		return nil, errors.New("failed to initialize any trackers")
 	}
 
+	filePriorities := make([]torrent.Priority, len(t.Info.FileList()))
+	for i := range filePriorities {
+		filePriorities[i] = torrent.PriorityNormal
+	}
+
+	webSeeds := make([]*torrent.WebSeed, len(t.URLList))
+	for i, u := range t.URLList {
+		webSeeds[i] = torrent.NewWebSeed(u, t.Info, nil)
+	}
+
+	picker := torrent.NewPicker(t.NumPieces())
+	choker := torrent.NewChoker(0)
+	choker.SetMaxUploads(cfg.MaxUploadsPerTorrent)
+	choker.SetUploadsDisabled(cfg.DisableUploads)
+	choker.SetOptimisticRounds(cfg.optimisticRounds())
 	session := &session{
-		peerID:     clientID,
-		torrent:    torrent,
-		trackers:   managedTrackers,
-		status:     statusStarted,
-		downloaded: 0,
-		uploaded:   0,
-		ctx:        ctx,
-		cancelFunc: cancelFunc,
+		peerID:         clientID,
+		torrent:        t,
+		trackers:       managedTrackers,
+		tiers:          tiers,
+		status:         statusQueued,
+		downloaded:     0,
+		uploaded:       0,
+		picker:         picker,
+		pieceDeadlines: make(map[int]map[*fileReader]time.Time),
+		clock:          utils.RealClock,
+		filePriorities: filePriorities,
+		storage:        cfg.newStorage(cfg.DownloadDir, t.Info),
+		downloadDir:    cfg.DownloadDir,
+		completedDir:   cfg.CompletedDir,
+		webSeeds:       webSeeds,
+		scheduler:      torrent.NewScheduler(picker, t.Info, 0, 0),
+		choker:         choker,
+		pieceDoneCh:    make(chan struct{}),
+		held:           make(map[int][]byte),
+		pieces:         make(map[int]*torrent.Piece),
+		peers:          make(map[*torrent.Peer]chan struct{}),
+		unverified:     make(map[int]bool),
+		hashFailures:   make(map[string]int),
+		banned:         make(map[string]bool),
+		speedHistory:   utils.NewRing[SpeedSample](speedHistorySize),
+		downLimiter:    utils.NewRateLimiter(0),
+		upLimiter:      utils.NewRateLimiter(0),
+		cfg:            cfg,
+		wakeCh:         make(chan struct{}, 1),
+		ctx:            ctx,
+		cancelFunc:     cancelFunc,
 	}
-	session.start()
 
 	return session, nil
 }
 
+// Files returns the torrent's files, in the order of their file indices.
+func (s *session) Files() []*torrent.File {
+	return s.torrent.Info.FileList()
+}
+
+// AddTracker registers an additional tracker with a running session. The
+// tracker is announced to right away and, like every other tracker, receives
+// the 'started' event on its first contact.
+func (s *session) AddTracker(url string) error {
+	mt, err := newManagedTracker(url, s.cfg)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	for _, existing := range s.trackers {
+		if existing.url == url {
+			s.mu.Unlock()
+			return fmt.Errorf("tracker %q already added", url)
+		}
+	}
+	s.trackers = append(s.trackers, mt)
+	s.tiers = append(s.tiers, newTrackerTier(mt))
+	s.mu.Unlock()
+
+	s.wake()
+	return nil
+}
+
+// SetPiecePriority overrides the download priority of a single piece, e.g. to
+// boost a streaming seek target. Incomplete pieces with a higher priority are
+// picked first; rarest-first applies among pieces of equal priority.
+func (s *session) SetPiecePriority(index int, prio torrent.Priority) error {
+	if index < 0 || index >= s.torrent.NumPieces() {
+		return fmt.Errorf("piece index %d out of range", index)
+	}
+
+	s.picker.SetPriority(index, prio)
+	return nil
+}
+
+// SetPieceDeadline sets the time by which a piece is needed, like a media
+// player reading just ahead of its playback position. Pieces are requested in
+// order of their nearest deadline before falling back to priority and
+// rarest-first for pieces without one. A zero deadline clears it.
+func (s *session) SetPieceDeadline(index int, deadline time.Time) error {
+	if index < 0 || index >= s.torrent.NumPieces() {
+		return fmt.Errorf("piece index %d out of range", index)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.setPieceDeadline(nil, index, deadline)
+	return nil
+}
+
+// SetFilePriority changes the download priority of a file. Every piece
+// overlapping the file is re-prioritized; a piece shared with a neighbouring
+// file takes the higher of the two priorities so that skipping one file never
+// starves the other.
+func (s *session) SetFilePriority(fileIndex int, prio torrent.Priority) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fileIndex < 0 || fileIndex >= len(s.filePriorities) {
+		return fmt.Errorf("file index %d out of range", fileIndex)
+	}
+	s.filePriorities[fileIndex] = prio
+
+	first, last := s.torrent.Info.FilePieces(fileIndex)
+	for piece := first; piece <= last; piece++ {
+		s.picker.SetPriority(piece, s.piecePriorityFromFiles(piece))
+	}
+
+	return nil
+}
+
+// SetSequential switches the session to downloading pieces in index order,
+// for streaming. Verified pieces are then also written in order: one that
+// completes ahead of an earlier wanted piece is held in memory until that
+// piece is written, so the data readable from the start of the torrent only
+// ever grows and a reader never runs into a gap. Turning it off writes the
+// held pieces right away.
+func (s *session) SetSequential(sequential bool) error {
+	s.mu.Lock()
+	s.sequential = sequential
+	s.mu.Unlock()
+
+	s.picker.SetSequential(sequential)
+	return s.flushHeld()
+}
+
+// ReadableOffset returns the number of bytes from the start of the torrent
+// that are verified and written to storage without a gap.
+func (s *session) ReadableOffset() int64 {
+	info := s.torrent.Info
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var offset int64
+	for i := 0; i < s.torrent.NumPieces(); i++ {
+		if _, held := s.held[i]; held || !s.picker.Has(i) {
+			break
+		}
+		offset += info.PieceSize(i)
+	}
+	return offset
+}
+
+// SetAlwaysActive marks the session as one the queue must never evict, e.g.
+// an important seed that shouldn't be paused when a new download needs a
+// slot.
+func (s *session) SetAlwaysActive(alwaysActive bool) {
+	s.mu.Lock()
+	s.alwaysActive = alwaysActive
+	onStateChange := s.onStateChange
+	s.mu.Unlock()
+
+	if onStateChange != nil {
+		onStateChange()
+	}
+}
+
+// Pause halts the session until Resume: it stops announcing, without telling
+// its trackers 'stopped', and disconnects and turns away peers, but keeps its
+// place in the client and its download state. The queue leaves a paused
+// session alone.
+func (s *session) Pause() {
+	s.mu.Lock()
+	paused := s.status == statusPaused
+	s.mu.Unlock()
+	if paused || s.ctx.Err() != nil {
+		return
+	}
+
+	s.halt(statusPaused)
+
+	s.mu.Lock()
+	s.queuePosition = 0
+	onStateChange := s.onStateChange
+	s.mu.Unlock()
+
+	// The session's slot is free for a queued one.
+	if onStateChange != nil {
+		onStateChange()
+	}
+}
+
+// Resume hands a paused session back to the queue, which starts it again
+// with a 'started' announce once it has a slot. A force-started or unqueued
+// session starts right away.
+func (s *session) Resume() {
+	s.mu.Lock()
+	if s.status != statusPaused {
+		s.mu.Unlock()
+		return
+	}
+	s.status = statusQueued
+	force := s.forceStart
+	onStateChange := s.onStateChange
+	s.mu.Unlock()
+
+	if force || onStateChange == nil {
+		s.start()
+	}
+	if onStateChange != nil {
+		onStateChange()
+	}
+}
+
+// SetUploadsDisabled turns download-only mode on or off for this session,
+// overriding the client-wide Config.DisableUploads. Peers are choked right away
+// when uploads are disabled. The upload counter reported to trackers stays at
+// what was actually uploaded.
+func (s *session) SetUploadsDisabled(disabled bool) {
+	s.choker.SetUploadsDisabled(disabled)
+	s.choker.Rechoke()
+}
+
+// SetRateLimits caps the torrent's download and upload rates, in bytes per
+// second, on top of any client-wide limits. Zero removes a cap. Transfers
+// already under way pick up the new rates with their next chunk.
+func (s *session) SetRateLimits(down, up int64) {
+	s.downLimiter.SetRate(down)
+	s.upLimiter.SetRate(up)
+}
+
+// RateLimits returns the torrent's download and upload rate caps in bytes per
+// second, zero where there is none.
+func (s *session) RateLimits() (down, up int64) {
+	return s.downLimiter.Rate(), s.upLimiter.Rate()
+}
+
+// SetCompletedDir sets the directory the torrent's data is moved to once it's
+// downloaded, overriding the client-wide default. An already complete torrent
+// is moved right away. An empty dir leaves the data where it is.
+func (s *session) SetCompletedDir(dir string) {
+	s.mu.Lock()
+	s.completedDir = dir
+	s.mu.Unlock()
+
+	if s.picker.Done() {
+		go s.moveCompleted()
+	}
+}
+
+// RecheckFile re-verifies the pieces overlapping a file against the data on
+// disk, e.g. after it was damaged outside of relay. Pieces that no longer
+// match are downloaded again; a completed torrent goes back to downloading if
+// any failed.
+func (s *session) RecheckFile(fileIndex int) error {
+	if fileIndex < 0 || fileIndex >= len(s.torrent.Info.FileList()) {
+		return fmt.Errorf("file index %d out of range", fileIndex)
+	}
+
+	var changed bool
+	first, last := s.torrent.Info.FilePieces(fileIndex)
+	for piece := first; piece <= last; piece++ {
+		ok := s.verifyPieceOnDisk(piece)
+		if ok == s.picker.Has(piece) {
+			continue
+		}
+
+		changed = true
+		if ok {
+			s.setHave(piece)
+		} else {
+			s.clearHave(piece)
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	s.mu.Lock()
+	if s.status == statusCompleted && !s.picker.Done() {
+		s.status = statusInProgress
+	}
+	onStateChange := s.onStateChange
+	s.mu.Unlock()
+
+	// Whether the torrent is a seed or a download may have changed.
+	if onStateChange != nil {
+		onStateChange()
+	}
+	return nil
+}
+
 /////////////// Private ///////////////
 
+// peerConnectOpts returns the options peers of the torrent are connected with,
+// dialed and accepted alike, so both count against the same caps and share
+// the same picker and choker.
+func (s *session) peerConnectOpts() *torrent.PeerConnectOpts {
+	return &torrent.PeerConnectOpts{
+		InfoHash: s.torrent.Info.Hash,
+		PeerID:   s.peerID,
+		Pieces:   int64(s.torrent.NumPieces()),
+		Picker:   s.picker,
+		IPVoter:  s.ipVoter,
+		Choker:   s.choker,
+		Policy:   s.connPolicy,
+		Slots:    s.connSlots,
+		Info:     s.torrent.Info,
+		Data:     sessionData{s},
+		Upload:   s.upLimiter,
+		ReadLimits: []*utils.RateLimiter{
+			s.downLimiter,
+			s.clientDownLimiter,
+		},
+		WriteLimits: []*utils.RateLimiter{s.clientUpLimiter},
+		Clock:       s.clock,
+		OnBlock:     s.receiveBlock,
+		OnUpload:    s.sentBlock,
+		OnUpdate:    s.wakeRequests,
+		OnPEX:       s.receivePEX,
+	}
+}
+
+// sentBlock counts a block served to a peer as uploaded.
+func (s *session) sentBlock(_ *torrent.Peer, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.uploaded += int64(n)
+}
+
+// receiveBlock adds a block a peer sent to its piece and tells the scheduler.
+// Once the piece has every block, it's verified: a valid piece is written out,
+// a corrupt one is scheduled again from scratch. Blocks of pieces we have, and
+// ones that don't fit their piece, are dropped without counting as downloaded.
+func (s *session) receiveBlock(
+	p *torrent.Peer,
+	index, begin int,
+	block []byte,
+) {
+	info := s.torrent.Info
+	if index < 0 || index >= len(info.Pieces) {
+		return
+	}
+
+	s.mu.Lock()
+	if s.picker.Has(index) {
+		s.mu.Unlock()
+		return
+	}
+	piece, ok := s.pieces[index]
+	if !ok {
+		piece = torrent.NewPiece(
+			index,
+			int(info.PieceSize(index)),
+			info.Pieces[index][:],
+			info.Verifier(),
+		)
+		s.pieces[index] = piece
+	}
+	s.mu.Unlock()
+
+	if err := piece.AddBlock(begin, block); err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.downloaded += int64(len(block))
+	s.mu.Unlock()
+	s.scheduler.Received(p, index, begin)
+	if !piece.IsComplete() {
+		return
+	}
+
+	// Only the last block's receiver goes on with the piece.
+	s.mu.Lock()
+	last := s.pieces[index] == piece
+	if last {
+		delete(s.pieces, index)
+	}
+	s.mu.Unlock()
+	if !last {
+		return
+	}
+
+	data := piece.AssembleData()
+	if !piece.Verify() {
+		slog.Warn(
+			"Piece failed verification",
+			"torrent", info.Name,
+			"piece", index,
+		)
+		s.blamePeers(s.scheduler.PieceFailed(index, data))
+		return
+	}
+	if err := s.writePiece(index, data); err != nil {
+		return
+	}
+	s.scheduler.PieceDone(index)
+}
+
+// blamePeers counts a piece that failed verification against every peer that
+// contributed blocks to it. A peer reaching hashFailBanThreshold is
+// disconnected and banned; an honest peer that shared a bad piece with it now
+// and then stays below the threshold.
+func (s *session) blamePeers(peers []*torrent.Peer) {
+	var ban []*torrent.Peer
+	s.mu.Lock()
+	for _, p := range peers {
+		host := peerHost(p.Addr)
+		s.hashFailures[host]++
+		if s.hashFailures[host] >= hashFailBanThreshold && !s.banned[host] {
+			s.banned[host] = true
+			ban = append(ban, p)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, p := range ban {
+		slog.Warn(
+			"Banning peer for sending corrupt data",
+			"torrent", s.torrent.Info.Name,
+			"addr", p.Addr,
+		)
+		p.Close()
+	}
+}
+
+// peerHost returns the IP address of a peer's host:port address, which bans
+// go by so a peer can't get around them by reconnecting from another port.
+func peerHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// sessionData reads the torrent's data from whatever storage the session
+// currently uses, so peers keep serving it after the data was moved.
+type sessionData struct {
+	s *session
+}
+
+func (d sessionData) ReadAt(p []byte, off int64) (int, error) {
+	return d.s.dataStorage().ReadAt(p, off)
+}
+
+// verifyPieceOnDisk reads a piece back from storage and reports whether it
+// matches its hash. Missing or short data counts as a mismatch.
+func (s *session) verifyPieceOnDisk(index int) bool {
+	info := s.torrent.Info
+
+	data := make([]byte, info.PieceSize(index))
+	offset := int64(index) * info.PieceLen
+	if _, err := s.dataStorage().ReadAt(data, offset); err != nil {
+		return false
+	}
+
+	return s.pieceValid(index, data)
+}
+
+// verifyExisting hashes the data already on disk and marks every piece that
+// matches as downloaded.
+func (s *session) verifyExisting() {
+	have := torrent.VerifyStorage(s.dataStorage(), s.torrent.Info)
+	for i := 0; i < s.torrent.NumPieces(); i++ {
+		if have.Has(i) {
+			s.setHave(i)
+		}
+	}
+}
+
+// resumeExisting verifies the data of a newly added torrent if any of its
+// files already exist in the download directory, e.g. from an earlier run
+// without saved state, so only what's missing is downloaded.
+func (s *session) resumeExisting() error {
+	for _, f := range s.torrent.Info.FileList() {
+		elems := append([]string{s.downloadDir}, f.Path...)
+		if _, err := os.Stat(filepath.Join(elems...)); err == nil {
+			s.verifyExisting()
+			return nil
+		}
+	}
+	return nil
+}
+
+// verifyUnverified hashes the data of the pieces in s.unverified and reports
+// whether all of them matched. Pieces that didn't are marked missing so
+// they're downloaded again.
+func (s *session) verifyUnverified() bool {
+	s.mu.Lock()
+	pieces := slices.Collect(maps.Keys(s.unverified))
+	clear(s.unverified)
+	s.mu.Unlock()
+
+	ok := true
+	for _, index := range pieces {
+		if !s.verifyPieceOnDisk(index) {
+			slog.Warn(
+				"Piece failed final verification",
+				"torrent", s.torrent.Info.Name,
+				"piece", index,
+			)
+			s.clearHave(index)
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// setHave records that we have a verified copy of the piece and counts its
+// bytes, once.
+func (s *session) setHave(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.picker.Has(index) {
+		return
+	}
+	s.picker.SetHave(index)
+	s.verified += s.torrent.Info.PieceSize(index)
+}
+
+// clearHave forgets a piece we had, so it's downloaded again.
+func (s *session) clearHave(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.unverified, index)
+	if !s.picker.Has(index) {
+		return
+	}
+	s.picker.ClearHave(index)
+	s.verified -= s.torrent.Info.PieceSize(index)
+}
+
+// pieceValid reports whether data hashes to the expected digest of the piece.
+func (s *session) pieceValid(index int, data []byte) bool {
+	info := s.torrent.Info
+	return bytes.Equal(info.Verifier().Sum(data), info.Pieces[index][:])
+}
+
+// piecePriorityFromFiles returns the highest priority among the files
+// overlapping piece. Callers must hold s.mu.
+func (s *session) piecePriorityFromFiles(piece int) torrent.Priority {
+	prio := torrent.PrioritySkip
+	for fileIndex, filePrio := range s.filePriorities {
+		first, last := s.torrent.Info.FilePieces(fileIndex)
+		if piece >= first && piece <= last {
+			prio = max(prio, filePrio)
+		}
+	}
+
+	return prio
+}
+
+func newManagedTracker(url string, cfg Config) (*managedTracker, error) {
+	trackerClient, err := newTrackerClient(url, tracker.Options{
+		Header:    cfg.trackerHeader(url),
+		LocalAddr: net.ParseIP(cfg.BindAddress),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &managedTracker{
+		url:      url,
+		client:   trackerClient,
+		interval: defaultAnnounceInterval,
+	}, nil
+}
+
+// wake nudges the announce loop without blocking if a nudge is already
+// pending.
+func (s *session) wake() {
+	select {
+	case s.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// start activates the session: it announces 'started' to its trackers and
+// keeps announcing until halted. Starting an active session is a no-op.
 func (s *session) start() {
-	go s.announceLoop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.runCancel != nil || s.ctx.Err() != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancelCause(s.ctx)
+	s.runCancel = cancel
+	s.queuePosition = 0
+	s.err = nil
+	s.status = statusInProgress
+	if s.picker.Done() {
+		s.status = statusCompleted
+	}
+	s.lastProgress = s.clock.Now()
+	s.stalled = false
+	s.announceCompleted = false
+
+	if s.cfg.PreallocateFiles && s.status == statusInProgress {
+		go s.preallocate()
+	}
+	s.choker.SetClock(s.clock)
+	s.scheduler.SetClock(s.clock)
+	s.announcing.Add(1)
+	go func() {
+		defer s.announcing.Done()
+		s.announceLoop(ctx)
+	}()
+	go s.choker.Run(ctx, s.cfg.chokeInterval())
+	go s.stallWatchdog(ctx)
+	go s.reapLoop(ctx)
+	for _, ws := range s.webSeeds {
+		go s.webSeedLoop(ctx, ws)
+	}
+	if !s.torrent.Info.IsPrivate {
+		go s.pexLoop(ctx)
+	}
+	if s.dht != nil && !s.torrent.Info.IsPrivate {
+		go s.dhtLoop(ctx)
+	}
+}
+
+// preallocate creates the torrent's files at their full size, if the storage
+// backend can, see Config.PreallocateFiles.
+func (s *session) preallocate() {
+	p, ok := s.dataStorage().(torrent.Preallocator)
+	if !ok {
+		return
+	}
+	if err := p.Preallocate(); err != nil {
+		s.fail(fmt.Errorf("failed to preallocate files: %w", err))
+	}
+}
+
+// halt deactivates the session, disconnecting its peers, and moves it into
+// status. Unless it's being paused, the trackers hear 'stopped'. Its download
+// state is preserved so it can be started again later.
+func (s *session) halt(status torrentStatus) {
+	s.mu.Lock()
+	cancel := s.runCancel
+	s.runCancel = nil
+	s.status = status
+	peers := slices.Collect(maps.Keys(s.peers))
+	s.mu.Unlock()
+
+	if cancel != nil {
+		cause := context.Canceled
+		if status == statusPaused {
+			cause = errPaused
+		}
+		cancel(cause)
+	}
+	for _, p := range peers {
+		p.Close()
+	}
+}
+
+// isActive reports whether the session is currently started.
+func (s *session) isActive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.runCancel != nil
 }
 
+// stop halts the session for good, disconnecting its peers and closing its
+// storage. It returns once the trackers heard 'stopped', or gave up on it after
+// stoppedAnnounceTimeout; a paused session tells them now.
 func (s *session) stop() {
+	s.mu.Lock()
+	paused := s.status == statusPaused
+	s.mu.Unlock()
+
+	s.halt(statusStopped)
 	s.cancelFunc()
+	if paused {
+		s.announceStopped(s.ctx)
+	}
+	s.announcing.Wait()
+
+	s.dataStorage().Close()
+}
+
+// runPeer runs a connected peer of the session, and the loop requesting blocks
+// from it, until it disconnects or the session halts. Banned peers, and any
+// peer while the session isn't active, are disconnected right away.
+func (s *session) runPeer(p *torrent.Peer) {
+	s.mu.Lock()
+	if s.runCancel == nil || s.banned[peerHost(p.Addr)] {
+		s.mu.Unlock()
+		p.Close()
+		return
+	}
+	wake := make(chan struct{}, 1)
+	s.peers[p] = wake
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go s.requestLoop(p, wake, done)
+	p.Start()
+	close(done)
+
+	s.mu.Lock()
+	delete(s.peers, p)
+	s.mu.Unlock()
 }
 
-func (s *session) announceLoop() {
-	s.broadcastAnnounce(statusStarted)
-	defer s.broadcastAnnounce(statusStopped)
+// connectPeers dials the peers the connection policy allows, best first,
+// skipping those we're connected to already or banned, and runs the ones that
+// answer. An inactive session dials no one.
+func (s *session) connectPeers(peers []*tracker.Peer) {
+	if !s.isActive() {
+		return
+	}
+
+	opts := s.peerConnectOpts()
+	if opts.Policy != nil {
+		peers = opts.Policy.Order(peers)
+	}
+
+	connected := make(map[string]bool)
+	s.mu.Lock()
+	for p := range s.peers {
+		connected[p.Addr] = true
+	}
+	banned := maps.Clone(s.banned)
+	s.mu.Unlock()
+
+	for _, rp := range peers {
+		if connected[rp.Addr()] || banned[peerHost(rp.Addr())] {
+			continue
+		}
+
+		go func() {
+			p, err := torrent.DialPeer(rp, opts)
+			if err != nil {
+				slog.Debug(
+					"Dialing peer failed",
+					"addr", rp.Addr(),
+					"error", err,
+				)
+				return
+			}
+			s.runPeer(p)
+		}()
+	}
+}
+
+// dataStorage returns the storage currently holding the torrent's data. It
+// changes when the data is moved.
+func (s *session) dataStorage() torrent.Storage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.storage
+}
+
+// fail halts the session with statusErrored, keeping err for display, and
+// lets the client hand its queue slot to another torrent. It's meant for
+// errors a retry won't fix, like a full disk, which need the user to step in.
+func (s *session) fail(err error) {
+	s.mu.Lock()
+	s.err = err
+	onStateChange := s.onStateChange
+	s.mu.Unlock()
+
+	s.halt(statusErrored)
+
+	if onStateChange != nil {
+		onStateChange()
+	}
+}
+
+// writePiece stores a verified piece and marks it complete. In sequential
+// mode the piece waits in memory until every wanted piece before it has been
+// written. If the storage rejects it, the session fails instead of dropping
+// the piece and downloading it over and over again.
+func (s *session) writePiece(index int, data []byte) error {
+	s.mu.Lock()
+	if !s.sequential {
+		s.mu.Unlock()
+		return s.storePiece(index, data)
+	}
+	s.held[index] = data
+	s.mu.Unlock()
+
+	// Counts as downloaded already, so it isn't handed out again while it
+	// waits.
+	s.setHave(index)
+	return s.flushHeld()
+}
+
+// flushHeld writes held pieces to storage in index order for as long as
+// nothing wanted is missing before the lowest one. Only one goroutine flushes
+// at a time; the others leave their pieces to it.
+func (s *session) flushHeld() error {
+	s.mu.Lock()
+	if s.flushing {
+		s.mu.Unlock()
+		return nil
+	}
+	s.flushing = true
+	s.mu.Unlock()
 
 	for {
-		var nextAnnounceTime *time.Time
 		s.mu.Lock()
+		index, data, ok := s.nextHeld()
+		if !ok {
+			s.flushing = false
+		}
+		s.mu.Unlock()
+
+		if !ok {
+			return nil
+		}
+		if err := s.storePiece(index, data); err != nil {
+			s.mu.Lock()
+			s.flushing = false
+			s.mu.Unlock()
+			return err
+		}
+	}
+}
+
+// nextHeld returns the held piece due to be written next, if any. Outside of
+// sequential mode every held piece is due. Callers must hold s.mu.
+func (s *session) nextHeld() (int, []byte, bool) {
+	if len(s.held) == 0 {
+		return 0, nil, false
+	}
+
+	index := -1
+	for i := range s.held {
+		if index == -1 || i < index {
+			index = i
+		}
+	}
+
+	if s.sequential {
+		for i := 0; i < index; i++ {
+			if s.picker.Wanted(i) && !s.picker.Has(i) {
+				return 0, nil, false
+			}
+		}
+	}
+	return index, s.held[index], true
+}
+
+// storePiece writes a verified piece to storage and marks it complete.
+func (s *session) storePiece(index int, data []byte) error {
+	err := torrent.WritePiece(s.dataStorage(), s.torrent.Info, index, data)
+	if err != nil {
+		err = fmt.Errorf("failed to write piece %d: %w", index, err)
+		s.fail(err)
+		return err
+	}
+
+	s.pieceCompleted(index)
+	return nil
+}
+
+// pieceCompleted records a verified piece and wakes up readers waiting on it.
+// Once every piece is in and verified the torrent completes, which its
+// trackers are told with 'completed'.
+func (s *session) pieceCompleted(index int) {
+	s.setHave(index)
+
+	s.mu.Lock()
+	delete(s.held, index)
+	close(s.pieceDoneCh)
+	s.pieceDoneCh = make(chan struct{})
+	s.lastProgress = s.clock.Now()
+	s.stalled = false
+
+	finished := s.status == statusInProgress && s.picker.Done() &&
+		len(s.held) == 0
+	peers := slices.Collect(maps.Keys(s.peers))
+	s.mu.Unlock()
+
+	for _, p := range peers {
+		if err := p.SendHave(index); err != nil {
+			slog.Debug("Sending have failed", "addr", p.Addr, "error", err)
+		}
+	}
+
+	// Never seed data that wasn't hashed; whatever fails is downloaded
+	// again before the torrent completes.
+	if finished && !s.verifyUnverified() {
+		return
+	}
+
+	s.mu.Lock()
+	finished = finished && s.status == statusInProgress
+	if finished {
+		s.status = statusCompleted
+		s.announceCompleted = true
+	}
+	onStateChange := s.onStateChange
+	s.mu.Unlock()
+
+	if finished {
+		s.wake()
+	}
+	if finished && onStateChange != nil {
+		onStateChange()
+	}
+	if finished {
+		go s.moveCompleted()
+	}
+}
+
+// moveCompleted moves the data of a complete torrent to its completed
+// directory, if it has one, and switches storage over to the new location so
+// seeding carries on from there. The session is in statusMoving meanwhile. A
+// failed move leaves the data where it was and the session errored.
+func (s *session) moveCompleted() {
+	s.mu.Lock()
+	src, dst := s.downloadDir, s.completedDir
+	if dst == "" || dst == src || s.status == statusMoving {
+		s.mu.Unlock()
+		return
+	}
+	prevStatus := s.status
+	s.status = statusMoving
+	s.moved = 0
+	s.mu.Unlock()
+
+	err := torrent.MoveFiles(s.torrent.Info, src, dst, func(moved int64) {
+		s.mu.Lock()
+		s.moved = moved
+		s.mu.Unlock()
+	})
+	if err != nil {
+		s.fail(fmt.Errorf("failed to move data to %s: %w", dst, err))
+		return
+	}
+
+	s.mu.Lock()
+	old := s.storage
+	s.storage = s.cfg.newStorage(dst, s.torrent.Info)
+	s.downloadDir = dst
+	if s.status == statusMoving {
+		s.status = prevStatus
+	}
+	s.mu.Unlock()
+
+	old.Close()
+}
+
+// stallWatchdog watches for the download getting stuck until ctx is done, see
+// checkStalled.
+func (s *session) stallWatchdog(ctx context.Context) {
+	for {
+		timer := s.clock.NewTimer(s.cfg.stallTimeout() / 4)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case now := <-timer.C():
+			s.checkStalled(now)
+		}
+	}
+}
+
+// checkStalled marks an incomplete download that hasn't completed a piece
+// within the stall timeout as stalled, e.g. because every peer chokes us or
+// sits on our requests, and tries to get it going again: trackers are asked
+// for fresh peers right away, and outstanding requests are returned to the
+// pool to be made again to whoever can serve them. It retries once per stall
+// timeout for as long as the stall lasts.
+func (s *session) checkStalled(now time.Time) {
+	timeout := s.cfg.stallTimeout()
+
+	s.mu.Lock()
+	if s.status != statusInProgress || now.Sub(s.lastProgress) < timeout ||
+		now.Sub(s.lastRecovery) < timeout {
+		s.mu.Unlock()
+		return
+	}
+	s.stalled = true
+	s.lastRecovery = now
+	since := s.lastProgress
+	s.mu.Unlock()
+
+	slog.Info(
+		"Download stalled, looking for new peers",
+		"torrent", s.torrent.Info.Name,
+		"since", since,
+	)
+	s.reannounce(false)
+	s.scheduler.ReleaseAll()
+}
+
+// reapLoop disconnects useless peers every peerReapInterval until ctx is done.
+func (s *session) reapLoop(ctx context.Context) {
+	for {
+		timer := s.clock.NewTimer(peerReapInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+			s.reapPeers()
+		}
+	}
+}
+
+// reapPeers disconnects the peers that went silent, or that snub us while we
+// want something from them, making room for peers that deliver. The blocks
+// outstanding with them go back to the pool once they're gone.
+func (s *session) reapPeers() {
+	s.mu.Lock()
+	peers := slices.Collect(maps.Keys(s.peers))
+	s.mu.Unlock()
+
+	for _, p := range peers {
+		if p.Useless(torrent.DefaultSnubTimeout) {
+			slog.Debug("Disconnecting useless peer", "addr", p.Addr)
+			p.Close()
+		}
+	}
+}
+
+// reannounce makes the announce loop announce to the active tracker of every
+// tier right away instead of waiting for their intervals. With restart set the
+// trackers are treated as never started, so they're sent 'started' again,
+// e.g. because our address changed.
+func (s *session) reannounce(restart bool) {
+	s.mu.Lock()
+	if restart {
 		for _, mt := range s.trackers {
+			mt.started = false
+		}
+	}
+	for _, tier := range s.tiers {
+		if mt := tier.active(); !mt.isAnnouncing {
+			mt.nextAnnounceTime = s.clock.Now()
+		}
+	}
+	s.mu.Unlock()
+
+	s.wake()
+}
+
+// waitPiece returns once the piece has been downloaded and verified. If block
+// is false it fails with ErrNotReady instead of waiting.
+func (s *session) waitPiece(index int, block bool) error {
+	for {
+		s.mu.Lock()
+		doneCh := s.pieceDoneCh
+		_, held := s.held[index]
+		s.mu.Unlock()
+
+		if s.picker.Has(index) && !held {
+			return nil
+		}
+		if !block {
+			return ErrNotReady
+		}
+
+		select {
+		case <-doneCh:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
+
+// waitDownload blocks until n more bytes may be downloaded under both the
+// torrent's and the client's download caps, or until ctx is done.
+func (s *session) waitDownload(ctx context.Context, n int) error {
+	if err := s.downLimiter.WaitN(ctx, n); err != nil {
+		return err
+	}
+	if s.clientDownLimiter != nil {
+		return s.clientDownLimiter.WaitN(ctx, n)
+	}
+	return nil
+}
+
+// webSeedLoop downloads pieces from ws until nothing is left to download, the
+// run ends or the web seed turns out to be unusable. After a failed fetch the
+// web seed rests for a while, leaving its pieces to peers.
+func (s *session) webSeedLoop(ctx context.Context, ws *torrent.WebSeed) {
+	all := utils.NewBitfield(s.torrent.NumPieces())
+	for i := 0; i < s.torrent.NumPieces(); i++ {
+		all.Set(i)
+	}
+
+	var failures int
+	for ctx.Err() == nil {
+		index, ok := s.scheduler.ClaimPiece(all)
+		if !ok {
+			return
+		}
+
+		size := int(s.torrent.Info.PieceSize(index))
+		if err := s.waitDownload(ctx, size); err != nil {
+			s.scheduler.PieceDone(index)
+			return
+		}
+		err := s.fetchWebSeedPiece(ctx, ws, index)
+		s.scheduler.PieceDone(index)
+
+		if err == nil {
+			failures = 0
+			continue
+		}
+		if errors.Is(err, torrent.ErrRangeUnsupported) {
+			slog.Warn("Disabling web seed", "url", ws.URL, "error", err)
+			return
+		}
+
+		failures++
+		timer := s.clock.NewTimer(
+			webSeedRetryInterval * time.Duration(failures),
+		)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+	}
+}
+
+func (s *session) fetchWebSeedPiece(
+	ctx context.Context,
+	ws *torrent.WebSeed,
+	index int,
+) error {
+	data, err := ws.FetchPiece(ctx, index)
+	if err != nil {
+		return err
+	}
+	if !s.pieceValid(index, data) {
+		return fmt.Errorf("webseed: piece %d failed verification", index)
+	}
+
+	s.mu.Lock()
+	s.downloaded += int64(len(data))
+	s.mu.Unlock()
+
+	return s.writePiece(index, data)
+}
+
+func (s *session) announceLoop(ctx context.Context) {
+	s.broadcastAnnounce(ctx, statusStarted)
+	defer func() {
+		// A paused session quietly leaves the swarm until it's resumed.
+		if !errors.Is(context.Cause(ctx), errPaused) {
+			s.announceStopped(ctx)
+		}
+	}()
+
+	for {
+		var nextAnnounceTime *time.Time
+		s.mu.Lock()
+		for _, tier := range s.tiers {
+			mt := tier.active()
 			if !mt.isAnnouncing &&
 				(nextAnnounceTime == nil || mt.nextAnnounceTime.Before(*nextAnnounceTime)) {
 				t := mt.nextAnnounceTime
@@ -126,31 +1461,58 @@ func (s *session) announceLoop() {
 
 		waitDuration := defaultAnnounceInterval
 		if nextAnnounceTime != nil {
-			waitDuration = time.Until(*nextAnnounceTime)
+			waitDuration = nextAnnounceTime.Sub(s.clock.Now())
 		}
 
-		timer := time.NewTimer(waitDuration)
+		timer := s.clock.NewTimer(waitDuration)
 
 		select {
-		case <-s.ctx.Done():
+		case <-ctx.Done():
 			timer.Stop()
 			return
-		case <-timer.C:
-			now := time.Now()
-			s.mu.Lock()
-			for _, mt := range s.trackers {
-				if !mt.isAnnouncing &&
-					now.After(mt.nextAnnounceTime) {
-					mt.isAnnouncing = true
-					go s.announceToTracker(mt, s.status)
-				}
+		case <-s.wakeCh:
+			timer.Stop()
+		case <-timer.C():
+		}
+
+		// Every tracker hears about the completed download right away.
+		s.mu.Lock()
+		completed := s.announceCompleted
+		s.announceCompleted = false
+		s.mu.Unlock()
+		if completed {
+			s.broadcastAnnounce(ctx, statusCompleted)
+		}
+
+		now := s.clock.Now()
+		s.mu.Lock()
+		for _, tier := range s.tiers {
+			mt := tier.active()
+			if !mt.isAnnouncing && !now.Before(mt.nextAnnounceTime) {
+				mt.isAnnouncing = true
+				go s.announceToTracker(ctx, mt, statusInProgress)
 			}
-			s.mu.Unlock()
 		}
+		s.mu.Unlock()
 	}
 }
 
-func (s *session) announceToTracker(mt *managedTracker, event torrentStatus) {
+// announceStopped tells the trackers we announced to that we stopped. ctx may
+// be done already; the announces are bounded by stoppedAnnounceTimeout.
+func (s *session) announceStopped(ctx context.Context) {
+	stopCtx, cancel := context.WithTimeout(
+		context.WithoutCancel(ctx),
+		stoppedAnnounceTimeout,
+	)
+	defer cancel()
+	s.broadcastAnnounce(stopCtx, statusStopped)
+}
+
+func (s *session) announceToTracker(
+	ctx context.Context,
+	mt *managedTracker,
+	event torrentStatus,
+) {
 	defer func() {
 		s.mu.Lock()
 		mt.isAnnouncing = false
@@ -158,42 +1520,112 @@ func (s *session) announceToTracker(mt *managedTracker, event torrentStatus) {
 	}()
 
 	s.mu.Lock()
+	// A tracker that never saw us start has nothing to stop, and one that
+	// hasn't acknowledged 'started' yet must get it before anything else.
+	if !mt.started {
+		if event == statusStopped {
+			s.mu.Unlock()
+			return
+		}
+		event = statusStarted
+	}
 	req := &tracker.AnnounceParams{
 		InfoHash:   s.torrent.Info.Hash,
 		PeerID:     s.peerID,
 		Downloaded: s.downloaded,
 		Uploaded:   s.uploaded,
-		Left:       s.torrent.Size - s.downloaded,
-		Port:       6969,
+		Left:       s.torrent.Size - s.verified,
+		Port:       s.cfg.ListenPort,
 		Event:      toTrackerStatus(event),
+		DictPeers:  mt.dictPeers,
+		Key:        s.announceKey,
+		// Support, never a requirement: we take plaintext peers too.
+		SupportCrypto: s.cfg.AnnounceCrypto,
+	}
+	if s.cfg.AnnounceExternalIP && s.ipVoter != nil {
+		req.IP, _ = s.ipVoter.External()
 	}
 	s.mu.Unlock()
 
-	res, err := mt.client.Announce(s.ctx, req)
+	// Bound the announce on its own so a tracker that never answers can't
+	// keep isAnnouncing set and stall rescheduling for it.
+	announceCtx, cancel := context.WithTimeout(ctx, s.cfg.announceTimeout())
+	res, err := mt.client.Announce(announceCtx, req)
+	cancel()
+
+	// The peers of a successful announce are dialed once s.mu is released.
+	var peers []*tracker.Peer
+	defer func() {
+		if len(peers) > 0 {
+			s.connectPeers(peers)
+		}
+	}()
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// Compact peer lists are asked for first; a tracker without them is
+	// asked again right away, and from then on, for the dictionary form.
+	if errors.Is(err, tracker.ErrCompactUnsupported) && !mt.dictPeers {
+		mt.dictPeers = true
+		mt.nextAnnounceTime = s.clock.Now()
+		s.wake()
+		return
+	}
 	if err != nil {
 		mt.failures++
 		backoffInterval := mt.interval * time.Duration(mt.failures+1)
-		mt.nextAnnounceTime = time.Now().Add(backoffInterval)
+		mt.nextAnnounceTime = s.clock.Now().Add(backoffInterval)
+
+		// Another tracker of the tier may do; try it right away.
+		if next := mt.tier.failover(mt); next != nil {
+			next.nextAnnounceTime = s.clock.Now()
+			s.wake()
+		}
 		return
 	}
 
 	mt.failures = 0
+	switch event {
+	case statusStopped:
+		// The next run has to start over with 'started'.
+		mt.started = false
+	case statusStarted:
+		mt.started = true
+		fallthrough
+	default:
+		mt.tier.promote(mt)
+		peers = res.Peers
+	}
+	mt.seeders, mt.leechers = res.Seeders, res.Leechers
 	mt.interval = time.Duration(res.Interval) * time.Second
 	if mt.interval <= 0 {
 		mt.interval = defaultAnnounceInterval
 	}
-	mt.nextAnnounceTime = time.Now().Add(mt.interval)
+	// Announcing more often than the tracker allows may get us banned.
+	mt.interval = max(
+		mt.interval,
+		time.Duration(res.MinInterval)*time.Second,
+	)
+	mt.nextAnnounceTime = s.clock.Now().Add(mt.interval)
 }
 
-func (s *session) broadcastAnnounce(event torrentStatus) {
+func (s *session) broadcastAnnounce(
+	ctx context.Context,
+	event torrentStatus,
+) {
 	s.mu.Lock()
-	// Copy the slice of trackers to avoid race conditions during iteration.
-	trackers := make([]*managedTracker, len(s.trackers))
-	copy(trackers, s.trackers)
+	// Collect the trackers to avoid race conditions during iteration. Only
+	// the active tracker of each tier is started, while every tracker that
+	// was started has to hear that we stopped.
+	var trackers []*managedTracker
+	if event == statusStopped {
+		trackers = slices.Clone(s.trackers)
+	} else {
+		for _, tier := range s.tiers {
+			trackers = append(trackers, tier.active())
+		}
+	}
 	s.mu.Unlock()
 
 	var wg sync.WaitGroup
@@ -201,7 +1633,7 @@ func (s *session) broadcastAnnounce(event torrentStatus) {
 		wg.Add(1)
 		go func(tracker *managedTracker) {
 			defer wg.Done()
-			s.announceToTracker(tracker, event)
+			s.announceToTracker(ctx, tracker, event)
 		}(mt)
 	}
 	wg.Wait()
@@ -209,11 +1641,13 @@ func (s *session) broadcastAnnounce(event torrentStatus) {
 
 func toTrackerStatus(event torrentStatus) tracker.Event {
 	switch event {
+	case statusStarted:
+		return tracker.EventStarted
 	case statusStopped:
 		return tracker.EventStopped
 	case statusCompleted:
 		return tracker.EventCompleted
 	default:
-		return tracker.EventStarted
+		return tracker.EventNone
 	}
 }
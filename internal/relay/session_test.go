@@ -0,0 +1,1432 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prxssh/relay/internal/torrent"
+	"github.com/prxssh/relay/internal/tracker"
+	"github.com/prxssh/relay/internal/utils"
+)
+
+// fakeTracker records every announce it receives and answers with a fixed
+// interval, or fails with err if set. With compactUnsupported set it refuses
+// announces asking for compact peer lists. It records scrapes and answers
+// them from stats, or refuses them if stats is nil.
+type fakeTracker struct {
+	mu                 sync.Mutex
+	events             []tracker.Event
+	lastParams         tracker.AnnounceParams
+	notify             chan tracker.Event
+	err                error
+	compactUnsupported bool
+	minInterval        uint32
+	peers              []*tracker.Peer
+	stats              map[[20]byte]tracker.ScrapeStats
+	scrapes            [][][20]byte
+	// Announces take this long to arrive
+	delay time.Duration
+}
+
+func newFakeTracker() *fakeTracker {
+	return &fakeTracker{notify: make(chan tracker.Event, 16)}
+}
+
+func (f *fakeTracker) Announce(
+	ctx context.Context,
+	params *tracker.AnnounceParams,
+) (*tracker.AnnounceResponse, error) {
+	// Like a real request, an announce with a done context never arrives.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	delay := f.delay
+	f.mu.Unlock()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(delay):
+	}
+
+	f.mu.Lock()
+	f.events = append(f.events, params.Event)
+	f.lastParams = *params
+	err, minInterval, peers := f.err, f.minInterval, f.peers
+	if f.compactUnsupported && !params.DictPeers {
+		err = tracker.ErrCompactUnsupported
+	}
+	f.mu.Unlock()
+
+	select {
+	case f.notify <- params.Event:
+	default:
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tracker.AnnounceResponse{
+		Interval:    1800,
+		MinInterval: minInterval,
+		Peers:       peers,
+	}, nil
+}
+
+func (f *fakeTracker) Scrape(
+	ctx context.Context,
+	infoHashes [][20]byte,
+) (map[[20]byte]tracker.ScrapeStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.stats == nil {
+		return nil, tracker.ErrScrapeUnsupported
+	}
+	f.scrapes = append(f.scrapes, slices.Clone(infoHashes))
+	res := make(map[[20]byte]tracker.ScrapeStats)
+	for _, hash := range infoHashes {
+		if st, ok := f.stats[hash]; ok {
+			res[hash] = st
+		}
+	}
+	return res, nil
+}
+
+func (f *fakeTracker) waitEvent(t *testing.T) tracker.Event {
+	t.Helper()
+
+	select {
+	case ev := <-f.notify:
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for announce")
+		return tracker.EventNone
+	}
+}
+
+// hangingTracker never answers an announce until its context is done.
+type hangingTracker struct{}
+
+func (hangingTracker) Announce(
+	ctx context.Context,
+	params *tracker.AnnounceParams,
+) (*tracker.AnnounceResponse, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (hangingTracker) Scrape(
+	ctx context.Context,
+	infoHashes [][20]byte,
+) (map[[20]byte]tracker.ScrapeStats, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// waitFor polls cond until it holds, failing the test after two seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// useFakeTrackers makes newTrackerClient hand out the given fakes keyed by
+// announce URL for the duration of the test.
+func useFakeTrackers(t *testing.T, fakes map[string]*fakeTracker) {
+	t.Helper()
+
+	orig := newTrackerClient
+	newTrackerClient = func(
+		url string,
+		_ tracker.Options,
+	) (tracker.ITrackerProtocol, error) {
+		f, ok := fakes[url]
+		if !ok {
+			return nil, fmt.Errorf("no fake tracker for %q", url)
+		}
+		return f, nil
+	}
+	t.Cleanup(func() { newTrackerClient = orig })
+}
+
+// newTestTorrent returns a single-file torrent of two 512-byte pieces.
+func newTestTorrent(announceURLs ...string) *torrent.Torrent {
+	return &torrent.Torrent{
+		AnnounceURLs: announceURLs,
+		Info: &torrent.Info{
+			Name:     "test",
+			Length:   1024,
+			PieceLen: 512,
+			Pieces:   make([][20]byte, 2),
+		},
+		Size: 1024,
+	}
+}
+
+// newTestSession starts a session for a test torrent announcing to a single
+// fake tracker and downloading into a temporary directory.
+func newTestSession(t *testing.T, cfg Config) (*session, *fakeTracker) {
+	t.Helper()
+
+	ft := newFakeTracker()
+	useFakeTrackers(t, map[string]*fakeTracker{"http://test/announce": ft})
+
+	cfg.DownloadDir = t.TempDir()
+	s, err := newSession(
+		context.Background(),
+		[20]byte{},
+		newTestTorrent("http://test/announce"),
+		cfg,
+	)
+	if err != nil {
+		t.Fatalf("newSession: %v", err)
+	}
+	s.start()
+	t.Cleanup(s.stop)
+
+	return s, ft
+}
+
+func TestAddTrackerSendsStartedOnFirstAnnounce(t *testing.T) {
+	first, second := newFakeTracker(), newFakeTracker()
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://first/announce":  first,
+		"http://second/announce": second,
+	})
+
+	s, err := newSession(
+		context.Background(),
+		[20]byte{},
+		newTestTorrent("http://first/announce"),
+		Config{DownloadDir: t.TempDir()},
+	)
+	if err != nil {
+		t.Fatalf("newSession: %v", err)
+	}
+	s.start()
+	defer s.stop()
+
+	if ev := first.waitEvent(t); ev != tracker.EventStarted {
+		t.Fatalf("first tracker got event %q, want %q", ev, tracker.EventStarted)
+	}
+
+	if err := s.AddTracker("http://second/announce"); err != nil {
+		t.Fatalf("AddTracker: %v", err)
+	}
+	if ev := second.waitEvent(t); ev != tracker.EventStarted {
+		t.Fatalf(
+			"added tracker got event %q, want %q",
+			ev,
+			tracker.EventStarted,
+		)
+	}
+
+	if err := s.AddTracker("http://second/announce"); err == nil {
+		t.Fatal("expected error adding a duplicate tracker")
+	}
+}
+
+func TestOpenWaitsForPieces(t *testing.T) {
+	s, _ := newTestSession(t, Config{BlockingReads: false})
+
+	r, err := s.Open(0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := r.Seek(600, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+
+	buf := make([]byte, 100)
+	if _, err := r.Read(buf); !errors.Is(err, ErrNotReady) {
+		t.Fatalf("Read before download: err = %v, want ErrNotReady", err)
+	}
+
+	data := bytes.Repeat([]byte{0xAB}, 512)
+	if _, err := s.storage.WriteAt(data, 512); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	s.pieceCompleted(1)
+
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatalf("Read after download: %v", err)
+	}
+	if !bytes.Equal(buf[:n], data[88:88+n]) {
+		t.Errorf("read unexpected data")
+	}
+}
+
+func TestReadersKeepEachOthersDeadlines(t *testing.T) {
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://test/announce": newFakeTracker(),
+	})
+	s, err := newSession(
+		context.Background(),
+		[20]byte{},
+		newTestTorrent("http://test/announce"),
+		Config{DownloadDir: t.TempDir()},
+	)
+	if err != nil {
+		t.Fatalf("newSession: %v", err)
+	}
+	clock := utils.NewFakeClock(time.Unix(1000, 0))
+	s.clock = clock
+	start := clock.Now()
+
+	first, err := s.Open(0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	clock.Advance(10 * time.Second)
+	second, err := s.Open(0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Both readers want the first piece; the earlier deadline wins, and it's
+	// measured on the session's clock.
+	if got := s.picker.Deadline(0); !got.Equal(start) {
+		t.Errorf("deadline %v with two readers, want %v", got, start)
+	}
+
+	// The first reader moving on leaves the second one's deadline.
+	if _, err := first.Seek(0, io.SeekEnd); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if got := s.picker.Deadline(0); !got.Equal(clock.Now()) {
+		t.Errorf("deadline %v after a reader left, want %v", got, clock.Now())
+	}
+
+	// Neither does a reader clear a deadline set by SetPieceDeadline.
+	manual := clock.Now().Add(time.Hour)
+	if err := s.SetPieceDeadline(1, manual); err != nil {
+		t.Fatalf("SetPieceDeadline: %v", err)
+	}
+	if _, err := second.Seek(0, io.SeekEnd); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if got := s.picker.Deadline(0); !got.IsZero() {
+		t.Errorf("deadline %v once no reader wants the piece", got)
+	}
+	if got := s.picker.Deadline(1); !got.Equal(manual) {
+		t.Errorf("manual deadline %v after readers left, want %v", got, manual)
+	}
+}
+
+func TestCloseWithdrawsReaderDeadlines(t *testing.T) {
+	s, _ := newTestSession(t, Config{})
+
+	r, err := s.Open(0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if got := s.picker.Deadline(0); got.IsZero() {
+		t.Fatal("open reader set no deadline")
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	for piece := 0; piece < s.torrent.NumPieces(); piece++ {
+		if got := s.picker.Deadline(piece); !got.IsZero() {
+			t.Errorf("piece %d deadline %v after Close", piece, got)
+		}
+	}
+	if len(s.pieceDeadlines) != 0 {
+		t.Errorf("%d pieces still tracked after Close", len(s.pieceDeadlines))
+	}
+	if _, err := r.Read(make([]byte, 1)); err == nil {
+		t.Error("Read succeeded on a closed reader")
+	}
+}
+
+func TestProgressAndETA(t *testing.T) {
+	s, _ := newTestSession(t, Config{})
+
+	if got := s.Progress(); got != 0 {
+		t.Errorf("Progress = %v before download, want 0", got)
+	}
+	if got := s.ETA(); got != ETAUnknown {
+		t.Errorf("ETA = %v without a download rate, want ETAUnknown", got)
+	}
+
+	// Completing a piece twice counts it once.
+	s.pieceCompleted(0)
+	s.pieceCompleted(0)
+	if got := s.Progress(); got != 0.5 {
+		t.Errorf("Progress = %v with one of two pieces, want 0.5", got)
+	}
+	s.speedHistory.Push(SpeedSample{Time: time.Now(), Download: 256})
+	if got := s.ETA(); got != 2*time.Second {
+		t.Errorf("ETA = %v for 512 bytes at 256 B/s, want 2s", got)
+	}
+
+	s.pieceCompleted(1)
+	if got := s.Progress(); got != 1 {
+		t.Errorf("Progress = %v when complete, want 1", got)
+	}
+	if got := s.ETA(); got != ETAUnknown {
+		t.Errorf("ETA = %v when complete, want ETAUnknown", got)
+	}
+}
+
+func TestStatsReportsSpeedAndETA(t *testing.T) {
+	s, _ := newTestSession(t, Config{})
+
+	clock := utils.NewFakeClock(time.Unix(0, 0))
+	last := clock.Now()
+	// tick transfers bytes during a second, then samples the rates like the
+	// client's stats loop.
+	tick := func(down, up int) {
+		s.mu.Lock()
+		s.downloaded += int64(down)
+		s.mu.Unlock()
+		s.sentBlock(nil, up)
+
+		clock.Advance(time.Second)
+		s.sampleSpeed(clock.Now(), clock.Now().Sub(last))
+		last = clock.Now()
+	}
+
+	if stats := s.Stats(); stats.DownloadSpeed != 0 || stats.ETA != ETAUnknown {
+		t.Errorf(
+			"speed %d, ETA %v before any sample; want 0, ETAUnknown",
+			stats.DownloadSpeed,
+			stats.ETA,
+		)
+	}
+
+	for range speedWindow {
+		tick(128, 64)
+	}
+	stats := s.Stats()
+	if stats.DownloadSpeed != 128 || stats.UploadSpeed != 64 {
+		t.Errorf(
+			"speeds %d/%d, want 128/64",
+			stats.DownloadSpeed,
+			stats.UploadSpeed,
+		)
+	}
+	if stats.Uploaded != 64*speedWindow {
+		t.Errorf("uploaded %d, want %d", stats.Uploaded, 64*speedWindow)
+	}
+	// Nothing is verified yet: 1024 bytes to go at 128 B/s.
+	if stats.ETA != 8*time.Second || s.ETA() != stats.ETA {
+		t.Errorf("ETA = %v (%v), want 8s", stats.ETA, s.ETA())
+	}
+
+	// A burst is averaged over the window.
+	tick(128+256*speedWindow, 0)
+	if got := s.Stats().DownloadSpeed; got != 128+256 {
+		t.Errorf("speed after a burst = %d, want %d", got, 128+256)
+	}
+}
+
+func TestSequentialWritesPiecesInOrder(t *testing.T) {
+	s, _ := newTestSession(t, Config{BlockingReads: false})
+	if err := s.SetSequential(true); err != nil {
+		t.Fatalf("SetSequential: %v", err)
+	}
+
+	r, err := s.Open(0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := r.Seek(600, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+
+	// The second piece completes first and has to wait for the first.
+	second := bytes.Repeat([]byte{0xCD}, 512)
+	if err := s.writePiece(1, second); err != nil {
+		t.Fatalf("writePiece(1): %v", err)
+	}
+	if got := s.ReadableOffset(); got != 0 {
+		t.Fatalf("ReadableOffset() = %d with a gap, want 0", got)
+	}
+	buf := make([]byte, 100)
+	if _, err := r.Read(buf); !errors.Is(err, ErrNotReady) {
+		t.Fatalf("Read of held piece: err = %v, want ErrNotReady", err)
+	}
+	onDisk := make([]byte, 512)
+	if _, err := s.storage.ReadAt(onDisk, 512); err == nil &&
+		bytes.Equal(onDisk, second) {
+		t.Fatal("held piece written before the piece ahead of it")
+	}
+
+	if err := s.writePiece(0, bytes.Repeat([]byte{0xAB}, 512)); err != nil {
+		t.Fatalf("writePiece(0): %v", err)
+	}
+	if got := s.ReadableOffset(); got != 1024 {
+		t.Fatalf("ReadableOffset() = %d, want 1024", got)
+	}
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatalf("Read after flush: %v", err)
+	}
+	if !bytes.Equal(buf[:n], second[88:88+n]) {
+		t.Errorf("read unexpected data")
+	}
+}
+
+func TestAnnounceTimeoutBacksOffStuckTracker(t *testing.T) {
+	orig := newTrackerClient
+	newTrackerClient = func(
+		string,
+		tracker.Options,
+	) (tracker.ITrackerProtocol, error) {
+		return hangingTracker{}, nil
+	}
+	t.Cleanup(func() { newTrackerClient = orig })
+
+	s, err := newSession(
+		context.Background(),
+		[20]byte{},
+		newTestTorrent("http://stuck/announce"),
+		Config{
+			DownloadDir:     t.TempDir(),
+			AnnounceTimeout: 20 * time.Millisecond,
+		},
+	)
+	if err != nil {
+		t.Fatalf("newSession: %v", err)
+	}
+	s.start()
+	defer s.stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		mt := s.trackers[0]
+		failures, announcing := mt.failures, mt.isAnnouncing
+		next := mt.nextAnnounceTime
+		s.mu.Unlock()
+
+		if failures > 0 && !announcing {
+			if !next.After(time.Now()) {
+				t.Fatalf("stuck tracker was not backed off")
+			}
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatal("announce to a hanging tracker was never abandoned")
+}
+
+func TestAnnounceCryptoSupport(t *testing.T) {
+	for _, advertise := range []bool{false, true} {
+		_, ft := newTestSession(t, Config{AnnounceCrypto: advertise})
+
+		ft.waitEvent(t)
+		ft.mu.Lock()
+		params := ft.lastParams
+		ft.mu.Unlock()
+		if params.SupportCrypto != advertise || params.RequireCrypto {
+			t.Errorf(
+				"AnnounceCrypto %v: supportcrypto %v, requirecrypto %v",
+				advertise,
+				params.SupportCrypto,
+				params.RequireCrypto,
+			)
+		}
+	}
+}
+
+func TestAnnounceBackoffAndMinInterval(t *testing.T) {
+	ft := newFakeTracker()
+	useFakeTrackers(t, map[string]*fakeTracker{"http://test/announce": ft})
+
+	s, err := newSession(
+		context.Background(),
+		[20]byte{},
+		newTestTorrent("http://test/announce"),
+		Config{DownloadDir: t.TempDir()},
+	)
+	if err != nil {
+		t.Fatalf("newSession: %v", err)
+	}
+	clock := utils.NewFakeClock(time.Now())
+	s.clock = clock
+	mt := s.trackers[0]
+
+	// Each failure in a row waits one interval longer.
+	ft.err = errors.New("tracker down")
+	for failures := 1; failures <= 3; failures++ {
+		s.announceToTracker(context.Background(), mt, statusInProgress)
+		want := clock.Now().Add(
+			defaultAnnounceInterval * time.Duration(failures+1),
+		)
+		if !mt.nextAnnounceTime.Equal(want) {
+			t.Fatalf(
+				"after %d failures next announce at %v, want %v",
+				failures,
+				mt.nextAnnounceTime,
+				want,
+			)
+		}
+	}
+
+	// A tracker's min interval wins over a shorter interval.
+	ft.err = nil
+	ft.minInterval = 3600
+	s.announceToTracker(context.Background(), mt, statusInProgress)
+	if mt.failures != 0 || mt.interval != time.Hour {
+		t.Fatalf(
+			"failures %d, interval %v; want 0, 1h",
+			mt.failures,
+			mt.interval,
+		)
+	}
+	if want := clock.Now().Add(time.Hour); !mt.nextAnnounceTime.Equal(want) {
+		t.Errorf("next announce at %v, want %v", mt.nextAnnounceTime, want)
+	}
+}
+
+func TestStopAnnouncesStopped(t *testing.T) {
+	s, ft := newTestSession(t, Config{})
+	if ev := ft.waitEvent(t); ev != tracker.EventStarted {
+		t.Fatalf("got event %q, want %q", ev, tracker.EventStarted)
+	}
+
+	s.stop()
+	if ev := ft.waitEvent(t); ev != tracker.EventStopped {
+		t.Fatalf("got event %q on stop, want %q", ev, tracker.EventStopped)
+	}
+}
+
+func TestPauseHaltsAnnouncesUntilResume(t *testing.T) {
+	s, ft := newTestSession(t, Config{})
+	if ev := ft.waitEvent(t); ev != tracker.EventStarted {
+		t.Fatalf("got event %q, want %q", ev, tracker.EventStarted)
+	}
+
+	// Pausing leaves the swarm without 'stopped', and nothing announces while
+	// paused, not even on request.
+	s.Pause()
+	if s.isActive() || s.Stats().Status != statusPaused {
+		t.Fatalf("paused session is %q", s.Stats().Status)
+	}
+	s.Pause()
+	s.reannounce(false)
+	select {
+	case ev := <-ft.notify:
+		t.Fatalf("paused session announced %q", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.Resume()
+	if ev := ft.waitEvent(t); ev != tracker.EventStarted {
+		t.Fatalf("got event %q on resume, want %q", ev, tracker.EventStarted)
+	}
+	if !s.isActive() || s.Stats().Status != statusInProgress {
+		t.Errorf("resumed session is %q", s.Stats().Status)
+	}
+}
+
+func TestStoppingPausedSessionAnnouncesStopped(t *testing.T) {
+	s, ft := newTestSession(t, Config{})
+	if ev := ft.waitEvent(t); ev != tracker.EventStarted {
+		t.Fatalf("got event %q, want %q", ev, tracker.EventStarted)
+	}
+
+	s.Pause()
+	s.stop()
+	if ev := ft.waitEvent(t); ev != tracker.EventStopped {
+		t.Fatalf("got event %q on stop, want %q", ev, tracker.EventStopped)
+	}
+}
+
+func TestPausedSessionServesNoBlocks(t *testing.T) {
+	s, _ := newTestSession(t, Config{})
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	for i := range 2 {
+		if err := s.writePiece(i, data[i*512:(i+1)*512]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	blocks := make(chan int, 2)
+	accepted := make(chan *torrent.Peer, 1)
+	disconnected := make(chan struct{})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		lookup := func(
+			infoHash [20]byte,
+		) (*torrent.PeerConnectOpts, bool) {
+			return &torrent.PeerConnectOpts{
+				InfoHash: infoHash,
+				PeerID:   [20]byte{'l', 'e', 'e', 'c', 'h'},
+				Pieces:   2,
+				Picker:   torrent.NewPicker(2),
+				OnBlock: func(_ *torrent.Peer, index, _ int, _ []byte) {
+					blocks <- index
+				},
+			}, true
+		}
+		p, err := torrent.AcceptPeer(conn, lookup)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { p.Close() })
+		p.SetInterested(true)
+		accepted <- p
+		p.Start()
+		close(disconnected)
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	s.connectPeers([]*tracker.Peer{{IP: addr.IP, Port: uint16(addr.Port)}})
+	leech := <-accepted
+	waitFor(t, "the leecher to be unchoked", leech.CanRequest)
+
+	if err := leech.SendRequest(0, 0, 512); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-blocks:
+	case <-time.After(time.Second):
+		t.Fatal("active session didn't serve the block")
+	}
+
+	s.Pause()
+	leech.SendRequest(1, 0, 512)
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("pausing didn't disconnect the leecher")
+	}
+	select {
+	case index := <-blocks:
+		t.Fatalf("paused session served piece %d", index)
+	default:
+	}
+
+	// Peers that turn up while paused aren't run either.
+	s.connectPeers([]*tracker.Peer{{IP: addr.IP, Port: uint16(addr.Port)}})
+	time.Sleep(50 * time.Millisecond)
+	s.mu.Lock()
+	peers := len(s.peers)
+	s.mu.Unlock()
+	if peers != 0 {
+		t.Errorf("paused session runs %d peers", peers)
+	}
+}
+
+func TestStalledDownloadReannounces(t *testing.T) {
+	s, ft := newTestSession(t, Config{StallTimeout: time.Minute})
+	if ev := ft.waitEvent(t); ev != tracker.EventStarted {
+		t.Fatalf("got event %q, want %q", ev, tracker.EventStarted)
+	}
+	for announcing := true; announcing; {
+		s.mu.Lock()
+		announcing = s.trackers[0].isAnnouncing
+		s.mu.Unlock()
+	}
+
+	s.checkStalled(time.Now())
+	if got := s.Stats().Status; got != statusInProgress {
+		t.Fatalf("status = %q before the stall timeout", got)
+	}
+
+	s.checkStalled(time.Now().Add(time.Minute))
+	if got := s.Stats().Status; got != statusStalled {
+		t.Fatalf("status = %q, want %q", got, statusStalled)
+	}
+	if ev := ft.waitEvent(t); ev != tracker.EventNone {
+		t.Fatalf("got event %q, want a regular re-announce", ev)
+	}
+
+	s.pieceCompleted(0)
+	if got := s.Stats().Status; got != statusInProgress {
+		t.Errorf("status = %q after progress, want %q", got, statusInProgress)
+	}
+}
+
+func TestTrackerFallsBackToDictPeers(t *testing.T) {
+	ft := newFakeTracker()
+	ft.compactUnsupported = true
+	useFakeTrackers(t, map[string]*fakeTracker{"http://test/announce": ft})
+
+	s, err := newSession(
+		context.Background(),
+		[20]byte{},
+		newTestTorrent("http://test/announce"),
+		Config{DownloadDir: t.TempDir()},
+	)
+	if err != nil {
+		t.Fatalf("newSession: %v", err)
+	}
+	s.start()
+	defer s.stop()
+
+	// Refused, then retried right away asking for dictionaries.
+	for i := 0; i < 2; i++ {
+		if ev := ft.waitEvent(t); ev != tracker.EventStarted {
+			t.Fatalf("announce %d: event %q, want %q", i, ev, "started")
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.mu.Lock()
+		started, failures := s.trackers[0].started, s.trackers[0].failures
+		s.mu.Unlock()
+		if started {
+			if failures != 0 {
+				t.Errorf("compact refusal counted as %d failures", failures)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("tracker never accepted the dictionary announce")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	got := s.persistentState().DictPeerTrackers
+	if len(got) != 1 || got[0] != "http://test/announce" {
+		t.Errorf("persisted dict peer trackers = %v", got)
+	}
+}
+
+func TestTierPromotesWorkingTracker(t *testing.T) {
+	failing, working := newFakeTracker(), newFakeTracker()
+	failing.err = errors.New("connection refused")
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://failing/announce": failing,
+		"http://working/announce": working,
+	})
+
+	// Both trackers in one tier, the failing one first.
+	tr := newTestTorrent("http://failing/announce", "http://working/announce")
+	tr.AnnounceTiers = [][]string{tr.AnnounceURLs}
+	s, err := newSession(
+		context.Background(),
+		[20]byte{},
+		tr,
+		Config{DownloadDir: t.TempDir()},
+	)
+	if err != nil {
+		t.Fatalf("newSession: %v", err)
+	}
+	if len(s.tiers) != 1 {
+		t.Fatalf("session has %d tiers, want 1", len(s.tiers))
+	}
+	tier := s.tiers[0]
+
+	s.start()
+	defer s.stop()
+
+	if ev := failing.waitEvent(t); ev != tracker.EventStarted {
+		t.Fatalf("failing tracker got event %q, want started", ev)
+	}
+	if ev := working.waitEvent(t); ev != tracker.EventStarted {
+		t.Fatalf("working tracker got event %q, want started", ev)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.mu.Lock()
+		front, active := tier.trackers[0].url, tier.active().url
+		s.mu.Unlock()
+
+		if front == "http://working/announce" &&
+			active == "http://working/announce" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tier front = %s, active = %s", front, active)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// fullDiskStorage fails every write as if the disk were full.
+type fullDiskStorage struct{}
+
+func (fullDiskStorage) ReadAt(p []byte, off int64) (int, error) {
+	return 0, io.EOF
+}
+
+func (fullDiskStorage) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: "test", Err: syscall.ENOSPC}
+}
+
+func (fullDiskStorage) Close() error {
+	return nil
+}
+
+func TestWritePieceFailureErrorsSession(t *testing.T) {
+	s, _ := newTestSession(t, Config{})
+	s.storage = fullDiskStorage{}
+
+	err := s.writePiece(0, make([]byte, 512))
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("writePiece: err = %v, want ENOSPC", err)
+	}
+
+	if s.isActive() {
+		t.Error("session still active after a failed write")
+	}
+	if s.picker.Has(0) {
+		t.Error("piece marked as had although it was never written")
+	}
+
+	stats := s.Stats()
+	if stats.Status != statusErrored {
+		t.Errorf("status = %q, want %q", stats.Status, statusErrored)
+	}
+	if !strings.Contains(stats.Error, "no space left") {
+		t.Errorf("error = %q, want it to mention the full disk", stats.Error)
+	}
+
+	// Starting again, e.g. after the user freed up space, clears the error.
+	s.start()
+	if stats := s.Stats(); stats.Error != "" {
+		t.Errorf("error = %q after restart, want none", stats.Error)
+	}
+}
+
+func downloadDir(s *session) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.downloadDir
+}
+
+func TestCompletedTorrentMovesToCompletedDir(t *testing.T) {
+	completedDir := t.TempDir()
+	s, _ := newTestSession(t, Config{CompletedDir: completedDir})
+
+	data := bytes.Repeat([]byte{0xCD}, 512)
+	for i := 0; i < 2; i++ {
+		if err := s.writePiece(i, data); err != nil {
+			t.Fatalf("writePiece(%d): %v", i, err)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Stats().Status != statusCompleted ||
+		downloadDir(s) != completedDir {
+		if time.Now().After(deadline) {
+			t.Fatalf("data was not moved, status %q", s.Stats().Status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, err := os.Stat(filepath.Join(completedDir, "test")); err != nil {
+		t.Fatalf("moved file: %v", err)
+	}
+
+	// Seeding reads from the new location.
+	buf := make([]byte, 512)
+	if _, err := s.dataStorage().ReadAt(buf, 512); err != nil {
+		t.Fatalf("ReadAt after move: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("read unexpected data after move")
+	}
+}
+
+// TestConcurrentSessionActivity exercises announces, peer-driven piece
+// completion and stats reads at the same time. It's meant to run under -race
+// and would hang on a lock-ordering deadlock.
+func TestConcurrentSessionActivity(t *testing.T) {
+	fakes := map[string]*fakeTracker{"http://test/announce": newFakeTracker()}
+	for i := 0; i < 4; i++ {
+		fakes[fmt.Sprintf("http://extra%d/announce", i)] = newFakeTracker()
+	}
+	useFakeTrackers(t, fakes)
+
+	c, err := NewClient(Config{DownloadDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(c.Close)
+
+	s, err := newSession(
+		context.Background(),
+		c.ID,
+		newTestTorrent("http://test/announce"),
+		c.cfg,
+	)
+	if err != nil {
+		t.Fatalf("newSession: %v", err)
+	}
+	t.Cleanup(s.stop)
+	if err := c.addSession(s); err != nil {
+		t.Fatalf("addSession: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				f(i)
+			}
+		}()
+	}
+
+	// Announces
+	run(func(i int) {
+		if i < 4 {
+			s.AddTracker(fmt.Sprintf("http://extra%d/announce", i))
+		}
+		s.wake()
+	})
+	// Peer activity
+	run(func(i int) {
+		bf := fullBitfieldFor(s.torrent.NumPieces())
+		s.picker.AddPeer(bf)
+		s.picker.PeerHave(i % s.torrent.NumPieces())
+		s.picker.RemovePeer(bf)
+		if i == 25 {
+			s.writePiece(0, make([]byte, 512))
+			s.writePiece(1, make([]byte, 512))
+		}
+	})
+	// Priority changes, as from the UI or a streaming reader
+	run(func(i int) {
+		s.SetFilePriority(0, torrent.Priority(i%4))
+		s.SetPieceDeadline(i%2, time.Now().Add(time.Second))
+	})
+	// Stats reads
+	run(func(i int) {
+		s.Stats()
+		s.sampleSpeed(time.Now(), time.Second)
+		c.Torrents()
+		c.rebalance()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("concurrent session activity deadlocked")
+	}
+}
+
+func fullBitfieldFor(numPieces int) utils.Bitfield {
+	bf := utils.NewBitfield(numPieces)
+	for i := 0; i < numPieces; i++ {
+		bf.Set(i)
+	}
+	return bf
+}
+
+func TestCompletionVerifiesRestoredPieces(t *testing.T) {
+	s, ft := newTestSession(t, Config{})
+	ft.waitEvent(t)
+
+	valid := bytes.Repeat([]byte{0xAB}, 512)
+	s.torrent.Info.Pieces = [][20]byte{sha1.Sum(valid), sha1.Sum(valid)}
+
+	// Saved state claims piece 0, but its data on disk is corrupt.
+	bf := utils.NewBitfield(2)
+	bf.Set(0)
+	s.restoreHave(bf)
+	if _, err := s.dataStorage().WriteAt(make([]byte, 512), 0); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+
+	if err := s.writePiece(1, valid); err != nil {
+		t.Fatalf("writePiece(1): %v", err)
+	}
+	if got := s.Stats().Status; got != statusInProgress {
+		t.Fatalf(
+			"status = %q with a corrupt piece, want %q",
+			got,
+			statusInProgress,
+		)
+	}
+	if s.picker.Has(0) {
+		t.Fatal("corrupt piece 0 still counts as downloaded")
+	}
+
+	// Fetched again, it completes the torrent, which is announced only now.
+	if err := s.writePiece(0, valid); err != nil {
+		t.Fatalf("writePiece(0): %v", err)
+	}
+	if got := s.Stats().Status; got != statusCompleted {
+		t.Fatalf("status = %q, want %q", got, statusCompleted)
+	}
+	if ev := ft.waitEvent(t); ev != tracker.EventCompleted {
+		t.Fatalf("got event %q, want %q", ev, tracker.EventCompleted)
+	}
+}
+
+func TestReceivedBlocksAreVerifiedAndWritten(t *testing.T) {
+	s, _ := newTestSession(t, Config{})
+
+	valid := bytes.Repeat([]byte{0xAB}, 512)
+	s.torrent.Info.Pieces = [][20]byte{sha1.Sum(valid), sha1.Sum(valid)}
+
+	// A block that doesn't fit its piece isn't taken, nor counted.
+	s.receiveBlock(nil, 1, 100, make([]byte, 10))
+	if got := s.Stats().Downloaded; got != 0 {
+		t.Errorf("downloaded %d bytes of a bad block, want 0", got)
+	}
+
+	// A corrupt piece is dropped and has to be downloaded again.
+	s.receiveBlock(nil, 0, 0, make([]byte, 512))
+	if s.picker.Has(0) {
+		t.Fatal("corrupt piece counted as downloaded")
+	}
+
+	s.receiveBlock(nil, 0, 0, valid)
+	if !s.picker.Has(0) {
+		t.Fatal("valid piece not counted as downloaded")
+	}
+	got := make([]byte, 512)
+	if _, err := s.dataStorage().ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+	if !bytes.Equal(got, valid) {
+		t.Error("piece wasn't written to storage")
+	}
+	if got := s.Stats().Downloaded; got != 1024 {
+		t.Errorf("downloaded %d bytes, want 1024", got)
+	}
+}
+
+// listenSeed accepts one connection on a loopback port for a torrent with
+// the given metainfo and data, unchokes the peer and serves its requests. The
+// accepted peer is sent on the returned channel.
+func listenSeed(
+	t *testing.T,
+	info *torrent.Info,
+	data []byte,
+) (*tracker.Peer, <-chan *torrent.Peer) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	picker := torrent.NewPicker(len(info.Pieces))
+	for i := range info.Pieces {
+		picker.SetHave(i)
+	}
+	accepted := make(chan *torrent.Peer, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		lookup := func(
+			infoHash [20]byte,
+		) (*torrent.PeerConnectOpts, bool) {
+			return &torrent.PeerConnectOpts{
+				InfoHash: infoHash,
+				PeerID:   [20]byte{'s', 'e', 'e', 'd'},
+				Pieces:   int64(len(info.Pieces)),
+				Picker:   picker,
+				Info:     info,
+				Data:     bytes.NewReader(data),
+			}, true
+		}
+		p, err := torrent.AcceptPeer(conn, lookup)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { p.Close() })
+		accepted <- p
+		p.SetChoking(false)
+		p.Start()
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return &tracker.Peer{IP: addr.IP, Port: uint16(addr.Port)}, accepted
+}
+
+func TestSessionDownloadsFromPeer(t *testing.T) {
+	s, _ := newTestSession(t, Config{})
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	info := s.torrent.Info
+	info.Pieces = [][20]byte{sha1.Sum(data[:512]), sha1.Sum(data[512:])}
+
+	addr, accepted := listenSeed(t, info, data)
+	s.connectPeers([]*tracker.Peer{addr})
+	waitFor(t, "the download", func() bool {
+		return s.picker.Has(0) && s.picker.Has(1)
+	})
+
+	// The seed is told about every piece we completed.
+	seed := <-accepted
+	waitFor(t, "the seed to learn our pieces", func() bool {
+		return seed.Stats().Pieces == 2
+	})
+
+	got := make([]byte, len(data))
+	if _, err := s.dataStorage().ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded data doesn't match the seed's")
+	}
+	if got := s.Stats().Downloaded; got != int64(len(data)) {
+		t.Errorf("downloaded %d bytes, want %d", got, len(data))
+	}
+}
+
+func TestSessionBansPeerSendingCorruptData(t *testing.T) {
+	s, _ := newTestSession(t, Config{})
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	info := s.torrent.Info
+	info.Pieces = [][20]byte{sha1.Sum(data[:512]), sha1.Sum(data[512:])}
+
+	// The seed serves data that matches none of the hashes.
+	addr, _ := listenSeed(t, info, bytes.Repeat([]byte{0xEE}, 1024))
+	s.connectPeers([]*tracker.Peer{addr})
+
+	waitFor(t, "the peer to be banned", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.banned[addr.IP.String()] && len(s.peers) == 0
+	})
+	s.mu.Lock()
+	failures := s.hashFailures[addr.IP.String()]
+	s.mu.Unlock()
+	if failures < hashFailBanThreshold {
+		t.Errorf(
+			"%d failures counted, want %d",
+			failures,
+			hashFailBanThreshold,
+		)
+	}
+	if s.picker.Has(0) || s.picker.Has(1) {
+		t.Error("corrupt piece counted as downloaded")
+	}
+}
+
+func TestSessionConnectsToAnnouncedPeers(t *testing.T) {
+	s, ft := newTestSession(t, Config{})
+	ft.waitEvent(t)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	info := s.torrent.Info
+	info.Pieces = [][20]byte{sha1.Sum(data[:512]), sha1.Sum(data[512:])}
+
+	// The next announce hands out the seed.
+	ft.mu.Lock()
+	addr, _ := listenSeed(t, info, data)
+	ft.peers = []*tracker.Peer{addr}
+	ft.mu.Unlock()
+	s.reannounce(false)
+
+	waitFor(t, "the download from the announced peer", func() bool {
+		return s.picker.Has(0) && s.picker.Has(1)
+	})
+}
+
+func TestSessionReapsSilentPeers(t *testing.T) {
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://test/announce": newFakeTracker(),
+	})
+	s, err := newSession(
+		context.Background(),
+		[20]byte{},
+		newTestTorrent("http://test/announce"),
+		Config{DownloadDir: t.TempDir()},
+	)
+	if err != nil {
+		t.Fatalf("newSession: %v", err)
+	}
+	clock := utils.NewFakeClock(time.Unix(1000, 0))
+	s.clock = clock
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	info := s.torrent.Info
+	info.Pieces = [][20]byte{sha1.Sum(data[:512]), sha1.Sum(data[512:])}
+	s.start()
+	t.Cleanup(s.stop)
+
+	addr, _ := listenSeed(t, info, data)
+	s.connectPeers([]*tracker.Peer{addr})
+	waitFor(t, "the download", func() bool {
+		return s.picker.Has(0) && s.picker.Has(1)
+	})
+	numPeers := func() int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.peers)
+	}
+
+	// The seed delivered, and we want nothing more from it; it's kept until
+	// it has been silent for too long.
+	clock.Advance(time.Minute)
+	s.reapPeers()
+	if n := numPeers(); n != 1 {
+		t.Fatalf("%d peers after a minute, want 1", n)
+	}
+
+	// The next sweep after that disconnects it.
+	clock.Advance(time.Minute)
+	waitFor(t, "the silent peer to be reaped", func() bool {
+		clock.Advance(peerReapInterval)
+		return numPeers() == 0
+	})
+}
+
+func TestRecheckFileRedownloadsCorruptPieces(t *testing.T) {
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://test/announce": newFakeTracker(),
+	})
+
+	// Piece 0 lies within file a, piece 1 spans the end of a and all of b.
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	tr := &torrent.Torrent{
+		AnnounceURLs: []string{"http://test/announce"},
+		Info: &torrent.Info{
+			Name:     "multi",
+			PieceLen: 512,
+			Pieces:   [][20]byte{sha1.Sum(data[:512]), sha1.Sum(data[512:])},
+			Files: []*torrent.File{
+				{Length: 600, Path: []string{"a"}},
+				{Length: 424, Path: []string{"b"}},
+			},
+		},
+		Size: int64(len(data)),
+	}
+
+	dir := t.TempDir()
+	s, err := newSession(
+		context.Background(),
+		[20]byte{},
+		tr,
+		Config{DownloadDir: dir},
+	)
+	if err != nil {
+		t.Fatalf("newSession: %v", err)
+	}
+	s.start()
+	t.Cleanup(s.stop)
+
+	for i := 0; i < 2; i++ {
+		if err := s.writePiece(i, data[i*512:(i+1)*512]); err != nil {
+			t.Fatalf("writePiece(%d): %v", i, err)
+		}
+	}
+	if got := s.Stats().Status; got != statusCompleted {
+		t.Fatalf("status = %q, want %q", got, statusCompleted)
+	}
+
+	// Intact file: nothing changes.
+	if err := s.RecheckFile(1); err != nil {
+		t.Fatalf("RecheckFile: %v", err)
+	}
+	if !s.picker.Has(0) || !s.picker.Has(1) {
+		t.Fatal("recheck of an intact file dropped pieces")
+	}
+
+	corrupt := bytes.Repeat([]byte{'!'}, 424)
+	path := filepath.Join(dir, "multi", "b")
+	if err := os.WriteFile(path, corrupt, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RecheckFile(1); err != nil {
+		t.Fatalf("RecheckFile: %v", err)
+	}
+	if !s.picker.Has(0) {
+		t.Error("piece outside the rechecked file was dropped")
+	}
+	if s.picker.Has(1) {
+		t.Error("corrupt piece still marked as downloaded")
+	}
+	if got := s.Stats().Status; got != statusInProgress {
+		t.Errorf("status = %q, want %q", got, statusInProgress)
+	}
+
+	if err := s.RecheckFile(2); err == nil {
+		t.Error("expected error for an out of range file")
+	}
+}
+
+func TestWebSeedDownloadsTorrent(t *testing.T) {
+	useFakeTrackers(t, map[string]*fakeTracker{
+		"http://test/announce": newFakeTracker(),
+	})
+
+	data := bytes.Repeat([]byte("webseed!"), 128)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		},
+	))
+	defer srv.Close()
+
+	tr := newTestTorrent("http://test/announce")
+	tr.URLList = []string{srv.URL + "/test"}
+	tr.Info.Pieces = [][20]byte{sha1.Sum(data[:512]), sha1.Sum(data[512:])}
+
+	dir := t.TempDir()
+	s, err := newSession(
+		context.Background(),
+		[20]byte{},
+		tr,
+		Config{DownloadDir: dir},
+	)
+	if err != nil {
+		t.Fatalf("newSession: %v", err)
+	}
+	s.start()
+	t.Cleanup(s.stop)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Stats().Status != statusCompleted {
+		if time.Now().After(deadline) {
+			t.Fatalf("download did not complete, status %q", s.Stats().Status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "test"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("downloaded data differs from the web seed's (err %v)", err)
+	}
+	if got := s.Stats().Downloaded; got != int64(len(data)) {
+		t.Errorf("downloaded = %d, want %d", got, len(data))
+	}
+}
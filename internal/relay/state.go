@@ -0,0 +1,206 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+
+	"github.com/prxssh/relay/internal/bencode"
+	"github.com/prxssh/relay/internal/dht"
+)
+
+// State is what the client persists between runs besides its Config: the
+// torrents that were added and how far along each one is, and the DHT nodes
+// it knew. It's stored as bencode, like the rest of the BitTorrent world.
+type State struct {
+	Torrents []TorrentState
+	// Good nodes of the DHT's routing table, so the next run joins the DHT
+	// without going through the bootstrap nodes
+	DHTNodes []*dht.Node
+}
+
+// TorrentState is the persisted state of a single torrent.
+type TorrentState struct {
+	// Where the torrent was added from: a .torrent path or a magnet URI
+	Source string
+	// Info hash identifying the torrent
+	InfoHash [sha1.Size]byte
+	// Directory the torrent's data lives in
+	DownloadDir string
+	// If true the user paused the torrent and it shouldn't start on load
+	Paused bool
+	// Bitfield of the pieces verified so far
+	Have []byte
+	// Announce URLs of the trackers that don't support compact peer lists
+	DictPeerTrackers []string
+}
+
+// DefaultStatePath returns where the state file lives, next to the default
+// config file.
+func DefaultStatePath() (string, error) {
+	configPath, err := DefaultConfigPath()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(filepath.Dir(configPath), "state.bencode"), nil
+}
+
+// LoadState reads the state file at path. A missing file yields an empty
+// state.
+func LoadState(path string) (State, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return State{}, nil
+	}
+	if err != nil {
+		return State{}, err
+	}
+
+	raw, err := bencode.NewUnmarshaller(bytes.NewReader(data)).Unmarshal()
+	if err != nil {
+		return State{}, fmt.Errorf("state: failed to decode %s: %w", path, err)
+	}
+
+	return decodeState(raw)
+}
+
+// SaveState atomically replaces the state file at path with state.
+func SaveState(path string, state State) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := bencode.NewMarshaller(&buf).Marshal(encodeState(state)); err != nil {
+		return fmt.Errorf("state: failed to encode: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+/////////////// Private ///////////////
+
+const (
+	keyStateTorrents     = "torrents"
+	keyStateSource       = "source"
+	keyStateInfoHash     = "info hash"
+	keyStateDownloadDir  = "download dir"
+	keyStatePaused       = "paused"
+	keyStateHave         = "have"
+	keyStateDictTrackers = "dict peer trackers"
+	keyStateDHTNodes     = "dht nodes"
+	keyStateNodeID       = "id"
+	keyStateNodeAddr     = "addr"
+)
+
+func encodeState(state State) map[string]any {
+	torrents := make([]any, 0, len(state.Torrents))
+	for _, ts := range state.Torrents {
+		paused := 0
+		if ts.Paused {
+			paused = 1
+		}
+
+		dictTrackers := make([]any, len(ts.DictPeerTrackers))
+		for i, url := range ts.DictPeerTrackers {
+			dictTrackers[i] = url
+		}
+
+		torrents = append(torrents, map[string]any{
+			keyStateSource:       ts.Source,
+			keyStateInfoHash:     string(ts.InfoHash[:]),
+			keyStateDownloadDir:  ts.DownloadDir,
+			keyStatePaused:       paused,
+			keyStateHave:         string(ts.Have),
+			keyStateDictTrackers: dictTrackers,
+		})
+	}
+
+	nodes := make([]any, len(state.DHTNodes))
+	for i, n := range state.DHTNodes {
+		nodes[i] = map[string]any{
+			keyStateNodeID:   string(n.ID[:]),
+			keyStateNodeAddr: n.Addr.String(),
+		}
+	}
+
+	return map[string]any{
+		keyStateTorrents: torrents,
+		keyStateDHTNodes: nodes,
+	}
+}
+
+func decodeState(raw any) (State, error) {
+	dict, ok := raw.(map[string]any)
+	if !ok {
+		return State{}, errors.New("state: top-level is not a dictionary")
+	}
+
+	rawTorrents, _ := dict[keyStateTorrents].([]any)
+	state := State{Torrents: make([]TorrentState, 0, len(rawTorrents))}
+
+	for i, entry := range rawTorrents {
+		td, ok := entry.(map[string]any)
+		if !ok {
+			return State{}, fmt.Errorf(
+				"state: torrent entry %d is not a dictionary",
+				i,
+			)
+		}
+
+		infoHash, _ := td[keyStateInfoHash].(string)
+		if len(infoHash) != sha1.Size {
+			return State{}, fmt.Errorf(
+				"state: torrent entry %d has an invalid info hash",
+				i,
+			)
+		}
+
+		ts := TorrentState{}
+		copy(ts.InfoHash[:], infoHash)
+		ts.Source, _ = td[keyStateSource].(string)
+		ts.DownloadDir, _ = td[keyStateDownloadDir].(string)
+		paused, _ := td[keyStatePaused].(int64)
+		ts.Paused = paused == 1
+		have, _ := td[keyStateHave].(string)
+		ts.Have = []byte(have)
+		dictTrackers, _ := td[keyStateDictTrackers].([]any)
+		for _, url := range dictTrackers {
+			if url, ok := url.(string); ok {
+				ts.DictPeerTrackers = append(ts.DictPeerTrackers, url)
+			}
+		}
+
+		state.Torrents = append(state.Torrents, ts)
+	}
+
+	// Nodes are only a head start; malformed ones are skipped.
+	rawNodes, _ := dict[keyStateDHTNodes].([]any)
+	for _, entry := range rawNodes {
+		nd, _ := entry.(map[string]any)
+		id, _ := nd[keyStateNodeID].(string)
+		addr, _ := nd[keyStateNodeAddr].(string)
+		addrPort, err := netip.ParseAddrPort(addr)
+		if len(id) != len(dht.NodeID{}) || err != nil {
+			continue
+		}
+		state.DHTNodes = append(state.DHTNodes, &dht.Node{
+			ID:   dht.NodeID([]byte(id)),
+			Addr: net.UDPAddrFromAddrPort(addrPort),
+		})
+	}
+
+	return state, nil
+}
@@ -0,0 +1,239 @@
+package relay
+
+import (
+	"crypto/sha1"
+	"time"
+
+	"github.com/prxssh/relay/internal/utils"
+)
+
+// SpeedSample is the average transfer rate over one stats tick.
+type SpeedSample struct {
+	// When the sample was taken
+	Time time.Time
+	// Download rate in bytes per second
+	Download int64
+	// Upload rate in bytes per second
+	Upload int64
+}
+
+const (
+	// Interval at which transfer rates are sampled
+	statsTickInterval = time.Second
+	// Number of samples kept for speed graphs
+	speedHistorySize = 60
+	// Number of latest samples the current speed is averaged over, which
+	// smooths out bursts
+	speedWindow = 5
+)
+
+// SessionStats is a point-in-time snapshot of a session's state, suitable for
+// display.
+type SessionStats struct {
+	// Info hash identifying the torrent
+	InfoHash [sha1.Size]byte
+	// Display name of the torrent
+	Name string
+	// Magnet link to share the torrent
+	Magnet string
+	// Current state of the torrent
+	Status torrentStatus
+	// Total number of bytes downloaded. Data that was already on disk isn't
+	// counted; see Verified.
+	Downloaded int64
+	// Bytes of the torrent we have a verified copy of, downloaded or found
+	// on disk
+	Verified int64
+	// Total number of bytes uploaded
+	Uploaded int64
+	// Download and upload rates in bytes per second, averaged over the last
+	// few stats ticks
+	DownloadSpeed int64
+	UploadSpeed   int64
+	// Estimated time until the download completes, ETAUnknown if there's
+	// no estimate
+	ETA time.Duration
+	// Best estimate of the swarm's seeders across all trackers
+	Seeders uint32
+	// Best estimate of the swarm's leechers across all trackers
+	Leechers uint32
+	// 1-based position in the client's queue, 0 if the torrent isn't queued
+	QueuePosition int
+	// Why the torrent was halted if Status is errored, empty otherwise
+	Error string
+	// Bytes moved to the completed directory so far if Status is moving
+	Moved int64
+	// Download and upload rate caps in effect for the torrent in bytes per
+	// second: the tighter of its own and the client-wide cap, zero where
+	// there is neither
+	DownloadLimit int64
+	UploadLimit   int64
+}
+
+// Stats returns a snapshot of the session's current state.
+func (s *session) Stats() SessionStats {
+	speed := s.speed()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := SessionStats{
+		InfoHash:      s.torrent.Info.Hash,
+		Name:          s.torrent.Info.Name,
+		Magnet:        s.torrent.MagnetURI(),
+		Status:        s.status,
+		Downloaded:    s.downloaded,
+		Verified:      s.verified,
+		Uploaded:      s.uploaded,
+		DownloadSpeed: speed.Download,
+		UploadSpeed:   speed.Upload,
+		ETA:           eta(s.torrent.Size-s.verified, speed.Download),
+		QueuePosition: s.queuePosition,
+		Moved:         s.moved,
+		DownloadLimit: effectiveLimit(s.downLimiter, s.clientDownLimiter),
+		UploadLimit:   effectiveLimit(s.upLimiter, s.clientUpLimiter),
+	}
+	if s.err != nil {
+		stats.Error = s.err.Error()
+	}
+	if s.status == statusInProgress && s.stalled {
+		stats.Status = statusStalled
+	}
+
+	// Trackers of the same torrent mostly see the same swarm, so summing
+	// their counts would overestimate it. The largest report is the best
+	// lower bound we have.
+	for _, mt := range s.trackers {
+		stats.Seeders = max(stats.Seeders, mt.seeders)
+		stats.Leechers = max(stats.Leechers, mt.leechers)
+	}
+
+	return stats
+}
+
+// ClientStats is a point-in-time snapshot of the client as a whole, suitable
+// for display.
+type ClientStats struct {
+	// Number of torrents the client has
+	Torrents int
+	// Nodes in the DHT's routing table, zero without a DHT
+	DHTNodes int
+}
+
+// Stats returns a snapshot of the client's current state.
+func (c *Client) Stats() ClientStats {
+	c.mu.RLock()
+	stats := ClientStats{Torrents: len(c.torrents)}
+	c.mu.RUnlock()
+
+	if c.dht != nil {
+		stats.DHTNodes = c.dht.NumNodes()
+	}
+	return stats
+}
+
+// ETAUnknown is returned by ETA when no estimate can be made.
+const ETAUnknown time.Duration = -1
+
+// Progress returns the fraction of the torrent's data we have verified, from
+// 0 to 1.
+func (s *session) Progress() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.torrent.Size <= 0 {
+		return 1
+	}
+	return float64(s.verified) / float64(s.torrent.Size)
+}
+
+// ETA estimates how long the rest of the download takes at the current
+// download rate. It's ETAUnknown while nothing is being downloaded, including
+// once the download is complete.
+func (s *session) ETA() time.Duration {
+	speed := s.speed()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return eta(s.torrent.Size-s.verified, speed.Download)
+}
+
+// SpeedHistory returns the session's recent transfer rates, oldest first, one
+// sample per stats tick.
+func (s *session) SpeedHistory() []SpeedSample {
+	return s.speedHistory.Snapshot()
+}
+
+/////////////// Private ///////////////
+
+// sampleSpeed records the transfer rate since the previous sample, elapsed
+// ago, in the session's history and returns it.
+func (s *session) sampleSpeed(now time.Time, elapsed time.Duration) SpeedSample {
+	s.mu.Lock()
+	down := s.downloaded - s.lastSampleDownloaded
+	up := s.uploaded - s.lastSampleUploaded
+	s.lastSampleDownloaded, s.lastSampleUploaded = s.downloaded, s.uploaded
+	s.mu.Unlock()
+
+	sample := SpeedSample{
+		Time:     now,
+		Download: perSecond(down, elapsed),
+		Upload:   perSecond(up, elapsed),
+	}
+	s.speedHistory.Push(sample)
+
+	return sample
+}
+
+// speed returns the session's transfer rates averaged over the last
+// speedWindow samples, zero before the first one.
+func (s *session) speed() SpeedSample {
+	history := s.speedHistory.Snapshot()
+	window := history[max(len(history)-speedWindow, 0):]
+	if len(window) == 0 {
+		return SpeedSample{}
+	}
+
+	var sum SpeedSample
+	for _, sample := range window {
+		sum.Download += sample.Download
+		sum.Upload += sample.Upload
+	}
+	return SpeedSample{
+		Time:     window[len(window)-1].Time,
+		Download: sum.Download / int64(len(window)),
+		Upload:   sum.Upload / int64(len(window)),
+	}
+}
+
+// effectiveLimit returns the tighter of a torrent's rate cap and the
+// client-wide one, which may be nil, zero standing for no cap.
+func effectiveLimit(own, client *utils.RateLimiter) int64 {
+	limit := own.Rate()
+	if client == nil {
+		return limit
+	}
+	if global := client.Rate(); limit == 0 || global > 0 && global < limit {
+		limit = global
+	}
+	return limit
+}
+
+// eta is how long remaining bytes take at rate bytes per second, ETAUnknown
+// if nothing remains or nothing is being transferred.
+func eta(remaining, rate int64) time.Duration {
+	if remaining <= 0 || rate <= 0 {
+		return ETAUnknown
+	}
+
+	seconds := float64(remaining) / float64(rate)
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func perSecond(bytes int64, elapsed time.Duration) int64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(bytes) / elapsed.Seconds())
+}
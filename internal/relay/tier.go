@@ -0,0 +1,55 @@
+package relay
+
+import "slices"
+
+// trackerTier is a group of interchangeable trackers from one tier of the
+// announce-list (BEP 12). Only one of them is announced to at a time. They
+// are tried in order until one works, which is then moved to the front of
+// the tier so it's tried first from then on.
+type trackerTier struct {
+	trackers []*managedTracker
+	// Index of the tracker currently announced to
+	current int
+}
+
+func newTrackerTier(trackers ...*managedTracker) *trackerTier {
+	tier := &trackerTier{trackers: trackers}
+	for _, mt := range trackers {
+		mt.tier = tier
+	}
+	return tier
+}
+
+// The methods below expect the caller to hold the session's lock.
+
+// active returns the tracker currently announced to.
+func (t *trackerTier) active() *managedTracker {
+	return t.trackers[t.current]
+}
+
+// promote moves mt, which just answered an announce, to the front of the
+// tier and makes it the active tracker.
+func (t *trackerTier) promote(mt *managedTracker) {
+	i := slices.Index(t.trackers, mt)
+	if i < 0 {
+		return
+	}
+
+	t.trackers = slices.Insert(slices.Delete(t.trackers, i, i+1), 0, mt)
+	t.current = 0
+}
+
+// failover moves on from mt, the active tracker, after it failed. It returns
+// the tracker to try next, or nil once every tracker of the tier failed in
+// turn, in which case the tier starts over from the front after its backoff.
+func (t *trackerTier) failover(mt *managedTracker) *managedTracker {
+	if t.active() != mt {
+		return nil
+	}
+
+	t.current = (t.current + 1) % len(t.trackers)
+	if t.current == 0 {
+		return nil
+	}
+	return t.active()
+}
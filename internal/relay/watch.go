@@ -0,0 +1,109 @@
+package relay
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// watchInterval is how often Config.WatchDir is scanned for new .torrent
+// files.
+const watchInterval = 5 * time.Second
+
+// watchProcessedDir is the subdirectory of Config.WatchDir added .torrent
+// files are moved to, unless they're deleted.
+const watchProcessedDir = "processed"
+
+/////////////// Private ///////////////
+
+// watchLoop adds the .torrent files dropped into Config.WatchDir on every
+// watchInterval tick, if a watch directory is configured.
+func (c *Client) watchLoop() {
+	if c.cfg.WatchDir == "" {
+		return
+	}
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	// Files that failed to add, with their modification time, so they're
+	// only tried again once they change, e.g. when they were still being
+	// written.
+	failed := make(map[string]time.Time)
+	c.scanWatchDir(failed)
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.scanWatchDir(failed)
+		}
+	}
+}
+
+// scanWatchDir adds every .torrent file in Config.WatchDir, then moves it to
+// the processed subdirectory or deletes it, see Config.WatchDeleteProcessed.
+// A torrent the client already has counts as added.
+func (c *Client) scanWatchDir(failed map[string]time.Time) {
+	entries, err := os.ReadDir(c.cfg.WatchDir)
+	if err != nil {
+		slog.Debug(
+			"Scanning watch directory failed",
+			"dir", c.cfg.WatchDir,
+			"error", err,
+		)
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() ||
+			!strings.EqualFold(filepath.Ext(entry.Name()), ".torrent") {
+			continue
+		}
+		path := filepath.Join(c.cfg.WatchDir, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if modTime, ok := failed[path]; ok && modTime.Equal(info.ModTime()) {
+			continue
+		}
+
+		_, err = c.AddTorrentFile(path)
+		if err != nil && !errors.Is(err, ErrTorrentExists) {
+			slog.Warn(
+				"Adding watched torrent failed",
+				"path", path,
+				"error", err,
+			)
+			failed[path] = info.ModTime()
+			continue
+		}
+		delete(failed, path)
+
+		if err := c.finishWatched(path); err != nil {
+			slog.Warn(
+				"Clearing watched torrent failed",
+				"path", path,
+				"error", err,
+			)
+		}
+	}
+}
+
+// finishWatched moves an added .torrent file out of the watch directory, or
+// deletes it, so it isn't added again.
+func (c *Client) finishWatched(path string) error {
+	if c.cfg.WatchDeleteProcessed {
+		return os.Remove(path)
+	}
+
+	dir := filepath.Join(c.cfg.WatchDir, watchProcessedDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.Rename(path, filepath.Join(dir, filepath.Base(path)))
+}
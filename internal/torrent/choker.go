@@ -0,0 +1,319 @@
+package torrent
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prxssh/relay/internal/utils"
+)
+
+const (
+	// DefaultUnchokeSlots is the number of peers unchoked for their upload
+	// rate unless configured otherwise.
+	DefaultUnchokeSlots = 4
+	// DefaultRechokeInterval is how often the choker reconsiders who to
+	// unchoke.
+	DefaultRechokeInterval = 10 * time.Second
+	// DefaultOptimisticUnchokeInterval is how long the optimistic unchoke
+	// lasts before it moves on to another peer.
+	DefaultOptimisticUnchokeInterval = 30 * time.Second
+	// defaultOptimisticRounds is the number of rechoke rounds the optimistic
+	// unchoke lasts with the default intervals.
+	defaultOptimisticRounds = 3
+)
+
+// Choker decides which peers we upload to, following the tit-for-tat
+// algorithm of BEP 3. Every rechoke round the interested peers that sent us
+// the most data since the previous round get the regular unchoke slots. One
+// more peer is unchoked optimistically regardless of what it gave us, so new
+// peers get a chance to prove themselves; that slot rotates every few rounds,
+// favouring peers that only just became interested. Seeds never need
+// anything from us and are left choked, and so are peers that went silent.
+// Peers that snub us, see Peer.Snubbed, can still earn a regular slot but are
+// passed over for the optimistic one. On top of that the number of unchoked
+// peers can be capped, per torrent and across torrents with UploadSlots; the
+// optimistic unchoke is the first to go when the cap is hit.
+//
+// Its lock is taken after session.mu and before Peer.writeMu.
+type Choker struct {
+	mu    sync.Mutex
+	slots int
+	// Connected peers in the order they were added
+	peers []*Peer
+	// Bytes received from each peer as of the previous round
+	lastReceived map[*Peer]int64
+	optimistic   *Peer
+	round        int
+	// Number of rounds the optimistic unchoke lasts
+	optimisticRounds int
+	// Peers that became interested since the optimistic slot was last
+	// assigned, first come first served
+	fresh []*Peer
+	// Most peers unchoked at once, the optimistic unchoke included; zero
+	// means no cap
+	maxUploads int
+	// Slots shared with the chokers of other torrents; may be nil
+	shared *UploadSlots
+	// If true every peer is kept choked
+	uploadsDisabled bool
+	// Times the rechoke rounds of Run
+	clock utils.Clock
+}
+
+func NewChoker(slots int) *Choker {
+	if slots <= 0 {
+		slots = DefaultUnchokeSlots
+	}
+
+	return &Choker{
+		slots:            slots,
+		lastReceived:     make(map[*Peer]int64),
+		optimisticRounds: defaultOptimisticRounds,
+		clock:            utils.RealClock,
+	}
+}
+
+// SetClock makes Run time its rounds on clock instead of the real time. It
+// takes effect with the next Run.
+func (c *Choker) SetClock(clock utils.Clock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.clock = clock
+}
+
+// SetOptimisticRounds makes the optimistic unchoke move on to another peer
+// every n rechoke rounds. Values below one are treated as one.
+func (c *Choker) SetOptimisticRounds(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.optimisticRounds = max(n, 1)
+}
+
+// SetMaxUploads caps the number of peers unchoked at once. Zero removes the
+// cap. It takes effect with the next round.
+func (c *Choker) SetMaxUploads(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxUploads = max(n, 0)
+}
+
+// SetUploadsDisabled keeps every peer choked while disabled is true, so
+// nothing is uploaded. It takes effect with the next round.
+func (c *Choker) SetUploadsDisabled(disabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.uploadsDisabled = disabled
+}
+
+// ShareUploadSlots makes the choker take its unchoked peers out of slots
+// shared with other torrents. A nil u stops sharing.
+func (c *Choker) ShareUploadSlots(u *UploadSlots) {
+	c.mu.Lock()
+	prev := c.shared
+	c.shared = u
+	c.mu.Unlock()
+
+	if prev != nil && prev != u {
+		prev.release(c)
+	}
+}
+
+// AddPeer puts a connected peer under the choker's control. Peers start out
+// choked.
+func (c *Choker) AddPeer(p *Peer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !slices.Contains(c.peers, p) {
+		c.peers = append(c.peers, p)
+	}
+}
+
+// RemovePeer forgets a peer that disconnected.
+func (c *Choker) RemovePeer(p *Peer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.peers = slices.DeleteFunc(c.peers, func(q *Peer) bool { return q == p })
+	c.fresh = slices.DeleteFunc(c.fresh, func(q *Peer) bool { return q == p })
+	delete(c.lastReceived, p)
+	if c.optimistic == p {
+		c.optimistic = nil
+	}
+}
+
+// PeerInterested is called when p tells us it became interested. If the
+// optimistic slot is free, or held by a peer that lost interest, p gets it
+// right away instead of waiting for the next round.
+func (c *Choker) PeerInterested(p *Peer) error {
+	c.mu.Lock()
+	if !slices.Contains(c.peers, p) || c.optimistic == p ||
+		p.Snubbed(DefaultSnubTimeout) {
+		c.mu.Unlock()
+		return nil
+	}
+
+	busy := c.optimistic != nil && c.optimistic.Stats().PeerInterested
+	if !busy {
+		unchoked := c.unchoked()
+		busy = unchoked >= c.uploadLimit(unchoked+1)
+	}
+	if busy {
+		if !slices.Contains(c.fresh, p) {
+			c.fresh = append(c.fresh, p)
+		}
+		c.mu.Unlock()
+		return nil
+	}
+
+	c.optimistic = p
+	c.mu.Unlock()
+
+	return p.SetChoking(false)
+}
+
+// Rechoke runs one round of the choking algorithm.
+func (c *Choker) Rechoke() {
+	c.mu.Lock()
+
+	type candidate struct {
+		peer    *Peer
+		rate    int64
+		snubbed bool
+	}
+	var candidates []candidate
+	for _, p := range c.peers {
+		stats := p.Stats()
+		rate := stats.Received - c.lastReceived[p]
+		c.lastReceived[p] = stats.Received
+
+		if stats.PeerInterested && !stats.IsSeed && p.Alive() {
+			candidates = append(candidates, candidate{
+				p,
+				rate,
+				p.Snubbed(DefaultSnubTimeout),
+			})
+		}
+	}
+
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		return cmp.Compare(b.rate, a.rate)
+	})
+	var unchoke, eligible []*Peer
+	for i, cand := range candidates {
+		if i < c.slots {
+			unchoke = append(unchoke, cand.peer)
+		} else if !cand.snubbed {
+			eligible = append(eligible, cand.peer)
+		}
+	}
+
+	if c.round%c.optimisticRounds == 0 ||
+		!slices.Contains(eligible, c.optimistic) {
+		c.optimistic = c.pickOptimistic(eligible)
+	}
+	if c.optimistic != nil {
+		unchoke = append(unchoke, c.optimistic)
+	}
+	unchoke = unchoke[:c.uploadLimit(len(unchoke))]
+	c.round++
+
+	peers := slices.Clone(c.peers)
+	c.mu.Unlock()
+
+	for _, p := range peers {
+		p.SetChoking(!slices.Contains(unchoke, p))
+	}
+}
+
+// Run rechokes every interval, as told by the choker's clock, until ctx is
+// done, then gives up the choker's shared upload slots.
+func (c *Choker) Run(ctx context.Context, interval time.Duration) {
+	c.mu.Lock()
+	clock := c.clock
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		shared := c.shared
+		c.mu.Unlock()
+
+		if shared != nil {
+			shared.release(c)
+		}
+	}()
+
+	for {
+		timer := clock.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+			c.Rechoke()
+		}
+	}
+}
+
+/////////////// Private ///////////////
+
+// The helpers below expect the caller to hold c.mu.
+
+// uploadLimit returns how many of want peers may be unchoked, going by the
+// per-torrent cap and the choker's share of the shared slots.
+func (c *Choker) uploadLimit(want int) int {
+	limit := want
+	if c.uploadsDisabled {
+		limit = 0
+	}
+	if c.maxUploads > 0 {
+		limit = min(limit, c.maxUploads)
+	}
+	if c.shared != nil {
+		limit = c.shared.grant(c, limit)
+	}
+	return limit
+}
+
+// unchoked returns the number of peers currently unchoked.
+func (c *Choker) unchoked() int {
+	var n int
+	for _, p := range c.peers {
+		if !p.Stats().AmChoking {
+			n++
+		}
+	}
+	return n
+}
+
+// pickOptimistic chooses the next optimistic unchoke among eligible peers:
+// the longest waiting newly interested peer, otherwise the next one after the
+// current pick in connection order.
+func (c *Choker) pickOptimistic(eligible []*Peer) *Peer {
+	if len(eligible) == 0 {
+		return nil
+	}
+
+	for i, p := range c.fresh {
+		if slices.Contains(eligible, p) {
+			c.fresh = slices.Delete(c.fresh, i, i+1)
+			return p
+		}
+	}
+
+	start := slices.Index(c.peers, c.optimistic) + 1
+	for i := range c.peers {
+		p := c.peers[(start+i)%len(c.peers)]
+		if p != c.optimistic && slices.Contains(eligible, p) {
+			return p
+		}
+	}
+	return eligible[0]
+}
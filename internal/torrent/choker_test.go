@@ -0,0 +1,247 @@
+package torrent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prxssh/relay/internal/utils"
+)
+
+// chokerPeer returns a peer managed by c that is missing every piece.
+func chokerPeer(t *testing.T, c *Choker) (*Peer, <-chan *message) {
+	t.Helper()
+
+	p, sent := pipePeer(t, 4, nil)
+	p.choker = c
+	c.AddPeer(p)
+	return p, sent
+}
+
+func TestChokerUnchokesInterestedPeer(t *testing.T) {
+	c := NewChoker(1)
+
+	// The regular slot goes to the peer we received the most from.
+	top, topSent := chokerPeer(t, c)
+	for _, msg := range []*message{
+		{id: msgInterested},
+		messagePiece(0, 0, make([]byte, BlockSize)),
+	} {
+		if err := top.handleMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectMessage(t, topSent, msgUnchoke)
+	c.Rechoke()
+	if top.Stats().AmChoking {
+		t.Fatal("top uploader is choked")
+	}
+
+	// A peer turning interested takes the free optimistic slot right away.
+	first, firstSent := chokerPeer(t, c)
+	if err := first.handleMessage(&message{id: msgInterested}); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, firstSent, msgUnchoke)
+
+	// With both slots taken the next one waits for the optimistic unchoke
+	// to rotate, and is first in line when it does.
+	late, lateSent := chokerPeer(t, c)
+	idle, _ := chokerPeer(t, c)
+	if err := late.handleMessage(&message{id: msgInterested}); err != nil {
+		t.Fatal(err)
+	}
+	if !late.Stats().AmChoking {
+		t.Fatal("late peer unchoked while both slots are taken")
+	}
+
+	for i := 0; i < defaultOptimisticRounds; i++ {
+		c.Rechoke()
+	}
+	expectMessage(t, lateSent, msgUnchoke)
+	expectMessage(t, firstSent, msgChoke)
+
+	if top.Stats().AmChoking {
+		t.Fatal("top uploader lost its regular slot")
+	}
+	if !idle.Stats().AmChoking {
+		t.Fatal("uninterested peer unchoked")
+	}
+}
+
+func TestChokerPassesOverSnubbingPeers(t *testing.T) {
+	c := NewChoker(1)
+	clock := utils.NewFakeClock(time.Now())
+
+	top, topSent := chokerPeer(t, c)
+	for _, msg := range []*message{
+		{id: msgInterested},
+		messagePiece(0, 0, make([]byte, BlockSize)),
+	} {
+		if err := top.handleMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectMessage(t, topSent, msgUnchoke)
+
+	// A peer with pieces we want that hasn't sent us any for a while.
+	snubbing, sent := pipePeer(t, 4, NewPicker(4))
+	snubbing.setClock(clock)
+	snubbing.choker = c
+	c.AddPeer(snubbing)
+	if err := snubbing.handleMessage(messageHave(0)); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, sent, msgInterested)
+	clock.Advance(DefaultSnubTimeout + time.Second)
+
+	if err := snubbing.handleMessage(&message{id: msgInterested}); err != nil {
+		t.Fatal(err)
+	}
+	c.Rechoke()
+	if !snubbing.Stats().AmChoking {
+		t.Fatal("snubbing peer got the optimistic unchoke")
+	}
+
+	// Delivering again puts it back in line.
+	msg := messagePiece(0, 0, make([]byte, BlockSize))
+	if err := snubbing.handleMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	c.Rechoke()
+	expectMessage(t, sent, msgUnchoke)
+
+	// A peer that went silent isn't unchoked at all.
+	clock.Advance(peerLivenessTimeout)
+	c.Rechoke()
+	expectMessage(t, sent, msgChoke)
+}
+
+func TestChokerChokesPeerThatLostInterest(t *testing.T) {
+	c := NewChoker(1)
+
+	p, sent := chokerPeer(t, c)
+	if err := p.handleMessage(&message{id: msgInterested}); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, sent, msgUnchoke)
+
+	if err := p.handleMessage(&message{id: msgNotInterested}); err != nil {
+		t.Fatal(err)
+	}
+	c.Rechoke()
+	expectMessage(t, sent, msgChoke)
+}
+
+func TestChokerRunRechokesOnClock(t *testing.T) {
+	c := NewChoker(1)
+	clock := utils.NewFakeClock(time.Now())
+	c.SetClock(clock)
+
+	p, sent := chokerPeer(t, c)
+	if err := p.handleMessage(&message{id: msgInterested}); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, sent, msgUnchoke)
+	if err := p.handleMessage(&message{id: msgNotInterested}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx, DefaultRechokeInterval)
+
+	// The peer that lost interest is choked once a round has passed.
+	waitFor(t, "the rechoke timer", func() bool { return clock.Timers() == 1 })
+	clock.Advance(DefaultRechokeInterval - time.Second)
+	select {
+	case msg := <-sent:
+		t.Fatalf("sent message %v before the round was due", msg)
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	expectMessage(t, sent, msgChoke)
+}
+
+func TestChokerRespectsMaxUploads(t *testing.T) {
+	c := NewChoker(4)
+	c.SetMaxUploads(1)
+
+	first, firstSent := chokerPeer(t, c)
+	second, _ := chokerPeer(t, c)
+	for _, p := range []*Peer{first, second} {
+		if err := p.handleMessage(&message{id: msgInterested}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectMessage(t, firstSent, msgUnchoke)
+
+	c.Rechoke()
+	var unchoked int
+	for _, p := range []*Peer{first, second} {
+		if !p.Stats().AmChoking {
+			unchoked++
+		}
+	}
+	if unchoked != 1 {
+		t.Errorf("%d peers unchoked, want 1", unchoked)
+	}
+}
+
+func TestChokerUploadsDisabled(t *testing.T) {
+	c := NewChoker(1)
+	c.SetUploadsDisabled(true)
+
+	p, sent := chokerPeer(t, c)
+	if err := p.handleMessage(&message{id: msgInterested}); err != nil {
+		t.Fatal(err)
+	}
+	c.Rechoke()
+	if !p.Stats().AmChoking {
+		t.Fatal("peer unchoked with uploads disabled")
+	}
+
+	c.SetUploadsDisabled(false)
+	c.Rechoke()
+	expectMessage(t, sent, msgUnchoke)
+}
+
+func TestUploadSlotsShareFairly(t *testing.T) {
+	testCases := []struct {
+		name   string
+		max    int
+		demand []int
+		want   []int
+	}{
+		{"equal demand", 4, []int{10, 10}, []int{2, 2}},
+		{"unused share goes to others", 4, []int{10, 1}, []int{3, 1}},
+		{"enough for everyone", 8, []int{2, 3}, []int{2, 3}},
+		{"fewer slots than torrents", 1, []int{2, 2}, []int{1, 0}},
+		{"idle torrent", 3, []int{5, 0}, []int{3, 0}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u := NewUploadSlots(tc.max)
+			chokers := make([]*Choker, len(tc.demand))
+			for i, want := range tc.demand {
+				chokers[i] = NewChoker(0)
+				u.grant(chokers[i], want)
+			}
+
+			u.mu.Lock()
+			alloc := u.allocate()
+			u.mu.Unlock()
+			for i, c := range chokers {
+				if alloc[c] != tc.want[i] {
+					t.Errorf(
+						"torrent %d got %d slots, want %d",
+						i,
+						alloc[c],
+						tc.want[i],
+					)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package torrent
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prxssh/relay/internal/tracker"
+)
+
+const (
+	// recentSuccessWindow is how long a peer we connected to keeps being
+	// dialed ahead of the others.
+	recentSuccessWindow = time.Hour
+	// maxRecentSuccesses bounds the memory spent remembering good peers;
+	// further successes replace an arbitrary earlier one.
+	maxRecentSuccesses = 1000
+)
+
+// ConnectPolicy decides which peers are dialed, and in which order. Peers in
+// an avoided range are never dialed. Of the rest, peers we recently connected
+// to come first, then, if preferred, those that advertised encryption
+// support. It's safe for concurrent use and meant to be shared by all
+// torrents.
+type ConnectPolicy struct {
+	preferEncrypted bool
+	avoid           []*net.IPNet
+
+	mu sync.Mutex
+	// When we last connected to each peer, keyed by address
+	succeeded map[string]time.Time
+	now       func() time.Time
+}
+
+func NewConnectPolicy(preferEncrypted bool, avoid []*net.IPNet) *ConnectPolicy {
+	return &ConnectPolicy{
+		preferEncrypted: preferEncrypted,
+		avoid:           avoid,
+		succeeded:       make(map[string]time.Time),
+		now:             time.Now,
+	}
+}
+
+// Allowed reports whether p may be dialed. Peers known only by host name are
+// allowed, since their address isn't known until they're resolved.
+func (cp *ConnectPolicy) Allowed(p *tracker.Peer) bool {
+	if p.IP == nil {
+		return true
+	}
+
+	return !slices.ContainsFunc(cp.avoid, func(r *net.IPNet) bool {
+		return r.Contains(p.IP)
+	})
+}
+
+// Order returns the peers that may be dialed, best first. The order among
+// equally good peers is kept.
+func (cp *ConnectPolicy) Order(peers []*tracker.Peer) []*tracker.Peer {
+	allowed := slices.DeleteFunc(slices.Clone(peers), func(p *tracker.Peer) bool {
+		return !cp.Allowed(p)
+	})
+
+	cp.mu.Lock()
+	now := cp.now()
+	rank := func(p *tracker.Peer) int {
+		r := 0
+		if at, ok := cp.succeeded[p.Addr()]; ok &&
+			now.Sub(at) < recentSuccessWindow {
+			r -= 2
+		}
+		if cp.preferEncrypted && p.SupportsCrypto {
+			r--
+		}
+		return r
+	}
+	slices.SortStableFunc(allowed, func(a, b *tracker.Peer) int {
+		return cmp.Compare(rank(a), rank(b))
+	})
+	cp.mu.Unlock()
+
+	return allowed
+}
+
+// Succeeded records that we connected to the peer at addr.
+func (cp *ConnectPolicy) Succeeded(addr string) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if _, ok := cp.succeeded[addr]; !ok &&
+		len(cp.succeeded) >= maxRecentSuccesses {
+		for evicted := range cp.succeeded {
+			delete(cp.succeeded, evicted)
+			break
+		}
+	}
+	cp.succeeded[addr] = cp.now()
+}
+
+// ParseIPRanges reads a list of IP ranges, one per line, as CIDR prefixes
+// ("10.0.0.0/8") or single addresses. Blank lines and lines starting with '#'
+// are skipped.
+func ParseIPRanges(r io.Reader) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if !strings.Contains(line, "/") {
+			ip := net.ParseIP(line)
+			if ip == nil {
+				return nil, fmt.Errorf(
+					"line %d: invalid address %q",
+					lineNum,
+					line,
+				)
+			}
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			ranges = append(ranges, &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(bits, bits),
+			})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		ranges = append(ranges, ipNet)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return ranges, nil
+}
@@ -0,0 +1,69 @@
+package torrent
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/prxssh/relay/internal/tracker"
+)
+
+func TestParseIPRanges(t *testing.T) {
+	ranges, err := ParseIPRanges(strings.NewReader(`
+# Some ISP
+192.0.2.0/24
+203.0.113.9
+2001:db8::/32
+`))
+	if err != nil {
+		t.Fatalf("ParseIPRanges: %v", err)
+	}
+	if len(ranges) != 3 {
+		t.Fatalf("got %d ranges, want 3", len(ranges))
+	}
+
+	for _, tc := range []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.2.200", true},
+		{"203.0.113.9", true},
+		{"203.0.113.10", false},
+		{"2001:db8::1", true},
+		{"198.51.100.1", false},
+	} {
+		ip := net.ParseIP(tc.ip)
+		got := slices.ContainsFunc(ranges, func(r *net.IPNet) bool {
+			return r.Contains(ip)
+		})
+		if got != tc.want {
+			t.Errorf("%s in ranges = %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+
+	if _, err := ParseIPRanges(strings.NewReader("10.0.0.0/33")); err == nil {
+		t.Error("expected an error for an invalid prefix")
+	}
+}
+
+func TestConnectPolicyOrder(t *testing.T) {
+	_, avoided, _ := net.ParseCIDR("192.0.2.0/24")
+	cp := NewConnectPolicy(true, []*net.IPNet{avoided})
+
+	peer := func(ip string, crypto bool) *tracker.Peer {
+		return &tracker.Peer{IP: net.ParseIP(ip), Port: 6881, SupportsCrypto: crypto}
+	}
+	plain := peer("198.51.100.1", false)
+	bad := peer("192.0.2.5", true)
+	encrypted := peer("198.51.100.2", true)
+	known := peer("198.51.100.3", false)
+	named := &tracker.Peer{Host: "peer.example.org", Port: 6881}
+	cp.Succeeded(known.Addr())
+
+	got := cp.Order([]*tracker.Peer{plain, bad, encrypted, named, known})
+	want := []*tracker.Peer{known, encrypted, plain, named}
+	if !slices.Equal(got, want) {
+		t.Errorf("Order = %v, want %v", got, want)
+	}
+}
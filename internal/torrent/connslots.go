@@ -0,0 +1,73 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"sync"
+)
+
+// ErrConnLimit is returned when connecting to or accepting a peer would exceed
+// a connection cap.
+var ErrConnLimit = errors.New("peer: connection limit reached")
+
+// ConnSlots caps the number of peer connections, across all torrents and per
+// torrent. Inbound and outbound connections draw on the same slots, so
+// neither direction can crowd the other out of the caps.
+//
+// Its lock is never held while taking another.
+type ConnSlots struct {
+	mu sync.Mutex
+	// Most connections overall and per torrent; zero means no cap
+	max           int
+	maxPerTorrent int
+	total         int
+	perTorrent    map[[sha1.Size]byte]int
+}
+
+func NewConnSlots(max, maxPerTorrent int) *ConnSlots {
+	return &ConnSlots{
+		max:           max,
+		maxPerTorrent: maxPerTorrent,
+		perTorrent:    make(map[[sha1.Size]byte]int),
+	}
+}
+
+// Count returns the number of connections overall and of the torrent with
+// infoHash.
+func (cs *ConnSlots) Count(infoHash [sha1.Size]byte) (total, torrent int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	return cs.total, cs.perTorrent[infoHash]
+}
+
+/////////////// Private ///////////////
+
+// acquire takes a slot for a connection of the torrent with infoHash, or
+// reports false if either cap is reached.
+func (cs *ConnSlots) acquire(infoHash [sha1.Size]byte) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.max > 0 && cs.total >= cs.max {
+		return false
+	}
+	if cs.maxPerTorrent > 0 && cs.perTorrent[infoHash] >= cs.maxPerTorrent {
+		return false
+	}
+
+	cs.total++
+	cs.perTorrent[infoHash]++
+	return true
+}
+
+// release gives back a slot taken by acquire.
+func (cs *ConnSlots) release(infoHash [sha1.Size]byte) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.total--
+	if cs.perTorrent[infoHash]--; cs.perTorrent[infoHash] <= 0 {
+		delete(cs.perTorrent, infoHash)
+	}
+}
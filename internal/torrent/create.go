@@ -0,0 +1,236 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prxssh/relay/internal/bencode"
+)
+
+// CreateOpts configures how a new torrent is created.
+type CreateOpts struct {
+	// Tracker announce URLs, each placed in its own tier
+	AnnounceURLs []string
+	// Free-form comment (optional)
+	Comment string
+	// Name and version of the creating program (optional)
+	CreatedBy string
+	// Number of bytes in each piece, a power of two of at least BlockSize.
+	// Zero picks one from the total size with RecommendedPieceLength.
+	PieceLength int64
+	// Marks the torrent private (BEP 27): peers must only be found through
+	// its trackers, never through DHT or peer exchange. It's part of the
+	// info dictionary and so changes the info hash.
+	Private bool
+}
+
+const (
+	// Bounds of the piece lengths RecommendedPieceLength picks
+	minPieceLength = BlockSize
+	maxPieceLength = 16 * 1024 * 1024
+	// Most pieces RecommendedPieceLength aims for
+	targetMaxPieces = 2000
+)
+
+// RecommendedPieceLength picks a piece length for a torrent of totalSize
+// bytes. Fewer, larger pieces keep the metainfo and per-piece overhead small;
+// more, smaller pieces can be verified and shared sooner. It aims for 1000 to
+// 2000 pieces: the smallest power of two that splits totalSize into at most
+// 2000 pieces, clamped to between 16 KiB and 16 MiB. Small torrents hence get
+// fewer pieces and huge ones more.
+func RecommendedPieceLength(totalSize int64) int64 {
+	pieceLen := int64(minPieceLength)
+	for pieceLen < maxPieceLength &&
+		(totalSize+pieceLen-1)/pieceLen > targetMaxPieces {
+		pieceLen *= 2
+	}
+	return pieceLen
+}
+
+// Create builds a torrent for the file or directory at root and writes its
+// bencoded metainfo to w. Directories become multi-file torrents holding every
+// regular file below them, in lexical path order.
+func Create(w io.Writer, root string, opts CreateOpts) error {
+	root = filepath.Clean(root)
+
+	pieceLen := opts.PieceLength
+	if pieceLen != 0 && (pieceLen < BlockSize || pieceLen&(pieceLen-1) != 0) {
+		return fmt.Errorf(
+			"create: piece length %d is not a power of two >= %d",
+			pieceLen,
+			BlockSize,
+		)
+	}
+
+	files, err := collectFiles(root)
+	if err != nil {
+		return err
+	}
+	if pieceLen == 0 {
+		var totalSize int64
+		for _, f := range files {
+			totalSize += f.length
+		}
+		pieceLen = RecommendedPieceLength(totalSize)
+	}
+
+	pieces, err := hashFiles(files, pieceLen)
+	if err != nil {
+		return err
+	}
+
+	info := map[string]any{
+		"name":         filepath.Base(root),
+		"piece length": pieceLen,
+		"pieces":       pieces,
+	}
+	if opts.Private {
+		info["private"] = int64(1)
+	}
+
+	if len(files) == 1 && files[0].rel == nil {
+		info["length"] = files[0].length
+	} else {
+		list := make([]any, len(files))
+		for i, f := range files {
+			path := make([]any, len(f.rel))
+			for j, elem := range f.rel {
+				path[j] = elem
+			}
+			list[i] = map[string]any{"length": f.length, "path": path}
+		}
+		info["files"] = list
+	}
+
+	metainfo := map[string]any{
+		"info":          info,
+		"creation date": time.Now().Unix(),
+	}
+	if len(opts.AnnounceURLs) > 0 {
+		metainfo["announce"] = opts.AnnounceURLs[0]
+
+		tiers := make([]any, len(opts.AnnounceURLs))
+		for i, u := range opts.AnnounceURLs {
+			tiers[i] = []any{u}
+		}
+		metainfo["announce-list"] = tiers
+	}
+	if opts.Comment != "" {
+		metainfo["comment"] = opts.Comment
+	}
+	if opts.CreatedBy != "" {
+		metainfo["created by"] = opts.CreatedBy
+	}
+
+	return bencode.NewMarshaller(w).Marshal(metainfo)
+}
+
+/////////////// Private ///////////////
+
+// sourceFile is a file on disk that goes into a new torrent.
+type sourceFile struct {
+	path   string
+	length int64
+	// Path elements relative to the torrent root; nil for a single file
+	rel []string
+}
+
+func collectFiles(root string) ([]*sourceFile, error) {
+	st, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !st.IsDir() {
+		return []*sourceFile{{path: root, length: st.Size()}}, nil
+	}
+
+	var files []*sourceFile
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, &sourceFile{
+			path:   path,
+			length: info.Size(),
+			rel:    strings.Split(filepath.ToSlash(rel), "/"),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New("create: directory contains no files")
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].path < files[j].path
+	})
+
+	return files, nil
+}
+
+// hashFiles hashes the concatenated contents of files in pieceLen chunks and
+// returns the concatenated SHA1 digests.
+func hashFiles(files []*sourceFile, pieceLen int64) (string, error) {
+	verifier := VerifierFor(PieceHashesV1)
+	buf := make([]byte, pieceLen)
+	pieces := make([]byte, 0)
+	filled := 0
+
+	for _, sf := range files {
+		f, err := os.Open(sf.path)
+		if err != nil {
+			return "", err
+		}
+
+		for {
+			n, err := io.ReadFull(f, buf[filled:])
+			filled += n
+
+			if filled == len(buf) {
+				pieces = append(pieces, verifier.Sum(buf)...)
+				filled = 0
+			}
+
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return "", err
+			}
+		}
+
+		f.Close()
+	}
+
+	if filled > 0 {
+		pieces = append(pieces, verifier.Sum(buf[:filled])...)
+	}
+
+	return string(pieces), nil
+}
@@ -0,0 +1,150 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateRoundTrip(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "album")
+
+	a := bytes.Repeat([]byte{'a'}, BlockSize+100)
+	b := bytes.Repeat([]byte{'b'}, 300)
+	writeTestFile(t, filepath.Join(root, "a.bin"), a)
+	writeTestFile(t, filepath.Join(root, "sub", "b.bin"), b)
+
+	var buf bytes.Buffer
+	err := Create(&buf, root, CreateOpts{
+		AnnounceURLs: []string{"http://tracker/announce"},
+		Comment:      "test",
+		PieceLength:  BlockSize,
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	tr, err := New(&buf)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if tr.Info.Name != "album" {
+		t.Errorf("name = %q, want %q", tr.Info.Name, "album")
+	}
+	if tr.Comment != "test" {
+		t.Errorf("comment = %q, want %q", tr.Comment, "test")
+	}
+	if tr.Size != int64(len(a)+len(b)) {
+		t.Errorf("size = %d, want %d", tr.Size, len(a)+len(b))
+	}
+	if len(tr.Info.Files) != 2 {
+		t.Fatalf("got %d files, want 2", len(tr.Info.Files))
+	}
+	if got := filepath.Join(tr.Info.Files[1].Path...); got != "sub/b.bin" {
+		t.Errorf("second file path = %q, want %q", got, "sub/b.bin")
+	}
+
+	// The second piece spans the end of a.bin and all of b.bin.
+	data := append(append([]byte{}, a...), b...)
+	if tr.NumPieces() != 2 {
+		t.Fatalf("got %d pieces, want 2", tr.NumPieces())
+	}
+	for i, want := range [][]byte{data[:BlockSize], data[BlockSize:]} {
+		if tr.Info.Pieces[i] != sha1.Sum(want) {
+			t.Errorf("piece %d hash mismatch", i)
+		}
+	}
+}
+
+func TestCreateRejectsBadPieceLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	writeTestFile(t, path, []byte("data"))
+
+	for _, pieceLen := range []int64{BlockSize + 1, BlockSize / 2} {
+		var buf bytes.Buffer
+		err := Create(&buf, path, CreateOpts{PieceLength: pieceLen})
+		if err == nil {
+			t.Errorf("piece length %d: expected error", pieceLen)
+		}
+	}
+}
+
+func TestCreatePrivate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	writeTestFile(t, path, []byte("data"))
+
+	create := func(private bool) *Torrent {
+		t.Helper()
+
+		var buf bytes.Buffer
+		err := Create(&buf, path, CreateOpts{
+			AnnounceURLs: []string{"http://tracker/announce"},
+			Private:      private,
+		})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		tr, err := New(&buf)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		return tr
+	}
+
+	private := create(true)
+	if !private.Info.IsPrivate {
+		t.Error("IsPrivate = false, want true")
+	}
+	if again := create(true); again.Info.Hash != private.Info.Hash {
+		t.Error("info hash of the same private torrent changed")
+	}
+	if public := create(false); public.Info.Hash == private.Info.Hash {
+		t.Error("private flag doesn't change the info hash")
+	}
+}
+
+func TestRecommendedPieceLength(t *testing.T) {
+	const (
+		kib = 1024
+		mib = 1024 * kib
+		gib = 1024 * mib
+	)
+
+	testCases := []struct {
+		size int64
+		want int64
+	}{
+		{0, 16 * kib},
+		{1 * mib, 16 * kib},
+		{32 * mib, 32 * kib},
+		{100 * mib, 64 * kib},
+		{1 * gib, 1 * mib},
+		{4 * gib, 4 * mib},
+		{100 * gib, 16 * mib},
+	}
+
+	for _, tc := range testCases {
+		if got := RecommendedPieceLength(tc.size); got != tc.want {
+			t.Errorf(
+				"RecommendedPieceLength(%d) = %d, want %d",
+				tc.size,
+				got,
+				tc.want,
+			)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/prxssh/relay/internal/bencode"
+)
+
+// Extension protocol (BEP 10). Support is signalled by a bit in the reserved
+// bytes of the handshake, after which both sides exchange an extended
+// handshake dictionary.
+
+const (
+	// msgExtended carries every extension message; the first payload byte is
+	// the extended message id, 0 being the extended handshake.
+	msgExtended messageid = 20
+
+	extHandshakeID = 0
+
+	// Reserved byte and bit signalling support for the extension protocol
+	extReservedByte = 5
+	extReservedBit  = 0x10
+)
+
+const (
+	// DefaultPeerReqq is the number of outstanding requests we assume a peer
+	// accepts when it doesn't advertise reqq, libtorrent's default.
+	DefaultPeerReqq = 250
+	// maxPeerReqq caps what a peer may ask us to keep outstanding, so a
+	// bogus reqq can't make us queue unbounded requests.
+	maxPeerReqq = 2048
+	// localReqq is the number of outstanding requests from a peer we're
+	// willing to queue, advertised in our extended handshake.
+	localReqq = 250
+)
+
+// extHandshake holds the fields of an extended handshake we care about.
+type extHandshake struct {
+	// Extended message ids the peer assigned to each extension it supports
+	m map[string]int64
+	// Number of outstanding requests the peer accepts, zero if not given
+	reqq int
+	// Client name and version, e.g. "relay 0.1"
+	version string
+	// Address the sender sees the receiver connecting from
+	yourIP net.IP
+	// Port the sender listens for connections on, zero if not given
+	port int
+	// Size of the info dictionary the sender can serve over ut_metadata,
+	// zero if not given
+	metadataSize int64
+}
+
+// messageExtHandshake returns our extended handshake.
+func messageExtHandshake(h *extHandshake) (*message, error) {
+	m := make(map[string]any, len(h.m))
+	for name, id := range h.m {
+		m[name] = id
+	}
+	dict := map[string]any{"m": m}
+	if h.reqq > 0 {
+		dict["reqq"] = int64(h.reqq)
+	}
+	if h.version != "" {
+		dict["v"] = h.version
+	}
+	if ip := compactIP(h.yourIP); ip != nil {
+		dict["yourip"] = string(ip)
+	}
+	if h.port > 0 {
+		dict["p"] = int64(h.port)
+	}
+	if h.metadataSize > 0 {
+		dict["metadata_size"] = h.metadataSize
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(extHandshakeID)
+	if err := bencode.NewMarshaller(&buf).Marshal(dict); err != nil {
+		return nil, err
+	}
+
+	return &message{id: msgExtended, payload: buf.Bytes()}, nil
+}
+
+// parseExtHandshake decodes the payload of an extended handshake, after the
+// extended message id. Unknown and malformed optional keys are ignored, as
+// BEP 10 asks.
+func parseExtHandshake(payload []byte) (*extHandshake, error) {
+	raw, err := bencode.NewUnmarshaller(bytes.NewReader(payload)).Unmarshal()
+	if err != nil {
+		return nil, fmt.Errorf("extended handshake: %w", err)
+	}
+	dict, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf(
+			"extended handshake: expected dictionary, got %T",
+			raw,
+		)
+	}
+
+	h := &extHandshake{m: make(map[string]int64)}
+	if m, ok := dict["m"].(map[string]any); ok {
+		for name, v := range m {
+			if id, ok := v.(int64); ok {
+				h.m[name] = id
+			}
+		}
+	}
+	if reqq, ok := dict["reqq"].(int64); ok && reqq > 0 {
+		h.reqq = int(min(reqq, maxPeerReqq))
+	}
+	h.version, _ = dict["v"].(string)
+	if yourIP, ok := dict["yourip"].(string); ok &&
+		(len(yourIP) == net.IPv4len || len(yourIP) == net.IPv6len) {
+		h.yourIP = net.IP(yourIP)
+	}
+	if port, ok := dict["p"].(int64); ok && port > 0 && port <= 65535 {
+		h.port = int(port)
+	}
+	if size, ok := dict["metadata_size"].(int64); ok && size > 0 {
+		h.metadataSize = size
+	}
+
+	return h, nil
+}
+
+// compactIP returns ip in its 4-byte form if it's an IPv4 address, as
+// 'yourip' expects.
+func compactIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
@@ -0,0 +1,83 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestHandshakeAdvertisesExtensions(t *testing.T) {
+	h := newHandshake([20]byte{1}, [20]byte{2})
+
+	got, err := readHanshake(bytes.NewReader(h.serialize()))
+	if err != nil {
+		t.Fatalf("readHandshake: %v", err)
+	}
+	if !got.supportsExtensions() {
+		t.Error("extension protocol bit lost in the round trip")
+	}
+	if !got.supportsFast() {
+		t.Error("fast extension bit lost in the round trip")
+	}
+	if got.reserved[fastReservedByte] != 0x04 {
+		t.Errorf("reserved byte 7 is %#x, want 0x04", got.reserved[7])
+	}
+}
+
+func TestPeerHonoursReqq(t *testing.T) {
+	testCases := []struct {
+		name string
+		reqq int
+		want int
+	}{
+		{"advertised", 3, 3},
+		{"absent", 0, DefaultPeerReqq},
+		{"capped", 1 << 20, maxPeerReqq},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ext, err := messageExtHandshake(&extHandshake{
+				m:    map[string]int64{"ut_metadata": 3},
+				reqq: tc.reqq,
+			})
+			if err != nil {
+				t.Fatalf("messageExtHandshake: %v", err)
+			}
+
+			p := schedulerPeer(t, 1)
+			if err := p.handleMessage(ext); err != nil {
+				t.Fatalf("handleMessage: %v", err)
+			}
+			if got := p.MaxRequests(); got != tc.want {
+				t.Errorf("MaxRequests = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPeerVotesForYourIP(t *testing.T) {
+	yourIP := net.ParseIP("203.0.113.7")
+	voter := NewIPVoter()
+
+	for i := 0; i < minIPVotes; i++ {
+		ext, err := messageExtHandshake(&extHandshake{yourIP: yourIP})
+		if err != nil {
+			t.Fatalf("messageExtHandshake: %v", err)
+		}
+		if n := len(ext.payload); n > 64 {
+			t.Fatalf("handshake of %d bytes, yourip not compact", n)
+		}
+
+		p := schedulerPeer(t, 1)
+		p.Addr = net.JoinHostPort(net.IPv4(10, 0, 0, byte(i)).String(), "6881")
+		p.ipVoter = voter
+		if err := p.handleMessage(ext); err != nil {
+			t.Fatalf("handleMessage: %v", err)
+		}
+	}
+
+	if ip, ok := voter.External(); !ok || !ip.Equal(yourIP) {
+		t.Errorf("External = %v, %v; want %v", ip, ok, yourIP)
+	}
+}
@@ -4,22 +4,56 @@ import (
 	"crypto/sha1"
 	"errors"
 	"io"
+	"time"
 )
 
 type handshake struct {
 	pstr     string
+	reserved [szReservedBytes]byte
 	infoHash [sha1.Size]byte
 	peerID   [sha1.Size]byte
 }
 
-const szReservedBytes = 8
+const (
+	szReservedBytes = 8
+	protocolString  = "BitTorrent protocol"
+
+	// Reserved byte and bit signalling support for the fast extension
+	fastReservedByte = 7
+	fastReservedBit  = 0x04
+)
+
+// handshakeTimeout bounds the whole handshake, so a peer that stalls part way
+// through can't hold on to the connection. It's a variable so tests don't
+// have to wait that long.
+var handshakeTimeout = 3 * time.Second
+
+// errBadProtocol is returned for a handshake that doesn't start with the
+// BitTorrent protocol string, e.g. some other protocol or random garbage.
+var errBadProtocol = errors.New("handshake: not the BitTorrent protocol")
 
 func newHandshake(infoHash, peerID [sha1.Size]byte) *handshake {
-	return &handshake{
-		pstr:     "BitTorrent protocol",
+	h := &handshake{
+		pstr:     protocolString,
 		infoHash: infoHash,
 		peerID:   peerID,
 	}
+	h.reserved[extReservedByte] |= extReservedBit
+	h.reserved[fastReservedByte] |= fastReservedBit
+
+	return h
+}
+
+// supportsExtensions reports whether the sender supports the extension
+// protocol (BEP 10).
+func (h *handshake) supportsExtensions() bool {
+	return h.reserved[extReservedByte]&extReservedBit != 0
+}
+
+// supportsFast reports whether the sender supports the fast extension
+// (BEP 6).
+func (h *handshake) supportsFast() bool {
+	return h.reserved[fastReservedByte]&fastReservedBit != 0
 }
 
 func (h *handshake) serialize() []byte {
@@ -29,7 +63,7 @@ func (h *handshake) serialize() []byte {
 	buf[0] = byte(len(h.pstr))
 	offset := 1
 	offset += copy(buf[offset:], []byte(h.pstr))
-	offset += copy(buf[offset:], make([]byte, szReservedBytes))
+	offset += copy(buf[offset:], h.reserved[:])
 	offset += copy(buf[offset:], h.infoHash[:])
 	offset += copy(buf[offset:], h.peerID[:])
 
@@ -43,27 +77,39 @@ func readHanshake(r io.Reader) (*handshake, error) {
 		return nil, err
 	}
 
+	// Anything but the one protocol we speak is rejected before reading
+	// more of it.
 	pstrlen := sizeBuf[0]
-	if pstrlen == 0 {
-		return nil, errors.New("pstrlen can't be 0")
+	if int(pstrlen) != len(protocolString) {
+		return nil, errBadProtocol
+	}
+	pstr := make([]byte, pstrlen)
+	if _, err := io.ReadFull(r, pstr); err != nil {
+		return nil, err
+	}
+	if string(pstr) != protocolString {
+		return nil, errBadProtocol
 	}
 
-	handshakeBuf := make([]byte, 48+pstrlen)
+	handshakeBuf := make([]byte, 48)
 	if _, err := io.ReadFull(r, handshakeBuf); err != nil {
 		return nil, err
 	}
 
+	var reserved [szReservedBytes]byte
 	var infoHash, peerID [sha1.Size]byte
 
-	// <pstrlen><pstr><reserved><info_hash><peer_id>
+	// <reserved><info_hash><peer_id>
+	copy(reserved[:], handshakeBuf[:szReservedBytes])
 	copy(
 		infoHash[:],
-		handshakeBuf[pstrlen+szReservedBytes:pstrlen+szReservedBytes+sha1.Size],
+		handshakeBuf[szReservedBytes:szReservedBytes+sha1.Size],
 	)
-	copy(peerID[:], handshakeBuf[pstrlen+szReservedBytes+sha1.Size:])
+	copy(peerID[:], handshakeBuf[szReservedBytes+sha1.Size:])
 
 	return &handshake{
-		pstr:     string(handshakeBuf[0:pstrlen]),
+		pstr:     protocolString,
+		reserved: reserved,
 		infoHash: infoHash,
 		peerID:   peerID,
 	}, nil
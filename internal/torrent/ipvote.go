@@ -0,0 +1,83 @@
+package torrent
+
+import (
+	"net"
+	"sync"
+)
+
+const (
+	// minIPVotes is the number of peers that have to agree on our address
+	// before it's believed.
+	minIPVotes = 3
+	// maxIPVoters bounds the memory spent on votes; further voters replace
+	// an arbitrary earlier one.
+	maxIPVoters = 1000
+)
+
+// IPVoter estimates our external IP address from what peers report seeing
+// in the 'yourip' field of their extended handshake. Every remote host gets a
+// single vote, its latest, so one peer connecting over and over can't sway
+// the result. It's safe for concurrent use and meant to be shared by all
+// torrents.
+type IPVoter struct {
+	mu sync.Mutex
+	// Reported address keyed by the host reporting it
+	votes map[string]string
+}
+
+func NewIPVoter() *IPVoter {
+	return &IPVoter{votes: make(map[string]string)}
+}
+
+// Vote records that the host at voterAddr (host or host:port) sees us as ip.
+func (v *IPVoter) Vote(voterAddr string, ip net.IP) {
+	if ip == nil || ip.IsUnspecified() {
+		return
+	}
+	host, _, err := net.SplitHostPort(voterAddr)
+	if err != nil {
+		host = voterAddr
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, ok := v.votes[host]; !ok && len(v.votes) >= maxIPVoters {
+		for evicted := range v.votes {
+			delete(v.votes, evicted)
+			break
+		}
+	}
+	v.votes[host] = ip.String()
+}
+
+// Reset forgets every vote, e.g. after a network change made them stale.
+func (v *IPVoter) Reset() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	clear(v.votes)
+}
+
+// External returns the address most peers report for us. It returns false
+// until at least minIPVotes peers agree and they make up a strict majority of
+// all voters.
+func (v *IPVoter) External() (net.IP, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	counts := make(map[string]int)
+	var best string
+	for _, ip := range v.votes {
+		counts[ip]++
+		if counts[ip] > counts[best] {
+			best = ip
+		}
+	}
+
+	n := counts[best]
+	if n < minIPVotes || 2*n <= len(v.votes) {
+		return nil, false
+	}
+	return net.ParseIP(best), true
+}
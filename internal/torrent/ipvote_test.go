@@ -0,0 +1,32 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPVoterMajority(t *testing.T) {
+	ours, other := net.ParseIP("203.0.113.7"), net.ParseIP("198.51.100.1")
+
+	v := NewIPVoter()
+	v.Vote("10.0.0.1:6881", ours)
+	v.Vote("10.0.0.2:6881", ours)
+	// Reconnecting from another port doesn't count twice.
+	v.Vote("10.0.0.2:7000", ours)
+	if _, ok := v.External(); ok {
+		t.Fatal("consensus from two hosts")
+	}
+
+	v.Vote("10.0.0.3:6881", ours)
+	if ip, ok := v.External(); !ok || !ip.Equal(ours) {
+		t.Fatalf("External = %v, %v; want %v", ip, ok, ours)
+	}
+
+	// Three dissenters leave no strict majority.
+	for _, host := range []string{"10.0.0.4", "10.0.0.5", "10.0.0.6"} {
+		v.Vote(host+":6881", other)
+	}
+	if ip, ok := v.External(); ok {
+		t.Errorf("External = %v with a tied vote", ip)
+	}
+}
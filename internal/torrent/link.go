@@ -0,0 +1,121 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// LinkMode is how LinkFiles puts existing copies of a torrent's files in
+// place.
+type LinkMode int
+
+const (
+	// LinkHard hardlinks the files, so both names share the same data.
+	// Writes through either name show up in both.
+	LinkHard LinkMode = iota
+	// LinkReflink clones the files copy-on-write, on filesystems that
+	// support it such as Btrfs and XFS. The clones share data until either
+	// side is written to.
+	LinkReflink
+	// LinkCopy copies the files.
+	LinkCopy
+)
+
+func (m LinkMode) String() string {
+	switch m {
+	case LinkHard:
+		return "hardlink"
+	case LinkReflink:
+		return "reflink"
+	case LinkCopy:
+		return "copy"
+	default:
+		return "unknown"
+	}
+}
+
+// LinkFiles puts the torrent's files found below srcDir in the same layout
+// below dstDir, linking them as mode says. Where that isn't possible, e.g.
+// across filesystems, the file is copied instead. Files missing from srcDir
+// and files already present in dstDir are skipped. Nothing is verified:
+// callers should check the linked data against the piece hashes.
+func LinkFiles(info *Info, srcDir, dstDir string, mode LinkMode) error {
+	for _, f := range info.FileList() {
+		src := filepath.Join(append([]string{srcDir}, f.Path...)...)
+		dst := filepath.Join(append([]string{dstDir}, f.Path...)...)
+
+		if err := linkFile(src, dst, mode); err != nil {
+			return fmt.Errorf("link: %s: %w", src, err)
+		}
+	}
+
+	return nil
+}
+
+/////////////// Private ///////////////
+
+func linkFile(src, dst string, mode LinkMode) error {
+	st, err := os.Stat(src)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !st.Mode().IsRegular() {
+		return errors.New("not a regular file")
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	switch mode {
+	case LinkHard:
+		if err := os.Link(src, dst); err == nil {
+			return nil
+		}
+	case LinkReflink:
+		if err := reflinkFile(src, dst); err == nil {
+			return nil
+		}
+	}
+
+	return copyFile(src, dst)
+}
+
+// copyFile copies src to dst through a temporary file, so a failed copy never
+// leaves a partial dst behind.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + ".part"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package torrent
+
+import "errors"
+
+// reflinkFile isn't implemented on this platform; files are copied instead.
+func reflinkFile(src, dst string) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,52 @@
+package torrent
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLinkFiles(t *testing.T) {
+	info := &Info{
+		Name: "multi",
+		Files: []*File{
+			{Length: 3, Path: []string{"a"}},
+			{Length: 4, Path: []string{"sub", "b"}},
+			{Length: 5, Path: []string{"missing"}},
+		},
+	}
+
+	for _, mode := range []LinkMode{LinkHard, LinkReflink, LinkCopy} {
+		t.Run(mode.String(), func(t *testing.T) {
+			src, dst := t.TempDir(), t.TempDir()
+			writeTestFile(t, filepath.Join(src, "multi", "a"), []byte("aaa"))
+			writeTestFile(
+				t,
+				filepath.Join(src, "multi", "sub", "b"),
+				[]byte("bbbb"),
+			)
+
+			if err := LinkFiles(info, src, dst, mode); err != nil {
+				t.Fatalf("LinkFiles: %v", err)
+			}
+
+			got, err := os.ReadFile(filepath.Join(dst, "multi", "sub", "b"))
+			if err != nil || string(got) != "bbbb" {
+				t.Errorf("linked file = %q, %v; want %q", got, err, "bbbb")
+			}
+			_, err = os.Stat(filepath.Join(dst, "multi", "missing"))
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("missing file was created: %v", err)
+			}
+
+			srcInfo, _ := os.Stat(filepath.Join(src, "multi", "a"))
+			dstInfo, _ := os.Stat(filepath.Join(dst, "multi", "a"))
+			shared := os.SameFile(srcInfo, dstInfo)
+			if shared != (mode == LinkHard) {
+				t.Errorf("source and link are the same file: %v", shared)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/prxssh/relay/internal/bencode"
+)
+
+// ErrInvalidMagnet is returned by ParseMagnet for a link that doesn't name a
+// torrent by its info hash.
+var ErrInvalidMagnet = errors.New("magnet: invalid magnet link")
+
+// Magnet is what a magnet link (BEP 9) tells about a torrent before its
+// metadata is known.
+type Magnet struct {
+	// SHA1 hash of the info dictionary
+	InfoHash [sha1.Size]byte
+	// Display name, a hint until the metadata arrives (optional)
+	Name string
+	// Trackers to find peers with (optional)
+	Trackers []string
+}
+
+// ParseMagnet parses a magnet link of the form
+// "magnet:?xt=urn:btih:<info hash>&dn=<name>&tr=<tracker>...". The info hash
+// may be hex or base32 encoded.
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMagnet, err)
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("%w: scheme %q", ErrInvalidMagnet, u.Scheme)
+	}
+
+	q := u.Query()
+	m := &Magnet{Name: q.Get("dn"), Trackers: q["tr"]}
+
+	var found bool
+	for _, xt := range q["xt"] {
+		hash, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+		if m.InfoHash, err = decodeInfoHash(hash); err != nil {
+			return nil, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: no urn:btih info hash", ErrInvalidMagnet)
+	}
+
+	return m, nil
+}
+
+// Metainfo builds the contents of a .torrent file from the link's trackers
+// and info, the info dictionary fetched from peers. info is embedded as is,
+// so the torrent keeps the link's info hash.
+func (m *Magnet) Metainfo(info []byte) ([]byte, error) {
+	if sha1.Sum(info) != m.InfoHash {
+		return nil, errors.New("magnet: info doesn't match the info hash")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('d')
+	// Keys in sorted order, as bencode requires.
+	if len(m.Trackers) > 0 {
+		tiers := make([]any, len(m.Trackers))
+		for i, tr := range m.Trackers {
+			tiers[i] = []any{tr}
+		}
+		err := bencode.NewMarshaller(&buf).Marshal(map[string]any{
+			"announce":      m.Trackers[0],
+			"announce-list": tiers,
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Splice the dictionary's entries into ours.
+		entries := buf.Bytes()[2 : buf.Len()-1]
+		buf.Truncate(1)
+		buf.Write(bytes.Clone(entries))
+	}
+	buf.WriteString("4:info")
+	buf.Write(info)
+	buf.WriteByte('e')
+
+	return buf.Bytes(), nil
+}
+
+/////////////// Private ///////////////
+
+// decodeInfoHash decodes a magnet link's info hash: 40 hex or 32 base32
+// characters.
+func decodeInfoHash(s string) ([sha1.Size]byte, error) {
+	var hash [sha1.Size]byte
+
+	var (
+		b   []byte
+		err error
+	)
+	switch len(s) {
+	case hex.EncodedLen(sha1.Size):
+		b, err = hex.DecodeString(s)
+	case base32.StdEncoding.EncodedLen(sha1.Size):
+		b, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return hash, fmt.Errorf(
+			"%w: info hash %q has the wrong length",
+			ErrInvalidMagnet,
+			s,
+		)
+	}
+	if err != nil {
+		return hash, fmt.Errorf(
+			"%w: malformed info hash %q",
+			ErrInvalidMagnet,
+			s,
+		)
+	}
+	copy(hash[:], b)
+
+	return hash, nil
+}
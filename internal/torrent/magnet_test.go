@@ -0,0 +1,104 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/prxssh/relay/internal/bencode"
+)
+
+func TestParseMagnet(t *testing.T) {
+	hash := sha1.Sum([]byte("info"))
+	hexHash := hex.EncodeToString(hash[:])
+	b32Hash := base32.StdEncoding.EncodeToString(hash[:])
+
+	testCases := []struct {
+		name    string
+		uri     string
+		wantErr bool
+	}{
+		{"hex", "magnet:?xt=urn:btih:" + hexHash, false},
+		{"base32", "magnet:?xt=urn:btih:" + b32Hash, false},
+		{"missing xt", "magnet:?dn=name", true},
+		{"short hash", "magnet:?xt=urn:btih:" + hexHash[:38], true},
+		{"bad hex", "magnet:?xt=urn:btih:" + hexHash[:39] + "z", true},
+		{"not a magnet", "http://example.org/?xt=urn:btih:" + hexHash, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := ParseMagnet(tc.uri)
+			if tc.wantErr {
+				if !errors.Is(err, ErrInvalidMagnet) {
+					t.Fatalf("err = %v, want %v", err, ErrInvalidMagnet)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseMagnet: %v", err)
+			}
+			if m.InfoHash != hash {
+				t.Errorf("info hash = %x, want %x", m.InfoHash, hash)
+			}
+		})
+	}
+
+	m, err := ParseMagnet(
+		"magnet:?xt=urn:btih:" + hexHash + "&dn=Big+Buck+Bunny" +
+			"&tr=http%3A%2F%2Fa.example%2Fannounce&tr=udp%3A%2F%2Fb.example",
+	)
+	if err != nil {
+		t.Fatalf("ParseMagnet: %v", err)
+	}
+	if m.Name != "Big Buck Bunny" {
+		t.Errorf("name = %q", m.Name)
+	}
+	want := []string{"http://a.example/announce", "udp://b.example"}
+	if !slices.Equal(m.Trackers, want) {
+		t.Errorf("trackers = %q, want %q", m.Trackers, want)
+	}
+}
+
+func TestMagnetMetainfoKeepsInfoHash(t *testing.T) {
+	var info bytes.Buffer
+	err := bencode.NewMarshaller(&info).Marshal(map[string]any{
+		"name":         "file",
+		"length":       int64(10),
+		"piece length": int64(BlockSize),
+		"pieces":       string(make([]byte, 20)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Magnet{
+		InfoHash: sha1.Sum(info.Bytes()),
+		Trackers: []string{"http://a.example/announce", "http://b.example/"},
+	}
+	data, err := m.Metainfo(info.Bytes())
+	if err != nil {
+		t.Fatalf("Metainfo: %v", err)
+	}
+
+	tr, err := New(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if tr.Info.Hash != m.InfoHash {
+		t.Errorf("info hash = %x, want %x", tr.Info.Hash, m.InfoHash)
+	}
+	// Trackers come back in no particular order.
+	slices.Sort(tr.AnnounceURLs)
+	if !slices.Equal(tr.AnnounceURLs, m.Trackers) {
+		t.Errorf("trackers = %q, want %q", tr.AnnounceURLs, m.Trackers)
+	}
+
+	if _, err := m.Metainfo([]byte("d4:name5:othere")); err == nil {
+		t.Error("expected an error for info of another torrent")
+	}
+}
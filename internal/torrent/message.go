@@ -2,6 +2,7 @@ package torrent
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 )
 
@@ -18,6 +19,12 @@ const (
 	msgRequest       messageid = 6
 	msgPiece         messageid = 7
 	msgCancel        messageid = 8
+	// Fast extension (BEP 6)
+	msgSuggest       messageid = 13
+	msgHaveAll       messageid = 14
+	msgHaveNone      messageid = 15
+	msgRejectRequest messageid = 16
+	msgAllowedFast   messageid = 17
 )
 
 // message represents a message exchanged between BitTorrent peers
@@ -120,3 +127,68 @@ func messageCancel(index, begin, length int) *message {
 
 	return &message{id: msgCancel, payload: payload}
 }
+
+func messageSuggest(index int) *message {
+	payload := make([]byte, 4)
+
+	binary.BigEndian.PutUint32(payload, uint32(index))
+
+	return &message{id: msgSuggest, payload: payload}
+}
+
+func messageHaveAll() *message {
+	return &message{id: msgHaveAll}
+}
+
+func messageHaveNone() *message {
+	return &message{id: msgHaveNone}
+}
+
+func messageRejectRequest(index, begin, length int) *message {
+	payload := make([]byte, 12)
+
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+
+	return &message{id: msgRejectRequest, payload: payload}
+}
+
+func messageAllowedFast(index int) *message {
+	payload := make([]byte, 4)
+
+	binary.BigEndian.PutUint32(payload, uint32(index))
+
+	return &message{id: msgAllowedFast, payload: payload}
+}
+
+// parseIndex decodes the piece index carried by a have, suggest piece or
+// allowed fast message.
+func parseIndex(m *message) (int, error) {
+	if len(m.payload) != 4 {
+		return 0, fmt.Errorf(
+			"message %d of %d bytes, want 4",
+			m.id,
+			len(m.payload),
+		)
+	}
+
+	return int(binary.BigEndian.Uint32(m.payload)), nil
+}
+
+// parseBlockRef decodes the block carried by a request, cancel or reject
+// request message.
+func parseBlockRef(m *message) (index, begin, length int, err error) {
+	if len(m.payload) != 12 {
+		return 0, 0, 0, fmt.Errorf(
+			"message %d of %d bytes, want 12",
+			m.id,
+			len(m.payload),
+		)
+	}
+
+	return int(binary.BigEndian.Uint32(m.payload[0:4])),
+		int(binary.BigEndian.Uint32(m.payload[4:8])),
+		int(binary.BigEndian.Uint32(m.payload[8:12])),
+		nil
+}
@@ -0,0 +1,79 @@
+package torrent
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFastMessagesMarshal(t *testing.T) {
+	testCases := []struct {
+		name string
+		msg  *message
+		want []byte
+	}{
+		{
+			"suggest piece",
+			messageSuggest(5),
+			[]byte{0, 0, 0, 5, 0x0D, 0, 0, 0, 5},
+		},
+		{"have all", messageHaveAll(), []byte{0, 0, 0, 1, 0x0E}},
+		{"have none", messageHaveNone(), []byte{0, 0, 0, 1, 0x0F}},
+		{
+			"reject request",
+			messageRejectRequest(1, 0x4000, 0x4000),
+			[]byte{
+				0, 0, 0, 13, 0x10,
+				0, 0, 0, 1,
+				0, 0, 0x40, 0,
+				0, 0, 0x40, 0,
+			},
+		},
+		{
+			"allowed fast",
+			messageAllowedFast(7),
+			[]byte{0, 0, 0, 5, 0x11, 0, 0, 0, 7},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := tc.msg.marshal()
+			if !bytes.Equal(data, tc.want) {
+				t.Fatalf("marshal = %x, want %x", data, tc.want)
+			}
+
+			got, err := unmarshalMessage(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("unmarshalMessage: %v", err)
+			}
+			if got.id != tc.msg.id ||
+				!bytes.Equal(got.payload, tc.msg.payload) {
+				t.Errorf("round trip gave %v, want %v", got, tc.msg)
+			}
+		})
+	}
+}
+
+func TestParseFastMessages(t *testing.T) {
+	index, err := parseIndex(messageAllowedFast(7))
+	if err != nil || index != 7 {
+		t.Errorf("parseIndex = %d, %v; want 7", index, err)
+	}
+	if _, err := parseIndex(messageHaveAll()); err == nil {
+		t.Error("expected an error for an index-less message")
+	}
+
+	i, begin, length, err := parseBlockRef(messageRejectRequest(1, 2, 3))
+	if err != nil || i != 1 || begin != 2 || length != 3 {
+		t.Errorf(
+			"parseBlockRef = %d, %d, %d, %v; want 1, 2, 3",
+			i,
+			begin,
+			length,
+			err,
+		)
+	}
+	if _, _, _, err := parseBlockRef(messageSuggest(1)); err == nil {
+		t.Error("expected an error for a short block reference")
+	}
+}
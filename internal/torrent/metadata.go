@@ -0,0 +1,139 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+)
+
+// metadataPieceSize is the size of every metadata piece but the last one, as
+// exchanged by the ut_metadata extension (BEP 9).
+const metadataPieceSize = 16 * 1024
+
+// DefaultMaxMetadataSize is the largest info dictionary we accept from a peer
+// unless configured otherwise. It comfortably fits torrents with hundreds of
+// thousands of pieces while keeping a lying peer from making us allocate
+// arbitrary amounts of memory.
+const DefaultMaxMetadataSize = 8 * 1024 * 1024
+
+var (
+	// ErrMetadataTooLarge is returned when a peer announces a metadata_size
+	// above the configured limit.
+	ErrMetadataTooLarge = errors.New("metadata: size exceeds limit")
+	// ErrMetadataHashMismatch is returned when the assembled metadata doesn't
+	// hash to the info hash we asked for. The peer sent bogus data and the
+	// metadata has to be fetched from a different one.
+	ErrMetadataHashMismatch = errors.New("metadata: info hash mismatch")
+)
+
+// metadataBuffer reassembles an info dictionary received piece by piece from
+// a single peer, validating every piece against the size the peer announced
+// in its extended handshake.
+type metadataBuffer struct {
+	size     int64
+	pieces   [][]byte
+	received int
+}
+
+// newMetadataBuffer prepares to receive size bytes of metadata. Sizes that
+// are not positive or exceed maxSize are rejected before anything is
+// allocated.
+func newMetadataBuffer(size, maxSize int64) (*metadataBuffer, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("metadata: invalid size %d", size)
+	}
+	if size > maxSize {
+		return nil, fmt.Errorf(
+			"%w: %d > %d bytes",
+			ErrMetadataTooLarge,
+			size,
+			maxSize,
+		)
+	}
+
+	numPieces := (size + metadataPieceSize - 1) / metadataPieceSize
+	return &metadataBuffer{
+		size:   size,
+		pieces: make([][]byte, numPieces),
+	}, nil
+}
+
+// numPieces returns the number of pieces the metadata is split into.
+func (m *metadataBuffer) numPieces() int {
+	return len(m.pieces)
+}
+
+// pieceLen returns the length of the metadata piece at index.
+func (m *metadataBuffer) pieceLen(index int) int {
+	if index == len(m.pieces)-1 {
+		return int(m.size - int64(index)*metadataPieceSize)
+	}
+	return metadataPieceSize
+}
+
+// addPiece stores a received piece. totalSize is the size the peer claims in
+// the data message, which has to match the size it announced. Pieces received
+// twice are ignored.
+func (m *metadataBuffer) addPiece(
+	index int,
+	totalSize int64,
+	data []byte,
+) error {
+	if totalSize != m.size {
+		return fmt.Errorf(
+			"metadata: total size %d disagrees with announced %d",
+			totalSize,
+			m.size,
+		)
+	}
+	if index < 0 || index >= len(m.pieces) {
+		return fmt.Errorf(
+			"metadata: piece %d out of range [0, %d)",
+			index,
+			len(m.pieces),
+		)
+	}
+	if len(data) != m.pieceLen(index) {
+		return fmt.Errorf(
+			"metadata: piece %d is %d bytes, want %d",
+			index,
+			len(data),
+			m.pieceLen(index),
+		)
+	}
+
+	if m.pieces[index] == nil {
+		m.pieces[index] = data
+		m.received++
+	}
+
+	return nil
+}
+
+// done reports whether every piece has been received.
+func (m *metadataBuffer) done() bool {
+	return m.received == len(m.pieces)
+}
+
+// verify assembles the received pieces and checks that they hash to
+// infoHash, returning the raw info dictionary.
+func (m *metadataBuffer) verify(infoHash [sha1.Size]byte) ([]byte, error) {
+	if !m.done() {
+		return nil, fmt.Errorf(
+			"metadata: only %d of %d pieces received",
+			m.received,
+			len(m.pieces),
+		)
+	}
+
+	data := make([]byte, 0, m.size)
+	for _, piece := range m.pieces {
+		data = append(data, piece...)
+	}
+
+	if sha1.Sum(data) != infoHash {
+		return nil, ErrMetadataHashMismatch
+	}
+
+	return data, nil
+}
@@ -0,0 +1,100 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"testing"
+)
+
+// feedMetadata adds data to m split into metadata pieces.
+func feedMetadata(t *testing.T, m *metadataBuffer, data []byte) {
+	t.Helper()
+
+	for i := 0; i < m.numPieces(); i++ {
+		end := min((i+1)*metadataPieceSize, len(data))
+		err := m.addPiece(i, int64(len(data)), data[i*metadataPieceSize:end])
+		if err != nil {
+			t.Fatalf("addPiece(%d): %v", i, err)
+		}
+	}
+}
+
+func TestMetadataBufferRejectsOversize(t *testing.T) {
+	_, err := newMetadataBuffer(
+		DefaultMaxMetadataSize+1,
+		DefaultMaxMetadataSize,
+	)
+	if !errors.Is(err, ErrMetadataTooLarge) {
+		t.Fatalf("err = %v, want ErrMetadataTooLarge", err)
+	}
+
+	if _, err := newMetadataBuffer(0, DefaultMaxMetadataSize); err == nil {
+		t.Fatal("expected error for an empty metadata size")
+	}
+}
+
+func TestMetadataBufferValidatesPieces(t *testing.T) {
+	const size = metadataPieceSize + 100
+
+	testCases := []struct {
+		name      string
+		index     int
+		totalSize int64
+		length    int
+	}{
+		{"index out of range", 2, size, 100},
+		{"short middle piece", 0, size, 100},
+		{"long last piece", 1, size, metadataPieceSize},
+		{"total size disagrees", 1, size + 1, 100},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := newMetadataBuffer(size, DefaultMaxMetadataSize)
+			if err != nil {
+				t.Fatalf("newMetadataBuffer: %v", err)
+			}
+			if m.numPieces() != 2 {
+				t.Fatalf("numPieces = %d, want 2", m.numPieces())
+			}
+
+			err = m.addPiece(tc.index, tc.totalSize, make([]byte, tc.length))
+			if err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestMetadataBufferVerify(t *testing.T) {
+	data := bytes.Repeat([]byte("d4:name4:test"), 3000)
+	infoHash := sha1.Sum(data)
+
+	m, err := newMetadataBuffer(int64(len(data)), DefaultMaxMetadataSize)
+	if err != nil {
+		t.Fatalf("newMetadataBuffer: %v", err)
+	}
+	if _, err := m.verify(infoHash); err == nil {
+		t.Fatal("expected error verifying incomplete metadata")
+	}
+
+	// A peer sending garbage of the right shape is caught by the hash.
+	bogus := bytes.Repeat([]byte{'x'}, len(data))
+	feedMetadata(t, m, bogus)
+	_, err = m.verify(infoHash)
+	if !errors.Is(err, ErrMetadataHashMismatch) {
+		t.Fatalf("err = %v, want ErrMetadataHashMismatch", err)
+	}
+
+	// Retrying with a fresh buffer from an honest peer succeeds.
+	m, _ = newMetadataBuffer(int64(len(data)), DefaultMaxMetadataSize)
+	feedMetadata(t, m, data)
+	got, err := m.verify(infoHash)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("assembled metadata differs from the original")
+	}
+}
@@ -0,0 +1,180 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// MoveFiles moves the torrent's data from below srcDir to the same layout
+// below dstDir. Files are renamed when possible; across filesystems they are
+// copied, verified against the source and only then deleted. Files that were
+// never created, e.g. because they were skipped, are ignored. If a file can't
+// be moved, the ones already moved are moved back. progress, if non-nil, is
+// called with the number of bytes moved so far.
+func MoveFiles(
+	info *Info,
+	srcDir, dstDir string,
+	progress func(moved int64),
+) error {
+	var moved int64
+	var done [][2]string
+	dirs := make(map[string]struct{})
+
+	for _, f := range info.FileList() {
+		src := filepath.Join(append([]string{srcDir}, f.Path...)...)
+		dst := filepath.Join(append([]string{dstDir}, f.Path...)...)
+
+		if err := moveFile(src, dst); err != nil {
+			// Put back what was already moved so the data stays usable
+			// from srcDir.
+			for i := len(done) - 1; i >= 0; i-- {
+				moveFile(done[i][1], done[i][0])
+			}
+			return fmt.Errorf("move: %s: %w", src, err)
+		}
+		done = append(done, [2]string{src, dst})
+		dirs[filepath.Dir(src)] = struct{}{}
+
+		moved += f.Length
+		if progress != nil {
+			progress(moved)
+		}
+	}
+
+	removeEmptyDirs(dirs, srcDir)
+	return nil
+}
+
+// DeleteFiles deletes the torrent's data below dir, along with the
+// directories that are left empty. Files that don't exist are ignored.
+func DeleteFiles(info *Info, dir string) error {
+	dirs := make(map[string]struct{})
+	var errs []error
+	for _, f := range info.FileList() {
+		path := filepath.Join(append([]string{dir}, f.Path...)...)
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("delete: %w", err))
+			continue
+		}
+		dirs[filepath.Dir(path)] = struct{}{}
+	}
+
+	removeEmptyDirs(dirs, dir)
+	return errors.Join(errs...)
+}
+
+/////////////// Private ///////////////
+
+func moveFile(src, dst string) error {
+	if _, err := os.Stat(src); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	// Renaming is cheap but only works within a filesystem. Whatever made it
+	// fail, copying either succeeds or reports the error more precisely.
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	return copyVerifyDelete(src, dst)
+}
+
+// copyVerifyDelete copies src to dst through a temporary file, re-reads the
+// copy to make sure it matches the source and deletes src once it does.
+func copyVerifyDelete(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + ".part"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	srcHash := sha1.New()
+	_, err = io.Copy(out, io.TeeReader(in, srcHash))
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	dstSum, err := fileSHA1(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if !bytes.Equal(dstSum, srcHash.Sum(nil)) {
+		os.Remove(tmp)
+		return errors.New("copy does not match the source")
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Remove(src)
+}
+
+func fileSHA1(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// removeEmptyDirs removes the directories the moved files lived in, and their
+// parents up to but excluding root, as long as they are empty. Directories
+// still holding anything else are left alone.
+func removeEmptyDirs(dirs map[string]struct{}, root string) {
+	root = filepath.Clean(root)
+
+	var all []string
+	seen := make(map[string]struct{})
+	for dir := range dirs {
+		for dir != root && len(dir) > len(root) {
+			if _, ok := seen[dir]; !ok {
+				seen[dir] = struct{}{}
+				all = append(all, dir)
+			}
+			dir = filepath.Dir(dir)
+		}
+	}
+
+	// Deepest first, so children are gone before their parents.
+	sort.Slice(all, func(i, j int) bool {
+		return len(all[i]) > len(all[j])
+	})
+	for _, dir := range all {
+		os.Remove(dir)
+	}
+}
@@ -0,0 +1,94 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMoveFiles(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	info := &Info{
+		Name: "multi",
+		Files: []*File{
+			{Length: 3, Path: []string{"a"}},
+			{Length: 4, Path: []string{"sub", "b"}},
+			{Length: 5, Path: []string{"skipped"}},
+		},
+	}
+	writeTestFile(t, filepath.Join(src, "multi", "a"), []byte("aaa"))
+	writeTestFile(t, filepath.Join(src, "multi", "sub", "b"), []byte("bbbb"))
+
+	var progress []int64
+	err := MoveFiles(info, src, dst, func(moved int64) {
+		progress = append(progress, moved)
+	})
+	if err != nil {
+		t.Fatalf("MoveFiles: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dst, "multi", "sub", "b"))
+	if err != nil || string(got) != "bbbb" {
+		t.Errorf("moved file = %q, %v; want %q", got, err, "bbbb")
+	}
+	_, err = os.Stat(filepath.Join(src, "multi"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("source directory left behind: %v", err)
+	}
+	if len(progress) != 3 || progress[2] != 12 {
+		t.Errorf("progress = %v, want 3 updates ending at 12", progress)
+	}
+}
+
+func TestDeleteFilesKeepsOtherData(t *testing.T) {
+	dir := t.TempDir()
+	info := &Info{
+		Name: "multi",
+		Files: []*File{
+			{Length: 3, Path: []string{"a"}},
+			{Length: 4, Path: []string{"sub", "b"}},
+			{Length: 5, Path: []string{"skipped"}},
+		},
+	}
+	writeTestFile(t, filepath.Join(dir, "multi", "a"), []byte("aaa"))
+	writeTestFile(t, filepath.Join(dir, "multi", "sub", "b"), []byte("bbbb"))
+	writeTestFile(t, filepath.Join(dir, "other"), []byte("keep"))
+
+	if err := DeleteFiles(info, dir); err != nil {
+		t.Fatalf("DeleteFiles: %v", err)
+	}
+	_, err := os.Stat(filepath.Join(dir, "multi"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("torrent directory left behind: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other")); err != nil {
+		t.Errorf("unrelated file deleted: %v", err)
+	}
+}
+
+func TestCopyVerifyDelete(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+
+	data := bytes.Repeat([]byte("data"), 10000)
+	writeTestFile(t, src, data)
+
+	if err := copyVerifyDelete(src, dst); err != nil {
+		t.Fatalf("copyVerifyDelete: %v", err)
+	}
+
+	got, err := os.ReadFile(dst)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("copy differs from source (err %v)", err)
+	}
+	if _, err := os.Stat(src); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("source not deleted: %v", err)
+	}
+	if _, err := os.Stat(dst + ".part"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
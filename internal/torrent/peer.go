@@ -2,11 +2,17 @@ package torrent
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prxssh/relay/internal/tracker"
@@ -20,11 +26,172 @@ type Peer struct {
 	Addr string
 	// TCP network connection to the peer
 	conn net.Conn
+	// Guards bitfield, numHave and state, which are updated by the read loop
+	// while others inspect them. It's taken after writeMu and before the
+	// picker's lock.
+	mu sync.Mutex
 	// Represents the pieces that the remote peer has. It's received
 	// immediately after the handshake.
 	bitfield utils.Bitfield
+	// Number of pieces in the torrent
+	numPieces int
+	// Number of pieces set in bitfield
+	numHave int
 	// Tracks the choking and interest status between the client and the peer.
 	state *peerState
+	// Knows which pieces we still need. The peer reports its availability to
+	// it and derives our interest from it. May be nil.
+	picker *Picker
+	// Serializes writes to conn, and interest updates with them so that
+	// concurrent updates can't reorder interested/not interested.
+	writeMu sync.Mutex
+	// Number of outstanding requests the peer accepts, from its extended
+	// handshake; zero until it sends one. Guarded by mu.
+	reqq int
+	// If true the peer's handshake signalled the extension protocol. Set
+	// before the peer is started.
+	extensions bool
+	// If true the peer's handshake signalled the fast extension. Set before
+	// the peer is started.
+	fast bool
+	// Closed once the peer's extended handshake arrived
+	extReady chan struct{}
+	// Extended message id the peer assigned to ut_metadata and the size of
+	// the info dictionary it serves; zero if it doesn't. Guarded by mu.
+	utMetadataID int64
+	metadataSize int64
+	// RequestMetadata in progress, if any. Guarded by mu.
+	metadataFetch *metadataFetch
+	// If true we exchange peers with the peer over ut_pex: the options asked
+	// for it and the torrent isn't private. Set before the peer is started.
+	pex bool
+	// Receives the peers the peer tells us about over ut_pex. May be nil.
+	onPEX func(p *Peer, peers []*tracker.Peer)
+	// Extended message id the peer assigned to ut_pex, zero if it doesn't
+	// support it, and the addresses our last messages told it about.
+	// Guarded by mu.
+	utPexID int64
+	pexSent map[string]bool
+	// Address the peer accepts connections on, empty if unknown. Guarded by
+	// mu.
+	listenAddr string
+	// Receives the address the peer reports seeing us at. May be nil.
+	ipVoter *IPVoter
+	// Encryption negotiated during the handshake. Set before the peer is
+	// started and never changed afterwards.
+	crypto CryptoMethod
+	// Decides when we unchoke the peer. May be nil.
+	choker *Choker
+	// Connection slot the peer holds until Start returns. May be nil.
+	slots    *ConnSlots
+	infoHash [sha1.Size]byte
+	// Torrent the peer's requests are served from. Both may be nil, in which
+	// case requests are ignored.
+	info *Info
+	data io.ReaderAt
+	// Limits the rate blocks are served at. May be nil.
+	upload *utils.RateLimiter
+	// Receives the blocks the peer sends. May be nil.
+	onBlock func(p *Peer, index, begin int, block []byte)
+	// Told the size of every block served to the peer. May be nil.
+	onUpload func(p *Peer, n int)
+	// Told whenever what we can request from the peer may have changed. May
+	// be nil.
+	onUpdate func(p *Peer)
+	// Bytes of block data received from the peer. Guarded by mu.
+	received int64
+	// When the peer last sent anything, keep-alives included, and when it
+	// last sent block data, or we turned interested in it if that's later.
+	// The first tells whether the connection is alive, the second whether
+	// the peer is of any use. Guarded by mu.
+	lastMessage time.Time
+	lastBlock   time.Time
+	// When we last sent the peer a message, so keep-alives are only sent
+	// on idle connections. Guarded by mu.
+	lastSent time.Time
+	clock    utils.Clock
+}
+
+// CryptoMethod is the stream encryption negotiated with a peer. The values
+// match the crypto_provide/crypto_select bits of Message Stream Encryption.
+type CryptoMethod int
+
+const (
+	CryptoPlaintext CryptoMethod = 0x01
+	CryptoRC4       CryptoMethod = 0x02
+)
+
+func (c CryptoMethod) String() string {
+	switch c {
+	case CryptoPlaintext:
+		return "plaintext"
+	case CryptoRC4:
+		return "rc4"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnCounts is the number of running peer connections by encryption.
+type ConnCounts struct {
+	Encrypted int64
+	Plaintext int64
+}
+
+// Running connections across all torrents, maintained by Peer.Start.
+var encryptedConns, plaintextConns atomic.Int64
+
+// Connections returns the number of running peer connections, split by
+// whether they are encrypted. Without Message Stream Encryption every
+// connection is counted as plaintext for now.
+func Connections() ConnCounts {
+	return ConnCounts{
+		Encrypted: encryptedConns.Load(),
+		Plaintext: plaintextConns.Load(),
+	}
+}
+
+const (
+	// peerLivenessTimeout is how long a peer may stay silent, keep-alives
+	// included, before the connection is considered dead. Peers are
+	// expected to send a keep-alive at least every two minutes.
+	peerLivenessTimeout = 2 * time.Minute
+	// keepAliveInterval is how long we may stay silent before sending the
+	// peer a keep-alive, comfortably below peerLivenessTimeout.
+	keepAliveInterval = 90 * time.Second
+	// DefaultSnubTimeout is how long a peer we're interested in may go
+	// without sending block data before it's considered to be snubbing us.
+	DefaultSnubTimeout = time.Minute
+	// maxRequestLength is the largest block a peer may request. Clients
+	// request BlockSize; anything past this is treated as abuse.
+	maxRequestLength = 128 * 1024
+)
+
+// ErrUnknownInfoHash is returned by AcceptPeer when the remote peer asks for
+// a torrent we don't serve.
+var ErrUnknownInfoHash = errors.New("peer: unknown info hash")
+
+// ErrChoked is returned when requesting blocks from a peer that is choking us
+// or that we haven't declared interest in.
+var ErrChoked = errors.New("peer: choked")
+
+// PeerStats is a point-in-time snapshot of a peer, suitable for display.
+type PeerStats struct {
+	// Network address of the remote peer
+	Addr string
+	// True if the peer has every piece of the torrent
+	IsSeed bool
+	// Number of pieces the peer has
+	Pieces int
+	// Bytes of block data received from the peer
+	Received int64
+	// Encryption negotiated with the peer
+	Crypto CryptoMethod
+	// Choking and interest status in both directions
+	AmChoking      bool
+	AmInterested   bool
+	PeerChoking    bool
+	PeerInterested bool
 }
 
 // peerState tracks the connection state with a remote peer. This is
@@ -46,77 +213,407 @@ type PeerConnectOpts struct {
 	InfoHash [sha1.Size]byte
 	PeerID   [sha1.Size]byte
 	Pieces   int64
+	// Picker of the download the peer belongs to (optional)
+	Picker *Picker
+	// Collects the peers' views of our external address (optional)
+	IPVoter *IPVoter
+	// Decides which of the peers get unchoked (optional)
+	Choker *Choker
+	// Decides which peers are dialed and in which order (optional)
+	Policy *ConnectPolicy
+	// Connection caps shared by inbound and outbound peers (optional). A
+	// connected peer holds its slot until Start returns.
+	Slots *ConnSlots
+	// Metainfo and data of the torrent, which the peer's block requests are
+	// served from (optional; without them requests are ignored)
+	Info *Info
+	Data io.ReaderAt
+	// Limits the rate blocks are served at (optional)
+	Upload *utils.RateLimiter
+	// Limit everything read from and written to the connection, e.g. to
+	// the torrent's and the client's download and upload caps (optional)
+	ReadLimits  []*utils.RateLimiter
+	WriteLimits []*utils.RateLimiter
+	// Clock the peer's timeouts are measured with (optional; defaults to
+	// utils.RealClock)
+	Clock utils.Clock
+	// Receives every block the peer sends, e.g. to assemble it into its
+	// piece (optional; without it blocks are only counted). It's called
+	// from the peer's message loop, which waits for it to return.
+	OnBlock func(p *Peer, index, begin int, block []byte)
+	// Called with the size of every block served to the peer, e.g. to count
+	// uploaded bytes (optional)
+	OnUpload func(p *Peer, n int)
+	// Called after every message that may change what can be requested
+	// from the peer: a choke or unchoke, news of its pieces, a block or a
+	// rejected request, e.g. to refill its request pipeline (optional). It's
+	// called from the peer's message loop, which waits for it to return.
+	OnUpdate func(p *Peer)
+	// Receives the peers a peer tells us about over ut_pex, e.g. to connect
+	// to them (optional; without it, or for a private torrent, peers aren't
+	// exchanged). It's called from the peer's message loop.
+	OnPEX func(p *Peer, peers []*tracker.Peer)
 }
 
-func ConnectToPeers(
-	remotePeers []*tracker.Peer,
-	opts *PeerConnectOpts,
-) ([]*Peer, error) {
-	var wg sync.WaitGroup
-	peerChan := make(chan *Peer, len(remotePeers))
+// DialPeer connects to a single remote peer and completes the handshake. The
+// peer isn't started, so the caller can run it with Start. It doesn't consult
+// the connection policy on whether to dial the peer, only telling it about the
+// connection; callers order and filter their peers with it first.
+func DialPeer(remotePeer *tracker.Peer, opts *PeerConnectOpts) (*Peer, error) {
+	p, err := connectToPeer(remotePeer, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Policy != nil {
+		opts.Policy.Succeeded(remotePeer.Addr())
+	}
 
-	for _, remotePeer := range remotePeers {
-		wg.Add(1)
+	return p, nil
+}
 
-		go func(rp *tracker.Peer) {
-			defer wg.Done()
+// AcceptPeer completes the handshake of an inbound connection, where the
+// remote peer speaks first. lookup returns the options of the torrent with the
+// info hash the peer asks for, or false if we don't serve it. Such a peer gets
+// no reply: its connection is closed right after its handshake was read, the
+// same way for every unknown info hash, so it can't probe which torrents we
+// host. Peers beyond the connection caps are turned away with ErrConnLimit.
+func AcceptPeer(
+	conn net.Conn,
+	lookup func(infoHash [sha1.Size]byte) (*PeerConnectOpts, bool),
+) (*Peer, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
 
-			peer, err := connectToPeer(rp, opts)
-			if err != nil {
-				return
-			}
+	remote, err := readHanshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	opts, ok := lookup(remote.infoHash)
+	if !ok {
+		conn.Close()
+		return nil, ErrUnknownInfoHash
+	}
+	if opts.Slots != nil && !opts.Slots.acquire(opts.InfoHash) {
+		conn.Close()
+		return nil, ErrConnLimit
+	}
 
-			go peer.Start()
+	p := newPeer(
+		conn.RemoteAddr().String(),
+		conn,
+		int(opts.Pieces),
+		opts.Picker,
+	)
+	p.applyOpts(opts)
 
-			peerChan <- peer
-		}(remotePeer)
+	local := newHandshake(opts.InfoHash, opts.PeerID)
+	if _, err := conn.Write(local.serialize()); err != nil {
+		p.close()
+		return nil, err
 	}
-	wg.Wait()
-	close(peerChan)
-
-	var connectedPeers []*Peer
-	for peer := range peerChan {
-		connectedPeers = append(connectedPeers, peer)
+	if err := p.sendExtHandshake(remote); err != nil {
+		p.close()
+		return nil, err
+	}
+	if err := p.sendAvailability(remote); err != nil {
+		p.close()
+		return nil, err
 	}
 
-	return connectedPeers, nil
+	return p, nil
 }
 
 func (p *Peer) Start() {
-	defer p.conn.Close()
+	counter := &plaintextConns
+	if p.IsEncrypted() {
+		counter = &encryptedConns
+	}
+	counter.Add(1)
+	defer counter.Add(-1)
+
+	if p.choker != nil {
+		p.choker.AddPeer(p)
+		defer p.choker.RemovePeer(p)
+	}
+
+	defer p.close()
+	defer p.forgetAvailability()
+
+	done := make(chan struct{})
+	defer close(done)
+	go p.sendKeepAlives(done)
+
 	p.readMessages()
 }
 
+// Close disconnects the peer, which makes Start return.
+func (p *Peer) Close() error {
+	return p.conn.Close()
+}
+
 func (p *Peer) Read() (*message, error) {
 	return unmarshalMessage(p.conn)
 }
 
+// MaxRequests returns the number of block requests we may keep outstanding
+// with the peer: its advertised reqq, or DefaultPeerReqq if it didn't send
+// one.
+func (p *Peer) MaxRequests() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.reqq > 0 {
+		return p.reqq
+	}
+	return DefaultPeerReqq
+}
+
+// IsEncrypted reports whether the connection to the peer is encrypted. Message
+// Stream Encryption isn't implemented yet, so every handshake yields a
+// plaintext connection and this is always false for now; it's a placeholder
+// for when MSE lands.
+func (p *Peer) IsEncrypted() bool {
+	return p.crypto == CryptoRC4
+}
+
+// CryptoMethod returns the encryption negotiated during the handshake. Until
+// Message Stream Encryption is implemented it's always CryptoPlaintext.
+func (p *Peer) CryptoMethod() CryptoMethod {
+	return p.crypto
+}
+
+// IsSeed reports whether the peer has all numPieces pieces, going by its
+// bitfield and the 'have' messages it sent since.
+func (p *Peer) IsSeed(numPieces int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return numPieces > 0 && p.numHave >= numPieces
+}
+
+// SetInterested tells the peer whether we're interested in its pieces. The
+// message is only sent when our interest actually changes.
+func (p *Peer) SetInterested(interested bool) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	return p.setInterested(interested)
+}
+
+// SetChoking tells the peer whether we choke it. The message is only sent when
+// that actually changes.
+func (p *Peer) SetChoking(choking bool) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	p.mu.Lock()
+	changed := p.state.amChoking != choking
+	p.state.amChoking = choking
+	p.mu.Unlock()
+
+	if !changed {
+		return nil
+	}
+
+	msg := messageUnchoke()
+	if choking {
+		msg = messageChoke()
+	}
+	return p.writeMessage(msg)
+}
+
+// UpdateInterest re-evaluates whether the peer has any piece we still need
+// and tells it when that changed, e.g. after it announced a new piece or we
+// completed the last piece it could give us. Without a picker it does
+// nothing.
+func (p *Peer) UpdateInterest() error {
+	if p.picker == nil {
+		return nil
+	}
+
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	return p.setInterested(p.picker.Interesting(p.availability()))
+}
+
+// CanRequest reports whether blocks may be requested from the peer: we must
+// have declared interest and it must have unchoked us.
+func (p *Peer) CanRequest() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.state.amInterested && !p.state.peerChoking
+}
+
+// SendRequest asks the peer for a block. It fails with ErrChoked unless
+// CanRequest.
+func (p *Peer) SendRequest(index, begin, length int) error {
+	if !p.CanRequest() {
+		return ErrChoked
+	}
+
+	return p.sendMessage(messageRequest(index, begin, length))
+}
+
+// SendHave tells the peer we completed a piece, so it can request it from us.
+func (p *Peer) SendHave(index int) error {
+	return p.sendMessage(messageHave(index))
+}
+
+// Alive reports whether the peer sent anything, a keep-alive being enough,
+// within peerLivenessTimeout.
+func (p *Peer) Alive() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.clock.Now().Sub(p.lastMessage) < peerLivenessTimeout
+}
+
+// Snubbed reports whether we're interested in the peer but it hasn't sent us
+// any block data for longer than timeout, counting from when we turned
+// interested at the earliest. Keep-alives don't count: a peer that keeps the
+// connection open without ever delivering is snubbing us all the same.
+func (p *Peer) Snubbed(timeout time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.state.amInterested && p.clock.Now().Sub(p.lastBlock) > timeout
+}
+
+// Useless reports whether the connection should be reaped: the peer went
+// silent, or it's snubbing us while we want something from it.
+func (p *Peer) Useless(snubTimeout time.Duration) bool {
+	return !p.Alive() || p.Snubbed(snubTimeout)
+}
+
+// Stats returns a snapshot of the peer's state.
+func (p *Peer) Stats() PeerStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return PeerStats{
+		Addr:           p.Addr,
+		IsSeed:         p.numPieces > 0 && p.numHave >= p.numPieces,
+		Pieces:         p.numHave,
+		Received:       p.received,
+		Crypto:         p.crypto,
+		AmChoking:      p.state.amChoking,
+		AmInterested:   p.state.amInterested,
+		PeerChoking:    p.state.peerChoking,
+		PeerInterested: p.state.peerInterested,
+	}
+}
+
 /////////////// Private ///////////////
 
 func connectToPeer(
 	remotePeer *tracker.Peer,
 	opts *PeerConnectOpts,
 ) (*Peer, error) {
-	addr := fmt.Sprintf("%s:%d", remotePeer.IP, remotePeer.Port)
-	conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
-	if err != nil {
-		return nil, err
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	ip := remotePeer.IP
+	if ip == nil {
+		var err error
+		if ip, err = peerResolver.resolve(ctx, remotePeer.Host); err != nil {
+			return nil, err
+		}
 	}
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(int(remotePeer.Port)))
 
-	p := &Peer{
-		Addr:     addr,
-		conn:     conn,
-		state:    initialPeerState(),
-		bitfield: utils.NewBitfield(int(opts.Pieces)),
+	if opts.Slots != nil && !opts.Slots.acquire(opts.InfoHash) {
+		return nil, ErrConnLimit
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		if opts.Slots != nil {
+			opts.Slots.release(opts.InfoHash)
+		}
+		return nil, err
 	}
 
+	p := newPeer(addr, conn, int(opts.Pieces), opts.Picker)
+	p.listenAddr = addr
+	p.applyOpts(opts)
 	if err := p.peformHandshake(opts); err != nil {
+		p.close()
 		return nil, err
 	}
 
 	return p, nil
 }
 
+// applyOpts hands the peer the parts of opts it keeps. The connection slot,
+// if any, must already be taken.
+func (p *Peer) applyOpts(opts *PeerConnectOpts) {
+	p.ipVoter = opts.IPVoter
+	p.choker = opts.Choker
+	p.info = opts.Info
+	p.data = opts.Data
+	p.upload = opts.Upload
+	if len(opts.ReadLimits) > 0 || len(opts.WriteLimits) > 0 {
+		p.conn = utils.LimitConn(p.conn, opts.ReadLimits, opts.WriteLimits)
+	}
+	p.onBlock = opts.OnBlock
+	p.onUpload = opts.OnUpload
+	p.onUpdate = opts.OnUpdate
+	p.pex = opts.OnPEX != nil && (opts.Info == nil || !opts.Info.IsPrivate)
+	p.onPEX = opts.OnPEX
+	p.slots = opts.Slots
+	p.infoHash = opts.InfoHash
+	if opts.Clock != nil {
+		p.setClock(opts.Clock)
+	}
+}
+
+// setClock replaces the peer's clock, restarting its timeouts on it.
+func (p *Peer) setClock(clock utils.Clock) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clock = clock
+	p.lastMessage = clock.Now()
+	p.lastBlock = p.lastMessage
+	p.lastSent = p.lastMessage
+}
+
+// close closes the connection and gives back its slot.
+func (p *Peer) close() {
+	p.conn.Close()
+	if p.slots != nil {
+		p.slots.release(p.infoHash)
+	}
+}
+
+func newPeer(
+	addr string,
+	conn net.Conn,
+	numPieces int,
+	picker *Picker,
+) *Peer {
+	now := utils.RealClock.Now()
+	return &Peer{
+		Addr:        addr,
+		conn:        conn,
+		state:       initialPeerState(),
+		bitfield:    utils.NewBitfield(numPieces),
+		numPieces:   numPieces,
+		picker:      picker,
+		crypto:      CryptoPlaintext,
+		lastMessage: now,
+		lastBlock:   now,
+		lastSent:    now,
+		clock:       utils.RealClock,
+		extReady:    make(chan struct{}),
+		pexSent:     make(map[string]bool),
+	}
+}
+
 func initialPeerState() *peerState {
 	return &peerState{
 		amChoking:      true,
@@ -127,7 +624,7 @@ func initialPeerState() *peerState {
 }
 
 func (p *Peer) peformHandshake(opts *PeerConnectOpts) error {
-	p.conn.SetDeadline(time.Now().Add(3 * time.Second))
+	p.conn.SetDeadline(time.Now().Add(handshakeTimeout))
 	defer p.conn.SetDeadline(time.Time{})
 
 	reqHandshake := newHandshake(opts.InfoHash, opts.PeerID)
@@ -145,55 +642,465 @@ func (p *Peer) peformHandshake(opts *PeerConnectOpts) error {
 		return errors.New("handshake: info hash mismatch")
 	}
 
-	if !bytes.Equal(resHandshake.peerID[:], opts.PeerID[:]) {
-		return errors.New("handshake: peer id mismatch")
+	// The remote has an ID of its own; ours coming back means we connected
+	// to ourselves, e.g. through our own announced address.
+	if bytes.Equal(resHandshake.peerID[:], opts.PeerID[:]) {
+		return errors.New("handshake: connected to ourselves")
 	}
 
-	return nil
+	// Message Stream Encryption isn't implemented, the plain BitTorrent
+	// handshake always yields an unencrypted connection.
+	p.crypto = CryptoPlaintext
+
+	if err := p.sendExtHandshake(resHandshake); err != nil {
+		return err
+	}
+	return p.sendAvailability(resHandshake)
+}
+
+// sendExtHandshake sends our extended handshake if the remote handshake says
+// the peer supports the extension protocol.
+func (p *Peer) sendExtHandshake(remote *handshake) error {
+	p.extensions = remote.supportsExtensions()
+	if !p.extensions {
+		return nil
+	}
+
+	m := map[string]int64{extUTMetadata: localUTMetadataID}
+	if p.pex {
+		m[extUTPex] = localUTPexID
+	}
+	ext, err := messageExtHandshake(&extHandshake{
+		m:      m,
+		reqq:   localReqq,
+		yourIP: remoteIP(p.conn),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = p.conn.Write(ext.marshal())
+	return err
+}
+
+// sendAvailability tells the peer which pieces we have. The fast extension
+// makes this mandatory, with have all or have none when one of them says it
+// all and a bitfield otherwise. Peers without it get a bitfield, which is left
+// out while we have nothing.
+func (p *Peer) sendAvailability(remote *handshake) error {
+	p.fast = remote.supportsFast()
+
+	have := utils.NewBitfield(p.numPieces)
+	if p.picker != nil {
+		for i := 0; i < p.numPieces; i++ {
+			if p.picker.Has(i) {
+				have.Set(i)
+			}
+		}
+	}
+
+	var msg *message
+	switch n := have.Count(); {
+	case p.fast && n == 0:
+		msg = messageHaveNone()
+	case p.fast && n == p.numPieces:
+		msg = messageHaveAll()
+	case n == 0:
+		return nil
+	default:
+		msg = &message{id: msgBitfield, payload: have}
+	}
+	_, err := p.conn.Write(msg.marshal())
+	return err
 }
 
 func (p *Peer) readMessages() {
 	for {
-		p.conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
+		p.conn.SetReadDeadline(time.Now().Add(peerLivenessTimeout))
 
 		msg, err := p.Read()
 		if err != nil {
 			return
 		}
 
+		p.mu.Lock()
+		p.lastMessage = p.clock.Now()
+		p.mu.Unlock()
+
 		if msg == nil { // keep-alive
 			continue
 		}
 
-		switch msg.id {
-		case msgBitfield:
-			p.bitfield = msg.payload
+		if err := p.handleMessage(msg); err != nil {
+			return
+		}
+	}
+}
+
+// sendKeepAlives sends the peer a keep-alive whenever we haven't sent it
+// anything for keepAliveInterval, so it doesn't drop the connection while
+// we're only listening. It returns once done is closed or a write fails.
+func (p *Peer) sendKeepAlives(done <-chan struct{}) {
+	for {
+		p.mu.Lock()
+		clock := p.clock
+		wait := keepAliveInterval - clock.Now().Sub(p.lastSent)
+		p.mu.Unlock()
+
+		if wait <= 0 {
+			if err := p.sendMessage(nil); err != nil {
+				return
+			}
+			continue
+		}
+
+		timer := clock.NewTimer(wait)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+	}
+}
+
+// handleMessage applies a message from the peer to its state. An error means
+// the peer broke the protocol and should be disconnected.
+func (p *Peer) handleMessage(msg *message) error {
+	availabilityChanged, err := p.applyMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	if msg.id == msgRequest {
+		return p.serveRequest(msg)
+	}
+	if msg.id == msgPiece && p.onBlock != nil {
+		p.onBlock(
+			p,
+			int(binary.BigEndian.Uint32(msg.payload[0:4])),
+			int(binary.BigEndian.Uint32(msg.payload[4:8])),
+			msg.payload[8:],
+		)
+	}
+	if msg.id == msgExtended && msg.payload[0] == localUTPexID && p.pex {
+		return p.receivePEX(msg.payload[1:])
+	}
+	if msg.id == msgInterested && p.choker != nil {
+		if err := p.choker.PeerInterested(p); err != nil {
+			return err
+		}
+	}
+
+	if availabilityChanged {
+		if err := p.UpdateInterest(); err != nil {
+			return err
+		}
+	}
+
+	switch msg.id {
+	case msgChoke, msgUnchoke, msgHave, msgBitfield, msgHaveAll,
+		msgHaveNone, msgPiece, msgRejectRequest:
+		if p.onUpdate != nil {
+			p.onUpdate(p)
+		}
+	}
+	return nil
+}
+
+// applyMessage updates the peer's state for msg and reports whether the set
+// of pieces the peer has changed.
+func (p *Peer) applyMessage(msg *message) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch msg.id {
+	case msgBitfield:
+		if len(msg.payload) != len(p.bitfield) {
+			return false, fmt.Errorf(
+				"bitfield of %d bytes, want %d",
+				len(msg.payload),
+				len(p.bitfield),
+			)
+		}
+		if !utils.Bitfield(msg.payload).SpareBitsClear(p.numPieces) {
+			return false, errors.New("bitfield has spare bits set")
+		}
+		p.replaceBitfield(msg.payload)
+		return true, nil
+
+	case msgHaveAll:
+		bitfield := utils.NewBitfield(p.numPieces)
+		for i := 0; i < p.numPieces; i++ {
+			bitfield.Set(i)
+		}
+		p.replaceBitfield(bitfield)
+		return true, nil
 
-		case msgChoke:
-			p.state.peerChoking = true
+	case msgHaveNone:
+		p.replaceBitfield(utils.NewBitfield(p.numPieces))
+		return true, nil
 
-		case msgUnchoke:
-			p.state.peerChoking = false
+	case msgChoke:
+		p.state.peerChoking = true
 
-		case msgInterested:
-			p.state.peerInterested = true
+	case msgUnchoke:
+		p.state.peerChoking = false
 
-		case msgNotInterested:
-			p.state.peerInterested = false
+	case msgInterested:
+		p.state.peerInterested = true
 
-		case msgHave:
-			// do something
+	case msgNotInterested:
+		p.state.peerInterested = false
 
-		case msgPiece:
-			// do something
+	case msgHave:
+		if len(msg.payload) != 4 {
+			return false, fmt.Errorf(
+				"have of %d bytes, want 4",
+				len(msg.payload),
+			)
+		}
+		index := int(binary.BigEndian.Uint32(msg.payload))
+		if index >= p.numPieces {
+			return false, fmt.Errorf(
+				"have for piece %d out of range",
+				index,
+			)
+		}
+		if p.bitfield.Has(index) {
+			return false, nil
+		}
+		p.bitfield.Set(index)
+		p.numHave++
+		if p.picker != nil {
+			p.picker.PeerHave(index)
+		}
+		return true, nil
 
+	case msgExtended:
+		if len(msg.payload) == 0 {
+			return false, errors.New("extended message without id")
+		}
+		if msg.payload[0] == localUTMetadataID {
+			return false, p.applyMetadataMessage(msg.payload[1:])
+		}
+		if msg.payload[0] != extHandshakeID {
+			// ut_pex is handled by handleMessage, outside the lock; no
+			// other extensions are supported.
+			return false, nil
+		}
+		ext, err := parseExtHandshake(msg.payload[1:])
+		if err != nil {
+			return false, err
+		}
+		p.reqq = ext.reqq
+		if p.ipVoter != nil && ext.yourIP != nil {
+			p.ipVoter.Vote(p.Addr, ext.yourIP)
+		}
+		p.utMetadataID = ext.m[extUTMetadata]
+		p.metadataSize = ext.metadataSize
+		p.utPexID = ext.m[extUTPex]
+		if p.listenAddr == "" && ext.port > 0 {
+			if host, _, err := net.SplitHostPort(p.Addr); err == nil {
+				port := strconv.Itoa(ext.port)
+				p.listenAddr = net.JoinHostPort(host, port)
+			}
+		}
+		select {
+		case <-p.extReady:
 		default:
-			// raise error/log
+			close(p.extReady)
+		}
+
+	case msgSuggest, msgAllowedFast:
+		// Hints we don't act on; only a piece out of range is an error.
+		index, err := parseIndex(msg)
+		if err != nil {
+			return false, err
+		}
+		if index >= p.numPieces {
+			return false, fmt.Errorf(
+				"message %d for piece %d out of range",
+				msg.id,
+				index,
+			)
+		}
+
+	case msgRejectRequest:
+		// The scheduler doesn't take single blocks back; another peer takes
+		// the block over once it has been outstanding for too long.
+		if _, _, _, err := parseBlockRef(msg); err != nil {
+			return false, err
+		}
+
+	case msgPiece:
+		if len(msg.payload) < 8 {
+			return false, fmt.Errorf(
+				"piece of %d bytes, want at least 8",
+				len(msg.payload),
+			)
+		}
+		// Counted towards the peer's standing with the choker.
+		p.received += int64(len(msg.payload) - 8)
+		p.lastBlock = p.clock.Now()
+
+	default:
+		// raise error/log
+	}
+
+	return false, nil
+}
+
+// serveRequest answers a block request from the peer. Requests while the peer
+// is choked, or for pieces we don't have, are dropped, or rejected if the peer
+// speaks the fast extension; a request that reaches past the end of its piece
+// breaks the protocol.
+func (p *Peer) serveRequest(msg *message) error {
+	if len(msg.payload) != 12 {
+		return fmt.Errorf("request of %d bytes, want 12", len(msg.payload))
+	}
+	index := int(binary.BigEndian.Uint32(msg.payload[0:4]))
+	begin := int64(binary.BigEndian.Uint32(msg.payload[4:8]))
+	length := int64(binary.BigEndian.Uint32(msg.payload[8:12]))
+
+	if p.info == nil || p.data == nil {
+		return p.rejectRequest(msg)
+	}
+	if index >= p.numPieces {
+		return fmt.Errorf("request for piece %d out of range", index)
+	}
+	pieceSize := p.info.PieceSize(index)
+	if length == 0 || length > maxRequestLength || begin+length > pieceSize {
+		return fmt.Errorf(
+			"request for %d bytes at %d of piece %d, which is %d bytes",
+			length,
+			begin,
+			index,
+			pieceSize,
+		)
+	}
+
+	p.mu.Lock()
+	choking := p.state.amChoking
+	p.mu.Unlock()
+	if choking || (p.picker != nil && !p.picker.Has(index)) {
+		return p.rejectRequest(msg)
+	}
+
+	block := make([]byte, length)
+	offset := int64(index)*p.info.PieceLen + begin
+	if _, err := p.data.ReadAt(block, offset); err != nil {
+		// Our storage failing isn't the peer's fault; don't hold it
+		// against it.
+		return p.rejectRequest(msg)
+	}
+	if p.upload != nil {
+		if err := p.upload.WaitN(context.Background(), len(block)); err != nil {
+			return err
 		}
 	}
+
+	if err := p.sendMessage(messagePiece(index, int(begin), block)); err != nil {
+		return err
+	}
+	if p.onUpload != nil {
+		p.onUpload(p, len(block))
+	}
+	return nil
+}
+
+// rejectRequest tells a peer speaking the fast extension that we won't serve
+// its request, so it can ask someone else right away. Other peers aren't told.
+func (p *Peer) rejectRequest(request *message) error {
+	if !p.fast {
+		return nil
+	}
+
+	return p.sendMessage(&message{
+		id:      msgRejectRequest,
+		payload: request.payload,
+	})
+}
+
+// replaceBitfield swaps in a complete new view of the peer's pieces, keeping
+// numHave and the picker's availability in step. Callers must hold p.mu.
+func (p *Peer) replaceBitfield(bitfield utils.Bitfield) {
+	if p.picker != nil {
+		p.picker.RemovePeer(p.bitfield)
+		p.picker.AddPeer(bitfield)
+	}
+
+	p.bitfield = bitfield
+	p.numHave = bitfield.Count()
+}
+
+// remoteIP returns the IP address conn is connected to, or nil if it isn't a
+// TCP connection.
+func remoteIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// availability returns a copy of the peer's bitfield.
+func (p *Peer) availability() utils.Bitfield {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return slices.Clone(p.bitfield)
+}
+
+// forgetAvailability withdraws the peer's pieces from the picker once it's
+// gone.
+func (p *Peer) forgetAvailability() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.picker != nil {
+		p.picker.RemovePeer(p.bitfield)
+	}
+	p.bitfield = utils.NewBitfield(p.numPieces)
+	p.numHave = 0
+}
+
+// setInterested records and sends a change in our interest. Callers must hold
+// p.writeMu.
+func (p *Peer) setInterested(interested bool) error {
+	p.mu.Lock()
+	changed := p.state.amInterested != interested
+	p.state.amInterested = interested
+	// A peer only owes us blocks from the moment we want some.
+	if changed && interested {
+		p.lastBlock = p.clock.Now()
+	}
+	p.mu.Unlock()
+
+	if !changed {
+		return nil
+	}
+
+	msg := messageNotInterested()
+	if interested {
+		msg = messageInterested()
+	}
+	return p.writeMessage(msg)
 }
 
 func (p *Peer) sendMessage(message *message) error {
-	_, err := p.conn.Write(message.marshal())
-	return err
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	return p.writeMessage(message)
+}
+
+// writeMessage writes message to the connection. Callers must hold p.writeMu.
+func (p *Peer) writeMessage(message *message) error {
+	if _, err := p.conn.Write(message.marshal()); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.lastSent = p.clock.Now()
+	p.mu.Unlock()
+	return nil
 }
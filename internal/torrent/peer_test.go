@@ -0,0 +1,1112 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prxssh/relay/internal/tracker"
+	"github.com/prxssh/relay/internal/utils"
+)
+
+func TestPeerIsSeed(t *testing.T) {
+	const numPieces = 10
+
+	bitfield := func(pieces ...int) *message {
+		bf := utils.NewBitfield(numPieces)
+		for _, i := range pieces {
+			bf.Set(i)
+		}
+		return &message{id: msgBitfield, payload: bf}
+	}
+
+	testCases := []struct {
+		name     string
+		messages []*message
+		seed     bool
+		pieces   int
+	}{
+		{
+			name:     "full bitfield",
+			messages: []*message{bitfield(0, 1, 2, 3, 4, 5, 6, 7, 8, 9)},
+			seed:     true,
+			pieces:   numPieces,
+		},
+		{
+			name:     "partial bitfield",
+			messages: []*message{bitfield(0, 1, 2)},
+			pieces:   3,
+		},
+		{
+			name: "completed through have",
+			messages: []*message{
+				bitfield(0, 1, 2, 3, 4, 5, 6, 7, 8),
+				messageHave(8),
+				messageHave(9),
+			},
+			seed:   true,
+			pieces: numPieces,
+		},
+		{
+			name:     "have all",
+			messages: []*message{{id: msgHaveAll}},
+			seed:     true,
+			pieces:   numPieces,
+		},
+		{
+			name: "have none after have all",
+			messages: []*message{
+				{id: msgHaveAll},
+				{id: msgHaveNone},
+			},
+			pieces: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newPeer("test", nil, numPieces, nil)
+			for _, msg := range tc.messages {
+				if err := p.handleMessage(msg); err != nil {
+					t.Fatalf("handleMessage(%d): %v", msg.id, err)
+				}
+			}
+
+			if got := p.IsSeed(numPieces); got != tc.seed {
+				t.Errorf("IsSeed = %v, want %v", got, tc.seed)
+			}
+			stats := p.Stats()
+			if stats.IsSeed != tc.seed || stats.Pieces != tc.pieces {
+				t.Errorf(
+					"stats seed=%v pieces=%d, want seed=%v pieces=%d",
+					stats.IsSeed,
+					stats.Pieces,
+					tc.seed,
+					tc.pieces,
+				)
+			}
+		})
+	}
+}
+
+func TestPeerHaveSetsBitfieldBits(t *testing.T) {
+	const numPieces = 10
+
+	p := newPeer("test", nil, numPieces, nil)
+	for _, msg := range []*message{
+		{id: msgBitfield, payload: utils.NewBitfield(numPieces)},
+		messageHave(3),
+		messageHave(7),
+		messageHave(7),
+	} {
+		if err := p.handleMessage(msg); err != nil {
+			t.Fatalf("handleMessage(%d): %v", msg.id, err)
+		}
+	}
+
+	bf := p.availability()
+	for i := 0; i < numPieces; i++ {
+		if want := i == 3 || i == 7; bf.Has(i) != want {
+			t.Errorf("piece %d: has = %v, want %v", i, bf.Has(i), want)
+		}
+	}
+	if got := p.Stats().Pieces; got != 2 {
+		t.Errorf("pieces = %d, want 2", got)
+	}
+}
+
+func TestPeerHandsBlocksToOnBlock(t *testing.T) {
+	p := newPeer("test", nil, 2, nil)
+
+	var got []BlockRequest
+	p.onBlock = func(from *Peer, index, begin int, block []byte) {
+		if from != p {
+			t.Error("block handed over from another peer")
+		}
+		got = append(got, BlockRequest{index, begin, len(block)})
+	}
+	for _, msg := range []*message{
+		messagePiece(1, 0, make([]byte, BlockSize)),
+		messagePiece(1, BlockSize, make([]byte, 10)),
+	} {
+		if err := p.handleMessage(msg); err != nil {
+			t.Fatalf("handleMessage: %v", err)
+		}
+	}
+
+	want := []BlockRequest{{1, 0, BlockSize}, {1, BlockSize, 10}}
+	if !slices.Equal(got, want) {
+		t.Errorf("blocks = %v, want %v", got, want)
+	}
+}
+
+func TestPeerReportsUpdates(t *testing.T) {
+	p := newPeer("test", nil, 2, nil)
+
+	var updates int
+	p.applyOpts(&PeerConnectOpts{OnUpdate: func(from *Peer) {
+		if from != p {
+			t.Error("update reported for another peer")
+		}
+		updates++
+	}})
+
+	testCases := []struct {
+		msg  *message
+		want bool
+	}{
+		{messageUnchoke(), true},
+		{messageHave(1), true},
+		{messagePiece(1, 0, make([]byte, 10)), true},
+		{messageInterested(), false},
+		{messageChoke(), true},
+	}
+	for _, tc := range testCases {
+		before := updates
+		if err := p.handleMessage(tc.msg); err != nil {
+			t.Fatalf("handleMessage(%d): %v", tc.msg.id, err)
+		}
+		if got := updates > before; got != tc.want {
+			t.Errorf(
+				"message %d reported: %v, want %v",
+				tc.msg.id,
+				got,
+				tc.want,
+			)
+		}
+	}
+}
+
+func TestPeerRejectsMalformedAvailability(t *testing.T) {
+	testCases := []struct {
+		name string
+		msg  *message
+	}{
+		{"short bitfield", &message{id: msgBitfield, payload: []byte{0xFF}}},
+		{
+			"bitfield with spare bits",
+			&message{id: msgBitfield, payload: []byte{0xFF, 0xE0}},
+		},
+		{"have out of range", messageHave(10)},
+		{"short have", &message{id: msgHave, payload: []byte{0, 1}}},
+		{"suggest out of range", messageSuggest(10)},
+		{"allowed fast out of range", messageAllowedFast(10)},
+		{
+			"short reject",
+			&message{id: msgRejectRequest, payload: []byte{0, 0, 0, 1}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newPeer("test", nil, 10, nil)
+			if err := p.handleMessage(tc.msg); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+// pipePeer returns a peer connected through an in-memory pipe and a channel
+// receiving every message the peer sends to the remote end.
+func pipePeer(
+	t *testing.T,
+	numPieces int,
+	picker *Picker,
+) (*Peer, <-chan *message) {
+	t.Helper()
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	sent := make(chan *message, 16)
+	go func() {
+		defer close(sent)
+		for {
+			msg, err := unmarshalMessage(remote)
+			if err != nil {
+				return
+			}
+			sent <- msg
+		}
+	}()
+
+	return newPeer("pipe", local, numPieces, picker), sent
+}
+
+// remotePeer is the far end of an in-memory connection to a Peer under test,
+// scripted by the test: it sends whatever messages the test hands it and
+// collects the messages the peer sends.
+type remotePeer struct {
+	t    *testing.T
+	conn net.Conn
+	sent <-chan *message
+}
+
+// connectedPeer returns a started peer that completed the handshake with a
+// scripted remote over an in-memory pipe, as if we had dialed it. The remote
+// supports the extension protocol and the fast extension; our extended
+// handshake and the message telling it our pieces have already been consumed.
+func connectedPeer(
+	t *testing.T,
+	numPieces int,
+	picker *Picker,
+) (*Peer, *remotePeer) {
+	t.Helper()
+
+	local, conn := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		conn.Close()
+	})
+
+	opts := &PeerConnectOpts{
+		InfoHash: [20]byte{1},
+		PeerID:   [20]byte{'l'},
+		Pieces:   int64(numPieces),
+		Picker:   picker,
+	}
+
+	sent := make(chan *message, 16)
+	go func() {
+		defer close(sent)
+
+		if _, err := readHanshake(conn); err != nil {
+			return
+		}
+		h := newHandshake(opts.InfoHash, [20]byte{'r'})
+		if _, err := conn.Write(h.serialize()); err != nil {
+			return
+		}
+		for {
+			msg, err := unmarshalMessage(conn)
+			if err != nil {
+				return
+			}
+			sent <- msg
+		}
+	}()
+
+	p := newPeer("pipe", local, numPieces, picker)
+	if err := p.peformHandshake(opts); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	go p.Start()
+
+	remote := &remotePeer{t: t, conn: conn, sent: sent}
+	remote.expect(msgExtended)
+	select {
+	case msg := <-sent:
+		if msg == nil || (msg.id != msgBitfield && msg.id != msgHaveAll &&
+			msg.id != msgHaveNone) {
+			t.Fatalf("peer sent %v, want its pieces", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the peer's pieces")
+	}
+	return p, remote
+}
+
+// send delivers msg to the peer.
+func (r *remotePeer) send(msg *message) {
+	r.t.Helper()
+
+	if _, err := r.conn.Write(msg.marshal()); err != nil {
+		r.t.Fatalf("sending message %d: %v", msg.id, err)
+	}
+}
+
+// expect returns the next message from the peer, failing unless it's a want.
+func (r *remotePeer) expect(want messageid) *message {
+	r.t.Helper()
+
+	return expectMessage(r.t, r.sent, want)
+}
+
+// waitFor polls cond until it holds, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// expectMessage returns the next message on sent, failing the test unless
+// it's a want.
+func expectMessage(
+	t *testing.T,
+	sent <-chan *message,
+	want messageid,
+) *message {
+	t.Helper()
+
+	select {
+	case msg := <-sent:
+		if msg == nil || msg.id != want {
+			t.Fatalf("peer sent %v, want message %d", msg, want)
+		}
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for message %d", want)
+		return nil
+	}
+}
+
+func TestPeerInterestFollowsAvailability(t *testing.T) {
+	const numPieces = 4
+
+	picker := NewPicker(numPieces)
+	picker.SetHave(0)
+	picker.SetHave(1)
+
+	p, sent := pipePeer(t, numPieces, picker)
+
+	steps := []struct {
+		name string
+		// Either a message from the peer or something happening on our side
+		msg    *message
+		action func()
+		// Message we expect to send in response, if any
+		want       messageid
+		wantSent   bool
+		interested bool
+	}{
+		{
+			name: "bitfield with only pieces we have",
+			msg: &message{
+				id:      msgBitfield,
+				payload: utils.Bitfield{0b11000000},
+			},
+		},
+		{
+			name:       "have for a piece we need",
+			msg:        messageHave(2),
+			want:       msgInterested,
+			wantSent:   true,
+			interested: true,
+		},
+		{
+			name:       "duplicate have",
+			msg:        messageHave(2),
+			interested: true,
+		},
+		{
+			name: "we complete the only piece the peer could give us",
+			action: func() {
+				picker.SetHave(2)
+				if err := p.UpdateInterest(); err != nil {
+					t.Fatalf("UpdateInterest: %v", err)
+				}
+			},
+			want:     msgNotInterested,
+			wantSent: true,
+		},
+		{
+			name:       "have all",
+			msg:        &message{id: msgHaveAll},
+			want:       msgInterested,
+			wantSent:   true,
+			interested: true,
+		},
+	}
+
+	for _, step := range steps {
+		if step.msg != nil {
+			if err := p.handleMessage(step.msg); err != nil {
+				t.Fatalf("%s: handleMessage: %v", step.name, err)
+			}
+		}
+		if step.action != nil {
+			step.action()
+		}
+
+		if step.wantSent {
+			expectMessage(t, sent, step.want)
+		}
+		if got := p.Stats().AmInterested; got != step.interested {
+			t.Fatalf(
+				"%s: interested = %v, want %v",
+				step.name,
+				got,
+				step.interested,
+			)
+		}
+	}
+
+	// Messages arrive in order, so a spurious interest message would show up
+	// ahead of this keep-alive.
+	if err := p.sendMessage(nil); err != nil {
+		t.Fatalf("sendMessage: %v", err)
+	}
+	if msg := <-sent; msg != nil {
+		t.Fatalf("unexpected message %d", msg.id)
+	}
+}
+
+func TestPeerRequestsOnlyWhenUnchoked(t *testing.T) {
+	picker := NewPicker(1)
+	p, sent := pipePeer(t, 1, picker)
+
+	err := p.SendRequest(0, 0, BlockSize)
+	if !errors.Is(err, ErrChoked) {
+		t.Fatalf("request while uninterested: err = %v, want ErrChoked", err)
+	}
+
+	if err := p.handleMessage(&message{id: msgHaveAll}); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, sent, msgInterested)
+
+	err = p.SendRequest(0, 0, BlockSize)
+	if !errors.Is(err, ErrChoked) {
+		t.Fatalf("request while choked: err = %v, want ErrChoked", err)
+	}
+
+	if err := p.handleMessage(messageUnchoke()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SendRequest(0, 0, BlockSize); err != nil {
+		t.Fatalf("request after unchoke: %v", err)
+	}
+	expectMessage(t, sent, msgRequest)
+}
+
+func TestPeerChokeAndInterestTransitions(t *testing.T) {
+	p, sent := pipePeer(t, 1, nil)
+
+	// Our side: only actual changes go out on the wire.
+	for _, interested := range []bool{true, true, false} {
+		if err := p.SetInterested(interested); err != nil {
+			t.Fatalf("SetInterested(%v): %v", interested, err)
+		}
+	}
+	for _, choking := range []bool{false, false, true} {
+		if err := p.SetChoking(choking); err != nil {
+			t.Fatalf("SetChoking(%v): %v", choking, err)
+		}
+	}
+	for _, want := range []messageid{
+		msgInterested,
+		msgNotInterested,
+		msgUnchoke,
+		msgChoke,
+	} {
+		expectMessage(t, sent, want)
+	}
+
+	// The peer's side.
+	steps := []struct {
+		msg            *message
+		peerChoking    bool
+		peerInterested bool
+	}{
+		{messageInterested(), true, true},
+		{messageUnchoke(), false, true},
+		{messageNotInterested(), false, false},
+		{messageChoke(), true, false},
+	}
+	for _, step := range steps {
+		if err := p.handleMessage(step.msg); err != nil {
+			t.Fatalf("handleMessage(%d): %v", step.msg.id, err)
+		}
+		stats := p.Stats()
+		if stats.PeerChoking != step.peerChoking ||
+			stats.PeerInterested != step.peerInterested {
+			t.Errorf(
+				"after message %d: choking %v, interested %v; want %v, %v",
+				step.msg.id,
+				stats.PeerChoking,
+				stats.PeerInterested,
+				step.peerChoking,
+				step.peerInterested,
+			)
+		}
+	}
+}
+
+// TestPeerConcurrentAccess runs the read loop while others update interest,
+// request blocks and read stats. It's meant to run under -race.
+func TestPeerConcurrentAccess(t *testing.T) {
+	const numPieces = 64
+
+	picker := NewPicker(numPieces)
+	local, remote := net.Pipe()
+	p := newPeer("pipe", local, numPieces, picker)
+
+	// Drain whatever the peer sends us.
+	go io.Copy(io.Discard, remote)
+
+	done := make(chan struct{})
+	go func() {
+		p.Start()
+		close(done)
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < numPieces; i++ {
+			remote.Write(messageHave(i).marshal())
+			if i == numPieces/2 {
+				remote.Write(messageUnchoke().marshal())
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < numPieces; i++ {
+			picker.SetHave(i)
+			p.UpdateInterest()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < numPieces; i++ {
+			p.Stats()
+			p.IsSeed(numPieces)
+			p.SendRequest(i, 0, BlockSize)
+		}
+	}()
+	wg.Wait()
+
+	remote.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("read loop did not exit after the connection closed")
+	}
+
+	if p.Stats().Pieces != 0 {
+		t.Error("peer kept its pieces after disconnecting")
+	}
+}
+
+func TestPeerCountsConnectionsByCrypto(t *testing.T) {
+	local, remote := net.Pipe()
+	p := newPeer("pipe", local, 1, nil)
+	if p.IsEncrypted() || p.Stats().Crypto != CryptoPlaintext {
+		t.Fatalf("crypto = %v, want plaintext", p.Stats().Crypto)
+	}
+
+	before := Connections()
+	done := make(chan struct{})
+	go func() {
+		p.Start()
+		close(done)
+	}()
+
+	// Pipe writes block until read, so once this returns the read loop
+	// is running.
+	remote.Write(messageUnchoke().marshal())
+	if got := Connections(); got.Plaintext != before.Plaintext+1 ||
+		got.Encrypted != before.Encrypted {
+		t.Errorf("connections while running = %+v, before %+v", got, before)
+	}
+
+	remote.Close()
+	<-done
+	if got := Connections(); got != before {
+		t.Errorf("connections after close = %+v, want %+v", got, before)
+	}
+}
+
+func TestAcceptPeer(t *testing.T) {
+	known := [20]byte{1}
+	picker := NewPicker(4)
+	opts := &PeerConnectOpts{
+		InfoHash: known,
+		PeerID:   [20]byte{9},
+		Pieces:   4,
+		Picker:   picker,
+	}
+	lookup := func(infoHash [20]byte) (*PeerConnectOpts, bool) {
+		if infoHash != known {
+			return nil, false
+		}
+		return opts, true
+	}
+
+	// dial sends the handshake of a remote peer asking for infoHash. It
+	// returns the accepted peer and whatever we answered until the
+	// connection was closed or went quiet.
+	dial := func(infoHash [20]byte) (*Peer, []byte, error) {
+		local, remote := net.Pipe()
+		t.Cleanup(func() {
+			local.Close()
+			remote.Close()
+		})
+
+		reply := make(chan []byte, 1)
+		go func() {
+			remote.Write(newHandshake(infoHash, [20]byte{7}).serialize())
+
+			var buf bytes.Buffer
+			remote.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			io.Copy(&buf, remote)
+			reply <- buf.Bytes()
+		}()
+
+		p, err := AcceptPeer(local, lookup)
+		return p, <-reply, err
+	}
+
+	t.Run("unknown info hash", func(t *testing.T) {
+		_, reply, err := dial([20]byte{2})
+		if !errors.Is(err, ErrUnknownInfoHash) {
+			t.Fatalf("AcceptPeer: err = %v, want ErrUnknownInfoHash", err)
+		}
+
+		// Closed without a word, and the torrent we do serve is untouched.
+		if len(reply) != 0 {
+			t.Errorf("rejected peer got %d bytes back", len(reply))
+		}
+		for i, n := range picker.availability {
+			if n != 0 {
+				t.Errorf("piece %d availability = %d, want 0", i, n)
+			}
+		}
+	})
+
+	t.Run("known info hash", func(t *testing.T) {
+		p, reply, err := dial(known)
+		if err != nil {
+			t.Fatalf("AcceptPeer: %v", err)
+		}
+		if p == nil {
+			t.Fatal("AcceptPeer returned no peer")
+		}
+
+		got, err := readHanshake(bytes.NewReader(reply))
+		if err != nil {
+			t.Fatalf("reading our handshake: %v", err)
+		}
+		if got.infoHash != known || got.peerID != opts.PeerID {
+			t.Error("handshake reply doesn't identify us and the torrent")
+		}
+	})
+}
+
+func TestAcceptPeerRejectsBadHandshake(t *testing.T) {
+	orig := handshakeTimeout
+	handshakeTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { handshakeTimeout = orig })
+
+	full := newHandshake([20]byte{1}, [20]byte{7}).serialize()
+	wrongProtocol := slices.Clone(full)
+	copy(wrongProtocol[1:], "BitTorrent protocoX")
+
+	testCases := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		// A valid start, then nothing.
+		{"stalled", full[:10], os.ErrDeadlineExceeded},
+		{"wrong protocol string", wrongProtocol, errBadProtocol},
+		{"wrong protocol length", []byte("\x05hello"), errBadProtocol},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer remote.Close()
+			go remote.Write(tc.data)
+
+			lookup := func([20]byte) (*PeerConnectOpts, bool) {
+				return &PeerConnectOpts{}, true
+			}
+			start := time.Now()
+			_, err := AcceptPeer(local, lookup)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("AcceptPeer: err = %v, want %v", err, tc.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("rejecting the handshake took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestPeerKeepAliveIsNotActivity(t *testing.T) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	go io.Copy(io.Discard, remote)
+
+	clock := utils.NewFakeClock(time.Now())
+	p := newPeer("pipe", local, 1, NewPicker(1))
+	p.setClock(clock)
+	go p.readMessages()
+
+	// send delivers messages to the peer. Another message is sent after
+	// them, so they have been handled by the time send returns.
+	send := func(msgs ...*message) {
+		t.Helper()
+		for _, msg := range append(msgs, messageChoke()) {
+			data := []byte{0, 0, 0, 0}
+			if msg != nil {
+				data = msg.marshal()
+			}
+			if _, err := remote.Write(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	send(&message{id: msgHaveAll})
+	if !p.Stats().AmInterested {
+		t.Fatal("not interested in a seed")
+	}
+
+	clock.Advance(DefaultSnubTimeout + time.Second)
+	send(nil) // keep-alive
+	if !p.Alive() {
+		t.Error("peer sending keep-alives is not alive")
+	}
+	if !p.Snubbed(DefaultSnubTimeout) || !p.Useless(DefaultSnubTimeout) {
+		t.Error("keep-alives counted as useful activity")
+	}
+
+	send(messagePiece(0, 0, make([]byte, 16)))
+	if p.Snubbed(DefaultSnubTimeout) || p.Useless(DefaultSnubTimeout) {
+		t.Error("peer delivering blocks is considered useless")
+	}
+
+	clock.Advance(peerLivenessTimeout)
+	if p.Alive() || !p.Useless(DefaultSnubTimeout) {
+		t.Error("silent peer is still considered alive")
+	}
+}
+
+func TestPeerSnubTimerStartsWithInterest(t *testing.T) {
+	clock := utils.NewFakeClock(time.Now())
+	p, sent := pipePeer(t, 2, NewPicker(2))
+	p.setClock(clock)
+
+	// Long connected without anything we want, then it gets a piece.
+	clock.Advance(2 * DefaultSnubTimeout)
+	if err := p.handleMessage(messageHave(0)); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, sent, msgInterested)
+	if p.Snubbed(DefaultSnubTimeout) {
+		t.Fatal("peer snubbed as soon as we turned interested")
+	}
+
+	clock.Advance(DefaultSnubTimeout + time.Second)
+	if !p.Snubbed(DefaultSnubTimeout) {
+		t.Error("peer not snubbed after withholding blocks since")
+	}
+}
+
+func TestPeerSendsKeepAlivesWhenIdle(t *testing.T) {
+	clock := utils.NewFakeClock(time.Now())
+	p, sent := pipePeer(t, 1, NewPicker(1))
+	p.setClock(clock)
+
+	stopped := make(chan struct{})
+	go func() {
+		p.Start()
+		close(stopped)
+	}()
+	asleep := func() bool { return clock.Timers() == 1 }
+
+	waitFor(t, "keep-alive timer", asleep)
+	clock.Advance(keepAliveInterval - time.Second)
+	clock.Advance(time.Second)
+	if msg := <-sent; msg != nil {
+		t.Fatalf("sent message %d, want a keep-alive", msg.id)
+	}
+
+	// Any other message resets the interval.
+	waitFor(t, "keep-alive timer", asleep)
+	clock.Advance(keepAliveInterval / 2)
+	if err := p.SetInterested(true); err != nil {
+		t.Fatalf("SetInterested: %v", err)
+	}
+	expectMessage(t, sent, msgInterested)
+	clock.Advance(keepAliveInterval / 2)
+	waitFor(t, "keep-alive timer", asleep)
+	clock.Advance(keepAliveInterval / 2)
+	if msg := <-sent; msg != nil {
+		t.Fatalf("sent message %d, want a keep-alive", msg.id)
+	}
+
+	p.conn.Close()
+	<-stopped
+	waitFor(t, "keep-alive timer to stop", func() bool {
+		return clock.Timers() == 0
+	})
+}
+
+func TestPeerDownloadsBlockFromRemote(t *testing.T) {
+	picker := NewPicker(2)
+	p, remote := connectedPeer(t, 2, picker)
+
+	// The remote has piece 0, which we want.
+	remote.send(&message{id: msgBitfield, payload: []byte{0x80}})
+	remote.expect(msgInterested)
+
+	remote.send(messageUnchoke())
+	waitFor(t, "unchoke", p.CanRequest)
+
+	if err := p.SendRequest(0, 0, BlockSize); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	req := remote.expect(msgRequest)
+	want := messageRequest(0, 0, BlockSize)
+	if !bytes.Equal(req.payload, want.payload) {
+		t.Fatalf("request payload = %x, want %x", req.payload, want.payload)
+	}
+
+	remote.send(messagePiece(0, 0, make([]byte, BlockSize)))
+	waitFor(t, "block", func() bool {
+		return p.Stats().Received == BlockSize
+	})
+}
+
+func TestPeerRejectsConnectionToItself(t *testing.T) {
+	local, conn := net.Pipe()
+	defer local.Close()
+	defer conn.Close()
+
+	opts := &PeerConnectOpts{InfoHash: [20]byte{1}, PeerID: [20]byte{'l'}}
+	go func() {
+		if _, err := readHanshake(conn); err != nil {
+			return
+		}
+		conn.Write(newHandshake(opts.InfoHash, opts.PeerID).serialize())
+	}()
+
+	p := newPeer("pipe", local, 1, nil)
+	if err := p.peformHandshake(opts); err == nil {
+		t.Fatal("handshake with our own peer ID succeeded")
+	}
+}
+
+func TestPeerServesShortLastPiece(t *testing.T) {
+	// Two pieces, the last one 5000 bytes long.
+	info := &Info{
+		Length:   BlockSize*2 + 5000,
+		PieceLen: BlockSize * 2,
+		Pieces:   make([][20]byte, 2),
+	}
+	data := make([]byte, info.Length)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	testCases := []struct {
+		name          string
+		begin, length int
+		wantErr       bool
+	}{
+		{"whole piece", 0, 5000, false},
+		{"tail", 4000, 1000, false},
+		{"past the end", 4000, 1001, true},
+		{"starts at the end", 5000, 1, true},
+		{"full block", 0, BlockSize, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			picker := NewPicker(2)
+			picker.SetHave(1)
+			p, sent := pipePeer(t, 2, picker)
+			p.info = info
+			p.data = bytes.NewReader(data)
+			var uploaded int
+			p.onUpload = func(_ *Peer, n int) { uploaded += n }
+			if err := p.SetChoking(false); err != nil {
+				t.Fatal(err)
+			}
+			expectMessage(t, sent, msgUnchoke)
+
+			err := p.handleMessage(messageRequest(1, tc.begin, tc.length))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("handleMessage: err = %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+
+			msg := expectMessage(t, sent, msgPiece)
+			offset := int(info.PieceLen) + tc.begin
+			want := messagePiece(1, tc.begin, data[offset:offset+tc.length])
+			if !bytes.Equal(msg.payload, want.payload) {
+				t.Error("served block differs from the torrent's data")
+			}
+			if uploaded != tc.length {
+				t.Errorf("counted %d bytes uploaded, want %d", uploaded, tc.length)
+			}
+		})
+	}
+}
+
+func TestInboundAndOutboundPeersShareConnSlots(t *testing.T) {
+	slots := NewConnSlots(1, 0)
+	opts := &PeerConnectOpts{
+		InfoHash: [20]byte{1},
+		PeerID:   [20]byte{'l'},
+		Pieces:   4,
+		Slots:    slots,
+	}
+	remoteHandshake := newHandshake(opts.InfoHash, [20]byte{'r'})
+
+	// A peer answering our dials, then ignoring everything it's sent.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := readHanshake(conn); err != nil {
+					return
+				}
+				conn.Write(remoteHandshake.serialize())
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	remotePeer := &tracker.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+
+	// An inbound peer takes the only slot...
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go func() {
+		remote.Write(remoteHandshake.serialize())
+		io.Copy(io.Discard, remote)
+	}()
+	inbound, err := AcceptPeer(
+		local,
+		func([20]byte) (*PeerConnectOpts, bool) { return opts, true },
+	)
+	if err != nil {
+		t.Fatalf("AcceptPeer: %v", err)
+	}
+
+	// ...so dialing out is refused while it's connected...
+	_, err = connectToPeer(remotePeer, opts)
+	if !errors.Is(err, ErrConnLimit) {
+		t.Fatalf("connectToPeer: err = %v, want %v", err, ErrConnLimit)
+	}
+
+	// ...and works once it disconnected.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		inbound.Start()
+	}()
+	remote.Close()
+	<-done
+
+	outbound, err := connectToPeer(remotePeer, opts)
+	if err != nil {
+		t.Fatalf("connectToPeer after the inbound peer left: %v", err)
+	}
+	defer outbound.close()
+
+	if total, _ := slots.Count(opts.InfoHash); total != 1 {
+		t.Errorf("%d connections counted, want 1", total)
+	}
+
+	// Now the outbound peer keeps inbound ones out.
+	local, remote = net.Pipe()
+	defer remote.Close()
+	go remote.Write(remoteHandshake.serialize())
+	_, err = AcceptPeer(
+		local,
+		func([20]byte) (*PeerConnectOpts, bool) { return opts, true },
+	)
+	if !errors.Is(err, ErrConnLimit) {
+		t.Fatalf("AcceptPeer: err = %v, want %v", err, ErrConnLimit)
+	}
+}
+
+func TestPeerNegotiatesFastExtension(t *testing.T) {
+	testCases := []struct {
+		name string
+		fast bool
+		have []int
+		want messageid
+	}{
+		{"seed", true, []int{0, 1, 2}, msgHaveAll},
+		{"leech", true, nil, msgHaveNone},
+		{"partial", true, []int{1}, msgBitfield},
+		{"without fast extension", false, []int{1}, msgBitfield},
+		{"without fast extension or pieces", false, nil, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			picker := NewPicker(3)
+			for _, i := range tc.have {
+				picker.SetHave(i)
+			}
+			p, sent := pipePeer(t, 3, picker)
+			p.info = &Info{
+				Length:   3 * BlockSize,
+				PieceLen: BlockSize,
+				Pieces:   make([][20]byte, 3),
+			}
+			p.data = bytes.NewReader(make([]byte, 3*BlockSize))
+
+			remote := newHandshake([20]byte{1}, [20]byte{'r'})
+			if !tc.fast {
+				remote.reserved[fastReservedByte] &^= fastReservedBit
+			}
+			if err := p.sendAvailability(remote); err != nil {
+				t.Fatalf("sendAvailability: %v", err)
+			}
+			if tc.want != 0 {
+				msg := expectMessage(t, sent, tc.want)
+				if tc.want == msgBitfield &&
+					!bytes.Equal(msg.payload, []byte{0x40}) {
+					t.Errorf("bitfield %08b, want 01000000", msg.payload)
+				}
+			}
+
+			// A request while choked is rejected only with the fast
+			// extension; the unchoke after it is the next message otherwise.
+			req := messageRequest(1, 0, BlockSize)
+			if err := p.handleMessage(req); err != nil {
+				t.Fatalf("handleMessage: %v", err)
+			}
+			if tc.fast {
+				msg := expectMessage(t, sent, msgRejectRequest)
+				if !bytes.Equal(msg.payload, req.payload) {
+					t.Errorf("rejected %x, want %x", msg.payload, req.payload)
+				}
+			}
+			if err := p.SetChoking(false); err != nil {
+				t.Fatal(err)
+			}
+			expectMessage(t, sent, msgUnchoke)
+		})
+	}
+}
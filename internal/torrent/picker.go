@@ -0,0 +1,258 @@
+package torrent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prxssh/relay/internal/utils"
+)
+
+// Priority ranks how eagerly a piece (or a file, which translates into the
+// pieces spanning it) should be downloaded.
+type Priority int
+
+const (
+	// PrioritySkip excludes a piece from downloading altogether.
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+// Picker decides which piece to download next. Pieces with a deadline come
+// first, nearest deadline first. The rest are ordered by priority and, among
+// pieces of equal priority, the one the fewest peers have wins (rarest-first),
+// with ties broken by the lowest index. In sequential mode the lowest index
+// wins outright instead, for players that consume the data front to back.
+type Picker struct {
+	mu sync.RWMutex
+	// Pieces we have downloaded and verified
+	have utils.Bitfield
+	// Number of connected peers that have each piece
+	availability []int
+	// Download priority of each piece
+	priorities []Priority
+	// Time by which a piece is needed, e.g. by a streaming reader
+	deadlines map[int]time.Time
+	// Pick pieces in index order rather than rarest-first
+	sequential bool
+}
+
+func NewPicker(numPieces int) *Picker {
+	priorities := make([]Priority, numPieces)
+	for i := range priorities {
+		priorities[i] = PriorityNormal
+	}
+
+	return &Picker{
+		have:         utils.NewBitfield(numPieces),
+		availability: make([]int, numPieces),
+		priorities:   priorities,
+		deadlines:    make(map[int]time.Time),
+	}
+}
+
+// SetPriority changes the priority of a single piece. Out of range indices are
+// ignored.
+func (pk *Picker) SetPriority(index int, prio Priority) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	if !pk.inRange(index) {
+		return
+	}
+	pk.priorities[index] = prio
+}
+
+// Priority returns the priority of a piece.
+func (pk *Picker) Priority(index int) Priority {
+	pk.mu.RLock()
+	defer pk.mu.RUnlock()
+
+	if !pk.inRange(index) {
+		return PrioritySkip
+	}
+	return pk.priorities[index]
+}
+
+// SetDeadline sets the time by which the piece is needed. A piece with a
+// deadline is wanted even if its priority says to skip it. A zero deadline
+// clears it.
+func (pk *Picker) SetDeadline(index int, deadline time.Time) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	if !pk.inRange(index) {
+		return
+	}
+
+	if deadline.IsZero() {
+		delete(pk.deadlines, index)
+		return
+	}
+	pk.deadlines[index] = deadline
+}
+
+// Deadline returns the time by which the piece is needed, zero if it has no
+// deadline.
+func (pk *Picker) Deadline(index int) time.Time {
+	pk.mu.RLock()
+	defer pk.mu.RUnlock()
+
+	return pk.deadlines[index]
+}
+
+// SetSequential switches between picking pieces in index order and
+// rarest-first. Deadlines and priorities still come first either way.
+func (pk *Picker) SetSequential(sequential bool) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	pk.sequential = sequential
+}
+
+// Wanted reports whether the piece is to be downloaded at all, i.e. it has a
+// deadline or a priority other than PrioritySkip.
+func (pk *Picker) Wanted(index int) bool {
+	pk.mu.RLock()
+	defer pk.mu.RUnlock()
+
+	return pk.inRange(index) && pk.wanted(index)
+}
+
+// SetHave records that we have a verified copy of the piece, so it's never
+// picked again.
+func (pk *Picker) SetHave(index int) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	pk.have.Set(index)
+	delete(pk.deadlines, index)
+}
+
+// ClearHave forgets a piece we had, e.g. because it failed a recheck, so it's
+// downloaded again.
+func (pk *Picker) ClearHave(index int) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	pk.have.Clear(index)
+}
+
+// Has reports whether we have a verified copy of the piece.
+func (pk *Picker) Has(index int) bool {
+	pk.mu.RLock()
+	defer pk.mu.RUnlock()
+
+	return pk.have.Has(index)
+}
+
+// Done reports whether every wanted piece has been downloaded, i.e. all that
+// remains are pieces marked PrioritySkip.
+func (pk *Picker) Done() bool {
+	pk.mu.RLock()
+	defer pk.mu.RUnlock()
+
+	for i := range pk.priorities {
+		if pk.wanted(i) && !pk.have.Has(i) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AddPeer accounts for the pieces in a newly received peer bitfield.
+func (pk *Picker) AddPeer(bf utils.Bitfield) {
+	pk.updateAvailability(bf, 1)
+}
+
+// RemovePeer reverts AddPeer (and any PeerHave calls) for a peer that went
+// away.
+func (pk *Picker) RemovePeer(bf utils.Bitfield) {
+	pk.updateAvailability(bf, -1)
+}
+
+// PeerHave accounts for a single 'have' announcement from a peer.
+func (pk *Picker) PeerHave(index int) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	if pk.inRange(index) {
+		pk.availability[index]++
+	}
+}
+
+// Interesting reports whether a peer that has the pieces in peerHas has any
+// piece we still want, i.e. whether we should be interested in it.
+func (pk *Picker) Interesting(peerHas utils.Bitfield) bool {
+	_, ok := pk.Pick(peerHas, nil)
+	return ok
+}
+
+// Pick returns the best piece to request from a peer that has the pieces in
+// peerHas. Pieces for which skip returns true (e.g. already in flight) are
+// ignored; skip may be nil. It returns false when the peer has nothing we
+// want.
+func (pk *Picker) Pick(peerHas utils.Bitfield, skip func(int) bool) (int, bool) {
+	pk.mu.RLock()
+	defer pk.mu.RUnlock()
+
+	best := -1
+	for i := range pk.priorities {
+		if !pk.wanted(i) || pk.have.Has(i) || !peerHas.Has(i) {
+			continue
+		}
+		if skip != nil && skip(i) {
+			continue
+		}
+
+		if best == -1 || pk.better(i, best) {
+			best = i
+		}
+	}
+
+	return best, best != -1
+}
+
+/////////////// Private ///////////////
+
+func (pk *Picker) inRange(index int) bool {
+	return index >= 0 && index < len(pk.priorities)
+}
+
+func (pk *Picker) wanted(index int) bool {
+	_, hasDeadline := pk.deadlines[index]
+	return hasDeadline || pk.priorities[index] != PrioritySkip
+}
+
+// better reports whether piece a should be picked over piece b.
+func (pk *Picker) better(a, b int) bool {
+	deadlineA, hasA := pk.deadlines[a]
+	deadlineB, hasB := pk.deadlines[b]
+	if hasA || hasB {
+		if hasA && hasB {
+			return deadlineA.Before(deadlineB)
+		}
+		return hasA
+	}
+
+	if pk.priorities[a] != pk.priorities[b] {
+		return pk.priorities[a] > pk.priorities[b]
+	}
+	if pk.sequential {
+		return a < b
+	}
+	return pk.availability[a] < pk.availability[b]
+}
+
+func (pk *Picker) updateAvailability(bf utils.Bitfield, delta int) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	for i := range pk.availability {
+		if bf.Has(i) {
+			pk.availability[i] += delta
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prxssh/relay/internal/utils"
+)
+
+func fullBitfield(n int) utils.Bitfield {
+	bf := utils.NewBitfield(n)
+	for i := 0; i < n; i++ {
+		bf.Set(i)
+	}
+	return bf
+}
+
+func TestPickerPick(t *testing.T) {
+	const numPieces = 4
+
+	// Pieces 0 and 1 are common, 2 and 3 are rare.
+	common := utils.NewBitfield(numPieces)
+	common.Set(0)
+	common.Set(1)
+
+	testCases := []struct {
+		name  string
+		setup func(pk *Picker)
+		skip  func(int) bool
+		want  int
+		found bool
+	}{
+		{
+			name:  "rarest first among equal priorities",
+			setup: func(pk *Picker) {},
+			want:  2,
+			found: true,
+		},
+		{
+			name: "higher priority beats rarity",
+			setup: func(pk *Picker) {
+				pk.SetPriority(1, PriorityHigh)
+			},
+			want:  1,
+			found: true,
+		},
+		{
+			name: "skipped and owned pieces are never picked",
+			setup: func(pk *Picker) {
+				pk.SetPriority(2, PrioritySkip)
+				pk.SetHave(3)
+			},
+			want:  0,
+			found: true,
+		},
+		{
+			name: "nearest deadline beats priority",
+			setup: func(pk *Picker) {
+				now := time.Now()
+				pk.SetPriority(1, PriorityHigh)
+				pk.SetDeadline(0, now.Add(2*time.Second))
+				pk.SetDeadline(3, now.Add(time.Second))
+			},
+			want:  3,
+			found: true,
+		},
+		{
+			name: "deadline overrides skip",
+			setup: func(pk *Picker) {
+				for i := 0; i < numPieces; i++ {
+					pk.SetPriority(i, PrioritySkip)
+				}
+				pk.SetDeadline(1, time.Now())
+			},
+			want:  1,
+			found: true,
+		},
+		{
+			name: "sequential picks the lowest index",
+			setup: func(pk *Picker) {
+				pk.SetSequential(true)
+			},
+			want:  0,
+			found: true,
+		},
+		{
+			name: "sequential still honours deadlines",
+			setup: func(pk *Picker) {
+				pk.SetSequential(true)
+				pk.SetDeadline(2, time.Now())
+			},
+			want:  2,
+			found: true,
+		},
+		{
+			name:  "skip callback excludes in-flight pieces",
+			setup: func(pk *Picker) {},
+			skip:  func(i int) bool { return i != 1 },
+			want:  1,
+			found: true,
+		},
+		{
+			name: "nothing wanted",
+			setup: func(pk *Picker) {
+				for i := 0; i < numPieces; i++ {
+					pk.SetPriority(i, PrioritySkip)
+				}
+			},
+			want:  -1,
+			found: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pk := NewPicker(numPieces)
+			pk.AddPeer(common)
+			pk.AddPeer(common)
+			pk.AddPeer(fullBitfield(numPieces))
+			tc.setup(pk)
+
+			got, found := pk.Pick(fullBitfield(numPieces), tc.skip)
+			if got != tc.want || found != tc.found {
+				t.Errorf(
+					"Pick() = (%d, %v), want (%d, %v)",
+					got,
+					found,
+					tc.want,
+					tc.found,
+				)
+			}
+		})
+	}
+}
@@ -2,7 +2,6 @@ package torrent
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"fmt"
 	"sync"
 )
@@ -18,16 +17,19 @@ type Block struct {
 // PieceState represents the state of a piece
 type PieceState int
 
-// Piece represents a piece of the torrent
+// Piece represents a piece of the torrent. Its lock comes last in the lock
+// order: methods never call out while holding it, and it must not be held
+// while acquiring any other lock.
 type Piece struct {
 	sync.RWMutex
-	Index      int             // Piece index
-	Length     int             // Length of the piece in bytes
-	Downloaded int             // Number of bytes downloaded
-	Blocks     []*Block        // Blocks within the piece
-	State      PieceState      // Current state of the piece
-	Requested  map[int]bool    // Tracks which blocks have been requested
-	Hash       [sha1.Size]byte // Expected SHA1 hash
+	Index      int          // Piece index
+	Length     int          // Length of the piece in bytes
+	Downloaded int          // Number of bytes downloaded
+	Blocks     []*Block     // Blocks within the piece
+	State      PieceState   // Current state of the piece
+	Requested  map[int]bool // Tracks which blocks have been requested
+	Hash       []byte       // Expected digest
+	verifier   Verifier     // Computes the digest compared against Hash
 }
 
 const (
@@ -38,7 +40,7 @@ const (
 
 const BlockSize = 16 * 1024 // 16KB
 
-func NewPiece(index, length int, hash [sha1.Size]byte) *Piece {
+func NewPiece(index, length int, hash []byte, verifier Verifier) *Piece {
 	numBlocks := length / BlockSize
 	if length%BlockSize != 0 {
 		numBlocks++
@@ -64,6 +66,7 @@ func NewPiece(index, length int, hash [sha1.Size]byte) *Piece {
 		Blocks:    blocks,
 		State:     PieceStateNone,
 		Requested: make(map[int]bool),
+		verifier:  verifier,
 	}
 }
 
@@ -80,7 +83,9 @@ func (p *Piece) MarkRequested(blockIndex int) {
 	p.State = PieceStatePending
 }
 
-// AddBlock adds a downloaded block to the piece
+// AddBlock adds a downloaded block to the piece. A block that was already
+// added, e.g. because it was requested from several peers in endgame, is
+// ignored: the data that came first is kept and counted once.
 func (p *Piece) AddBlock(begin int, data []byte) error {
 	p.Lock()
 	defer p.Unlock()
@@ -98,6 +103,10 @@ func (p *Piece) AddBlock(begin int, data []byte) error {
 			)
 		}
 
+		if block.Data != nil {
+			return nil
+		}
+
 		p.Blocks[i].Data = data
 		p.Downloaded += len(data)
 
@@ -112,7 +121,7 @@ func (p *Piece) IsComplete() bool {
 	p.RLock()
 	defer p.RUnlock()
 
-	return p.Length == p.Downloaded
+	return p.isComplete()
 }
 
 // AssembleData copies all block data into a single byte slice
@@ -120,38 +129,20 @@ func (p *Piece) AssembleData() []byte {
 	p.RLock()
 	defer p.RUnlock()
 
-	if !p.IsComplete() {
-		return nil
-	}
-
-	data := make([]byte, p.Length)
-	for _, block := range p.Blocks {
-		if block.Data == nil {
-			continue
-		}
-
-		copy(data[block.Begin:], block.Data)
-	}
-
-	return data
+	return p.assembleData()
 }
 
-// Verify validates the piece integrity using SHA1 hash
+// Verify validates the piece integrity against its expected digest
 func (p *Piece) Verify() bool {
 	p.RLock()
 	defer p.RUnlock()
 
-	if !p.IsComplete() {
-		return false
-	}
-
-	data := p.AssembleData()
+	data := p.assembleData()
 	if data == nil {
 		return false
 	}
 
-	hash := sha1.Sum(data)
-	return bytes.Equal(p.Hash[:], hash[:])
+	return bytes.Equal(p.Hash, p.verifier.Sum(data))
 }
 
 // NextRequest requests next block to download, or nil if all blocks are requested
@@ -189,3 +180,30 @@ func (p *Piece) ResetRequests() {
 		p.State = PieceStateNone
 	}
 }
+
+/////////////// Private ///////////////
+
+// The helpers below expect the caller to hold the piece's lock. RWMutex read
+// locks must not be taken recursively: a writer queued in between would
+// deadlock both.
+
+func (p *Piece) isComplete() bool {
+	return p.Length == p.Downloaded
+}
+
+func (p *Piece) assembleData() []byte {
+	if !p.isComplete() {
+		return nil
+	}
+
+	data := make([]byte, p.Length)
+	for _, block := range p.Blocks {
+		if block.Data == nil {
+			continue
+		}
+
+		copy(data[block.Begin:], block.Data)
+	}
+
+	return data
+}
@@ -0,0 +1,54 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+)
+
+func TestPieceAddBlockIgnoresDuplicates(t *testing.T) {
+	p := NewPiece(0, BlockSize*2, nil, nil)
+
+	first := bytes.Repeat([]byte{1}, BlockSize)
+	for _, data := range [][]byte{first, bytes.Repeat([]byte{2}, BlockSize)} {
+		if err := p.AddBlock(0, data); err != nil {
+			t.Fatalf("AddBlock: %v", err)
+		}
+	}
+
+	if p.Downloaded != BlockSize {
+		t.Errorf("Downloaded = %d, want %d", p.Downloaded, BlockSize)
+	}
+	if p.IsComplete() {
+		t.Error("piece complete with one of its two blocks")
+	}
+	if !bytes.Equal(p.Blocks[0].Data, first) {
+		t.Error("duplicate replaced the block's data")
+	}
+}
+
+func TestPieceAssembledFromTwoBlocksVerifies(t *testing.T) {
+	data := bytes.Repeat([]byte("piece"), (BlockSize+100)/5)
+	hash := sha1.Sum(data)
+	p := NewPiece(0, len(data), hash[:], VerifierFor(PieceHashesV1))
+
+	if err := p.AddBlock(BlockSize, data[BlockSize:]); err != nil {
+		t.Fatalf("AddBlock(second): %v", err)
+	}
+	if p.IsComplete() || p.Verify() {
+		t.Fatal("piece complete with one of its two blocks")
+	}
+	if err := p.AddBlock(0, data[:BlockSize]); err != nil {
+		t.Fatalf("AddBlock(first): %v", err)
+	}
+
+	if !p.IsComplete() {
+		t.Fatal("piece incomplete with all its blocks")
+	}
+	if !p.Verify() {
+		t.Error("piece failed verification")
+	}
+	if !bytes.Equal(p.AssembleData(), data) {
+		t.Error("assembled data differs")
+	}
+}
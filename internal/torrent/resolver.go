@@ -0,0 +1,74 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// dnsCacheTTL is how long a resolved peer host name is reused before it's
+// looked up again.
+const dnsCacheTTL = 5 * time.Minute
+
+// peerResolver resolves the host names of peers that weren't given by IP. It's
+// shared by every connection so a swarm full of the same names only costs a
+// lookup each.
+var peerResolver = newDNSCache(net.DefaultResolver.LookupIPAddr, dnsCacheTTL)
+
+// dnsCache remembers the address each host name resolved to for a while.
+// Failed lookups aren't cached.
+type dnsCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	lookup  func(ctx context.Context, host string) ([]net.IPAddr, error)
+	now     func() time.Time
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	ip      net.IP
+	expires time.Time
+}
+
+func newDNSCache(
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error),
+	ttl time.Duration,
+) *dnsCache {
+	return &dnsCache{
+		ttl:     ttl,
+		lookup:  lookup,
+		now:     time.Now,
+		entries: make(map[string]dnsEntry),
+	}
+}
+
+// resolve returns an address of host. IP literals are returned as they are.
+func (c *dnsCache) resolve(ctx context.Context, host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.ip, nil
+	}
+
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("resolve %s: no addresses", host)
+	}
+
+	ip := addrs[0].IP
+	c.mu.Lock()
+	c.entries[host] = dnsEntry{ip: ip, expires: c.now().Add(c.ttl)}
+	c.mu.Unlock()
+
+	return ip, nil
+}
@@ -0,0 +1,49 @@
+package torrent
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDNSCacheReusesLookups(t *testing.T) {
+	var lookups int
+	c := newDNSCache(
+		func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			lookups++
+			return []net.IPAddr{{IP: net.IPv4(10, 0, 0, byte(lookups))}}, nil
+		},
+		time.Minute,
+	)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		ip, err := c.resolve(context.Background(), "peer.example.org")
+		if err != nil {
+			t.Fatalf("resolve: %v", err)
+		}
+		if !ip.Equal(net.IPv4(10, 0, 0, 1)) {
+			t.Fatalf("resolved to %s, want the first lookup's 10.0.0.1", ip)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	ip, err := c.resolve(context.Background(), "peer.example.org")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if !ip.Equal(net.IPv4(10, 0, 0, 2)) || lookups != 2 {
+		t.Errorf(
+			"expired entry not looked up again: %s after %d lookups",
+			ip,
+			lookups,
+		)
+	}
+
+	if _, err := c.resolve(context.Background(), "10.1.2.3"); err != nil ||
+		lookups != 2 {
+		t.Error("IP literal was looked up")
+	}
+}
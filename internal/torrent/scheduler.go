@@ -0,0 +1,375 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prxssh/relay/internal/utils"
+)
+
+// DefaultMaxInFlight is the number of block requests kept outstanding per
+// peer unless configured otherwise.
+const DefaultMaxInFlight = 16
+
+// DefaultStealAfter is how long a block may stay outstanding with one peer
+// before an idle peer is allowed to take it over.
+const DefaultStealAfter = 30 * time.Second
+
+// BlockRequest identifies a block to request from a peer.
+type BlockRequest struct {
+	Piece  int
+	Begin  int
+	Length int
+}
+
+// Scheduler hands out blocks to request across all peers of a download.
+// Peers ask it for work instead of picking pieces themselves: it first
+// completes pieces already in progress, then starts new ones as the picker
+// orders them. Every peer has at most maxInFlight outstanding blocks, fewer if
+// it advertised a lower reqq. When there is no fresh work left, an idle peer
+// takes over blocks another peer has been sitting on for longer than
+// stealAfter, so one slow peer can't hold up a piece. A peer that snubs us,
+// see Peer.Snubbed, gets one block at a time until it delivers again, and one
+// that went silent gets none.
+//
+// Its lock is taken after Peer.mu and before Picker.mu.
+type Scheduler struct {
+	mu          sync.Mutex
+	picker      *Picker
+	info        *Info
+	maxInFlight int
+	stealAfter  time.Duration
+	// Tells when blocks were requested, and when they're up for stealing
+	clock utils.Clock
+	// Pieces being downloaded, block by block or as a whole
+	pieces map[int]*scheduledPiece
+	// Number of outstanding blocks per peer
+	inFlight map[*Peer]int
+}
+
+type scheduledPiece struct {
+	blocks []scheduledBlock
+	// Claimed whole by ClaimPiece, no blocks are handed out
+	claimed bool
+}
+
+type scheduledBlock struct {
+	// Peer the block was last handed to, nil while unassigned
+	owner       *Peer
+	requestedAt time.Time
+	received    bool
+	// Peer the block was received from
+	from *Peer
+}
+
+func NewScheduler(
+	picker *Picker,
+	info *Info,
+	maxInFlight int,
+	stealAfter time.Duration,
+) *Scheduler {
+	if maxInFlight <= 0 {
+		maxInFlight = DefaultMaxInFlight
+	}
+	if stealAfter <= 0 {
+		stealAfter = DefaultStealAfter
+	}
+
+	return &Scheduler{
+		picker:      picker,
+		info:        info,
+		maxInFlight: maxInFlight,
+		stealAfter:  stealAfter,
+		clock:       utils.RealClock,
+		pieces:      make(map[int]*scheduledPiece),
+		inFlight:    make(map[*Peer]int),
+	}
+}
+
+// SetClock makes the scheduler time outstanding requests on clock instead of
+// the real time.
+func (sc *Scheduler) SetClock(clock utils.Clock) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.clock = clock
+}
+
+// Next returns the next block p should request. It returns false when p's
+// pipeline is full or p has nothing we can use.
+func (sc *Scheduler) Next(p *Peer) (BlockRequest, bool) {
+	if !p.Alive() {
+		return BlockRequest{}, false
+	}
+	has, limit := p.availability(), p.MaxRequests()
+	if p.Snubbed(DefaultSnubTimeout) {
+		limit = 1
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.inFlight[p] >= min(sc.maxInFlight, limit) {
+		return BlockRequest{}, false
+	}
+
+	if req, ok := sc.unassigned(p, has); ok {
+		return req, true
+	}
+
+	index, ok := sc.picker.Pick(has, sc.inProgress)
+	if ok {
+		sc.pieces[index] = sc.newScheduledPiece(index)
+		return sc.assign(p, index, 0), true
+	}
+
+	return sc.steal(p, has)
+}
+
+// Received records that the block at begin in piece arrived from p. It
+// reports whether that completed the piece, which the caller then verifies
+// and reports back with PieceDone. Blocks nobody is waiting for are ignored.
+func (sc *Scheduler) Received(p *Peer, piece, begin int) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sp, ok := sc.pieces[piece]
+	if !ok || sp.claimed || begin%BlockSize != 0 {
+		return false
+	}
+	i := begin / BlockSize
+	if i >= len(sp.blocks) || sp.blocks[i].received {
+		return false
+	}
+
+	b := &sp.blocks[i]
+	if b.owner != nil {
+		sc.release(b.owner)
+	}
+	b.owner = nil
+	b.received = true
+	b.from = p
+
+	for _, b := range sp.blocks {
+		if !b.received {
+			return false
+		}
+	}
+	return true
+}
+
+// Release returns every block outstanding with p to the pool, for when p
+// choked us, stopped responding or disconnected.
+func (sc *Scheduler) Release(p *Peer) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for _, sp := range sc.pieces {
+		for i := range sp.blocks {
+			if sp.blocks[i].owner == p {
+				sp.blocks[i].owner = nil
+			}
+		}
+	}
+	delete(sc.inFlight, p)
+}
+
+// ReleaseAll returns every outstanding block to the pool, so requests stuck
+// with peers that never answer can be made again to anyone.
+func (sc *Scheduler) ReleaseAll() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for _, sp := range sc.pieces {
+		for i := range sp.blocks {
+			sp.blocks[i].owner = nil
+		}
+	}
+	clear(sc.inFlight)
+}
+
+// ClaimPiece picks a piece from the ones in has to be downloaded as a whole,
+// e.g. by a web seed, and keeps it from being handed to peers.
+func (sc *Scheduler) ClaimPiece(has utils.Bitfield) (int, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	index, ok := sc.picker.Pick(has, sc.inProgress)
+	if ok {
+		sc.pieces[index] = &scheduledPiece{claimed: true}
+	}
+	return index, ok
+}
+
+// PieceDone drops a piece from the schedule once it has been verified, or
+// claimed and abandoned. Verified pieces must be marked with Picker.SetHave
+// first; anything else is scheduled again from scratch.
+func (sc *Scheduler) PieceDone(index int) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sp, ok := sc.pieces[index]
+	if !ok {
+		return
+	}
+	for _, b := range sp.blocks {
+		if b.owner != nil {
+			sc.release(b.owner)
+		}
+	}
+	delete(sc.pieces, index)
+}
+
+// PieceFailed drops a piece that failed verification from the schedule, so
+// it's downloaded again from scratch, and returns the peers that contributed
+// blocks to it. With debug logging enabled it also logs which peer sent which
+// block along with the block's SHA1, taken from the piece's data, so a peer
+// sending bad data can be picked out across attempts.
+func (sc *Scheduler) PieceFailed(index int, data []byte) []*Peer {
+	sc.mu.Lock()
+	sp, ok := sc.pieces[index]
+	if !ok {
+		sc.mu.Unlock()
+		return nil
+	}
+	blocks := sp.blocks
+	for _, b := range blocks {
+		if b.owner != nil {
+			sc.release(b.owner)
+		}
+	}
+	delete(sc.pieces, index)
+	sc.mu.Unlock()
+
+	var peers []*Peer
+	for _, b := range blocks {
+		if b.from != nil && !slices.Contains(peers, b.from) {
+			peers = append(peers, b.from)
+		}
+	}
+
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		logFailedPiece(index, blocks, data)
+	}
+	return peers
+}
+
+/////////////// Private ///////////////
+
+// logFailedPiece logs the sender and checksum of every block of a piece that
+// failed verification.
+func logFailedPiece(index int, blocks []scheduledBlock, data []byte) {
+	for i, b := range blocks {
+		if b.from == nil {
+			continue
+		}
+
+		begin := i * BlockSize
+		end := min(begin+BlockSize, len(data))
+		var sum string
+		if begin < end {
+			digest := sha1.Sum(data[begin:end])
+			sum = hex.EncodeToString(digest[:])
+		}
+
+		slog.Debug(
+			"Block of failed piece",
+			"piece", index,
+			"begin", begin,
+			"peer", b.from.Addr,
+			"sha1", sum,
+		)
+	}
+}
+
+// The helpers below expect the caller to hold sc.mu.
+
+func (sc *Scheduler) inProgress(index int) bool {
+	_, ok := sc.pieces[index]
+	return ok
+}
+
+func (sc *Scheduler) newScheduledPiece(index int) *scheduledPiece {
+	length := int(sc.info.PieceSize(index))
+	numBlocks := (length + BlockSize - 1) / BlockSize
+
+	return &scheduledPiece{blocks: make([]scheduledBlock, numBlocks)}
+}
+
+// unassigned finds a block nobody is working on in a piece that's already in
+// progress.
+func (sc *Scheduler) unassigned(
+	p *Peer,
+	has utils.Bitfield,
+) (BlockRequest, bool) {
+	for index, sp := range sc.pieces {
+		if sp.claimed || !has.Has(index) {
+			continue
+		}
+		for i, b := range sp.blocks {
+			if b.owner == nil && !b.received {
+				return sc.assign(p, index, i), true
+			}
+		}
+	}
+
+	return BlockRequest{}, false
+}
+
+// steal takes over the longest outstanding block of another peer, provided
+// it has been waiting for more than stealAfter.
+func (sc *Scheduler) steal(p *Peer, has utils.Bitfield) (BlockRequest, bool) {
+	deadline := sc.clock.Now().Add(-sc.stealAfter)
+
+	piece, block := -1, -1
+	var oldest time.Time
+	for index, sp := range sc.pieces {
+		if sp.claimed || !has.Has(index) {
+			continue
+		}
+		for i, b := range sp.blocks {
+			if b.owner == nil || b.owner == p || b.received ||
+				b.requestedAt.After(deadline) {
+				continue
+			}
+			if piece == -1 || b.requestedAt.Before(oldest) {
+				piece, block, oldest = index, i, b.requestedAt
+			}
+		}
+	}
+	if piece == -1 {
+		return BlockRequest{}, false
+	}
+
+	sc.release(sc.pieces[piece].blocks[block].owner)
+	return sc.assign(p, piece, block), true
+}
+
+func (sc *Scheduler) assign(p *Peer, piece, block int) BlockRequest {
+	sc.pieces[piece].blocks[block] = scheduledBlock{
+		owner:       p,
+		requestedAt: sc.clock.Now(),
+	}
+	sc.inFlight[p]++
+
+	begin := block * BlockSize
+	return BlockRequest{
+		Piece:  piece,
+		Begin:  begin,
+		Length: sc.info.BlockLength(piece, begin),
+	}
+}
+
+// release frees one of p's pipeline slots.
+func (sc *Scheduler) release(p *Peer) {
+	if sc.inFlight[p] <= 1 {
+		delete(sc.inFlight, p)
+		return
+	}
+	sc.inFlight[p]--
+}
@@ -0,0 +1,258 @@
+package torrent
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prxssh/relay/internal/utils"
+)
+
+// schedulerPeer returns a peer holding every one of numPieces pieces. Its
+// connection is never used.
+func schedulerPeer(t *testing.T, numPieces int) *Peer {
+	t.Helper()
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	p := newPeer("pipe", local, numPieces, nil)
+	if err := p.handleMessage(&message{id: msgHaveAll}); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestSchedulerFastPeerDrainsSlowPeer(t *testing.T) {
+	// A single piece of four blocks, so both peers work on the same piece.
+	info := &Info{
+		Length:   4 * BlockSize,
+		PieceLen: 4 * BlockSize,
+		Pieces:   make([][20]byte, 1),
+	}
+
+	clock := utils.NewFakeClock(time.Now())
+	sc := NewScheduler(NewPicker(1), info, 2, 10*time.Second)
+	sc.SetClock(clock)
+
+	slow, fast := schedulerPeer(t, 1), schedulerPeer(t, 1)
+
+	next := func(p *Peer) BlockRequest {
+		t.Helper()
+		req, ok := sc.Next(p)
+		if !ok {
+			t.Fatal("no block handed out")
+		}
+		return req
+	}
+
+	// The slow peer fills its pipeline and never delivers.
+	stalled := []BlockRequest{next(slow), next(slow)}
+	if _, ok := sc.Next(slow); ok {
+		t.Fatal("slow peer got a block beyond its pipeline")
+	}
+
+	// The fast peer gets the rest of the piece and delivers it.
+	for i := 0; i < 2; i++ {
+		req := next(fast)
+		if sc.Received(fast, req.Piece, req.Begin) {
+			t.Fatal("piece complete without the slow peer's blocks")
+		}
+	}
+
+	// Nothing is left to hand out until the slow peer's requests are stale.
+	if _, ok := sc.Next(fast); ok {
+		t.Fatal("block stolen before stealAfter elapsed")
+	}
+	clock.Advance(11 * time.Second)
+
+	var complete bool
+	for range stalled {
+		req := next(fast)
+		complete = sc.Received(fast, req.Piece, req.Begin)
+	}
+	if !complete {
+		t.Fatal("piece not complete after the fast peer drained it")
+	}
+
+	// A late delivery from the slow peer is ignored, and its slots are free.
+	if sc.Received(slow, stalled[0].Piece, stalled[0].Begin) {
+		t.Error("late duplicate completed the piece again")
+	}
+	if n := sc.inFlight[slow]; n != 0 {
+		t.Errorf("slow peer has %d blocks in flight, want 0", n)
+	}
+}
+
+func TestSchedulerReleasesChokedPeer(t *testing.T) {
+	info := &Info{
+		Length:   2*BlockSize + 100,
+		PieceLen: 2*BlockSize + 100,
+		Pieces:   make([][20]byte, 1),
+	}
+	sc := NewScheduler(NewPicker(1), info, 0, 0)
+
+	choked, other := schedulerPeer(t, 1), schedulerPeer(t, 1)
+	for i := 0; i < 3; i++ {
+		if _, ok := sc.Next(choked); !ok {
+			t.Fatalf("block %d not handed out", i)
+		}
+	}
+	if _, ok := sc.Next(other); ok {
+		t.Fatal("block handed out twice")
+	}
+
+	sc.Release(choked)
+
+	var got []BlockRequest
+	for {
+		req, ok := sc.Next(other)
+		if !ok {
+			break
+		}
+		got = append(got, req)
+	}
+	if len(got) != 3 {
+		t.Fatalf("got %d released blocks, want 3", len(got))
+	}
+	for _, req := range got {
+		if req.Begin == 2*BlockSize && req.Length != 100 {
+			t.Errorf("last block length = %d, want 100", req.Length)
+		}
+	}
+}
+
+func TestSchedulerClaimedPiecesAreNotShared(t *testing.T) {
+	info := &Info{Length: 100, PieceLen: 100, Pieces: make([][20]byte, 1)}
+	sc := NewScheduler(NewPicker(1), info, 0, 0)
+	p := schedulerPeer(t, 1)
+
+	index, ok := sc.ClaimPiece(p.availability())
+	if !ok || index != 0 {
+		t.Fatalf("ClaimPiece = %d, %v", index, ok)
+	}
+	if _, ok := sc.Next(p); ok {
+		t.Fatal("block of a claimed piece handed to a peer")
+	}
+
+	// An abandoned claim is scheduled again.
+	sc.PieceDone(index)
+	if _, ok := sc.Next(p); !ok {
+		t.Fatal("piece not scheduled after the claim was dropped")
+	}
+}
+
+func TestSchedulerRespectsReqq(t *testing.T) {
+	info := &Info{
+		Length:   8 * BlockSize,
+		PieceLen: 8 * BlockSize,
+		Pieces:   make([][20]byte, 1),
+	}
+	sc := NewScheduler(NewPicker(1), info, 16, 0)
+
+	p := schedulerPeer(t, 1)
+	ext, _ := messageExtHandshake(&extHandshake{reqq: 2})
+	if err := p.handleMessage(ext); err != nil {
+		t.Fatalf("handleMessage: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, ok := sc.Next(p); !ok {
+			t.Fatalf("request %d not handed out", i)
+		}
+	}
+	if _, ok := sc.Next(p); ok {
+		t.Error("handed out more requests than the peer's reqq")
+	}
+}
+
+func TestSchedulerHoldsBackSnubbingPeers(t *testing.T) {
+	info := &Info{
+		Length:   8 * BlockSize,
+		PieceLen: 8 * BlockSize,
+		Pieces:   make([][20]byte, 1),
+	}
+	sc := NewScheduler(NewPicker(1), info, 16, 0)
+	clock := utils.NewFakeClock(time.Now())
+
+	p, _ := pipePeer(t, 1, NewPicker(1))
+	p.setClock(clock)
+	if err := p.handleMessage(&message{id: msgHaveAll}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(DefaultSnubTimeout + time.Second)
+
+	// A peer snubbing us gets one block to prove itself with.
+	req, ok := sc.Next(p)
+	if !ok {
+		t.Fatal("no block for a snubbing peer")
+	}
+	if _, ok := sc.Next(p); ok {
+		t.Fatal("snubbing peer got a second block")
+	}
+
+	msg := messagePiece(req.Piece, req.Begin, make([]byte, BlockSize))
+	if err := p.handleMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	sc.Received(p, req.Piece, req.Begin)
+	for i := 0; i < 2; i++ {
+		if _, ok := sc.Next(p); !ok {
+			t.Fatalf("request %d not handed out after a delivery", i)
+		}
+	}
+
+	// A peer that went silent gets nothing.
+	clock.Advance(peerLivenessTimeout)
+	if _, ok := sc.Next(p); ok {
+		t.Error("silent peer got a block")
+	}
+}
+
+func TestSchedulerPieceFailedNamesContributors(t *testing.T) {
+	info := &Info{
+		Length:   2 * BlockSize,
+		PieceLen: 2 * BlockSize,
+		Pieces:   make([][20]byte, 1),
+	}
+	sc := NewScheduler(NewPicker(1), info, 1, 0)
+
+	var logs bytes.Buffer
+	orig := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(
+		&logs,
+		&slog.HandlerOptions{Level: slog.LevelDebug},
+	)))
+	t.Cleanup(func() { slog.SetDefault(orig) })
+
+	good, bad := schedulerPeer(t, 1), schedulerPeer(t, 1)
+	good.Addr, bad.Addr = "good:1", "bad:1"
+	for _, p := range []*Peer{good, bad} {
+		req, ok := sc.Next(p)
+		if !ok {
+			t.Fatalf("no block for %s", p.Addr)
+		}
+		sc.Received(p, req.Piece, req.Begin)
+	}
+
+	peers := sc.PieceFailed(0, make([]byte, 2*BlockSize))
+	if len(peers) != 2 {
+		t.Fatalf("got %d contributors, want 2", len(peers))
+	}
+	for _, addr := range []string{"peer=good:1", "peer=bad:1"} {
+		if !strings.Contains(logs.String(), addr) {
+			t.Errorf("debug log doesn't mention %s:\n%s", addr, logs.String())
+		}
+	}
+
+	// The piece is downloaded again from scratch.
+	if req, ok := sc.Next(good); !ok || req.Piece != 0 {
+		t.Error("failed piece wasn't scheduled again")
+	}
+}
@@ -0,0 +1,252 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/prxssh/relay/internal/utils"
+)
+
+// Storage persists a torrent's data. Offsets are relative to the torrent's
+// contiguous data, i.e. all of its files concatenated in order, so callers
+// never have to care about file boundaries.
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
+
+// Flusher is implemented by Storage backends that buffer writes in memory.
+// Flush makes [off, off+n) durable, e.g. once a piece is complete.
+type Flusher interface {
+	Flush(off int64, n int) error
+}
+
+// Preallocator is implemented by Storage backends that can create every file
+// of the torrent at its full size up front, along with its directories.
+type Preallocator interface {
+	Preallocate() error
+}
+
+// WritePiece writes a verified piece at its place in the torrent's data,
+// wherever its file boundaries fall, and makes it durable if the backend
+// buffers writes.
+func WritePiece(st Storage, info *Info, index int, data []byte) error {
+	if index < 0 || index >= len(info.Pieces) {
+		return fmt.Errorf("storage: piece %d out of range", index)
+	}
+	if int64(len(data)) != info.PieceSize(index) {
+		return fmt.Errorf(
+			"storage: piece %d has %d bytes, want %d",
+			index,
+			len(data),
+			info.PieceSize(index),
+		)
+	}
+
+	offset := int64(index) * info.PieceLen
+	if _, err := st.WriteAt(data, offset); err != nil {
+		return err
+	}
+	if f, ok := st.(Flusher); ok {
+		return f.Flush(offset, len(data))
+	}
+	return nil
+}
+
+// VerifyStorage hashes every piece of the data in st against info and returns
+// the pieces that are complete, e.g. to resume a download from files already
+// on disk. Pieces that can't be read in full, because a file is missing or
+// short, count as incomplete.
+func VerifyStorage(st Storage, info *Info) utils.Bitfield {
+	have := utils.NewBitfield(len(info.Pieces))
+	verifier := info.Verifier()
+
+	var buf []byte
+	for i := range info.Pieces {
+		buf = slices.Grow(buf[:0], int(info.PieceSize(i)))[:info.PieceSize(i)]
+		if _, err := st.ReadAt(buf, int64(i)*info.PieceLen); err != nil {
+			continue
+		}
+		if bytes.Equal(verifier.Sum(buf), info.Pieces[i][:]) {
+			have.Set(i)
+		}
+	}
+
+	return have
+}
+
+// fileStorage is the default Storage backend. It spreads the torrent's data
+// over regular files laid out below a download directory.
+type fileStorage struct {
+	mu    sync.Mutex
+	files []*storageFile
+}
+
+// storageFile is one file of the torrent, opened lazily on first access.
+type storageFile struct {
+	path   string
+	offset int64
+	length int64
+	handle *os.File
+}
+
+// NewFileStorage returns a Storage that keeps the torrent's files below dir.
+// Files and their parent directories are created when first written to.
+func NewFileStorage(dir string, info *Info) Storage {
+	var offset int64
+	var files []*storageFile
+
+	for _, f := range info.FileList() {
+		elems := append([]string{dir}, f.Path...)
+		files = append(files, &storageFile{
+			path:   filepath.Join(elems...),
+			offset: offset,
+			length: f.Length,
+		})
+		offset += f.Length
+	}
+
+	return &fileStorage{files: files}
+}
+
+func (fs *fileStorage) ReadAt(p []byte, off int64) (int, error) {
+	return fs.each(p, off, false, readFileAt)
+}
+
+func (fs *fileStorage) WriteAt(p []byte, off int64) (int, error) {
+	return fs.each(p, off, true, (*os.File).WriteAt)
+}
+
+// Preallocate creates every file and grows it to its full size. The files are
+// sparse where the filesystem allows, so nothing is written.
+func (fs *fileStorage) Preallocate() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, f := range fs.files {
+		handle, err := f.open(true)
+		if err != nil {
+			return err
+		}
+		stat, err := handle.Stat()
+		if err != nil {
+			return err
+		}
+		if stat.Size() >= f.length {
+			continue
+		}
+		if err := handle.Truncate(f.length); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fs *fileStorage) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var errs []error
+	for _, f := range fs.files {
+		if f.handle == nil {
+			continue
+		}
+		errs = append(errs, f.handle.Close())
+		f.handle = nil
+	}
+
+	return errors.Join(errs...)
+}
+
+/////////////// Private ///////////////
+
+// fileOp reads or writes buf at offset off of a single file.
+type fileOp func(f *os.File, buf []byte, off int64) (int, error)
+
+// each splits the torrent-wide range [off, off+len(p)) into per-file ranges
+// and applies op to each of them in order. Missing files are created only if
+// create is set.
+func (fs *fileStorage) each(
+	p []byte,
+	off int64,
+	create bool,
+	op fileOp,
+) (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var done int
+	for _, f := range fs.files {
+		if done == len(p) {
+			break
+		}
+
+		pos := off + int64(done)
+		if pos < f.offset || pos >= f.offset+f.length {
+			continue
+		}
+
+		fileOff := pos - f.offset
+		chunk := min(int64(len(p)-done), f.length-fileOff)
+
+		handle, err := f.open(create)
+		if err != nil {
+			return done, err
+		}
+
+		n, err := op(handle, p[done:done+int(chunk)], fileOff)
+		done += n
+		if err != nil {
+			return done, err
+		}
+	}
+
+	if done < len(p) {
+		return done, fmt.Errorf(
+			"storage: offset %d out of range",
+			off+int64(done),
+		)
+	}
+
+	return done, nil
+}
+
+// readFileAt is (*os.File).ReadAt, except that a short read caused by the file
+// not being fully written yet is reported as io.ErrUnexpectedEOF.
+func readFileAt(f *os.File, buf []byte, off int64) (int, error) {
+	n, err := f.ReadAt(buf, off)
+	if errors.Is(err, io.EOF) && n < len(buf) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (f *storageFile) open(create bool) (*os.File, error) {
+	if f.handle != nil {
+		return f.handle, nil
+	}
+
+	flags := os.O_RDWR
+	if create {
+		if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+			return nil, err
+		}
+		flags |= os.O_CREATE
+	}
+
+	handle, err := os.OpenFile(f.path, flags, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	f.handle = handle
+	return handle, nil
+}
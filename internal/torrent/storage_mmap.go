@@ -0,0 +1,202 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmapStorage is a Storage backend that maps each of the torrent's files into
+// memory and copies data in and out of the mappings, saving a syscall per
+// block on large torrents. Writes only reach the disk once flushed.
+type mmapStorage struct {
+	mu    sync.Mutex
+	files []*mmapFile
+}
+
+// mmapFile is one file of the torrent, mapped lazily on first access.
+type mmapFile struct {
+	path   string
+	offset int64
+	length int64
+	data   []byte
+}
+
+// NewMmapStorage returns a memory-mapped Storage that keeps the torrent's
+// files below dir. Files are created at their full size when first written
+// to. On platforms without mmap it returns the regular file backend.
+func NewMmapStorage(dir string, info *Info) Storage {
+	var offset int64
+	var files []*mmapFile
+
+	for _, f := range info.FileList() {
+		elems := append([]string{dir}, f.Path...)
+		files = append(files, &mmapFile{
+			path:   filepath.Join(elems...),
+			offset: offset,
+			length: f.Length,
+		})
+		offset += f.Length
+	}
+
+	return &mmapStorage{files: files}
+}
+
+func (ms *mmapStorage) ReadAt(p []byte, off int64) (int, error) {
+	return ms.each(p, off, false, func(mapped, buf []byte) {
+		copy(buf, mapped)
+	})
+}
+
+func (ms *mmapStorage) WriteAt(p []byte, off int64) (int, error) {
+	return ms.each(p, off, true, func(mapped, buf []byte) {
+		copy(mapped, buf)
+	})
+}
+
+// Flush synchronously writes the mapped pages holding [off, off+n) back to
+// disk.
+func (ms *mmapStorage) Flush(off int64, n int) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	pageSize := int64(os.Getpagesize())
+	end := off + int64(n)
+
+	for _, f := range ms.files {
+		if f.data == nil || end <= f.offset || off >= f.offset+f.length {
+			continue
+		}
+
+		// msync wants a page-aligned start address.
+		start := max(off-f.offset, 0) &^ (pageSize - 1)
+		stop := min(end-f.offset, f.length)
+
+		if err := unix.Msync(f.data[start:stop], unix.MS_SYNC); err != nil {
+			return fmt.Errorf("storage: msync %s: %w", f.path, err)
+		}
+	}
+
+	return nil
+}
+
+func (ms *mmapStorage) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var errs []error
+	for _, f := range ms.files {
+		if f.data == nil {
+			continue
+		}
+		errs = append(errs, unix.Munmap(f.data))
+		f.data = nil
+	}
+
+	return errors.Join(errs...)
+}
+
+/////////////// Private ///////////////
+
+// each splits the torrent-wide range [off, off+len(p)) into per-file ranges
+// and calls op with the mapped region and the matching part of p for each of
+// them in order. Missing files are created only if create is set.
+func (ms *mmapStorage) each(
+	p []byte,
+	off int64,
+	create bool,
+	op func(mapped, buf []byte),
+) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var done int
+	for _, f := range ms.files {
+		if done == len(p) {
+			break
+		}
+
+		pos := off + int64(done)
+		if pos < f.offset || pos >= f.offset+f.length {
+			continue
+		}
+
+		fileOff := pos - f.offset
+		chunk := min(int64(len(p)-done), f.length-fileOff)
+
+		data, err := f.mmap(create)
+		if err != nil {
+			return done, err
+		}
+
+		op(data[fileOff:fileOff+chunk], p[done:done+int(chunk)])
+		done += int(chunk)
+	}
+
+	if done < len(p) {
+		return done, fmt.Errorf(
+			"storage: offset %d out of range",
+			off+int64(done),
+		)
+	}
+
+	return done, nil
+}
+
+// mmap maps the whole file, creating it at its full length first if create
+// is set. Touching a mapping beyond the end of its file faults, so a file
+// that's shorter than expected is never mapped.
+func (f *mmapFile) mmap(create bool) ([]byte, error) {
+	if f.data != nil {
+		return f.data, nil
+	}
+
+	flags := os.O_RDWR
+	if create {
+		if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+			return nil, err
+		}
+		flags |= os.O_CREATE
+	}
+
+	handle, err := os.OpenFile(f.path, flags, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	// The mapping stays valid after the descriptor is closed.
+	defer handle.Close()
+
+	st, err := handle.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if st.Size() < f.length {
+		if !create {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err := handle.Truncate(f.length); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := unix.Mmap(
+		int(handle.Fd()),
+		0,
+		int(f.length),
+		unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_SHARED,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("storage: mmap %s: %w", f.path, err)
+	}
+
+	f.data = data
+	return data, nil
+}
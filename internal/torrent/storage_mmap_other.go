@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package torrent
+
+// NewMmapStorage falls back to the regular file backend on platforms without
+// mmap support.
+func NewMmapStorage(dir string, info *Info) Storage {
+	return NewFileStorage(dir, info)
+}
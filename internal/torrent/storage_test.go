@@ -0,0 +1,248 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// storageBackends lists every Storage constructor so tests and benchmarks
+// run against all of them.
+var storageBackends = []struct {
+	name string
+	new  func(dir string, info *Info) Storage
+}{
+	{"file", NewFileStorage},
+	{"mmap", NewMmapStorage},
+}
+
+func TestStorageSpansFiles(t *testing.T) {
+	info := &Info{
+		Name: "multi",
+		Files: []*File{
+			{Length: 5, Path: []string{"a"}},
+			{Length: 0, Path: []string{"empty"}},
+			{Length: 7, Path: []string{"sub", "b"}},
+		},
+	}
+	data := []byte("hello, world")
+
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			st := backend.new(dir, info)
+			if _, err := st.WriteAt(data[3:9], 3); err != nil {
+				t.Fatalf("WriteAt: %v", err)
+			}
+			if _, err := st.WriteAt(data[:3], 0); err != nil {
+				t.Fatalf("WriteAt: %v", err)
+			}
+			if _, err := st.WriteAt(data[9:], 9); err != nil {
+				t.Fatalf("WriteAt: %v", err)
+			}
+			if f, ok := st.(Flusher); ok {
+				if err := f.Flush(0, len(data)); err != nil {
+					t.Fatalf("Flush: %v", err)
+				}
+			}
+
+			got := make([]byte, len(data))
+			if _, err := st.ReadAt(got, 0); err != nil {
+				t.Fatalf("ReadAt: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("read %q, want %q", got, data)
+			}
+
+			if _, err := st.WriteAt([]byte("x"), int64(len(data))); err == nil {
+				t.Error("expected error writing past the end")
+			}
+			if err := st.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			onDisk, err := os.ReadFile(filepath.Join(dir, "multi", "sub", "b"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(onDisk, data[5:]) {
+				t.Errorf("second file holds %q, want %q", onDisk, data[5:])
+			}
+		})
+	}
+}
+
+func TestWritePieceAcrossFiles(t *testing.T) {
+	testCases := []struct {
+		name  string
+		files []*File
+	}{
+		{"single file", nil},
+		{
+			"piece straddles two files",
+			[]*File{
+				{Length: 6, Path: []string{"a"}},
+				{Length: 6, Path: []string{"sub", "b"}},
+			},
+		},
+	}
+	data := []byte("0123456789ab")
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			info := &Info{
+				Name:     "data",
+				Length:   int64(len(data)),
+				Files:    tc.files,
+				PieceLen: 4,
+				Pieces:   make([][20]byte, 3),
+			}
+			st := NewFileStorage(t.TempDir(), info)
+			defer st.Close()
+
+			// Piece 1 covers bytes 4-7, across the boundary at 6.
+			for _, i := range []int{1, 0, 2} {
+				err := WritePiece(st, info, i, data[i*4:(i+1)*4])
+				if err != nil {
+					t.Fatalf("WritePiece(%d): %v", i, err)
+				}
+			}
+			got := make([]byte, len(data))
+			if _, err := st.ReadAt(got, 0); err != nil {
+				t.Fatalf("ReadAt: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("read %q, want %q", got, data)
+			}
+
+			if err := WritePiece(st, info, 0, data[:3]); err == nil {
+				t.Error("expected error for a short piece")
+			}
+			if err := WritePiece(st, info, 3, data[:4]); err == nil {
+				t.Error("expected error for a piece out of range")
+			}
+		})
+	}
+}
+
+func TestPreallocateCreatesFullSizeFiles(t *testing.T) {
+	info := &Info{
+		Name: "multi",
+		Files: []*File{
+			{Length: 1000, Path: []string{"a"}},
+			{Length: 0, Path: []string{"empty"}},
+			{Length: 5000, Path: []string{"sub", "dir", "b"}},
+		},
+	}
+	dir := t.TempDir()
+	st := NewFileStorage(dir, info)
+	defer st.Close()
+
+	if err := st.(Preallocator).Preallocate(); err != nil {
+		t.Fatalf("Preallocate: %v", err)
+	}
+	for _, f := range info.Files {
+		elems := append([]string{dir, "multi"}, f.Path...)
+		stat, err := os.Stat(filepath.Join(elems...))
+		if err != nil {
+			t.Fatalf("file %v wasn't created: %v", f.Path, err)
+		}
+		if stat.Size() != f.Length {
+			t.Errorf("%v has %d bytes, want %d", f.Path, stat.Size(), f.Length)
+		}
+	}
+}
+
+func TestVerifyStorageFindsCompletePieces(t *testing.T) {
+	data := []byte("0123456789")
+	info := &Info{
+		Name: "multi",
+		Files: []*File{
+			{Length: 6, Path: []string{"a"}},
+			{Length: 4, Path: []string{"b"}},
+		},
+		PieceLen: 4,
+	}
+	for i := 0; i < len(data); i += 4 {
+		info.Pieces = append(
+			info.Pieces,
+			sha1.Sum(data[i:min(i+4, len(data))]),
+		)
+	}
+	dir := t.TempDir()
+	st := NewFileStorage(dir, info)
+	defer st.Close()
+
+	// Piece 0 matches, piece 1 is corrupt, and piece 2 falls in the
+	// missing file b.
+	if err := os.MkdirAll(filepath.Join(dir, "multi"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	err := os.WriteFile(
+		filepath.Join(dir, "multi", "a"),
+		[]byte("0123xx"),
+		0o644,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	have := VerifyStorage(st, info)
+	for i, want := range []bool{true, false, false} {
+		if have.Has(i) != want {
+			t.Errorf("piece %d complete = %v, want %v", i, have.Has(i), want)
+		}
+	}
+
+	for i := range 3 {
+		err := WritePiece(st, info, i, data[i*4:min((i+1)*4, len(data))])
+		if err != nil {
+			t.Fatalf("WritePiece(%d): %v", i, err)
+		}
+	}
+	if have := VerifyStorage(st, info); have.Count() != 3 {
+		t.Errorf("%d pieces complete after writing all, want 3", have.Count())
+	}
+}
+
+func BenchmarkStorageWritePiece(b *testing.B) {
+	const (
+		pieceLen  = 256 * 1024
+		numPieces = 64
+	)
+
+	info := &Info{
+		Name: "bench",
+		Files: []*File{
+			{Length: numPieces * pieceLen / 2, Path: []string{"a"}},
+			{Length: numPieces * pieceLen / 2, Path: []string{"b"}},
+		},
+	}
+	piece := bytes.Repeat([]byte{0xAB}, pieceLen)
+
+	for _, backend := range storageBackends {
+		b.Run(fmt.Sprintf("backend=%s", backend.name), func(b *testing.B) {
+			st := backend.new(b.TempDir(), info)
+			defer st.Close()
+
+			b.SetBytes(pieceLen)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				off := int64(i%numPieces) * pieceLen
+				if _, err := st.WriteAt(piece, off); err != nil {
+					b.Fatal(err)
+				}
+				if f, ok := st.(Flusher); ok {
+					if err := f.Flush(off, pieceLen); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -2,18 +2,30 @@ package torrent
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
+	"net/url"
+	"slices"
+	"strings"
 
 	"github.com/prxssh/relay/internal/bencode"
+	"github.com/prxssh/relay/internal/utils"
 )
 
 // Torrent represents the complete data from a .torrent file
 type Torrent struct {
 	// Announce URLs of the tracker. It combines both announce and announce-list.
 	AnnounceURLs []string
+	// The same trackers grouped into the tiers of announce-list (BEP 12),
+	// in order, each tier shuffled. The trackers of a tier are
+	// interchangeable: one is used at a time, the next when it fails.
+	// announce makes up a tier of its own unless announce-list names it.
+	AnnounceTiers [][]string
 	// Creation time of the torrent in UNIX epoch format (optional)
 	CreationDate int64
 	// Comments of the author (optional)
@@ -22,6 +34,8 @@ type Torrent struct {
 	CreatedBy string
 	// String encoding format used to generate the pieces part (optional)
 	Encoding string
+	// GetRight-style web seed URLs from url-list (BEP 19) (optional)
+	URLList []string
 	// Describes the files of the torrent
 	Info *Info
 	// Size of this torrent
@@ -44,8 +58,17 @@ type Info struct {
 	Length int64
 	// Only present in multi-file mode
 	Files []*File
-	// SHA1 of the raw info dictionary
+	// Digest of the raw info dictionary, made with the Verifier of
+	// PieceHashes: SHA1 for v1 and hybrid torrents, SHA256 truncated to 20
+	// bytes, as used on the wire, for v2-only ones.
 	Hash [sha1.Size]byte
+	// Metainfo format version; 1 unless the info dict says otherwise
+	MetaVersion int
+	// Kind of the piece hashes in Pieces, which decides how pieces are
+	// verified
+	PieceHashes PieceHashes
+	// The bencoded info dictionary exactly as read, which Hash digests
+	Raw []byte
 }
 
 // File represents a single file within a multi-file torrent
@@ -63,14 +86,98 @@ func (m *Torrent) NumPieces() int {
 	return len(m.Info.Pieces)
 }
 
+// HashHex returns the info hash as 40 lowercase hex digits, the form users
+// and most tools expect.
+func (m *Torrent) HashHex() string {
+	return hex.EncodeToString(m.Info.Hash[:])
+}
+
+// MagnetURI returns a magnet link (BEP 9) for the torrent carrying its info
+// hash, name and trackers.
+func (m *Torrent) MagnetURI() string {
+	var b strings.Builder
+	b.WriteString("magnet:?xt=urn:btih:")
+	b.WriteString(m.HashHex())
+	if m.Info.Name != "" {
+		b.WriteString("&dn=")
+		b.WriteString(url.QueryEscape(m.Info.Name))
+	}
+	for _, tr := range m.AnnounceURLs {
+		b.WriteString("&tr=")
+		b.WriteString(url.QueryEscape(tr))
+	}
+
+	return b.String()
+}
+
+// ParsePhase names a step of loading a torrent, for showing progress while a
+// huge metainfo file is loaded.
+type ParsePhase string
+
+const (
+	// The metainfo is read from its source. Parse doesn't report it; it's
+	// for callers that fetch the data before parsing it.
+	PhaseReading ParsePhase = "reading"
+	// The bencoded metainfo is decoded
+	PhaseDecoding ParsePhase = "decoding"
+	// The info dictionary is hashed into the info hash
+	PhaseHashing ParsePhase = "hashing info"
+	// The piece hashes, files and trackers are checked
+	PhaseValidating ParsePhase = "validating"
+)
+
+// ErrUnsupportedV2 is returned when parsing a v2-only torrent (BEP 52), which
+// can't be downloaded yet. Hybrid torrents, which carry v1 piece hashes as
+// well, are supported.
+var ErrUnsupportedV2 = errors.New("metainfo: unsupported v2 torrent")
+
 func New(r io.Reader) (*Torrent, error) {
-	p, err := newParser(r)
+	return Parse(context.Background(), r, nil)
+}
+
+// Parse reads a torrent from the bencoded metainfo in r like New. It calls
+// progress, unless nil, as each phase begins and gives up with the context's
+// error once ctx is done.
+func Parse(
+	ctx context.Context,
+	r io.Reader,
+	progress func(ParsePhase),
+) (*Torrent, error) {
+	if progress == nil {
+		progress = func(ParsePhase) {}
+	}
+
+	progress(PhaseDecoding)
+	p, err := newParser(utils.ContextReader(ctx, r))
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
 		return nil, err
 	}
+	p.ctx, p.progress = ctx, progress
+
 	return p.parse()
 }
 
+// ParseInfo parses a bencoded info dictionary on its own, e.g. one fetched
+// from peers for a magnet link.
+func ParseInfo(data []byte) (*Info, error) {
+	p, err := newParser(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	p.data = map[string]any{"info": p.data}
+	p.rawInfo = data
+
+	return p.parseInfo()
+}
+
+// Verifier returns the digest used to verify this torrent's pieces.
+func (i *Info) Verifier() Verifier {
+	return VerifierFor(i.PieceHashes)
+}
+
 func (i *Info) Size() int64 {
 	if len(i.Files) == 0 {
 		return i.Length
@@ -84,14 +191,99 @@ func (i *Info) Size() int64 {
 	return size
 }
 
+// FileList returns the files of the torrent in order, with paths relative to
+// the download directory. A single-file torrent yields one entry named after
+// the torrent; multi-file paths are rooted in a directory of that name.
+func (i *Info) FileList() []*File {
+	if len(i.Files) == 0 {
+		return []*File{{Length: i.Length, Path: []string{i.Name}}}
+	}
+
+	files := make([]*File, len(i.Files))
+	for idx, f := range i.Files {
+		files[idx] = &File{
+			Length: f.Length,
+			MD5:    f.MD5,
+			Path:   append([]string{i.Name}, f.Path...),
+		}
+	}
+
+	return files
+}
+
+// PieceSize returns the length of the piece at index. Every piece is PieceLen
+// bytes long except possibly the last one.
+func (i *Info) PieceSize(index int) int64 {
+	if index < 0 || index >= len(i.Pieces) {
+		return 0
+	}
+
+	begin := int64(index) * i.PieceLen
+	return min(i.PieceLen, i.Size()-begin)
+}
+
+// BlockLength returns the length of the block starting at begin within the
+// piece at index: BlockSize, or less for the last block of a piece. It's zero
+// if begin is outside the piece.
+func (i *Info) BlockLength(index, begin int) int {
+	size := i.PieceSize(index)
+	if begin < 0 || int64(begin) >= size {
+		return 0
+	}
+
+	return int(min(BlockSize, size-int64(begin)))
+}
+
+// FileOffset returns the offset of the file at fileIndex within the torrent's
+// contiguous data.
+func (i *Info) FileOffset(fileIndex int) int64 {
+	files := i.FileList()
+	fileIndex = max(0, min(fileIndex, len(files)))
+
+	var offset int64
+	for _, f := range files[:fileIndex] {
+		offset += f.Length
+	}
+
+	return offset
+}
+
+// FilePieces returns the indices of the first and last pieces overlapping the
+// file at fileIndex. For empty files last is less than first.
+func (i *Info) FilePieces(fileIndex int) (first, last int) {
+	files := i.FileList()
+	if fileIndex < 0 || fileIndex >= len(files) || i.PieceLen <= 0 {
+		return 0, -1
+	}
+
+	offset := i.FileOffset(fileIndex)
+	length := files[fileIndex].Length
+	if length == 0 {
+		return 0, -1
+	}
+
+	first = int(offset / i.PieceLen)
+	last = int((offset + length - 1) / i.PieceLen)
+	return first, last
+}
+
 /////////////// Private ///////////////
 
 type parser struct {
 	data map[string]any
+	// The info dictionary as encoded in the input, see Info.Raw
+	rawInfo []byte
+	// Set on the top-level parser only, see phase
+	ctx      context.Context
+	progress func(ParsePhase)
 }
 
 func newParser(r io.Reader) (*parser, error) {
-	unmarshalled, err := bencode.NewUnmarshaller(r).Unmarshal()
+	var raw bytes.Buffer
+	u := bencode.NewUnmarshaller(io.TeeReader(r, &raw))
+	u.RecordSpan("info")
+
+	unmarshalled, err := u.Unmarshal()
 	if err != nil {
 		return nil, err
 	}
@@ -103,7 +295,24 @@ func newParser(r io.Reader) (*parser, error) {
 		)
 	}
 
-	return &parser{data: data}, nil
+	p := &parser{data: data, ctx: context.Background()}
+	if span, ok := u.Span("info"); ok {
+		p.rawInfo = raw.Bytes()[span.Start:span.End]
+	}
+
+	return p, nil
+}
+
+// phase reports the start of the next phase, or the context's error if the
+// parse was canceled.
+func (p *parser) phase(phase ParsePhase) error {
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+	if p.progress != nil {
+		p.progress(phase)
+	}
+	return nil
 }
 
 func (p *parser) parse() (*Torrent, error) {
@@ -115,18 +324,21 @@ func (p *parser) parse() (*Torrent, error) {
 		)
 	}
 
-	announceURLs, err := p.parseAnnounce()
+	tiers, err := p.parseAnnounce()
 	if err != nil {
 		return nil, err
 	}
+	shuffleTiers(tiers, rand.Shuffle)
 
 	return &Torrent{
-		Info:         info,
-		AnnounceURLs: announceURLs,
-		CreationDate: p.getInt("creation date"),
-		Comment:      p.getString("comment"),
-		CreatedBy:    p.getString("created by"),
-		Size:         info.Size(),
+		Info:          info,
+		AnnounceURLs:  slices.Concat(tiers...),
+		AnnounceTiers: tiers,
+		URLList:       p.parseURLList(),
+		CreationDate:  p.getInt("creation date"),
+		Comment:       p.getString("comment"),
+		CreatedBy:     p.getString("created by"),
+		Size:          info.Size(),
 	}, nil
 }
 
@@ -138,12 +350,30 @@ func (p *parser) parseInfo() (*Info, error) {
 		)
 	}
 
-	infoHash, err := calculateSHA1Hash(infoDict)
-	if err != nil {
+	infoParser := &parser{data: infoDict}
+
+	metaVersion := int(infoParser.getInt("meta version"))
+	if metaVersion == 0 {
+		metaVersion = 1
+	}
+	if metaVersion > 2 {
+		return nil, fmt.Errorf("unsupported meta version %d", metaVersion)
+	}
+	// v2-only torrents describe their pieces in a file tree of merkle roots
+	// instead of the v1 'pieces' string.
+	hashes, ok := pieceHashesOf(infoDict)
+	if ok && hashes == PieceHashesV2 {
+		return nil, ErrUnsupportedV2
+	}
+
+	if err := p.phase(PhaseHashing); err != nil {
 		return nil, err
 	}
+	infoHash := calculateInfoHash(p.rawInfo, VerifierFor(hashes))
 
-	infoParser := &parser{data: infoDict}
+	if err := p.phase(PhaseValidating); err != nil {
+		return nil, err
+	}
 
 	piecesStr, ok := infoParser.data["pieces"].(string)
 	if !ok {
@@ -168,13 +398,16 @@ func (p *parser) parseInfo() (*Info, error) {
 	}
 
 	return &Info{
-		Hash:      infoHash,
-		Name:      infoParser.getString("name"),
-		PieceLen:  infoParser.getInt("piece length"),
-		Pieces:    pieces,
-		IsPrivate: infoParser.getInt("private") == 1,
-		Length:    infoParser.getInt("length"),
-		Files:     files,
+		Hash:        infoHash,
+		Name:        infoParser.getString("name"),
+		PieceLen:    infoParser.getInt("piece length"),
+		Pieces:      pieces,
+		IsPrivate:   infoParser.getInt("private") == 1,
+		Length:      infoParser.getInt("length"),
+		Files:       files,
+		MetaVersion: metaVersion,
+		PieceHashes: hashes,
+		Raw:         p.rawInfo,
 	}, nil
 }
 
@@ -219,37 +452,81 @@ func (p *parser) parseFiles() ([]*File, error) {
 	return files, nil
 }
 
-func (p *parser) parseAnnounce() ([]string, error) {
-	urls := make(map[string]struct{})
+// parseAnnounce returns the tiers of announce-list in order, followed by
+// announce as a tier of its own if no tier names it. A tracker listed more
+// than once is kept where it first appears; empty tiers are dropped.
+func (p *parser) parseAnnounce() ([][]string, error) {
+	var tiers [][]string
+	seen := make(map[string]struct{})
+	addTier := func(urls []any) {
+		var tier []string
+		for _, u := range urls {
+			urlStr, ok := u.(string)
+			if !ok || urlStr == "" {
+				continue
+			}
+			if _, ok := seen[urlStr]; ok {
+				continue
+			}
+			seen[urlStr] = struct{}{}
+			tier = append(tier, urlStr)
+		}
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
 
 	if rawList, ok := p.data["announce-list"].([]any); ok {
 		for _, tier := range rawList {
 			if tierList, ok := tier.([]any); ok {
-				for _, u := range tierList {
-					if urlStr, ok := u.(string); ok {
-						urls[urlStr] = struct{}{}
-					}
-				}
+				addTier(tierList)
 			}
 		}
 	}
+	addTier([]any{p.getString("announce")})
 
-	if announce := p.getString("announce"); announce != "" {
-		urls[announce] = struct{}{}
-	}
-
-	if len(urls) == 0 {
+	if len(tiers) == 0 {
 		return nil, errors.New(
 			"no trackers found in announce or announce-list",
 		)
 	}
 
-	announceList := make([]string, 0, len(urls))
-	for u := range urls {
-		announceList = append(announceList, u)
+	return tiers, nil
+}
+
+// shuffleTiers shuffles the trackers within each tier with shuffle, as BEP 12
+// asks, so load is spread over a tier's trackers. The tiers keep their order.
+func shuffleTiers(
+	tiers [][]string,
+	shuffle func(n int, swap func(i, j int)),
+) {
+	for _, tier := range tiers {
+		shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
 	}
+}
 
-	return announceList, nil
+// parseURLList reads url-list, which holds either a single URL or a list of
+// them.
+func (p *parser) parseURLList() []string {
+	switch v := p.data["url-list"].(type) {
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	case []any:
+		var urls []string
+		for _, u := range v {
+			if urlStr, ok := u.(string); ok && urlStr != "" {
+				urls = append(urls, urlStr)
+			}
+		}
+		return urls
+	default:
+		return nil
+	}
 }
 
 func (p *parser) getString(key string) string {
@@ -268,12 +545,13 @@ func (p *parser) getInt(key string) int64 {
 	return 0
 }
 
-func calculateSHA1Hash(infoDict map[string]any) ([sha1.Size]byte, error) {
-	var buf bytes.Buffer
-
-	if err := bencode.NewMarshaller(&buf).Marshal(infoDict); err != nil {
-		return [sha1.Size]byte{}, err
-	}
-
-	return sha1.Sum(buf.Bytes()), nil
+// calculateInfoHash digests the info dictionary as it was encoded, truncating
+// digests longer than 20 bytes (v2) to the size used in handshakes and
+// announces. Marshalling the parsed dictionary again isn't guaranteed to give
+// back the same bytes, e.g. for unsorted keys, and any difference would make
+// the hash one no peer knows.
+func calculateInfoHash(raw []byte, verifier Verifier) [sha1.Size]byte {
+	var hash [sha1.Size]byte
+	copy(hash[:], verifier.Sum(raw))
+	return hash
 }
@@ -0,0 +1,376 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/prxssh/relay/internal/bencode"
+)
+
+func TestMagnetURI(t *testing.T) {
+	tr := &Torrent{
+		AnnounceURLs: []string{"http://tracker.example/announce?key=a&b"},
+		Info:         &Info{Name: "Big Buck Bunny", Hash: [20]byte{0xde, 0xad}},
+	}
+
+	wantHash := "dead000000000000000000000000000000000000"
+	if got := tr.HashHex(); got != wantHash {
+		t.Errorf("HashHex = %s, want %s", got, wantHash)
+	}
+
+	want := "magnet:?xt=urn:btih:" + wantHash +
+		"&dn=Big+Buck+Bunny" +
+		"&tr=http%3A%2F%2Ftracker.example%2Fannounce%3Fkey%3Da%26b"
+	if got := tr.MagnetURI(); got != want {
+		t.Errorf("MagnetURI = %s, want %s", got, want)
+	}
+}
+
+func TestParseReportsPhasesAndStops(t *testing.T) {
+	var buf bytes.Buffer
+	err := bencode.NewMarshaller(&buf).Marshal(map[string]any{
+		"announce": "http://tracker.example/announce",
+		"info": map[string]any{
+			"name":         "file",
+			"length":       int64(10),
+			"piece length": int64(BlockSize),
+			"pieces":       string(make([]byte, 20)),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var phases []ParsePhase
+	_, err = Parse(
+		context.Background(),
+		bytes.NewReader(buf.Bytes()),
+		func(phase ParsePhase) { phases = append(phases, phase) },
+	)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := []ParsePhase{PhaseDecoding, PhaseHashing, PhaseValidating}
+	if !slices.Equal(phases, want) {
+		t.Errorf("phases = %v, want %v", phases, want)
+	}
+
+	// Canceling while hashing stops the parse before validation.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	phases = nil
+	_, err = Parse(ctx, bytes.NewReader(buf.Bytes()), func(phase ParsePhase) {
+		phases = append(phases, phase)
+		if phase == PhaseHashing {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Parse: err = %v, want %v", err, context.Canceled)
+	}
+	if phases[len(phases)-1] != PhaseHashing {
+		t.Errorf("parse went on to %v after cancellation", phases)
+	}
+}
+
+func TestParseAnnounceTiers(t *testing.T) {
+	var buf bytes.Buffer
+	err := bencode.NewMarshaller(&buf).Marshal(map[string]any{
+		"announce": "http://e/",
+		"announce-list": []any{
+			[]any{"http://a/", "http://b/"},
+			[]any{},
+			[]any{"http://c/"},
+			// a is already in the first tier.
+			[]any{"http://a/", "http://d/"},
+		},
+		"info": map[string]any{
+			"name":         "file",
+			"length":       int64(10),
+			"piece length": int64(BlockSize),
+			"pieces":       string(make([]byte, 20)),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := New(&buf)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	want := [][]string{
+		{"http://a/", "http://b/"},
+		{"http://c/"},
+		{"http://d/"},
+		{"http://e/"},
+	}
+	if len(tr.AnnounceTiers) != len(want) {
+		t.Fatalf("tiers = %q, want %q", tr.AnnounceTiers, want)
+	}
+	for i, tier := range tr.AnnounceTiers {
+		// Shuffled within the tier.
+		if !slices.Equal(slices.Sorted(slices.Values(tier)), want[i]) {
+			t.Errorf("tier %d = %q, want %q", i, tier, want[i])
+		}
+	}
+	if !slices.Equal(tr.AnnounceURLs, slices.Concat(tr.AnnounceTiers...)) {
+		t.Errorf(
+			"announce URLs %q don't follow the tiers %q",
+			tr.AnnounceURLs,
+			tr.AnnounceTiers,
+		)
+	}
+}
+
+func TestShuffleTiersIsDeterministicPerSeed(t *testing.T) {
+	tiers := func() [][]string {
+		return [][]string{
+			{"http://a/", "http://b/", "http://c/", "http://d/"},
+			{"http://e/"},
+			{"http://f/", "http://g/", "http://h/"},
+		}
+	}
+	shuffled := func(seed uint64) [][]string {
+		s := tiers()
+		shuffleTiers(s, rand.New(rand.NewPCG(seed, seed)).Shuffle)
+		return s
+	}
+
+	first, again := shuffled(1), shuffled(1)
+	for i := range first {
+		if !slices.Equal(first[i], again[i]) {
+			t.Errorf("tier %d shuffled to %q, then %q", i, first[i], again[i])
+		}
+		sorted := slices.Sorted(slices.Values(first[i]))
+		if !slices.Equal(sorted, tiers()[i]) {
+			t.Errorf(
+				"tier %d = %q, want a shuffle of %q",
+				i,
+				first[i],
+				tiers()[i],
+			)
+		}
+	}
+
+	// Some seed reorders the first tier.
+	var reordered bool
+	for seed := range uint64(10) {
+		if !slices.Equal(shuffled(seed)[0], tiers()[0]) {
+			reordered = true
+			break
+		}
+	}
+	if !reordered {
+		t.Error("shuffling never changed the order within a tier")
+	}
+}
+
+func TestNumPiecesCountsPieces(t *testing.T) {
+	// More than eight pieces, so a count of bitfield bytes would differ.
+	const numPieces = 9
+
+	var buf bytes.Buffer
+	err := bencode.NewMarshaller(&buf).Marshal(map[string]any{
+		"announce": "http://tracker.example/announce",
+		"info": map[string]any{
+			"name":         "file",
+			"length":       int64(numPieces*BlockSize - 100),
+			"piece length": int64(BlockSize),
+			"pieces":       string(make([]byte, numPieces*20)),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := New(&buf)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got := tr.NumPieces(); got != numPieces {
+		t.Errorf("NumPieces = %d, want %d", got, numPieces)
+	}
+}
+
+func TestInfoHashDigestsRawInfo(t *testing.T) {
+	// Keys out of order and one repeated: marshalling the parsed dictionary
+	// again would sort them and drop the duplicate.
+	info := "d4:name4:file6:lengthi10e12:piece lengthi16384e" +
+		"6:pieces20:" + string(make([]byte, 20)) + "4:name4:filee"
+	data := "d8:announce20:http://tracker/annnc4:info" + info + "e"
+
+	tr, err := New(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if want := sha1.Sum([]byte(info)); tr.Info.Hash != want {
+		t.Errorf("info hash = %x, want %x", tr.Info.Hash, want)
+	}
+	if string(tr.Info.Raw) != info {
+		t.Errorf("raw info = %q, want %q", tr.Info.Raw, info)
+	}
+
+	parsed, err := ParseInfo([]byte(info))
+	if err != nil {
+		t.Fatalf("ParseInfo: %v", err)
+	}
+	if parsed.Hash != tr.Info.Hash {
+		t.Errorf("ParseInfo hash = %x, want %x", parsed.Hash, tr.Info.Hash)
+	}
+}
+
+func TestBlockLength(t *testing.T) {
+	// Two pieces of two blocks, the last one 5000 bytes long.
+	info := &Info{
+		Length:   BlockSize*2 + 5000,
+		PieceLen: BlockSize * 2,
+		Pieces:   make([][20]byte, 2),
+	}
+
+	testCases := []struct {
+		index, begin int
+		want         int
+	}{
+		{0, 0, BlockSize},
+		{0, BlockSize, BlockSize},
+		{0, BlockSize * 2, 0},
+		{1, 0, 5000},
+		{1, 4000, 1000},
+		{1, 5000, 0},
+		{2, 0, 0},
+	}
+
+	for _, tc := range testCases {
+		if got := info.BlockLength(tc.index, tc.begin); got != tc.want {
+			t.Errorf(
+				"BlockLength(%d, %d) = %d, want %d",
+				tc.index,
+				tc.begin,
+				got,
+				tc.want,
+			)
+		}
+	}
+}
+
+func TestParseMetaVersion(t *testing.T) {
+	testCases := []struct {
+		name    string
+		info    map[string]any
+		want    int
+		wantErr error
+	}{
+		{"v1", map[string]any{"pieces": string(make([]byte, 20))}, 1, nil},
+		{
+			"hybrid",
+			map[string]any{
+				"meta version": int64(2),
+				"pieces":       string(make([]byte, 20)),
+				"file tree":    map[string]any{},
+			},
+			2,
+			nil,
+		},
+		{
+			"v2 only",
+			map[string]any{
+				"meta version": int64(2),
+				"file tree":    map[string]any{},
+			},
+			0,
+			ErrUnsupportedV2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.info["name"] = "file"
+			tc.info["length"] = int64(10)
+			tc.info["piece length"] = int64(BlockSize)
+
+			var buf bytes.Buffer
+			err := bencode.NewMarshaller(&buf).Marshal(map[string]any{
+				"announce": "http://tracker.example/announce",
+				"info":     tc.info,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tr, err := New(&buf)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("New: err = %v, want %v", err, tc.wantErr)
+			}
+			if err == nil && tr.Info.MetaVersion != tc.want {
+				t.Errorf(
+					"MetaVersion = %d, want %d",
+					tr.Info.MetaVersion,
+					tc.want,
+				)
+			}
+		})
+	}
+}
+
+func TestHybridTorrentVerifiesTheV1Way(t *testing.T) {
+	// A hybrid torrent of one file of one piece, with the v1 'pieces' next
+	// to the v2 file tree and piece layers, the way BEP 52 lays them out.
+	data := []byte("a hybrid torrent's only piece")
+	v1 := sha1.Sum(data)
+	v2 := sha256.Sum256(data)
+	info := map[string]any{
+		"meta version": int64(2),
+		"name":         "hybrid",
+		"length":       int64(len(data)),
+		"piece length": int64(BlockSize),
+		"pieces":       string(v1[:]),
+		"file tree": map[string]any{
+			"hybrid": map[string]any{
+				"": map[string]any{
+					"length":      int64(len(data)),
+					"pieces root": string(v2[:]),
+				},
+			},
+		},
+	}
+	var rawInfo bytes.Buffer
+	if err := bencode.NewMarshaller(&rawInfo).Marshal(info); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err := bencode.NewMarshaller(&buf).Marshal(map[string]any{
+		"announce":     "http://tracker.example/announce",
+		"info":         info,
+		"piece layers": map[string]any{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := New(&buf)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if tr.Info.MetaVersion != 2 || tr.Info.PieceHashes != PieceHashesV1 {
+		t.Errorf(
+			"meta version %d with piece hashes %d, want 2 with v1",
+			tr.Info.MetaVersion,
+			tr.Info.PieceHashes,
+		)
+	}
+	// v1 peers and trackers know the torrent by the SHA1 of its info.
+	if want := sha1.Sum(rawInfo.Bytes()); tr.Info.Hash != want {
+		t.Errorf("info hash = %x, want %x", tr.Info.Hash, want)
+	}
+	if got := tr.Info.Verifier().Sum(data); !bytes.Equal(got, v1[:]) {
+		t.Errorf("piece digest = %x, want %x", got, v1)
+	}
+}
@@ -0,0 +1,96 @@
+package torrent
+
+import (
+	"slices"
+	"sync"
+)
+
+// UploadSlots caps the number of peers unchoked across the chokers of several
+// torrents, bounding how thinly upload bandwidth is spread. The slots are
+// split max-min fairly: every torrent is entitled to an equal share, and what
+// one doesn't need goes to the others wanting more. Chokers ask for their
+// share every round, so the split follows demand from one round to the next.
+//
+// Its lock is taken after Choker.mu and never held while taking another.
+type UploadSlots struct {
+	mu  sync.Mutex
+	max int
+	// Chokers drawing on the slots, in the order they first asked
+	chokers []*Choker
+	// Number of slots each choker last asked for
+	demand map[*Choker]int
+}
+
+func NewUploadSlots(max int) *UploadSlots {
+	return &UploadSlots{
+		max:    max,
+		demand: make(map[*Choker]int),
+	}
+}
+
+/////////////// Private ///////////////
+
+// grant records that c wants to unchoke want peers and returns how many it
+// may.
+func (u *UploadSlots) grant(c *Choker, want int) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if _, ok := u.demand[c]; !ok {
+		u.chokers = append(u.chokers, c)
+	}
+	u.demand[c] = want
+
+	return u.allocate()[c]
+}
+
+// release withdraws c, leaving its slots to the other chokers.
+func (u *UploadSlots) release(c *Choker) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.chokers = slices.DeleteFunc(u.chokers, func(o *Choker) bool {
+		return o == c
+	})
+	delete(u.demand, c)
+}
+
+// allocate splits the slots among the chokers' demands by water-filling:
+// every round each unsatisfied choker gets an equal part of what's left,
+// until the slots run out or every demand is met. When fewer slots are left
+// than chokers want them, the earliest chokers get one each. Callers must
+// hold u.mu.
+func (u *UploadSlots) allocate() map[*Choker]int {
+	alloc := make(map[*Choker]int, len(u.chokers))
+
+	var pending []*Choker
+	for _, c := range u.chokers {
+		if u.demand[c] > 0 {
+			pending = append(pending, c)
+		}
+	}
+
+	remaining := u.max
+	for len(pending) > 0 && remaining > 0 {
+		share := remaining / len(pending)
+		if share == 0 {
+			for _, c := range pending[:remaining] {
+				alloc[c]++
+			}
+			break
+		}
+
+		var unsatisfied []*Choker
+		for _, c := range pending {
+			give := min(share, u.demand[c]-alloc[c])
+			alloc[c] += give
+			remaining -= give
+			if alloc[c] < u.demand[c] {
+				unsatisfied = append(unsatisfied, c)
+			}
+		}
+		pending = unsatisfied
+	}
+
+	return alloc
+}
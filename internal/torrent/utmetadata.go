@@ -0,0 +1,361 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/prxssh/relay/internal/bencode"
+)
+
+// Metadata exchange (BEP 9). Peers that know a torrent's info dictionary
+// serve it in metadataPieceSize pieces over the 'ut_metadata' extension, which
+// is what makes magnet links work.
+
+const (
+	extUTMetadata = "ut_metadata"
+	// localUTMetadataID is the extended message id we assign to ut_metadata;
+	// peers send us metadata with it.
+	localUTMetadataID = 1
+
+	// ut_metadata msg_type values
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+
+	// metadataFetchTimeout bounds a whole metadata fetch from one peer
+	// unless the context has an earlier deadline.
+	metadataFetchTimeout = 30 * time.Second
+)
+
+// ErrNoMetadata is returned by FetchMetadata when the peer doesn't support
+// the metadata exchange or refuses to send the metadata.
+var ErrNoMetadata = errors.New("metadata: peer can't provide metadata")
+
+// FetchMetadata connects to the peer at addr only to download the info
+// dictionary of the torrent with opts.InfoHash, e.g. to start a magnet
+// download. It performs the handshake and the extended handshake, requests
+// every metadata piece and disconnects as soon as the metadata is complete or
+// the peer turns out not to have it. The peer never enters the choke and
+// request loop of a regular connection. The returned dictionary has been
+// verified against the info hash.
+func FetchMetadata(
+	ctx context.Context,
+	addr string,
+	opts *PeerConnectOpts,
+) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return fetchMetadata(ctx, conn, opts)
+}
+
+// RequestMetadata downloads the info dictionary of the torrent with infoHash
+// from a started peer over ut_metadata, next to the regular message loop. It
+// waits for the peer's extended handshake and fails with ErrNoMetadata if the
+// peer doesn't serve metadata or refuses to. The dictionary is verified
+// against infoHash before it's parsed.
+func (p *Peer) RequestMetadata(infoHash [sha1.Size]byte) (*Info, error) {
+	if !p.extensions {
+		return nil, ErrNoMetadata
+	}
+
+	timer := p.clock.NewTimer(metadataFetchTimeout)
+	defer timer.Stop()
+	select {
+	case <-p.extReady:
+	case <-timer.C():
+		return nil, ErrNoMetadata
+	}
+
+	fetch, id, err := p.startMetadataFetch(infoHash)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		p.mu.Lock()
+		if p.metadataFetch == fetch {
+			p.metadataFetch = nil
+		}
+		p.mu.Unlock()
+	}()
+
+	for i := 0; i < fetch.buf.numPieces(); i++ {
+		msg, err := messageMetadataRequest(id, i)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.sendMessage(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	select {
+	case res := <-fetch.done:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return ParseInfo(res.data)
+	case <-timer.C():
+		return nil, errors.New("metadata: timed out")
+	}
+}
+
+/////////////// Private ///////////////
+
+// metadataFetch is a RequestMetadata in progress on a started peer.
+type metadataFetch struct {
+	infoHash [sha1.Size]byte
+	buf      *metadataBuffer
+	// Receives the verified metadata or the error that ended the fetch
+	done chan metadataResult
+}
+
+type metadataResult struct {
+	data []byte
+	err  error
+}
+
+// startMetadataFetch registers a metadata fetch for the size the peer
+// announced and returns it with the peer's ut_metadata message id.
+func (p *Peer) startMetadataFetch(
+	infoHash [sha1.Size]byte,
+) (*metadataFetch, byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.utMetadataID <= 0 || p.utMetadataID > 255 || p.metadataSize == 0 {
+		return nil, 0, ErrNoMetadata
+	}
+	if p.metadataFetch != nil {
+		return nil, 0, errors.New("metadata: fetch already in progress")
+	}
+	buf, err := newMetadataBuffer(p.metadataSize, DefaultMaxMetadataSize)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	p.metadataFetch = &metadataFetch{
+		infoHash: infoHash,
+		buf:      buf,
+		done:     make(chan metadataResult, 1),
+	}
+	return p.metadataFetch, byte(p.utMetadataID), nil
+}
+
+// applyMetadataMessage handles a ut_metadata message of a started peer,
+// after the extended message id. Messages without a fetch in progress, and
+// requests for metadata we don't serve, are ignored. The caller must hold
+// p.mu.
+func (p *Peer) applyMetadataMessage(payload []byte) error {
+	msgType, piece, totalSize, data, err := parseMetadataMessage(payload)
+	if err != nil {
+		return err
+	}
+	fetch := p.metadataFetch
+	if fetch == nil {
+		return nil
+	}
+
+	var res metadataResult
+	switch msgType {
+	case metadataReject:
+		res.err = ErrNoMetadata
+	case metadataData:
+		if err := fetch.buf.addPiece(piece, totalSize, data); err != nil {
+			res.err = err
+			break
+		}
+		if !fetch.buf.done() {
+			return nil
+		}
+		res.data, res.err = fetch.buf.verify(fetch.infoHash)
+	default:
+		return nil
+	}
+
+	p.metadataFetch = nil
+	fetch.done <- res
+	return nil
+}
+
+// fetchMetadata runs the metadata exchange of FetchMetadata over conn.
+func fetchMetadata(
+	ctx context.Context,
+	conn net.Conn,
+	opts *PeerConnectOpts,
+) ([]byte, error) {
+	deadline := time.Now().Add(metadataFetchTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	data, err := exchangeMetadata(conn, opts)
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return nil, ctxErr
+	}
+	return data, err
+}
+
+func exchangeMetadata(conn net.Conn, opts *PeerConnectOpts) ([]byte, error) {
+	local := newHandshake(opts.InfoHash, opts.PeerID)
+	if _, err := conn.Write(local.serialize()); err != nil {
+		return nil, err
+	}
+	remote, err := readHanshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	if remote.infoHash != opts.InfoHash {
+		return nil, errors.New("handshake: info hash mismatch")
+	}
+	if !remote.supportsExtensions() {
+		return nil, ErrNoMetadata
+	}
+
+	ext, err := messageExtHandshake(&extHandshake{
+		m: map[string]int64{extUTMetadata: localUTMetadataID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(ext.marshal()); err != nil {
+		return nil, err
+	}
+
+	var buf *metadataBuffer
+	for {
+		msg, err := unmarshalMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		// Anything but extension messages, keep-alives included, is of no
+		// interest here.
+		if msg == nil || msg.id != msgExtended || len(msg.payload) == 0 {
+			continue
+		}
+
+		switch msg.payload[0] {
+		case extHandshakeID:
+			if buf != nil {
+				continue
+			}
+			buf, err = requestMetadata(conn, msg.payload[1:])
+			if err != nil {
+				return nil, err
+			}
+
+		case localUTMetadataID:
+			if buf == nil {
+				return nil, errors.New("metadata: data before handshake")
+			}
+			msgType, piece, totalSize, data, err := parseMetadataMessage(
+				msg.payload[1:],
+			)
+			if err != nil {
+				return nil, err
+			}
+			switch msgType {
+			case metadataReject:
+				return nil, ErrNoMetadata
+			case metadataData:
+				if err := buf.addPiece(piece, totalSize, data); err != nil {
+					return nil, err
+				}
+			}
+			if buf.done() {
+				return buf.verify(opts.InfoHash)
+			}
+		}
+	}
+}
+
+// requestMetadata handles the peer's extended handshake: it prepares a buffer
+// for the metadata size the peer announced and requests every piece of it.
+func requestMetadata(conn net.Conn, payload []byte) (*metadataBuffer, error) {
+	h, err := parseExtHandshake(payload)
+	if err != nil {
+		return nil, err
+	}
+	id, ok := h.m[extUTMetadata]
+	if !ok || id <= 0 || id > 255 || h.metadataSize == 0 {
+		return nil, ErrNoMetadata
+	}
+
+	buf, err := newMetadataBuffer(h.metadataSize, DefaultMaxMetadataSize)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < buf.numPieces(); i++ {
+		msg, err := messageMetadataRequest(byte(id), i)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(msg.marshal()); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf, nil
+}
+
+// messageMetadataRequest asks for a metadata piece. id is the extended
+// message id the peer assigned to ut_metadata.
+func messageMetadataRequest(id byte, piece int) (*message, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(id)
+	err := bencode.NewMarshaller(&buf).Marshal(map[string]any{
+		"msg_type": int64(metadataRequest),
+		"piece":    int64(piece),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &message{id: msgExtended, payload: buf.Bytes()}, nil
+}
+
+// parseMetadataMessage decodes a ut_metadata message, after the extended
+// message id. For data messages the piece's bytes follow the bencoded
+// dictionary.
+func parseMetadataMessage(
+	payload []byte,
+) (msgType, piece int, totalSize int64, data []byte, err error) {
+	r := bytes.NewReader(payload)
+	u := bencode.NewUnmarshaller(r)
+	raw, err := u.Unmarshal()
+	if err != nil {
+		return 0, 0, 0, nil, fmt.Errorf("ut_metadata: %w", err)
+	}
+	dict, ok := raw.(map[string]any)
+	if !ok {
+		return 0, 0, 0, nil, fmt.Errorf(
+			"ut_metadata: expected dictionary, got %T",
+			raw,
+		)
+	}
+
+	t, ok1 := dict["msg_type"].(int64)
+	p, ok2 := dict["piece"].(int64)
+	if !ok1 || !ok2 {
+		return 0, 0, 0, nil, errors.New(
+			"ut_metadata: missing msg_type or piece",
+		)
+	}
+	totalSize, _ = dict["total_size"].(int64)
+
+	// Whatever the unmarshaller didn't consume is the piece data.
+	dictLen := len(payload) - r.Len() - u.Buffered()
+	return int(t), int(p), totalSize, payload[dictLen:], nil
+}
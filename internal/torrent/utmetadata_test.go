@@ -0,0 +1,262 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/prxssh/relay/internal/bencode"
+)
+
+// serveMetadata plays the remote end of a metadata fetch over conn: a peer
+// serving info over ut_metadata, or refusing every request if reject is set.
+// It returns once conn is closed.
+func serveMetadata(
+	t *testing.T,
+	conn net.Conn,
+	info []byte,
+	reject bool,
+) {
+	const remoteID = 3
+
+	if _, err := readHanshake(conn); err != nil {
+		t.Errorf("reading handshake: %v", err)
+		return
+	}
+	h := newHandshake(sha1.Sum(info), [20]byte{8})
+	if _, err := conn.Write(h.serialize()); err != nil {
+		return
+	}
+
+	msg, err := unmarshalMessage(conn)
+	if err != nil || msg.id != msgExtended {
+		t.Errorf("expected extended handshake, got %v (%v)", msg, err)
+		return
+	}
+	ext, err := parseExtHandshake(msg.payload[1:])
+	if err != nil || ext.m[extUTMetadata] != localUTMetadataID {
+		t.Errorf("extended handshake doesn't advertise ut_metadata")
+		return
+	}
+
+	reply, err := messageExtHandshake(&extHandshake{
+		m:            map[string]int64{extUTMetadata: remoteID},
+		metadataSize: int64(len(info)),
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := conn.Write(reply.marshal()); err != nil {
+		return
+	}
+
+	// Requests are answered from a separate goroutine: the pipe has no
+	// buffer, and the fetcher sends all its requests before reading.
+	requests := make(chan int, 16)
+	go func() {
+		defer close(requests)
+		for {
+			msg, err := unmarshalMessage(conn)
+			if err != nil {
+				return
+			}
+			_, piece, _, _, err := parseMetadataMessage(msg.payload[1:])
+			if err != nil || msg.payload[0] != remoteID {
+				t.Errorf("bad metadata request: %v", err)
+				return
+			}
+			requests <- piece
+		}
+	}()
+
+	for piece := range requests {
+		var payload bytes.Buffer
+		payload.WriteByte(localUTMetadataID)
+		dict := map[string]any{
+			"msg_type": int64(metadataReject),
+			"piece":    int64(piece),
+		}
+		if !reject {
+			dict["msg_type"] = int64(metadataData)
+			dict["total_size"] = int64(len(info))
+		}
+		bencode.NewMarshaller(&payload).Marshal(dict)
+		if !reject {
+			end := min((piece+1)*metadataPieceSize, len(info))
+			payload.Write(info[piece*metadataPieceSize : end])
+		}
+
+		msg := &message{id: msgExtended, payload: payload.Bytes()}
+		if _, err := conn.Write(msg.marshal()); err != nil {
+			return
+		}
+	}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	// Two metadata pieces, the second one short.
+	name := strings.Repeat("x", metadataPieceSize)
+	info := []byte("d4:name" + "16384:" + name + "e")
+
+	testCases := []struct {
+		name    string
+		reject  bool
+		wantErr error
+	}{
+		{"served", false, nil},
+		{"rejected", true, ErrNoMetadata},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer remote.Close()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				serveMetadata(t, remote, info, tc.reject)
+			}()
+
+			got, err := fetchMetadata(
+				context.Background(),
+				local,
+				&PeerConnectOpts{InfoHash: sha1.Sum(info)},
+			)
+			local.Close()
+			<-done
+
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("fetchMetadata: err = %v, want %v", err, tc.wantErr)
+			}
+			if err == nil && !bytes.Equal(got, info) {
+				t.Error("fetched metadata differs from the info dictionary")
+			}
+		})
+	}
+}
+
+func TestParseMetadataMessageSplitsData(t *testing.T) {
+	var payload bytes.Buffer
+	bencode.NewMarshaller(&payload).Marshal(map[string]any{
+		"msg_type":   int64(metadataData),
+		"piece":      int64(1),
+		"total_size": int64(20000),
+	})
+	payload.WriteString("d5:piece")
+
+	msgType, piece, totalSize, data, err := parseMetadataMessage(
+		payload.Bytes(),
+	)
+	if err != nil {
+		t.Fatalf("parseMetadataMessage: %v", err)
+	}
+	if msgType != metadataData || piece != 1 || totalSize != 20000 {
+		t.Errorf(
+			"got type %d piece %d size %d, want 1, 1, 20000",
+			msgType,
+			piece,
+			totalSize,
+		)
+	}
+	if string(data) != "d5:piece" {
+		t.Errorf("data = %q, want %q", data, "d5:piece")
+	}
+}
+
+func TestPeerRequestMetadataReassemblesPieces(t *testing.T) {
+	const remoteID = 3
+
+	var buf bytes.Buffer
+	bencode.NewMarshaller(&buf).Marshal(map[string]any{
+		"name":         strings.Repeat("x", metadataPieceSize),
+		"length":       int64(10),
+		"piece length": int64(BlockSize),
+		"pieces":       string(make([]byte, 20)),
+	})
+	info := buf.Bytes()
+
+	testCases := []struct {
+		name    string
+		infoAt  func(piece int) []byte
+		wantErr error
+	}{
+		{"valid", func(int) []byte { return info }, nil},
+		{
+			"corrupt",
+			func(piece int) []byte {
+				if piece == 1 {
+					return bytes.ToUpper(info)
+				}
+				return info
+			},
+			ErrMetadataHashMismatch,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, remote := connectedPeer(t, 1, nil)
+			ext, err := messageExtHandshake(&extHandshake{
+				m:            map[string]int64{extUTMetadata: remoteID},
+				metadataSize: int64(len(info)),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			remote.send(ext)
+
+			type result struct {
+				info *Info
+				err  error
+			}
+			done := make(chan result, 1)
+			go func() {
+				info, err := p.RequestMetadata(sha1.Sum(info))
+				done <- result{info, err}
+			}()
+
+			var pieces []int
+			for range 2 {
+				msg := remote.expect(msgExtended)
+				_, piece, _, _, err := parseMetadataMessage(msg.payload[1:])
+				if err != nil || msg.payload[0] != remoteID {
+					t.Fatalf("bad metadata request: %v", err)
+				}
+				pieces = append(pieces, piece)
+			}
+
+			// Answer the last piece first.
+			for i := len(pieces) - 1; i >= 0; i-- {
+				piece := pieces[i]
+				var payload bytes.Buffer
+				payload.WriteByte(localUTMetadataID)
+				bencode.NewMarshaller(&payload).Marshal(map[string]any{
+					"msg_type":   int64(metadataData),
+					"piece":      int64(piece),
+					"total_size": int64(len(info)),
+				})
+				end := min((piece+1)*metadataPieceSize, len(info))
+				payload.Write(tc.infoAt(piece)[piece*metadataPieceSize : end])
+				remote.send(&message{id: msgExtended, payload: payload.Bytes()})
+			}
+
+			res := <-done
+			if !errors.Is(res.err, tc.wantErr) {
+				t.Fatalf(
+					"RequestMetadata: err = %v, want %v",
+					res.err,
+					tc.wantErr,
+				)
+			}
+			if res.err == nil && res.info.Hash != sha1.Sum(info) {
+				t.Error("parsed info has the wrong hash")
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/prxssh/relay/internal/bencode"
+	"github.com/prxssh/relay/internal/tracker"
+)
+
+// Peer exchange (BEP 11). Connected peers tell each other, at most once a
+// minute, which peers they connected to and dropped since their last message
+// over the 'ut_pex' extension. It's never used for private torrents, whose
+// peers must only come from their trackers.
+
+const (
+	extUTPex = "ut_pex"
+	// localUTPexID is the extended message id we assign to ut_pex; peers
+	// send us peer exchange messages with it.
+	localUTPexID = 2
+
+	// PEXInterval is how often connected peers may be sent a peer exchange
+	// message.
+	PEXInterval = time.Minute
+	// maxPEXPeers is the most peers added or dropped in one message, as
+	// BEP 11 asks. Peers beyond it are left for the next message, or
+	// ignored when a peer sends them.
+	maxPEXPeers = 50
+
+	// Bits of the 'added.f' flags of a peer
+	pexFlagCrypto = 0x01
+)
+
+// SendPEX tells the peer, over ut_pex, about the peers we're connected to:
+// the ones it hasn't been told about yet as added, the ones gone since the
+// last message as dropped. Peers whose listen address is unknown, and the peer
+// itself, are left out. It does nothing if we don't exchange peers with the
+// peer or there's nothing new to tell.
+func (p *Peer) SendPEX(peers []*Peer) error {
+	if !p.pex {
+		return nil
+	}
+
+	connected := make(map[string]bool, len(peers))
+	for _, other := range peers {
+		if other == p {
+			continue
+		}
+		if addr := other.listenAddress(); addr != "" {
+			connected[addr] = true
+		}
+	}
+
+	p.mu.Lock()
+	id := p.utPexID
+	if id <= 0 || id > 255 {
+		p.mu.Unlock()
+		return nil
+	}
+	var added, dropped []string
+	for addr := range connected {
+		if !p.pexSent[addr] && len(added) < maxPEXPeers {
+			added = append(added, addr)
+			p.pexSent[addr] = true
+		}
+	}
+	for addr := range p.pexSent {
+		if !connected[addr] && len(dropped) < maxPEXPeers {
+			dropped = append(dropped, addr)
+			delete(p.pexSent, addr)
+		}
+	}
+	p.mu.Unlock()
+
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+	msg, err := messagePEX(byte(id), added, dropped)
+	if err != nil {
+		return err
+	}
+	return p.sendMessage(msg)
+}
+
+/////////////// Private ///////////////
+
+// pexMessage is a decoded ut_pex message.
+type pexMessage struct {
+	added   []*tracker.Peer
+	dropped []*tracker.Peer
+}
+
+// listenAddress returns the address the peer accepts connections on: the one
+// we dialed, or for inbound peers the port of their extended handshake at
+// their IP. It's empty if an inbound peer didn't say.
+func (p *Peer) listenAddress() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.listenAddr
+}
+
+// receivePEX hands the peers added by a ut_pex message, after the extended
+// message id, to onPEX.
+func (p *Peer) receivePEX(payload []byte) error {
+	msg, err := parsePEXMessage(payload)
+	if err != nil {
+		return err
+	}
+	if len(msg.added) > maxPEXPeers {
+		msg.added = msg.added[:maxPEXPeers]
+	}
+
+	if len(msg.added) > 0 && p.onPEX != nil {
+		p.onPEX(p, msg.added)
+	}
+	return nil
+}
+
+// messagePEX returns a ut_pex message adding and dropping the peers at the
+// given host:port addresses. id is the extended message id the peer assigned
+// to ut_pex.
+func messagePEX(id byte, added, dropped []string) (*message, error) {
+	dict := make(map[string]any)
+	var added4, added6, flags4, flags6, dropped4, dropped6 []byte
+	for _, addr := range added {
+		if b, ok := compactAddr(addr, net.IPv4len); ok {
+			added4 = append(added4, b...)
+			flags4 = append(flags4, 0)
+		} else if b, ok := compactAddr(addr, net.IPv6len); ok {
+			added6 = append(added6, b...)
+			flags6 = append(flags6, 0)
+		}
+	}
+	for _, addr := range dropped {
+		if b, ok := compactAddr(addr, net.IPv4len); ok {
+			dropped4 = append(dropped4, b...)
+		} else if b, ok := compactAddr(addr, net.IPv6len); ok {
+			dropped6 = append(dropped6, b...)
+		}
+	}
+	dict["added"] = string(added4)
+	dict["added.f"] = string(flags4)
+	dict["dropped"] = string(dropped4)
+	if len(added6) > 0 || len(dropped6) > 0 {
+		dict["added6"] = string(added6)
+		dict["added6.f"] = string(flags6)
+		dict["dropped6"] = string(dropped6)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(id)
+	if err := bencode.NewMarshaller(&buf).Marshal(dict); err != nil {
+		return nil, err
+	}
+
+	return &message{id: msgExtended, payload: buf.Bytes()}, nil
+}
+
+// parsePEXMessage decodes a ut_pex message, after the extended message id.
+// Missing keys mean no peers; flags are optional and only tell whether a peer
+// supports encryption.
+func parsePEXMessage(payload []byte) (*pexMessage, error) {
+	raw, err := bencode.NewUnmarshaller(bytes.NewReader(payload)).Unmarshal()
+	if err != nil {
+		return nil, fmt.Errorf("ut_pex: %w", err)
+	}
+	dict, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("ut_pex: expected dictionary, got %T", raw)
+	}
+
+	msg := &pexMessage{}
+	for _, family := range []struct {
+		suffix string
+		ipLen  int
+	}{
+		{"", net.IPv4len},
+		{"6", net.IPv6len},
+	} {
+		added, err := pexPeers(dict, "added"+family.suffix, family.ipLen)
+		if err != nil {
+			return nil, err
+		}
+		flags, _ := dict["added"+family.suffix+".f"].(string)
+		for i, peer := range added {
+			if i < len(flags) && flags[i]&pexFlagCrypto != 0 {
+				peer.SupportsCrypto = true
+			}
+		}
+		dropped, err := pexPeers(dict, "dropped"+family.suffix, family.ipLen)
+		if err != nil {
+			return nil, err
+		}
+
+		msg.added = append(msg.added, added...)
+		msg.dropped = append(msg.dropped, dropped...)
+	}
+
+	return msg, nil
+}
+
+// pexPeers decodes the compact peers under key, each an IP of ipLen bytes and
+// a port.
+func pexPeers(
+	dict map[string]any,
+	key string,
+	ipLen int,
+) ([]*tracker.Peer, error) {
+	s, _ := dict[key].(string)
+	size := ipLen + 2
+	if len(s)%size != 0 {
+		return nil, fmt.Errorf(
+			"ut_pex: %s of %d bytes, not a multiple of %d",
+			key,
+			len(s),
+			size,
+		)
+	}
+
+	peers := make([]*tracker.Peer, 0, len(s)/size)
+	for b := []byte(s); len(b) > 0; b = b[size:] {
+		peers = append(peers, &tracker.Peer{
+			IP:   net.IP(bytes.Clone(b[:ipLen])),
+			Port: binary.BigEndian.Uint16(b[ipLen:size]),
+		})
+	}
+	return peers, nil
+}
+
+// compactAddr packs a host:port address as an IP of ipLen bytes and a port.
+// ok is false if the address isn't of that family.
+func compactAddr(addr string, ipLen int) (b []byte, ok bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, false
+	}
+	ip := net.ParseIP(host)
+	n, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, false
+	}
+
+	if ipLen == net.IPv4len {
+		ip = ip.To4()
+	} else if ip.To4() != nil {
+		ip = nil
+	}
+	if ip == nil {
+		return nil, false
+	}
+	return binary.BigEndian.AppendUint16(bytes.Clone(ip), uint16(n)), true
+}
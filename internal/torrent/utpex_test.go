@@ -0,0 +1,193 @@
+package torrent
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/prxssh/relay/internal/tracker"
+)
+
+func TestParsePEXMessage(t *testing.T) {
+	// Two IPv4 peers, the first preferring encryption and the second a seed
+	// reachable over uTP, one IPv6 peer and one dropped peer, keys in the
+	// order a real client sends them.
+	payload := []byte("d5:added12:" +
+		"\x01\x02\x03\x04\x1a\xe1" +
+		"\x05\x06\x07\x08\xc8\xd5" +
+		"7:added.f2:\x01\x06" +
+		"6:added618:" +
+		"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+		"\x1a\xe1" +
+		"8:added6.f1:\x00" +
+		"7:dropped6:\x09\x09\x09\x09\x00\x50" +
+		"8:dropped60:" +
+		"e")
+
+	msg, err := parsePEXMessage(payload)
+	if err != nil {
+		t.Fatalf("parsePEXMessage: %v", err)
+	}
+
+	addrs := func(peers []*tracker.Peer) []string {
+		var s []string
+		for _, p := range peers {
+			s = append(s, p.Addr())
+		}
+		return s
+	}
+	wantAdded := []string{
+		"1.2.3.4:6881",
+		"5.6.7.8:51413",
+		"[2001:db8::1]:6881",
+	}
+	if got := addrs(msg.added); !slices.Equal(got, wantAdded) {
+		t.Errorf("added = %q, want %q", got, wantAdded)
+	}
+	wantDropped := []string{"9.9.9.9:80"}
+	if got := addrs(msg.dropped); !slices.Equal(got, wantDropped) {
+		t.Errorf("dropped = %q, want %q", got, wantDropped)
+	}
+	for i, want := range []bool{true, false, false} {
+		if got := msg.added[i].SupportsCrypto; got != want {
+			t.Errorf("added[%d].SupportsCrypto = %v, want %v", i, got, want)
+		}
+	}
+
+	if _, err := parsePEXMessage([]byte("d5:added5:12345e")); err == nil {
+		t.Error("expected an error for a truncated added peer")
+	}
+}
+
+func TestPeerEmitsPEXPeers(t *testing.T) {
+	testCases := []struct {
+		name    string
+		private bool
+	}{
+		{"public", false},
+		{"private", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			p, sent := pipePeer(t, 1, nil)
+			p.applyOpts(&PeerConnectOpts{
+				Info: &Info{IsPrivate: tc.private},
+				OnPEX: func(_ *Peer, peers []*tracker.Peer) {
+					for _, rp := range peers {
+						got = append(got, rp.Addr())
+					}
+				},
+			})
+
+			// Our extended handshake only offers ut_pex for public torrents.
+			remote := newHandshake([20]byte{1}, [20]byte{'r'})
+			if err := p.sendExtHandshake(remote); err != nil {
+				t.Fatalf("sendExtHandshake: %v", err)
+			}
+			ext, err := parseExtHandshake(
+				expectMessage(t, sent, msgExtended).payload[1:],
+			)
+			if err != nil {
+				t.Fatalf("parseExtHandshake: %v", err)
+			}
+			if _, ok := ext.m[extUTPex]; ok == tc.private {
+				t.Errorf("ut_pex offered = %v", ok)
+			}
+
+			msg, err := messagePEX(
+				localUTPexID,
+				[]string{"10.0.0.1:6881", "[2001:db8::2]:6882"},
+				nil,
+			)
+			if err != nil {
+				t.Fatalf("messagePEX: %v", err)
+			}
+			if err := p.handleMessage(msg); err != nil {
+				t.Fatalf("handleMessage: %v", err)
+			}
+
+			want := []string{"10.0.0.1:6881", "[2001:db8::2]:6882"}
+			if tc.private {
+				want = nil
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("emitted %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSendPEXReportsAddedAndDropped(t *testing.T) {
+	p, sent := pipePeer(t, 1, nil)
+	p.applyOpts(&PeerConnectOpts{OnPEX: func(*Peer, []*tracker.Peer) {}})
+	ext, err := messageExtHandshake(&extHandshake{
+		m: map[string]int64{extUTPex: 7},
+	})
+	if err != nil {
+		t.Fatalf("messageExtHandshake: %v", err)
+	}
+	if err := p.handleMessage(ext); err != nil {
+		t.Fatalf("handleMessage: %v", err)
+	}
+
+	// An outbound peer listens where we dialed it; an inbound one where its
+	// extended handshake says.
+	dialed := newPeer("1.2.3.4:6881", nil, 1, nil)
+	dialed.listenAddr = dialed.Addr
+	inbound := newPeer("5.6.7.8:40000", nil, 1, nil)
+	ext, err = messageExtHandshake(&extHandshake{port: 5000})
+	if err != nil {
+		t.Fatalf("messageExtHandshake: %v", err)
+	}
+	if err := inbound.handleMessage(ext); err != nil {
+		t.Fatalf("handleMessage: %v", err)
+	}
+	unknown := newPeer("9.9.9.9:40000", nil, 1, nil)
+
+	expectPEX := func(wantAdded, wantDropped []string) {
+		t.Helper()
+
+		msg := expectMessage(t, sent, msgExtended)
+		if msg.payload[0] != 7 {
+			t.Fatalf("sent extended message %d, want 7", msg.payload[0])
+		}
+		pex, err := parsePEXMessage(msg.payload[1:])
+		if err != nil {
+			t.Fatalf("parsePEXMessage: %v", err)
+		}
+		var added, dropped []string
+		for _, rp := range pex.added {
+			added = append(added, rp.Addr())
+		}
+		for _, rp := range pex.dropped {
+			dropped = append(dropped, rp.Addr())
+		}
+		slices.Sort(added)
+		if !slices.Equal(added, wantAdded) ||
+			!slices.Equal(dropped, wantDropped) {
+			t.Errorf(
+				"added %q, dropped %q; want %q, %q",
+				added,
+				dropped,
+				wantAdded,
+				wantDropped,
+			)
+		}
+	}
+
+	if err := p.SendPEX([]*Peer{p, dialed, inbound, unknown}); err != nil {
+		t.Fatalf("SendPEX: %v", err)
+	}
+	expectPEX([]string{"1.2.3.4:6881", "5.6.7.8:5000"}, nil)
+
+	// Nothing changed, so nothing is sent; the next message only drops the
+	// inbound peer.
+	if err := p.SendPEX([]*Peer{p, dialed, inbound}); err != nil {
+		t.Fatalf("SendPEX: %v", err)
+	}
+	if err := p.SendPEX([]*Peer{p, dialed}); err != nil {
+		t.Fatalf("SendPEX: %v", err)
+	}
+	expectPEX(nil, []string{"5.6.7.8:5000"})
+}
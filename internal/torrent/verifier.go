@@ -0,0 +1,72 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+)
+
+// Verifier computes the digests a torrent's pieces and info dictionary are
+// checked against. v1 piece hashes are SHA1, v2 ones (BEP 52) SHA256.
+type Verifier interface {
+	// Sum returns the digest of data.
+	Sum(data []byte) []byte
+	// Size returns the length of a digest in bytes.
+	Size() int
+}
+
+// PieceHashes tells which kind of piece hashes an info dictionary carries.
+type PieceHashes int
+
+const (
+	// PieceHashesV1 are the SHA1 digests of the 'pieces' string. Hybrid
+	// torrents carry them next to the v2 ones.
+	PieceHashesV1 PieceHashes = iota
+	// PieceHashesV2 are the SHA256 merkle roots of the 'file tree', the only
+	// hashes of a v2-only torrent.
+	PieceHashesV2
+)
+
+type sha1Verifier struct{}
+
+type sha256Verifier struct{}
+
+// VerifierFor returns the Verifier for pieces of the given kind of hashes.
+// It, not the meta version, decides the digest: a hybrid torrent says it's
+// version 2, yet its 'pieces' and its info hash on the v1 wire are SHA1.
+func VerifierFor(hashes PieceHashes) Verifier {
+	if hashes == PieceHashesV2 {
+		return sha256Verifier{}
+	}
+	return sha1Verifier{}
+}
+
+// pieceHashesOf returns the kind of piece hashes infoDict carries: v1 whenever
+// it has 'pieces', v2 if it only has a 'file tree'. ok is false if it has
+// neither.
+func pieceHashesOf(infoDict map[string]any) (hashes PieceHashes, ok bool) {
+	if _, ok := infoDict["pieces"]; ok {
+		return PieceHashesV1, true
+	}
+	if _, ok := infoDict["file tree"]; ok {
+		return PieceHashesV2, true
+	}
+	return 0, false
+}
+
+func (sha1Verifier) Sum(data []byte) []byte {
+	sum := sha1.Sum(data)
+	return sum[:]
+}
+
+func (sha1Verifier) Size() int {
+	return sha1.Size
+}
+
+func (sha256Verifier) Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func (sha256Verifier) Size() int {
+	return sha256.Size
+}
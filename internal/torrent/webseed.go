@@ -0,0 +1,187 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ErrRangeUnsupported is returned by a web seed whose server ignores HTTP
+// Range requests. The web seed disables itself, since it could only ever
+// serve whole files.
+var ErrRangeUnsupported = errors.New("webseed: server doesn't support ranges")
+
+// WebSeed downloads torrent data over HTTP from a GetRight-style web seed
+// (BEP 19). For single-file torrents the URL points at the file itself; for
+// multi-file torrents it's a directory holding the torrent's root directory,
+// below which the files are laid out by their paths.
+type WebSeed struct {
+	// URL from the torrent's url-list
+	URL    string
+	info   *Info
+	client *http.Client
+
+	mu       sync.Mutex
+	disabled bool
+}
+
+// webSeedSpan is the part of a piece stored in one file of the torrent.
+type webSeedSpan struct {
+	url    string
+	offset int64
+	length int64
+}
+
+func NewWebSeed(rawURL string, info *Info, client *http.Client) *WebSeed {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &WebSeed{URL: rawURL, info: info, client: client}
+}
+
+// Disabled reports whether the web seed turned out to be unusable.
+func (ws *WebSeed) Disabled() bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	return ws.disabled
+}
+
+// FetchPiece downloads a whole piece with one Range request per file the
+// piece spans. The data isn't verified.
+func (ws *WebSeed) FetchPiece(ctx context.Context, index int) ([]byte, error) {
+	if ws.Disabled() {
+		return nil, ErrRangeUnsupported
+	}
+	if index < 0 || index >= len(ws.info.Pieces) {
+		return nil, fmt.Errorf("webseed: piece %d out of range", index)
+	}
+
+	spans, err := ws.spans(
+		int64(index)*ws.info.PieceLen,
+		ws.info.PieceSize(index),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, ws.info.PieceSize(index))
+	for _, span := range spans {
+		data, err = ws.fetchRange(ctx, span, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+/////////////// Private ///////////////
+
+// spans maps the torrent-wide range [off, off+length) to the file URLs and
+// offsets holding it.
+func (ws *WebSeed) spans(off, length int64) ([]webSeedSpan, error) {
+	var spans []webSeedSpan
+	var fileOffset int64
+
+	for _, f := range ws.info.FileList() {
+		start, end := fileOffset, fileOffset+f.Length
+		fileOffset = end
+
+		if length == 0 {
+			break
+		}
+		if off >= end || f.Length == 0 {
+			continue
+		}
+
+		u, err := ws.fileURL(f)
+		if err != nil {
+			return nil, err
+		}
+
+		n := min(length, end-off)
+		spans = append(spans, webSeedSpan{
+			url:    u,
+			offset: off - start,
+			length: n,
+		})
+		off += n
+		length -= n
+	}
+
+	return spans, nil
+}
+
+// fileURL returns where the web seed serves f. A single-file torrent's URL
+// names the file, unless it ends in a slash, in which case the torrent name
+// is appended like for multi-file torrents.
+func (ws *WebSeed) fileURL(f *File) (string, error) {
+	multiFile := len(ws.info.Files) > 0
+	if !multiFile && !strings.HasSuffix(ws.URL, "/") {
+		return ws.URL, nil
+	}
+
+	base, err := url.Parse(ws.URL)
+	if err != nil {
+		return "", fmt.Errorf("webseed: invalid url %q: %w", ws.URL, err)
+	}
+
+	// f.Path starts with the torrent name in both modes, see FileList.
+	return base.JoinPath(f.Path...).String(), nil
+}
+
+// fetchRange requests span and appends its data to buf.
+func (ws *WebSeed) fetchRange(
+	ctx context.Context,
+	span webSeedSpan,
+	buf []byte,
+) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, span.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(
+		"Range",
+		fmt.Sprintf("bytes=%d-%d", span.offset, span.offset+span.length-1),
+	)
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		ws.mu.Lock()
+		ws.disabled = true
+		ws.mu.Unlock()
+		return nil, ErrRangeUnsupported
+	default:
+		return nil, fmt.Errorf(
+			"webseed: %s returned status %d",
+			span.url,
+			resp.StatusCode,
+		)
+	}
+
+	start := len(buf)
+	buf = buf[:start+int(span.length)]
+	if _, err := io.ReadFull(resp.Body, buf[start:]); err != nil {
+		return nil, fmt.Errorf(
+			"webseed: short response from %s: %w",
+			span.url,
+			err,
+		)
+	}
+
+	return buf, nil
+}
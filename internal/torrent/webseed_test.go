@@ -0,0 +1,124 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveFiles serves content keyed by URL path, honouring Range requests
+// unless ranges is false.
+func serveFiles(
+	t *testing.T,
+	files map[string][]byte,
+	ranges bool,
+) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			data, ok := files[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			if !ranges {
+				w.Write(data)
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		},
+	))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestWebSeedFetchPiece(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+
+	testCases := []struct {
+		name  string
+		info  *Info
+		files map[string][]byte
+		// URL path of the web seed, appended to the server address
+		path string
+	}{
+		{
+			name:  "single file",
+			info:  &Info{Name: "file.bin", Length: 1000},
+			files: map[string][]byte{"/mirror/renamed.bin": data},
+			path:  "/mirror/renamed.bin",
+		},
+		{
+			name:  "single file below a directory url",
+			info:  &Info{Name: "file.bin", Length: 1000},
+			files: map[string][]byte{"/mirror/file.bin": data},
+			path:  "/mirror/",
+		},
+		{
+			name: "multi file",
+			info: &Info{
+				Name: "my album",
+				Files: []*File{
+					{Length: 300, Path: []string{"a.bin"}},
+					{Length: 0, Path: []string{"empty"}},
+					{Length: 700, Path: []string{"disc 2", "b.bin"}},
+				},
+			},
+			files: map[string][]byte{
+				"/mirror/my album/a.bin":        data[:300],
+				"/mirror/my album/disc 2/b.bin": data[300:],
+			},
+			path: "/mirror",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.info.PieceLen = 256
+			tc.info.Pieces = make([][20]byte, 4)
+
+			srv := serveFiles(t, tc.files, true)
+			ws := NewWebSeed(srv.URL+tc.path, tc.info, srv.Client())
+
+			for i := 0; i < 4; i++ {
+				got, err := ws.FetchPiece(context.Background(), i)
+				if err != nil {
+					t.Fatalf("FetchPiece(%d): %v", i, err)
+				}
+
+				want := data[i*256 : min((i+1)*256, len(data))]
+				if !bytes.Equal(got, want) {
+					t.Errorf("piece %d = %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWebSeedDisablesWithoutRangeSupport(t *testing.T) {
+	data := []byte(strings.Repeat("x", 512))
+	info := &Info{
+		Name:     "file.bin",
+		Length:   512,
+		PieceLen: 256,
+		Pieces:   make([][20]byte, 2),
+	}
+
+	srv := serveFiles(t, map[string][]byte{"/file.bin": data}, false)
+	ws := NewWebSeed(srv.URL+"/file.bin", info, srv.Client())
+
+	_, err := ws.FetchPiece(context.Background(), 1)
+	if !errors.Is(err, ErrRangeUnsupported) {
+		t.Fatalf("err = %v, want ErrRangeUnsupported", err)
+	}
+	if !ws.Disabled() {
+		t.Error("web seed still enabled")
+	}
+}
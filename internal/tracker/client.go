@@ -3,11 +3,24 @@ package tracker
 import (
 	"context"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
+	"strconv"
 )
 
+// ErrCompactUnsupported is returned by Announce when the tracker refused to
+// answer with a compact peer list. Announcing with DictPeers set should work.
+var ErrCompactUnsupported = errors.New(
+	"tracker: compact peer lists not supported",
+)
+
+// ErrScrapeUnsupported is returned by Scrape for trackers whose announce URL
+// has no scrape counterpart (BEP 48).
+var ErrScrapeUnsupported = errors.New("tracker: scrape not supported")
+
 // ITrackerProtocol defines the standard Tracker operations
 type ITrackerProtocol interface {
 	// Announce sends the client's state to the tracker and returns the
@@ -16,11 +29,20 @@ type ITrackerProtocol interface {
 		ctx context.Context,
 		params *AnnounceParams,
 	) (*AnnounceResponse, error)
+	// Scrape returns the swarm statistics of the given torrents without
+	// announcing. Torrents the tracker doesn't know are missing from the
+	// result.
+	Scrape(
+		ctx context.Context,
+		infoHashes [][sha1.Size]byte,
+	) (map[[sha1.Size]byte]ScrapeStats, error)
 }
 
 type Event string
 
 const (
+	// EventNone is used for the regular, periodic announces.
+	EventNone      Event = ""
 	EventStarted   Event = "started"
 	EventCompleted Event = "completed"
 	EventStopped   Event = "stopped"
@@ -42,8 +64,30 @@ type AnnounceParams struct {
 	Left int64
 	// Current event (started/completed/stopped)
 	Event Event
+	// Our external address, for trackers that can't see it themselves, e.g.
+	// behind a proxy (optional)
+	IP net.IP
+	// Tell the tracker we can encrypt connections, so it can favour peers
+	// that can too (optional)
+	SupportCrypto bool
+	// Tell the tracker we only accept encrypted connections; implies
+	// SupportCrypto (optional)
+	RequireCrypto bool
+	// Ask for the peer list as dictionaries instead of the compact form, for
+	// trackers that don't support the latter (optional)
+	DictPeers bool
+	// Number of peers wanted; zero asks for DefaultNumWant
+	NumWant int
+	// Identifies us to the tracker across changes of our IP address. Unlike
+	// the peer ID it isn't shared with peers, so it should stay the same for
+	// the life of the client (optional)
+	Key string
 }
 
+// DefaultNumWant is how many peers an announce asks for unless told
+// otherwise. Trackers tend to default to fewer.
+const DefaultNumWant = 50
+
 // AnnounceResponse is what the tracker returns on announce
 type AnnounceResponse struct {
 	// Unique identifier for the tracker
@@ -60,17 +104,53 @@ type AnnounceResponse struct {
 	MinInterval uint32
 }
 
+// ScrapeStats is what the tracker knows about one torrent's swarm
+type ScrapeStats struct {
+	// Clients that have the whole torrent
+	Seeders uint32
+	// Clients still downloading
+	Leechers uint32
+	// Number of times the torrent was downloaded to completion
+	Completed uint32
+}
+
 // Peer is one peer endpoint from the tracker
 type Peer struct {
 	// Identifier for this peer (absent in compact mode)
 	ID string
-	// IP of this peer
+	// IP of this peer; nil if the source gave a host name instead
 	IP net.IP
+	// Host name of this peer, set only if IP is nil
+	Host string
 	// Port on which this peer is listenting to connections
 	Port uint16
+	// If true the peer advertised support for encrypted connections, e.g.
+	// through the flags of a peer exchange message
+	SupportsCrypto bool
+}
+
+// Addr returns the peer's address in host:port form. It contains a host name
+// that still has to be resolved if the peer has no IP.
+func (p *Peer) Addr() string {
+	host := p.Host
+	if p.IP != nil {
+		host = p.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(p.Port)))
+}
+
+// Options tweaks how a tracker client talks to its tracker.
+type Options struct {
+	// Extra HTTP headers sent with every request to the tracker, e.g. an
+	// Authorization header some private tracker proxies require
+	Header http.Header
+	// Local address announces are sent from, e.g. a VPN interface's. If it
+	// isn't available, announces fail rather than going out another way.
+	// Nil lets the system choose.
+	LocalAddr net.IP
 }
 
-func New(announce string) (ITrackerProtocol, error) {
+func New(announce string, opts Options) (ITrackerProtocol, error) {
 	u, err := url.Parse(announce)
 	if err != nil {
 		return nil, fmt.Errorf(
@@ -82,7 +162,9 @@ func New(announce string) (ITrackerProtocol, error) {
 
 	switch u.Scheme {
 	case "http", "https":
-		return newHTTPTrackerClient(u)
+		return newHTTPTrackerClient(u, opts)
+	case "udp":
+		return newUDPTrackerClient(u, opts)
 	default:
 		return nil, fmt.Errorf(
 			"tracker: unsupported tracker protocol %q",
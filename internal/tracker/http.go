@@ -2,6 +2,7 @@ package tracker
 
 import (
 	"context"
+	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -10,6 +11,8 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/prxssh/relay/internal/bencode"
 )
@@ -18,19 +21,26 @@ import (
 type HTTPTrackerClient struct {
 	announceURL *url.URL
 	client      *http.Client
+	// Extra headers added to every request
+	header http.Header
 }
 
 // Constants for tracker requests and responses to avoid "magic strings".
 const (
 	// Query parameters
-	paramInfoHash   = "info_hash"
-	paramPeerID     = "peer_id"
-	paramPort       = "port"
-	paramUploaded   = "uploaded"
-	paramDownloaded = "downloaded"
-	paramLeft       = "left"
-	paramCompact    = "compact"
-	paramEvent      = "event"
+	paramInfoHash      = "info_hash"
+	paramPeerID        = "peer_id"
+	paramPort          = "port"
+	paramUploaded      = "uploaded"
+	paramDownloaded    = "downloaded"
+	paramLeft          = "left"
+	paramCompact       = "compact"
+	paramEvent         = "event"
+	paramIP            = "ip"
+	paramSupportCrypto = "supportcrypto"
+	paramRequireCrypto = "requirecrypto"
+	paramNumWant       = "numwant"
+	paramKey           = "key"
 
 	// Bencode dictionary keys
 	keyFailureReason = "failure reason"
@@ -41,9 +51,12 @@ const (
 	keyComplete      = "complete"
 	keyIncomplete    = "incomplete"
 	keyPeers         = "peers"
+	keyPeers6        = "peers6"
 	keyPeerID        = "peer id"
 	keyPeerIP        = "ip"
 	keyPeerPort      = "port"
+	keyFiles         = "files"
+	keyDownloaded    = "downloaded"
 )
 
 func (c *HTTPTrackerClient) Announce(
@@ -52,7 +65,7 @@ func (c *HTTPTrackerClient) Announce(
 ) (*AnnounceResponse, error) {
 	reqURL := c.buildAnnounceURL(params)
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	req, err := c.newRequest(ctx, reqURL)
 	if err != nil {
 		return nil, err
 	}
@@ -75,15 +88,88 @@ func (c *HTTPTrackerClient) Announce(
 	return parseTrackerResponse(resp.Body)
 }
 
+func (c *HTTPTrackerClient) Scrape(
+	ctx context.Context,
+	infoHashes [][sha1.Size]byte,
+) (map[[sha1.Size]byte]ScrapeStats, error) {
+	reqURL, err := scrapeURL(c.announceURL)
+	if err != nil {
+		return nil, err
+	}
+	q := reqURL.Query()
+	for _, hash := range infoHashes {
+		q.Add(paramInfoHash, string(hash[:]))
+	}
+	reqURL.RawQuery = q.Encode()
+
+	req, err := c.newRequest(ctx, reqURL.String())
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf(
+			"tracker returned non-OK status %d: %s",
+			resp.StatusCode,
+			string(bodyBytes),
+		)
+	}
+
+	return parseScrapeResponse(resp.Body)
+}
+
 // ///////////// Private ///////////////
 
-func newHTTPTrackerClient(url *url.URL) (*HTTPTrackerClient, error) {
+func newHTTPTrackerClient(
+	url *url.URL,
+	opts Options,
+) (*HTTPTrackerClient, error) {
+	client := &http.Client{}
+	if opts.LocalAddr != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		// Proxies would carry the announce over the default route.
+		transport.Proxy = nil
+		transport.DialContext = (&net.Dialer{
+			LocalAddr: &net.TCPAddr{IP: opts.LocalAddr},
+			Timeout:   30 * time.Second,
+		}).DialContext
+		client.Transport = transport
+	}
+
 	return &HTTPTrackerClient{
 		announceURL: url,
-		client:      &http.Client{},
+		client:      client,
+		header:      opts.Header.Clone(),
 	}, nil
 }
 
+// newRequest builds a GET request to reqURL carrying the client's extra
+// headers.
+func (c *HTTPTrackerClient) newRequest(
+	ctx context.Context,
+	reqURL string,
+) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range c.header {
+		for _, v := range values {
+			req.Header.Add(key, v)
+		}
+	}
+
+	return req, nil
+}
+
 func (c *HTTPTrackerClient) buildAnnounceURL(params *AnnounceParams) string {
 	reqURL := *c.announceURL
 
@@ -94,11 +180,33 @@ func (c *HTTPTrackerClient) buildAnnounceURL(params *AnnounceParams) string {
 	q.Set(paramUploaded, strconv.FormatInt(params.Uploaded, 10))
 	q.Set(paramDownloaded, strconv.FormatInt(params.Downloaded, 10))
 	q.Set(paramLeft, strconv.FormatInt(params.Left, 10))
-	q.Set(paramCompact, "1")
+	if params.DictPeers {
+		q.Set(paramCompact, "0")
+	} else {
+		q.Set(paramCompact, "1")
+	}
 
 	if params.Event != "" {
 		q.Set(paramEvent, string(params.Event))
 	}
+	if params.IP != nil {
+		q.Set(paramIP, params.IP.String())
+	}
+	if params.SupportCrypto || params.RequireCrypto {
+		q.Set(paramSupportCrypto, "1")
+	}
+	if params.RequireCrypto {
+		q.Set(paramRequireCrypto, "1")
+	}
+	numWant := params.NumWant
+	if numWant == 0 {
+		numWant = DefaultNumWant
+	}
+	q.Set(paramNumWant, strconv.Itoa(numWant))
+	if params.Key != "" {
+		q.Set(paramKey, params.Key)
+	}
+	reqURL.RawQuery = q.Encode()
 
 	return reqURL.String()
 }
@@ -120,6 +228,11 @@ func parseTrackerResponse(r io.Reader) (*AnnounceResponse, error) {
 	}
 
 	if failure, ok := data[keyFailureReason].(string); ok {
+		// Trackers without compact support tend to say so, e.g. "Tracker
+		// only supports compact=0" or "compact not supported".
+		if strings.Contains(strings.ToLower(failure), paramCompact) {
+			return nil, fmt.Errorf("%w: %s", ErrCompactUnsupported, failure)
+		}
 		return nil, fmt.Errorf("tracker error: %s", failure)
 	}
 
@@ -164,26 +277,119 @@ func parseTrackerResponse(r io.Reader) (*AnnounceResponse, error) {
 	}, nil
 }
 
-func parsePeers(data map[string]any) ([]*Peer, error) {
-	peersData, ok := data[keyPeers]
+// scrapeURL derives the scrape URL from an announce URL (BEP 48): the last
+// path segment has to start with "announce", which is replaced by "scrape".
+func scrapeURL(announce *url.URL) (*url.URL, error) {
+	u := *announce
+
+	i := strings.LastIndex(u.Path, "/") + 1
+	rest, ok := strings.CutPrefix(u.Path[i:], "announce")
 	if !ok {
-		// It's common for trackers to omit the 'peers' key if there are none.
-		// Return an empty slice instead of an error.
-		return []*Peer{}, nil
+		return nil, fmt.Errorf(
+			"%w: %s",
+			ErrScrapeUnsupported,
+			announce.Redacted(),
+		)
+	}
+	u.Path = u.Path[:i] + "scrape" + rest
+	u.RawPath = ""
+
+	return &u, nil
+}
+
+func parseScrapeResponse(
+	r io.Reader,
+) (map[[sha1.Size]byte]ScrapeStats, error) {
+	raw, err := bencode.NewUnmarshaller(r).Unmarshal()
+	if err != nil {
+		return nil, fmt.Errorf(
+			"failed to unmarshal scrape response: %w",
+			err,
+		)
+	}
+	data, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf(
+			"unexpected response type, expected dictionary, got %T",
+			raw,
+		)
+	}
+	if failure, ok := data[keyFailureReason].(string); ok {
+		return nil, fmt.Errorf("tracker error: %s", failure)
 	}
 
-	switch peers := peersData.(type) {
-	case string:
-		return parseCompactPeers([]byte(peers))
-	case []any:
-		return parseDictPeers(peers)
-	default:
-		return nil, fmt.Errorf("invalid 'peers' format: expected string or list, got %T", peersData)
+	files, _ := data[keyFiles].(map[string]any)
+	stats := make(map[[sha1.Size]byte]ScrapeStats, len(files))
+	for key, val := range files {
+		file, ok := val.(map[string]any)
+		if !ok || len(key) != sha1.Size {
+			continue
+		}
+		complete, _ := file[keyComplete].(int64)
+		incomplete, _ := file[keyIncomplete].(int64)
+		downloaded, _ := file[keyDownloaded].(int64)
+		stats[[sha1.Size]byte([]byte(key))] = ScrapeStats{
+			Seeders:   uint32(complete),
+			Leechers:  uint32(incomplete),
+			Completed: uint32(downloaded),
+		}
 	}
+
+	return stats, nil
 }
 
-func parseCompactPeers(peerData []byte) ([]*Peer, error) {
-	const peerSize = 6 // 4 bytes for IP, 2 for port.
+// parsePeers collects peers from both the 'peers' (IPv4) and 'peers6' (IPv6,
+// BEP 7) keys. Trackers are free to use the compact or the dictionary model for
+// either key independently, so each one is decoded on its own and the results
+// are merged.
+func parsePeers(data map[string]any) ([]*Peer, error) {
+	// It's common for trackers to omit the peer keys if there are none, so
+	// start with an empty slice instead of erroring.
+	peers := []*Peer{}
+
+	sources := []struct {
+		key   string
+		ipLen int
+	}{
+		{key: keyPeers, ipLen: net.IPv4len},
+		{key: keyPeers6, ipLen: net.IPv6len},
+	}
+
+	for _, src := range sources {
+		peersData, ok := data[src.key]
+		if !ok {
+			continue
+		}
+
+		var parsed []*Peer
+		var err error
+
+		switch v := peersData.(type) {
+		case string:
+			parsed, err = parseCompactPeers([]byte(v), src.ipLen)
+		case []any:
+			parsed, err = parseDictPeers(v)
+		default:
+			err = fmt.Errorf(
+				"invalid '%s' format: expected string or list, got %T",
+				src.key,
+				peersData,
+			)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		peers = append(peers, parsed...)
+	}
+
+	return peers, nil
+}
+
+// parseCompactPeers decodes the compact peer model: a string of fixed-size
+// entries, each an IP of ipLen bytes followed by a 2-byte big-endian port.
+func parseCompactPeers(peerData []byte, ipLen int) ([]*Peer, error) {
+	peerSize := ipLen + 2
 	if len(peerData)%peerSize != 0 {
 		return nil, fmt.Errorf(
 			"invalid compact peer list length: %d",
@@ -194,16 +400,45 @@ func parseCompactPeers(peerData []byte) ([]*Peer, error) {
 	numPeers := len(peerData) / peerSize
 	peers := make([]*Peer, 0, numPeers)
 
-	for i := 0; i < len(peerData); i++ {
+	for i := 0; i < numPeers; i++ {
 		offset := i * peerSize
-		peers[i].IP = net.IP(peerData[offset : offset+4])
-		peers[i].Port = binary.BigEndian.Uint16(
-			peerData[offset+4 : offset+6],
-		)
+
+		// Copy the address so the peer doesn't alias the response buffer.
+		ip := make(net.IP, ipLen)
+		copy(ip, peerData[offset:offset+ipLen])
+
+		peers = append(peers, &Peer{
+			IP: ip,
+			Port: binary.BigEndian.Uint16(
+				peerData[offset+ipLen : offset+peerSize],
+			),
+		})
 	}
 	return peers, nil
 }
 
+// validHostname reports whether s is a syntactically valid DNS name.
+func validHostname(s string) bool {
+	if len(s) == 0 || len(s) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(strings.TrimSuffix(s, "."), ".") {
+		if len(label) == 0 || len(label) > 63 ||
+			label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range []byte(label) {
+			isAlnum := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+				c >= '0' && c <= '9'
+			if !isAlnum && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func parseDictPeers(peerList []any) ([]*Peer, error) {
 	peers := make([]*Peer, 0, len(peerList)) // Pre-allocate slice capacity.
 
@@ -233,19 +468,19 @@ func parseDictPeers(peerList []any) ([]*Peer, error) {
 			)
 		}
 
-		ip := net.ParseIP(ipStr)
-		if ip == nil {
+		// The address may be a DNS name as well as an IP.
+		peer := &Peer{Port: uint16(portVal)}
+		if ip := net.ParseIP(ipStr); ip != nil {
+			peer.IP = ip
+		} else if validHostname(ipStr) {
+			peer.Host = ipStr
+		} else {
 			return nil, fmt.Errorf(
-				"invalid IP address string '%s' in peer entry at index %d",
+				"invalid address '%s' in peer entry at index %d",
 				ipStr,
 				i,
 			)
 		}
-
-		peer := &Peer{
-			IP:   ip,
-			Port: uint16(portVal),
-		}
 		// Peer ID is optional.
 		if id, ok := peerDict[keyPeerID].(string); ok {
 			peer.ID = id
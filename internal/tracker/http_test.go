@@ -0,0 +1,500 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prxssh/relay/internal/bencode"
+)
+
+func encodeResponse(t *testing.T, resp map[string]any) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := bencode.NewMarshaller(&buf).Marshal(resp); err != nil {
+		t.Fatalf("failed to encode tracker response: %v", err)
+	}
+	return &buf
+}
+
+func TestParseTrackerResponseMergesPeersAndPeers6(t *testing.T) {
+	compact := string([]byte{10, 0, 0, 1, 0x1A, 0xE1})
+
+	resp := encodeResponse(t, map[string]any{
+		"interval": 1800,
+		"peers":    compact,
+		"peers6": []any{
+			map[string]any{
+				"ip":      "2001:db8::1",
+				"port":    51413,
+				"peer id": "-XX0001-abcdefghijkl",
+			},
+		},
+	})
+
+	got, err := parseTrackerResponse(resp)
+	if err != nil {
+		t.Fatalf("parseTrackerResponse: %v", err)
+	}
+
+	want := []struct {
+		ip   string
+		port uint16
+	}{
+		{ip: "10.0.0.1", port: 6881},
+		{ip: "2001:db8::1", port: 51413},
+	}
+
+	if len(got.Peers) != len(want) {
+		t.Fatalf("got %d peers, want %d", len(got.Peers), len(want))
+	}
+	for i, w := range want {
+		p := got.Peers[i]
+		if !p.IP.Equal(net.ParseIP(w.ip)) || p.Port != w.port {
+			t.Errorf(
+				"peer %d = %s:%d, want %s:%d",
+				i,
+				p.IP,
+				p.Port,
+				w.ip,
+				w.port,
+			)
+		}
+	}
+	if got.Peers[1].ID != "-XX0001-abcdefghijkl" {
+		t.Errorf("peer id = %q, want it preserved", got.Peers[1].ID)
+	}
+}
+
+func TestParseCompactPeers(t *testing.T) {
+	testCases := []struct {
+		name    string
+		data    []byte
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "two peers",
+			data: []byte{
+				192, 168, 1, 10, 0x1A, 0xE1,
+				10, 0, 0, 2, 0xC8, 0xD5,
+			},
+			want: []string{"192.168.1.10:6881", "10.0.0.2:51413"},
+		},
+		{name: "empty", data: []byte{}, want: []string{}},
+		{name: "misaligned", data: make([]byte, 7), wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			peers, err := parseCompactPeers(tc.data, net.IPv4len)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCompactPeers: %v", err)
+			}
+			if len(peers) != len(tc.want) {
+				t.Fatalf("got %d peers, want %d", len(peers), len(tc.want))
+			}
+			for i, want := range tc.want {
+				if got := peers[i].Addr(); got != want {
+					t.Errorf("peer %d = %s, want %s", i, got, want)
+				}
+			}
+		})
+	}
+
+	// Peers must not alias the response buffer.
+	data := []byte{10, 0, 0, 1, 0x1A, 0xE1}
+	peers, _ := parseCompactPeers(data, net.IPv4len)
+	data[0] = 99
+	if !peers[0].IP.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("peer IP changed with the buffer to %s", peers[0].IP)
+	}
+}
+
+func TestParseTrackerResponseDecodesCompactPeers6(t *testing.T) {
+	var peers6 []byte
+	for _, ip := range []string{"2001:db8::1", "fe80::abcd:1"} {
+		peers6 = append(peers6, net.ParseIP(ip)...)
+		peers6 = append(peers6, 0x1A, 0xE1)
+	}
+
+	resp := encodeResponse(t, map[string]any{
+		"interval": 1800,
+		"peers6":   string(peers6),
+	})
+	got, err := parseTrackerResponse(resp)
+	if err != nil {
+		t.Fatalf("parseTrackerResponse: %v", err)
+	}
+
+	// Addr brackets the IPv6 addresses for dialing.
+	want := []string{"[2001:db8::1]:6881", "[fe80::abcd:1]:6881"}
+	if len(got.Peers) != len(want) {
+		t.Fatalf("got %d peers, want %d", len(got.Peers), len(want))
+	}
+	for i, w := range want {
+		p := got.Peers[i]
+		if len(p.IP) != net.IPv6len || p.Addr() != w {
+			t.Errorf(
+				"peer %d = %s (%d byte IP), want %s",
+				i,
+				p.Addr(),
+				len(p.IP),
+				w,
+			)
+		}
+	}
+
+	// A trailing partial entry is rejected.
+	resp = encodeResponse(t, map[string]any{"peers6": string(peers6[:20])})
+	if _, err := parseTrackerResponse(resp); err == nil {
+		t.Error("expected an error for a misaligned peers6 blob")
+	}
+}
+
+func TestParseDictPeersAcceptsHostNames(t *testing.T) {
+	peers, err := parseDictPeers([]any{
+		map[string]any{"ip": "peer.example.org", "port": int64(6881)},
+		map[string]any{"ip": "10.0.0.1", "port": int64(6882)},
+	})
+	if err != nil {
+		t.Fatalf("parseDictPeers: %v", err)
+	}
+
+	if peers[0].IP != nil || peers[0].Host != "peer.example.org" {
+		t.Errorf("peer 0 = %+v, want host name peer.example.org", peers[0])
+	}
+	if got := peers[0].Addr(); got != "peer.example.org:6881" {
+		t.Errorf("peer 0 address = %q", got)
+	}
+	if got := peers[1].Addr(); got != "10.0.0.1:6882" {
+		t.Errorf("peer 1 address = %q", got)
+	}
+
+	_, err = parseDictPeers([]any{
+		map[string]any{"ip": "not a host", "port": int64(6881)},
+	})
+	if err == nil {
+		t.Error("expected an error for an invalid address")
+	}
+}
+
+func TestBuildAnnounceURLSendsParams(t *testing.T) {
+	// Private trackers put the passkey in the announce URL's own query.
+	u, _ := url.Parse("http://tracker.example.org/announce?passkey=secret")
+	c, _ := newHTTPTrackerClient(u, Options{})
+
+	params := &AnnounceParams{
+		InfoHash:   [20]byte{0xde, 0xad, ' ', '&'},
+		PeerID:     [20]byte{'-', 'R', 'L'},
+		Port:       6881,
+		Uploaded:   10,
+		Downloaded: 20,
+		Left:       30,
+		Event:      EventStarted,
+	}
+	reqURL, err := url.Parse(c.buildAnnounceURL(params))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := reqURL.Query()
+	want := map[string]string{
+		"passkey":    "secret",
+		"info_hash":  string(params.InfoHash[:]),
+		"peer_id":    string(params.PeerID[:]),
+		"port":       "6881",
+		"uploaded":   "10",
+		"downloaded": "20",
+		"left":       "30",
+		"compact":    "1",
+		"event":      "started",
+	}
+	for key, v := range want {
+		if got := q.Get(key); got != v {
+			t.Errorf("%s = %q, want %q", key, got, v)
+		}
+	}
+}
+
+func TestBuildAnnounceURLAdvertisesCrypto(t *testing.T) {
+	u, _ := url.Parse("http://tracker.example.org/announce")
+	c, _ := newHTTPTrackerClient(u, Options{})
+
+	testCases := []struct {
+		name             string
+		params           AnnounceParams
+		support, require string
+	}{
+		{"off", AnnounceParams{}, "", ""},
+		{"supported", AnnounceParams{SupportCrypto: true}, "1", ""},
+		{"required", AnnounceParams{RequireCrypto: true}, "1", "1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reqURL, err := url.Parse(c.buildAnnounceURL(&tc.params))
+			if err != nil {
+				t.Fatal(err)
+			}
+			q := reqURL.Query()
+			if got := q.Get("supportcrypto"); got != tc.support {
+				t.Errorf("supportcrypto = %q, want %q", got, tc.support)
+			}
+			if got := q.Get("requirecrypto"); got != tc.require {
+				t.Errorf("requirecrypto = %q, want %q", got, tc.require)
+			}
+		})
+	}
+}
+
+func TestBuildAnnounceURLSendsNumWantAndKey(t *testing.T) {
+	u, _ := url.Parse("http://tracker.example.org/announce")
+	c, _ := newHTTPTrackerClient(u, Options{})
+
+	testCases := []struct {
+		name         string
+		params       AnnounceParams
+		numWant, key string
+	}{
+		{"defaults", AnnounceParams{}, "50", ""},
+		{
+			"set",
+			AnnounceParams{NumWant: 200, Key: "1A2B3C4D"},
+			"200",
+			"1A2B3C4D",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reqURL, err := url.Parse(c.buildAnnounceURL(&tc.params))
+			if err != nil {
+				t.Fatal(err)
+			}
+			q := reqURL.Query()
+			if got := q.Get("numwant"); got != tc.numWant {
+				t.Errorf("numwant = %q, want %q", got, tc.numWant)
+			}
+			if got := q.Get("key"); got != tc.key {
+				t.Errorf("key = %q, want %q", got, tc.key)
+			}
+		})
+	}
+}
+
+func TestAnnounceReportsCompactRefusal(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			resp := map[string]any{"interval": 1800, "peers": []any{}}
+			if r.URL.Query().Get("compact") != "0" {
+				resp = map[string]any{
+					"failure reason": "This tracker only supports compact=0",
+				}
+			}
+			w.Write(encodeResponse(t, resp).Bytes())
+		},
+	))
+	defer srv.Close()
+
+	client, err := New(srv.URL+"/announce", Options{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	_, err = client.Announce(context.Background(), &AnnounceParams{})
+	if !errors.Is(err, ErrCompactUnsupported) {
+		t.Fatalf(
+			"compact announce: err = %v, want %v",
+			err,
+			ErrCompactUnsupported,
+		)
+	}
+	_, err = client.Announce(
+		context.Background(),
+		&AnnounceParams{DictPeers: true},
+	)
+	if err != nil {
+		t.Fatalf("dictionary announce: %v", err)
+	}
+}
+
+func TestAnnounceSendsExtraHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != "alice" || pass != "hunter2" ||
+				r.Header.Get("X-Api-Token") != "token" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			w.Write(encodeResponse(t, map[string]any{
+				"interval": 1800,
+				"peers":    "",
+			}).Bytes())
+		},
+	))
+	defer srv.Close()
+
+	header := make(http.Header)
+	header.Set("X-Api-Token", "token")
+	header.Set(
+		"Authorization",
+		"Basic "+base64.StdEncoding.EncodeToString([]byte("alice:hunter2")),
+	)
+
+	client, err := New(srv.URL+"/announce", Options{Header: header})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	resp, err := client.Announce(context.Background(), &AnnounceParams{})
+	if err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+	if resp.Interval != 1800 {
+		t.Errorf("interval = %d, want 1800", resp.Interval)
+	}
+}
+
+func TestAnnounceBindsLocalAddr(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write(encodeResponse(t, map[string]any{
+				"interval": 1800,
+				"peers":    "",
+			}).Bytes())
+		},
+	))
+	defer srv.Close()
+
+	client, err := New(
+		srv.URL+"/announce",
+		Options{LocalAddr: net.ParseIP("127.0.0.1")},
+	)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_, err = client.Announce(context.Background(), &AnnounceParams{})
+	if err != nil {
+		t.Fatalf("Announce from a local address: %v", err)
+	}
+
+	// An address we don't have, e.g. of a VPN that went down, makes the
+	// announce fail instead of taking another route.
+	client, err = New(
+		srv.URL+"/announce",
+		Options{LocalAddr: net.ParseIP("192.0.2.1")},
+	)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_, err = client.Announce(context.Background(), &AnnounceParams{})
+	if err == nil {
+		t.Fatal("announce succeeded from an unavailable address")
+	}
+}
+
+func TestScrapeURL(t *testing.T) {
+	testCases := []struct {
+		announce string
+		want     string
+	}{
+		{"http://t.example/announce", "http://t.example/scrape"},
+		{"http://t.example/x/announce", "http://t.example/x/scrape"},
+		{"http://t.example/announce.php", "http://t.example/scrape.php"},
+		{
+			"http://t.example/announce?passkey=abc",
+			"http://t.example/scrape?passkey=abc",
+		},
+		{"http://t.example/a", ""},
+		{"http://t.example/announce/x", ""},
+		{"http://t.example/my-announce", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.announce, func(t *testing.T) {
+			u, _ := url.Parse(tc.announce)
+			got, err := scrapeURL(u)
+			if tc.want == "" {
+				if !errors.Is(err, ErrScrapeUnsupported) {
+					t.Fatalf("err = %v, want %v", err, ErrScrapeUnsupported)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("scrapeURL: %v", err)
+			}
+			if got.String() != tc.want {
+				t.Errorf("scrape URL = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestScrapeReturnsStatsPerHash(t *testing.T) {
+	first, second := [20]byte{1}, [20]byte{2}
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			hashes := r.URL.Query()[paramInfoHash]
+			if r.URL.Path != "/scrape" || len(hashes) != 2 {
+				http.Error(w, "bad scrape", http.StatusBadRequest)
+				return
+			}
+			w.Write(encodeResponse(t, map[string]any{
+				"files": map[string]any{
+					string(first[:]): map[string]any{
+						"complete":   5,
+						"incomplete": 3,
+						"downloaded": 40,
+					},
+					string(second[:]): map[string]any{
+						"complete":   1,
+						"incomplete": 0,
+						"downloaded": 2,
+					},
+				},
+			}).Bytes())
+		},
+	))
+	defer srv.Close()
+
+	client, err := New(srv.URL+"/announce", Options{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	stats, err := client.Scrape(
+		context.Background(),
+		[][20]byte{first, second},
+	)
+	if err != nil {
+		t.Fatalf("Scrape: %v", err)
+	}
+
+	want := map[[20]byte]ScrapeStats{
+		first:  {Seeders: 5, Leechers: 3, Completed: 40},
+		second: {Seeders: 1, Leechers: 0, Completed: 2},
+	}
+	if len(stats) != len(want) {
+		t.Fatalf("got stats for %d torrents, want %d", len(stats), len(want))
+	}
+	for hash, w := range want {
+		if stats[hash] != w {
+			t.Errorf("stats of %x = %+v, want %+v", hash[0], stats[hash], w)
+		}
+	}
+}
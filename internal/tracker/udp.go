@@ -0,0 +1,339 @@
+package tracker
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// UDPTrackerClient is a UDP-based implementation of ITrackerProtocol
+// (BEP 15). Every request first obtains a connection ID from the tracker,
+// then sends the request with it, both over the same socket.
+type UDPTrackerClient struct {
+	// host:port of the tracker
+	addr string
+	// Local address the socket is bound to, nil to let the system choose
+	localAddr net.IP
+	// How long the first attempt of a request waits for an answer; each
+	// retransmission waits twice as long as the one before.
+	retryTimeout time.Duration
+}
+
+const (
+	// Magic constant that identifies the connect request
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	// udpRetryTimeout and udpMaxRetries are the retransmission schedule of
+	// BEP 15: a request is sent again after 15 * 2^n seconds, up to n = 8.
+	udpRetryTimeout = 15 * time.Second
+	udpMaxRetries   = 8
+
+	// udpMaxScrapeHashes is the most info hashes one scrape request carries,
+	// which keeps it within a typical MTU.
+	udpMaxScrapeHashes = 74
+
+	// Fixed sizes of the requests and the headers of their responses
+	udpConnectSize          = 16
+	udpAnnounceSize         = 98
+	udpAnnounceResponseSize = 20
+	udpHeaderSize           = 8
+	udpScrapeEntrySize      = 12
+
+	udpMaxPacketSize = 65535
+)
+
+func (c *UDPTrackerClient) Announce(
+	ctx context.Context,
+	params *AnnounceParams,
+) (*AnnounceResponse, error) {
+	conn, connID, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp, err := c.roundTrip(
+		ctx,
+		conn,
+		buildUDPAnnounce(connID, params),
+		udpActionAnnounce,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < udpAnnounceResponseSize {
+		return nil, fmt.Errorf(
+			"udp tracker: announce response of %d bytes",
+			len(resp),
+		)
+	}
+
+	// Trackers answer with peers of the address family we reached them
+	// over.
+	ipLen := net.IPv4len
+	if conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil {
+		ipLen = net.IPv6len
+	}
+	peers, err := parseCompactPeers(resp[udpAnnounceResponseSize:], ipLen)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AnnounceResponse{
+		Interval: binary.BigEndian.Uint32(resp[8:12]),
+		Leechers: binary.BigEndian.Uint32(resp[12:16]),
+		Seeders:  binary.BigEndian.Uint32(resp[16:20]),
+		Peers:    peers,
+	}, nil
+}
+
+// Scrape asks for the statistics of at most udpMaxScrapeHashes torrents per
+// request. UDP trackers report torrents they don't know as empty swarms.
+func (c *UDPTrackerClient) Scrape(
+	ctx context.Context,
+	infoHashes [][sha1.Size]byte,
+) (map[[sha1.Size]byte]ScrapeStats, error) {
+	stats := make(map[[sha1.Size]byte]ScrapeStats, len(infoHashes))
+	if len(infoHashes) == 0 {
+		return stats, nil
+	}
+
+	conn, connID, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	for start := 0; start < len(infoHashes); start += udpMaxScrapeHashes {
+		batch := infoHashes[start:min(
+			start+udpMaxScrapeHashes,
+			len(infoHashes),
+		)]
+
+		req := udpRequestHeader(connID, udpActionScrape)
+		for _, hash := range batch {
+			req = append(req, hash[:]...)
+		}
+		resp, err := c.roundTrip(ctx, conn, req, udpActionScrape)
+		if err != nil {
+			return nil, err
+		}
+
+		entries := resp[udpHeaderSize:]
+		for _, hash := range batch {
+			if len(entries) < udpScrapeEntrySize {
+				break
+			}
+			stats[hash] = ScrapeStats{
+				Seeders:   binary.BigEndian.Uint32(entries[0:4]),
+				Completed: binary.BigEndian.Uint32(entries[4:8]),
+				Leechers:  binary.BigEndian.Uint32(entries[8:12]),
+			}
+			entries = entries[udpScrapeEntrySize:]
+		}
+	}
+
+	return stats, nil
+}
+
+/////////////// Private ///////////////
+
+func newUDPTrackerClient(
+	u *url.URL,
+	opts Options,
+) (*UDPTrackerClient, error) {
+	if u.Port() == "" {
+		return nil, fmt.Errorf("tracker: udp tracker %q has no port", u.Host)
+	}
+
+	return &UDPTrackerClient{
+		addr:         u.Host,
+		localAddr:    opts.LocalAddr,
+		retryTimeout: udpRetryTimeout,
+	}, nil
+}
+
+// connect opens a socket to the tracker and obtains a connection ID over it.
+// The socket is bound to the configured local address, so requests fail if
+// it's unavailable rather than leaving through the default route. The caller
+// closes the socket.
+func (c *UDPTrackerClient) connect(
+	ctx context.Context,
+) (net.Conn, uint64, error) {
+	var dialer net.Dialer
+	if c.localAddr != nil {
+		dialer.LocalAddr = &net.UDPAddr{IP: c.localAddr}
+	}
+	conn, err := dialer.DialContext(ctx, "udp", c.addr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req := binary.BigEndian.AppendUint64(nil, udpProtocolID)
+	req = binary.BigEndian.AppendUint32(req, udpActionConnect)
+	req = binary.BigEndian.AppendUint32(req, 0)
+
+	resp, err := c.roundTrip(ctx, conn, req, udpActionConnect)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	if len(resp) < udpConnectSize {
+		conn.Close()
+		return nil, 0, fmt.Errorf(
+			"udp tracker: connect response of %d bytes",
+			len(resp),
+		)
+	}
+
+	return conn, binary.BigEndian.Uint64(resp[8:16]), nil
+}
+
+// roundTrip sends req, whose transaction ID it fills in, and returns the
+// tracker's answer to it, retransmitting on BEP 15's schedule while none
+// comes. Answers to other transactions are ignored, error answers returned
+// as errors.
+func (c *UDPTrackerClient) roundTrip(
+	ctx context.Context,
+	conn net.Conn,
+	req []byte,
+	action uint32,
+) ([]byte, error) {
+	var tid [4]byte
+	rand.Read(tid[:])
+	copy(req[12:16], tid[:])
+
+	// Reads don't watch ctx; cut them short when it's done.
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	buf := make([]byte, udpMaxPacketSize)
+	for n := 0; n <= udpMaxRetries; n++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(c.retryTimeout << n))
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		for {
+			size, err := conn.Read(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			resp := buf[:size]
+			if size < udpHeaderSize || [4]byte(resp[4:8]) != tid {
+				continue
+			}
+			switch binary.BigEndian.Uint32(resp[0:4]) {
+			case action:
+				return resp, nil
+			case udpActionError:
+				return nil, fmt.Errorf(
+					"tracker error: %s",
+					resp[udpHeaderSize:],
+				)
+			default:
+				return nil, fmt.Errorf(
+					"udp tracker: answered action %d with %d",
+					action,
+					binary.BigEndian.Uint32(resp[0:4]),
+				)
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("udp tracker: %s didn't answer", c.addr)
+}
+
+// udpRequestHeader returns the header of a request with a connection ID,
+// leaving the transaction ID to roundTrip.
+func udpRequestHeader(connID uint64, action uint32) []byte {
+	req := binary.BigEndian.AppendUint64(nil, connID)
+	req = binary.BigEndian.AppendUint32(req, action)
+	return binary.BigEndian.AppendUint32(req, 0)
+}
+
+// buildUDPAnnounce returns the announce request for params. There is no
+// field for the crypto or dictionary peer flags, which are left out.
+func buildUDPAnnounce(connID uint64, params *AnnounceParams) []byte {
+	req := make([]byte, 0, udpAnnounceSize)
+	req = append(req, udpRequestHeader(connID, udpActionAnnounce)...)
+	req = append(req, params.InfoHash[:]...)
+	req = append(req, params.PeerID[:]...)
+	req = binary.BigEndian.AppendUint64(req, uint64(params.Downloaded))
+	req = binary.BigEndian.AppendUint64(req, uint64(params.Left))
+	req = binary.BigEndian.AppendUint64(req, uint64(params.Uploaded))
+	req = binary.BigEndian.AppendUint32(req, udpEvent(params.Event))
+
+	var ip [net.IPv4len]byte
+	if v4 := params.IP.To4(); v4 != nil {
+		ip = [net.IPv4len]byte(v4)
+	}
+	req = append(req, ip[:]...)
+	req = binary.BigEndian.AppendUint32(req, udpKey(params.Key))
+
+	numWant := params.NumWant
+	if numWant == 0 {
+		numWant = DefaultNumWant
+	}
+	req = binary.BigEndian.AppendUint32(req, uint32(numWant))
+
+	return binary.BigEndian.AppendUint16(req, params.Port)
+}
+
+// udpEvent returns the number BEP 15 gives event.
+func udpEvent(event Event) uint32 {
+	switch event {
+	case EventCompleted:
+		return 1
+	case EventStarted:
+		return 2
+	case EventStopped:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// udpKey turns the announce key into the 32 bits UDP announces carry: the
+// key's own value if it's 8 hex digits, as ours are, a hash of it otherwise.
+func udpKey(key string) uint32 {
+	if key == "" {
+		return 0
+	}
+	if len(key) == 8 {
+		if v, err := strconv.ParseUint(key, 16, 32); err == nil {
+			return uint32(v)
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
@@ -0,0 +1,243 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// mockUDPTracker is a scripted BEP 15 tracker. It ignores the first dropFirst
+// packets, hands out connID, answers announces with peers and scrapes with
+// stats, and records the announce requests it gets.
+type mockUDPTracker struct {
+	conn      *net.UDPConn
+	connID    uint64
+	dropFirst int
+	peers     []byte
+	stats     map[[20]byte]ScrapeStats
+	announces chan []byte
+}
+
+func newMockUDPTracker(t *testing.T) *mockUDPTracker {
+	t.Helper()
+
+	localhost := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	conn, err := net.ListenUDP("udp4", localhost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockUDPTracker{
+		conn:      conn,
+		connID:    0xC0FFEE,
+		announces: make(chan []byte, 4),
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return m
+}
+
+func (m *mockUDPTracker) url() string {
+	return "udp://" + m.conn.LocalAddr().String() + "/announce"
+}
+
+func (m *mockUDPTracker) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if m.dropFirst > 0 {
+			m.dropFirst--
+			continue
+		}
+		req := buf[:n]
+		action := binary.BigEndian.Uint32(req[8:12])
+
+		reply := binary.BigEndian.AppendUint32(nil, action)
+		reply = append(reply, req[12:16]...)
+		switch {
+		case action == udpActionConnect:
+			reply = binary.BigEndian.AppendUint64(reply, m.connID)
+		case binary.BigEndian.Uint64(req[0:8]) != m.connID:
+			reply = binary.BigEndian.AppendUint32(nil, udpActionError)
+			reply = append(reply, req[12:16]...)
+			reply = append(reply, "bad connection id"...)
+		case action == udpActionAnnounce:
+			m.announces <- slices.Clone(req)
+			reply = binary.BigEndian.AppendUint32(reply, 1800)
+			reply = binary.BigEndian.AppendUint32(reply, 3)
+			reply = binary.BigEndian.AppendUint32(reply, 7)
+			reply = append(reply, m.peers...)
+		case action == udpActionScrape:
+			for hashes := req[16:]; len(hashes) >= 20; hashes = hashes[20:] {
+				s := m.stats[[20]byte(hashes)]
+				reply = binary.BigEndian.AppendUint32(reply, s.Seeders)
+				reply = binary.BigEndian.AppendUint32(reply, s.Completed)
+				reply = binary.BigEndian.AppendUint32(reply, s.Leechers)
+			}
+		}
+
+		m.conn.WriteToUDP(reply, addr)
+	}
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	mock := newMockUDPTracker(t)
+	// The lost connect request is sent again.
+	mock.dropFirst = 1
+	mock.peers = []byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0xc8, 0xd5}
+	go mock.serve()
+
+	client, err := New(mock.url(), Options{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	client.(*UDPTrackerClient).retryTimeout = 50 * time.Millisecond
+
+	params := &AnnounceParams{
+		InfoHash:   [20]byte{0xAA},
+		PeerID:     [20]byte{'-', 'R', 'L'},
+		Port:       6881,
+		Uploaded:   10,
+		Downloaded: 20,
+		Left:       30,
+		Event:      EventStarted,
+		Key:        "1A2B3C4D",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.Announce(ctx, params)
+	if err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+	if resp.Interval != 1800 || resp.Leechers != 3 || resp.Seeders != 7 {
+		t.Errorf(
+			"interval %d, leechers %d, seeders %d; want 1800, 3, 7",
+			resp.Interval,
+			resp.Leechers,
+			resp.Seeders,
+		)
+	}
+	var got []string
+	for _, p := range resp.Peers {
+		got = append(got, p.Addr())
+	}
+	want := []string{"10.0.0.1:6881", "10.0.0.2:51413"}
+	if !slices.Equal(got, want) {
+		t.Errorf("peers = %q, want %q", got, want)
+	}
+
+	req := <-mock.announces
+	if len(req) != udpAnnounceSize {
+		t.Fatalf("announce of %d bytes, want %d", len(req), udpAnnounceSize)
+	}
+	if [20]byte(req[16:36]) != params.InfoHash ||
+		[20]byte(req[36:56]) != params.PeerID {
+		t.Errorf("announced info hash %x, peer ID %q", req[16:36], req[36:56])
+	}
+	fields := []struct {
+		name      string
+		got, want uint64
+	}{
+		{"downloaded", binary.BigEndian.Uint64(req[56:64]), 20},
+		{"left", binary.BigEndian.Uint64(req[64:72]), 30},
+		{"uploaded", binary.BigEndian.Uint64(req[72:80]), 10},
+		{"event", uint64(binary.BigEndian.Uint32(req[80:84])), 2},
+		{"key", uint64(binary.BigEndian.Uint32(req[88:92])), 0x1A2B3C4D},
+		{"num_want", uint64(binary.BigEndian.Uint32(req[92:96])), 50},
+		{"port", uint64(binary.BigEndian.Uint16(req[96:98])), 6881},
+	}
+	for _, f := range fields {
+		if f.got != f.want {
+			t.Errorf("%s = %d, want %d", f.name, f.got, f.want)
+		}
+	}
+}
+
+func TestUDPScrape(t *testing.T) {
+	mock := newMockUDPTracker(t)
+	known := [20]byte{0xAA}
+	mock.stats = map[[20]byte]ScrapeStats{
+		known: {Seeders: 5, Completed: 9, Leechers: 2},
+	}
+	go mock.serve()
+
+	client, err := New(mock.url(), Options{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// More hashes than fit one request.
+	hashes := [][20]byte{known}
+	for i := range udpMaxScrapeHashes {
+		hashes = append(hashes, [20]byte{0xBB, byte(i)})
+	}
+	stats, err := client.Scrape(ctx, hashes)
+	if err != nil {
+		t.Fatalf("Scrape: %v", err)
+	}
+	if len(stats) != len(hashes) {
+		t.Errorf("got stats of %d torrents, want %d", len(stats), len(hashes))
+	}
+	if got := stats[known]; got != mock.stats[known] {
+		t.Errorf("stats = %+v, want %+v", got, mock.stats[known])
+	}
+}
+
+func TestUDPTrackerError(t *testing.T) {
+	mock := newMockUDPTracker(t)
+	go mock.serve()
+
+	client, err := New(mock.url(), Options{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	conn, _, err := client.(*UDPTrackerClient).connect(context.Background())
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer conn.Close()
+
+	// A request with a connection ID the tracker didn't hand out.
+	_, err = client.(*UDPTrackerClient).roundTrip(
+		context.Background(),
+		conn,
+		buildUDPAnnounce(1, &AnnounceParams{}),
+		udpActionAnnounce,
+	)
+	if err == nil || err.Error() != "tracker error: bad connection id" {
+		t.Errorf("err = %v, want the tracker's error", err)
+	}
+}
+
+func TestUDPAnnounceBindsLocalAddr(t *testing.T) {
+	mock := newMockUDPTracker(t)
+	go mock.serve()
+
+	client, err := New(mock.url(), Options{LocalAddr: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_, err = client.Announce(context.Background(), &AnnounceParams{})
+	if err != nil {
+		t.Fatalf("Announce from a local address: %v", err)
+	}
+
+	// An address we don't have, e.g. of a VPN that went down, makes the
+	// announce fail instead of taking another route.
+	client, err = New(mock.url(), Options{LocalAddr: net.ParseIP("192.0.2.1")})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_, err = client.Announce(context.Background(), &AnnounceParams{})
+	if err == nil {
+		t.Fatal("announce succeeded from an unavailable address")
+	}
+}
@@ -0,0 +1,40 @@
+package tui
+
+import (
+	"time"
+
+	"github.com/atotto/clipboard"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// noticeDuration is how long a confirmation stays on screen.
+const noticeDuration = 3 * time.Second
+
+// copiedMsg reports the outcome of copying text to the clipboard.
+type copiedMsg struct {
+	// What was copied, e.g. "magnet link"
+	what string
+	text string
+	err  error
+}
+
+// clearNoticeMsg hides the notice with the given id, unless a newer one has
+// replaced it since.
+type clearNoticeMsg struct {
+	id int
+}
+
+// copyToClipboard copies text to the system clipboard. Without a clipboard,
+// e.g. over SSH or on a headless box, the copiedMsg carries the error so the
+// text can be shown for copying by hand instead.
+func copyToClipboard(what, text string) tea.Cmd {
+	return func() tea.Msg {
+		return copiedMsg{what: what, text: text, err: clipboard.WriteAll(text)}
+	}
+}
+
+func clearNoticeAfter(id int) tea.Cmd {
+	return tea.Tick(noticeDuration, func(time.Time) tea.Msg {
+		return clearNoticeMsg{id: id}
+	})
+}
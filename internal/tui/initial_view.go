@@ -1,12 +1,26 @@
 package tui
 
 import (
+	"encoding/hex"
+	"fmt"
+
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/prxssh/relay/internal/relay"
+	"github.com/prxssh/relay/internal/torrent"
 )
 
 type initialViewModel struct {
-	theme         theme
+	theme    theme
+	torrents []relay.SessionStats
+	conns    torrent.ConnCounts
+	// Index of the highlighted torrent
+	selected int
+	// Transient message, e.g. confirming a copy, and its id so that only
+	// the latest one gets cleared
+	notice        string
+	noticeErr     bool
+	noticeID      int
 	width, height int
 }
 
@@ -19,9 +33,64 @@ func (m *initialViewModel) SetSize(width, height int) {
 }
 
 func (m *initialViewModel) Update(msg tea.Msg) (screen, tea.Cmd) {
+	switch msg := msg.(type) {
+	case torrentsMsg:
+		m.torrents = msg.torrents
+		m.conns = msg.conns
+		m.selected = max(0, min(m.selected, len(m.torrents)-1))
+
+	case tea.KeyMsg:
+		return m, m.handleKey(msg)
+
+	case copiedMsg:
+		m.noticeID++
+		m.notice, m.noticeErr = "Copied "+msg.what+" to the clipboard", false
+		if msg.err != nil {
+			m.notice = fmt.Sprintf(
+				"No clipboard available, %s: %s",
+				msg.what,
+				msg.text,
+			)
+			m.noticeErr = true
+			// Leave it up long enough to copy by hand.
+			return m, nil
+		}
+		return m, clearNoticeAfter(m.noticeID)
+
+	case clearNoticeMsg:
+		if msg.id == m.noticeID {
+			m.notice = ""
+		}
+	}
+
 	return m, nil
 }
 
+// handleKey moves the selection and runs the actions on the selected
+// torrent.
+func (m *initialViewModel) handleKey(msg tea.KeyMsg) tea.Cmd {
+	if len(m.torrents) == 0 {
+		return nil
+	}
+	selected := m.torrents[m.selected]
+
+	switch msg.String() {
+	case "up", "k":
+		m.selected = max(0, m.selected-1)
+	case "down", "j":
+		m.selected = min(len(m.torrents)-1, m.selected+1)
+	case "m":
+		return copyToClipboard("magnet link", selected.Magnet)
+	case "i":
+		return copyToClipboard(
+			"info hash",
+			hex.EncodeToString(selected.InfoHash[:]),
+		)
+	}
+
+	return nil
+}
+
 func (m *initialViewModel) View() string {
 	if m.width == 0 {
 		return ""
@@ -32,11 +101,67 @@ func (m *initialViewModel) View() string {
 
 	styledLogo := logoStyle.Render(logo)
 	statusText := helpStyle.Render("No torrents added.")
+	if len(m.torrents) > 0 {
+		statusText = lipgloss.JoinVertical(
+			lipgloss.Center,
+			m.torrentList(),
+			helpStyle.Render(fmt.Sprintf(
+				"Peers: %d encrypted, %d plaintext",
+				m.conns.Encrypted,
+				m.conns.Plaintext,
+			)),
+		)
+	}
 	helpText := helpStyle.Render(
 		"Press 'a' to add a torrent or 'q' to quite.",
 	)
+	if len(m.torrents) > 0 {
+		helpText = helpStyle.Render(
+			"'m' copy magnet, 'i' copy info hash, 'a' add, 'q' quit.",
+		)
+	}
+	if m.notice != "" {
+		noticeStyle := lipgloss.NewStyle().Foreground(m.theme.Green)
+		if m.noticeErr {
+			noticeStyle = noticeStyle.Foreground(m.theme.Yellow)
+		}
+		helpText = lipgloss.JoinVertical(
+			lipgloss.Center,
+			noticeStyle.Render(m.notice),
+			helpText,
+		)
+	}
 
 	return lipgloss.NewStyle().
 		Align(lipgloss.Center).
 		Render(lipgloss.JoinVertical(lipgloss.Center, styledLogo, statusText, helpText))
 }
+
+// torrentList renders one line per torrent with its status. Torrents halted
+// by an error get a second line explaining why.
+func (m *initialViewModel) torrentList() string {
+	nameStyle := lipgloss.NewStyle().Foreground(m.theme.Fg)
+	statusStyle := lipgloss.NewStyle().Foreground(m.theme.Gray)
+	errorStyle := lipgloss.NewStyle().Foreground(m.theme.Red)
+
+	selectedStyle := nameStyle.Foreground(m.theme.Yellow)
+
+	lines := make([]string, 0, len(m.torrents))
+	for i, t := range m.torrents {
+		cursor, style := "  ", nameStyle
+		if i == m.selected {
+			cursor, style = "> ", selectedStyle
+		}
+		lines = append(lines, fmt.Sprintf(
+			"%s%s  %s",
+			cursor,
+			style.Render(t.Name),
+			statusStyle.Render(string(t.Status)),
+		))
+		if t.Error != "" {
+			lines = append(lines, errorStyle.Render("    "+t.Error))
+		}
+	}
+
+	return lipgloss.JoinVertical(lipgloss.Left, lines...)
+}
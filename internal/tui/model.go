@@ -1,9 +1,12 @@
 package tui
 
 import (
+	"time"
+
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/prxssh/relay/internal/relay"
+	"github.com/prxssh/relay/internal/torrent"
 )
 
 const logo = `
@@ -16,10 +19,21 @@ ______ _____ _       _____   __
 `
 
 func Start() error {
-	client, err := relay.NewClient()
+	configPath, err := relay.DefaultConfigPath()
+	if err != nil {
+		return err
+	}
+
+	cfg, err := relay.LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	client, err := relay.NewClient(cfg)
 	if err != nil {
 		return err
 	}
+	defer client.Close()
 
 	p := tea.NewProgram(newModel(client), tea.WithAltScreen())
 	_, err = p.Run()
@@ -52,8 +66,36 @@ func newModel(client *relay.Client) model {
 	}
 }
 
+// torrentsMsg carries a fresh snapshot of every torrent's stats and of the
+// peer connections.
+type torrentsMsg struct {
+	torrents []relay.SessionStats
+	conns    torrent.ConnCounts
+}
+
+const refreshInterval = time.Second
+
+// Init shows the torrents restored from the last run right away; the refresh
+// ticks start from there.
 func (m model) Init() tea.Cmd {
-	return nil
+	return m.snapshotTorrents
+}
+
+// refreshTorrents snapshots the client's torrents after refreshInterval.
+func (m model) refreshTorrents() tea.Cmd {
+	return tea.Tick(refreshInterval, func(time.Time) tea.Msg {
+		return m.snapshotTorrents()
+	})
+}
+
+func (m model) snapshotTorrents() tea.Msg {
+	sessions := m.client.Torrents()
+
+	stats := make([]relay.SessionStats, len(sessions))
+	for i, s := range sessions {
+		stats[i] = s.Stats()
+	}
+	return torrentsMsg{torrents: stats, conns: torrent.Connections()}
 }
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -61,6 +103,9 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var currScreen screen
 
 	switch msg := msg.(type) {
+	case torrentsMsg:
+		m.screens[m.activeState], cmd = m.screens[m.activeState].Update(msg)
+		return m, tea.Batch(cmd, m.refreshTorrents())
 	case tea.WindowSizeMsg:
 		m.width, m.height = msg.Width, msg.Height
 		for i := range m.screens {
@@ -1,5 +1,11 @@
 package utils
 
+import "math/bits"
+
+// Bitfield is a set of piece indices in the wire format of the bitfield
+// message: the highest bit of the first byte is index 0. The spare bits at the
+// end of the last byte are kept clear; bitfields from peers that set them are
+// rejected before they get here.
 type Bitfield []byte
 
 func NewBitfield(size int) Bitfield {
@@ -57,3 +63,53 @@ func (bf Bitfield) Set(index int) {
 	//   10110101 (the new value of the byte)
 	bf[byteIndex] |= (1 << (7 - bitIndex))
 }
+
+func (bf Bitfield) Clear(index int) {
+	byteIndex, bitIndex := index/8, index%8
+
+	if byteIndex < 0 || byteIndex >= len(bf) {
+		return
+	}
+
+	// Inverting the mask gives a byte with every bit set except the one we
+	// want to clear. The AND operation then zeroes that bit and keeps the
+	// others as they are.
+	//
+	// Example for index 10 (byteIndex=1, bitIndex=2):
+	// ^Mask = ^00100000 = 11011111 (binary)
+	//
+	// If the byte is `10110101`:
+	//   10110101 (byte)
+	// & 11011111 (inverted mask)
+	// ----------
+	//   10010101 (the new value of the byte)
+	bf[byteIndex] &^= (1 << (7 - bitIndex))
+}
+
+// Count returns the number of indices set.
+func (bf Bitfield) Count() int {
+	n := 0
+	for _, b := range bf {
+		n += bits.OnesCount8(b)
+	}
+	return n
+}
+
+// Empty reports whether no index is set.
+func (bf Bitfield) Empty() bool {
+	for _, b := range bf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SpareBitsClear reports whether the bits past the first size indices, the
+// padding of the last byte, are all clear.
+func (bf Bitfield) SpareBitsClear(size int) bool {
+	if size%8 == 0 || size/8 >= len(bf) {
+		return true
+	}
+	return bf[size/8]&(0xFF>>(size%8)) == 0
+}
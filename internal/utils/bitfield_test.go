@@ -0,0 +1,80 @@
+package utils
+
+import "testing"
+
+func TestBitfieldSetClearRoundTrip(t *testing.T) {
+	bf := NewBitfield(20)
+	for _, i := range []int{0, 7, 8, 19} {
+		bf.Set(i)
+		if !bf.Has(i) {
+			t.Errorf("index %d not set", i)
+		}
+		bf.Clear(i)
+		if bf.Has(i) {
+			t.Errorf("index %d not cleared", i)
+		}
+	}
+	if !bf.Empty() {
+		t.Errorf("bitfield %08b not empty after clearing", bf)
+	}
+
+	// Out of range indices are ignored.
+	bf.Set(-1)
+	bf.Set(24)
+	if !bf.Empty() {
+		t.Errorf("out of range Set changed the bitfield to %08b", bf)
+	}
+}
+
+func TestBitfieldCount(t *testing.T) {
+	testCases := []struct {
+		size int
+		set  []int
+		want int
+	}{
+		{size: 0, want: 0},
+		{size: 8, set: []int{0, 7}, want: 2},
+		{size: 9, set: []int{7, 8}, want: 2},
+		{size: 16, set: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 15}, want: 10},
+		{size: 17, set: []int{16}, want: 1},
+	}
+
+	for _, tc := range testCases {
+		bf := NewBitfield(tc.size)
+		for _, i := range tc.set {
+			bf.Set(i)
+		}
+		if got := bf.Count(); got != tc.want {
+			t.Errorf("size %d: Count() = %d, want %d", tc.size, got, tc.want)
+		}
+		if got := bf.Empty(); got != (tc.want == 0) {
+			t.Errorf("size %d: Empty() = %v", tc.size, got)
+		}
+	}
+}
+
+func TestBitfieldSpareBitsClear(t *testing.T) {
+	testCases := []struct {
+		bf   Bitfield
+		size int
+		want bool
+	}{
+		{Bitfield{0xFF}, 8, true},
+		{Bitfield{0xFF, 0x80}, 9, true},
+		{Bitfield{0xFF, 0xC0}, 9, false},
+		{Bitfield{0xE0}, 3, true},
+		{Bitfield{0xE1}, 3, false},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.bf.SpareBitsClear(tc.size); got != tc.want {
+			t.Errorf(
+				"%08b with size %d: SpareBitsClear() = %v, want %v",
+				tc.bf,
+				tc.size,
+				got,
+				tc.want,
+			)
+		}
+	}
+}
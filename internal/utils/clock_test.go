@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClockFiresTimersOnAdvance(t *testing.T) {
+	start := time.Unix(0, 0)
+	c := NewFakeClock(start)
+
+	short := c.NewTimer(time.Second)
+	long := c.After(time.Minute)
+	stopped := c.NewTimer(time.Second)
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatal("Stop should succeed once on a pending timer")
+	}
+	if got := c.Timers(); got != 2 {
+		t.Fatalf("Timers() = %d, want 2", got)
+	}
+
+	c.Advance(time.Second)
+	select {
+	case now := <-short.C():
+		if !now.Equal(start.Add(time.Second)) {
+			t.Errorf("timer fired at %v, want %v", now, start.Add(time.Second))
+		}
+	default:
+		t.Fatal("due timer didn't fire")
+	}
+	select {
+	case <-long:
+		t.Fatal("timer fired early")
+	case <-stopped.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+
+	c.Advance(time.Minute)
+	select {
+	case <-long:
+	default:
+		t.Fatal("After channel didn't fire")
+	}
+	if short.Stop() {
+		t.Error("Stop succeeded on a fired timer")
+	}
+	if got := c.Timers(); got != 0 {
+		t.Errorf("Timers() = %d after all fired, want 0", got)
+	}
+}
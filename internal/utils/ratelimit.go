@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits a byte stream to a rate using a token bucket. The bucket
+// holds a second's worth of bytes, so short bursts pass at full speed. A rate
+// of zero means unlimited. It's safe for concurrent use.
+type RateLimiter struct {
+	mu sync.Mutex
+	// Bytes per second; zero means unlimited
+	rate int64
+	// Bytes that may pass right away; negative while waiters are in debt
+	tokens float64
+	// When tokens was last topped up
+	last  time.Time
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func NewRateLimiter(rate int64) *RateLimiter {
+	l := &RateLimiter{
+		rate:  max(rate, 0),
+		now:   time.Now,
+		sleep: sleepContext,
+	}
+	l.tokens = float64(l.rate)
+	l.last = l.now()
+
+	return l
+}
+
+// Rate returns the current rate in bytes per second, zero if unlimited.
+func (l *RateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.rate
+}
+
+// SetRate changes the rate, in bytes per second, effective immediately. Zero
+// removes the limit.
+func (l *RateLimiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	wasUnlimited := l.rate == 0
+	l.rate = max(rate, 0)
+	if wasUnlimited {
+		l.tokens = float64(l.rate)
+	}
+	l.tokens = min(l.tokens, float64(l.rate))
+}
+
+// WaitN blocks until n bytes may pass, or until ctx is done.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+
+	l.refill()
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	wait := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	l.mu.Unlock()
+
+	if err := l.sleep(ctx, wait); err != nil {
+		// Nothing passed, so give the bytes back to the others.
+		l.mu.Lock()
+		l.tokens += float64(n)
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// LimitConn returns conn with every read throttled by the limiters in read and
+// every write by those in write, so a connection can count against several
+// caps at once, e.g. its torrent's and the client's. Nil limiters are
+// skipped. Reads are paid for once they return, writes before they're made.
+func LimitConn(conn net.Conn, read, write []*RateLimiter) net.Conn {
+	return &limitedConn{
+		Conn:  conn,
+		read:  nonNil(read),
+		write: nonNil(write),
+	}
+}
+
+/////////////// Private ///////////////
+
+type limitedConn struct {
+	net.Conn
+	read  []*RateLimiter
+	write []*RateLimiter
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	for _, l := range c.read {
+		l.WaitN(context.Background(), n)
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	for _, l := range c.write {
+		l.WaitN(context.Background(), len(p))
+	}
+	return c.Conn.Write(p)
+}
+
+func nonNil(limiters []*RateLimiter) []*RateLimiter {
+	var kept []*RateLimiter
+	for _, l := range limiters {
+		if l != nil {
+			kept = append(kept, l)
+		}
+	}
+	return kept
+}
+
+// refill tops up the bucket for the time passed since the last call. The
+// caller must hold l.mu.
+func (l *RateLimiter) refill() {
+	now := l.now()
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+
+	if elapsed > 0 {
+		l.tokens = min(
+			l.tokens+elapsed*float64(l.rate),
+			float64(l.rate),
+		)
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
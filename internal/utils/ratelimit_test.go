@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeClockLimiter returns a limiter whose clock only moves while it sleeps,
+// and the total time it slept.
+func fakeClockLimiter(rate int64) (*RateLimiter, *time.Duration) {
+	clock := time.Unix(0, 0)
+	var slept time.Duration
+
+	l := NewRateLimiter(rate)
+	l.now = func() time.Time { return clock }
+	l.last = clock
+	l.sleep = func(ctx context.Context, d time.Duration) error {
+		clock = clock.Add(d)
+		slept += d
+		return nil
+	}
+	return l, &slept
+}
+
+func TestRateLimiterDelaysToRate(t *testing.T) {
+	l, slept := fakeClockLimiter(1000)
+
+	steps := []struct {
+		n    int
+		want time.Duration
+	}{
+		// The full bucket lets a second's worth through at once...
+		{1000, 0},
+		// ...after which bytes pass at the rate.
+		{500, 500 * time.Millisecond},
+		{1000, time.Second},
+		{2000, 2 * time.Second},
+	}
+
+	for i, step := range steps {
+		before := *slept
+		if err := l.WaitN(context.Background(), step.n); err != nil {
+			t.Fatalf("step %d: WaitN: %v", i, err)
+		}
+		if got := *slept - before; got != step.want {
+			t.Errorf(
+				"step %d: waited %v for %d bytes, want %v",
+				i,
+				got,
+				step.n,
+				step.want,
+			)
+		}
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	l, slept := fakeClockLimiter(0)
+
+	err := l.WaitN(context.Background(), 1<<30)
+	if err != nil || *slept != 0 {
+		t.Fatalf("unlimited WaitN waited %v (%v)", *slept, err)
+	}
+
+	l.SetRate(100)
+	l.WaitN(context.Background(), 100)
+	l.WaitN(context.Background(), 100)
+	if *slept != time.Second {
+		t.Errorf("waited %v after limiting to 100 B/s, want 1s", *slept)
+	}
+
+	l.SetRate(0)
+	l.WaitN(context.Background(), 1<<30)
+	if *slept != time.Second {
+		t.Errorf("waited %v more after removing the limit", *slept-time.Second)
+	}
+}
+
+func TestLimitConnDelaysReadsAndWrites(t *testing.T) {
+	readLimit, readSlept := fakeClockLimiter(1000)
+	writeLimit, writeSlept := fakeClockLimiter(500)
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	conn := LimitConn(
+		local,
+		[]*RateLimiter{readLimit, nil},
+		[]*RateLimiter{writeLimit},
+	)
+
+	go remote.Write(make([]byte, 3000))
+	buf := make([]byte, 3000)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	// A second's worth passes right away, the rest at 1000 B/s.
+	if *readSlept != 2*time.Second {
+		t.Errorf("reading 3000 bytes at 1000 B/s took %v, want 2s", *readSlept)
+	}
+
+	go io.Copy(io.Discard, remote)
+	if _, err := conn.Write(make([]byte, 1000)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if *writeSlept != time.Second {
+		t.Errorf("writing 1000 bytes at 500 B/s took %v, want 1s", *writeSlept)
+	}
+}
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"context"
+	"io"
+)
+
+// ContextReader returns a reader that reads from r until ctx is done, after
+// which every read fails with the context's error. A read already blocked in r
+// isn't interrupted.
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
@@ -0,0 +1,62 @@
+package utils
+
+import "sync"
+
+// Ring is a fixed-capacity, concurrency-safe buffer that keeps the most recent
+// values pushed into it, overwriting the oldest once full.
+type Ring[T any] struct {
+	mu     sync.Mutex
+	values []T
+	// Index the next value is written to
+	next int
+	// Whether the buffer has wrapped around at least once
+	full bool
+}
+
+func NewRing[T any](capacity int) *Ring[T] {
+	return &Ring[T]{values: make([]T, capacity)}
+}
+
+// Push appends v, evicting the oldest value if the ring is full.
+func (r *Ring[T]) Push(v T) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.values) == 0 {
+		return
+	}
+
+	r.values[r.next] = v
+	r.next = (r.next + 1) % len(r.values)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Last returns the most recently pushed value, or false if the ring is empty.
+func (r *Ring[T]) Last() (T, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full && r.next == 0 {
+		var zero T
+		return zero, false
+	}
+
+	last := (r.next - 1 + len(r.values)) % len(r.values)
+	return r.values[last], true
+}
+
+// Snapshot returns a copy of the stored values, oldest first.
+func (r *Ring[T]) Snapshot() []T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]T(nil), r.values[:r.next]...)
+	}
+
+	out := make([]T, 0, len(r.values))
+	out = append(out, r.values[r.next:]...)
+	return append(out, r.values[:r.next]...)
+}